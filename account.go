@@ -0,0 +1,101 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the account state kept alongside developers.
+package main
+
+import (
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+)
+
+// developerRes is a developer along with the account state broome keeps
+// outside of the developer schema.
+type developerRes struct {
+	*schemas.Developer
+	EmailVerified   bool             `json:"emailVerified"`
+	EmailVerifiedAt *time.Time       `json:"emailVerifiedAt,omitempty"`
+	Subscription    *db.Subscription `json:"subscription,omitempty"`
+
+	// BillingStatus is active, expired, past_due or downgraded. Past due
+	// licenses keep working until GraceEndsAt.
+	BillingStatus string     `json:"billingStatus"`
+	GraceEndsAt   *time.Time `json:"graceEndsAt,omitempty"`
+
+	Organizations []*membershipRes `json:"organizations"`
+	TwoFactor     bool             `json:"twoFactor"`
+}
+
+// newDeveloperRes gets the full account state for a developer.
+func newDeveloperRes(d *schemas.Developer) (*developerRes, error) {
+	// Credentials are never sent back, even to the developer they belong to.
+	public := *d
+	public.Password, public.Salt, public.Token = "", "", ""
+	res := &developerRes{Developer: &public}
+
+	verified, v, err := isVerified(d)
+	if err != nil {
+		return nil, err
+	}
+	res.EmailVerified = verified
+	if v != nil && verified {
+		res.EmailVerifiedAt = &v.VerifiedAt
+	}
+
+	sub, err := store.GetSubscription(d.ID)
+	if err == nil {
+		res.Subscription = sub
+	} else if err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	status, graceEndsAt, err := billingStatus(d, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	res.BillingStatus = status
+	if status == billingPastDue {
+		res.GraceEndsAt = &graceEndsAt
+	}
+
+	res.Organizations, err = getMemberships(d)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := getTwoFactor(d)
+	if err != nil {
+		return nil, err
+	}
+	res.TwoFactor = t != nil
+
+	return res, nil
+}
+
+// licensed checks if the developer has a license that works at now, either
+// their own or one an organization pays for.
+func (res *developerRes) licensed(now time.Time) bool {
+	return res.ownLicense(now) || res.payingOrganization(now) != nil
+}
+
+// ownLicense checks if the developer's own license works at now.
+func (res *developerRes) ownLicense(now time.Time) bool {
+	if res.BillingStatus == billingPastDue {
+		return res.GraceEndsAt.After(now)
+	}
+
+	return res.Expiration.After(now)
+}
+
+// payingOrganization gets an organization that pays for the developer's
+// license at now, or nil if none do.
+func (res *developerRes) payingOrganization(now time.Time) *db.Organization {
+	for _, m := range res.Organizations {
+		if m.Active() && m.CurrentPeriodEnd.After(now) {
+			return m.Organization
+		}
+	}
+
+	return nil
+}
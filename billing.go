@@ -0,0 +1,332 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the plans catalog and subscriptions.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long an attempt to make a payment holds it from other attempts.
+const paymentLease = time.Minute
+
+var errPaymentInProgress = errors.New("This payment is already being made.")
+
+// paymentReq is the body of a payment, the plan defaults to the catalog's
+// default plan.
+type paymentReq struct {
+	StripeToken string `json:"stripeToken"`
+	Plan        string `json:"plan"`
+}
+
+// newPaymentProvider creates the payment provider for the billing config.
+func newPaymentProvider(c *config.Config) (payment.Provider, error) {
+	switch c.Billing.Provider {
+	case "stripe":
+		return payment.NewStripeProvider(c.Stripe.SecretKey), nil
+	case "fake":
+		plans := make([]payment.Plan, len(c.Billing.Plans))
+		for i, plan := range c.Billing.Plans {
+			plans[i] = payment.Plan{
+				ID:       plan.ID,
+				Amount:   plan.Amount,
+				Currency: plan.Currency,
+				Interval: plan.Interval,
+			}
+		}
+
+		return payment.NewFake(plans...), nil
+	}
+
+	return nil, errors.New("unknown payment provider " + c.Billing.Provider)
+}
+
+// subscribe puts a developer on a plan, creating their customer the first
+// time they pay. token is a card from stripe.js, and may be empty if the
+// customer already has one. Starting or changing a subscription is charged,
+// so it's recorded in the ledger and only happens once for the same request
+// key and subscription state.
+func subscribe(d *schemas.Developer, plan *config.PlanConfig, token, requestKey string) (*db.Subscription, error) {
+	current, err := store.GetSubscription(d.ID)
+	if err == mgo.ErrNotFound {
+		current, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parts := []string{plan.ID, token, requestKey}
+	if current != nil {
+		parts = append(parts, current.PlanID, current.Status, current.CurrentPeriodEnd.UTC().Format(time.RFC3339))
+
+		// Only the card is changing.
+		if current.Active() && current.PlanID == plan.ID {
+			return updateSubscription(d, plan, token, paymentKey(d, append(parts, "card")...))
+		}
+	}
+
+	p := &db.Payment{
+		Key:         paymentKey(d, parts...),
+		DeveloperID: d.ID,
+		Description: "Subscription to " + plan.Name,
+		PlanID:      plan.ID,
+		Amount:      plan.Amount,
+		Currency:    plan.Currency,
+		CustomerID:  d.StripeToken,
+	}
+
+	var sub *db.Subscription
+	_, err = takePayment(p, func(p *db.Payment) error {
+		var err error
+		sub, err = updateSubscription(d, plan, token, p.Key)
+		p.CustomerID = d.StripeToken
+		if sub != nil {
+			p.PeriodEnd = sub.CurrentPeriodEnd
+		}
+		return err
+	}, func(p *db.Payment) (bool, error) {
+		customerID, providerSub, err := findSubscription(d.StripeToken, p.Key)
+		if customerID == "" || err != nil {
+			return false, err
+		}
+
+		sub, err = syncSubscription(d, customerID, providerSub)
+		p.CustomerID = customerID
+		if sub != nil {
+			p.PeriodEnd = sub.CurrentPeriodEnd
+		}
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// It was paid for by an earlier attempt, which updated the developer.
+	if sub == nil {
+		paid, err := store.GetDeveloperById(d.ID.Hex())
+		if err != nil {
+			return nil, err
+		}
+		*d = *paid
+
+		return store.GetSubscription(d.ID)
+	}
+
+	return sub, nil
+}
+
+// updateSubscription puts a developer on a plan with the payment provider.
+func updateSubscription(d *schemas.Developer, plan *config.PlanConfig, token, key string) (*db.Subscription, error) {
+	if d.StripeToken == "" {
+		customer, err := payments.CreateCustomer(&payment.CustomerParams{
+			Email:          d.Email,
+			Description:    d.Name,
+			Card:           token,
+			PlanID:         plan.ID,
+			IdempotencyKey: key,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return syncSubscription(d, customer.ID, customer.Subscription)
+	}
+
+	sub, err := payments.UpdateSubscription(d.StripeToken, &payment.SubscriptionParams{
+		PlanID:         plan.ID,
+		Card:           token,
+		Prorate:        true,
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return syncSubscription(d, d.StripeToken, sub)
+}
+
+// findSubscription looks up a subscription change made with an idempotency
+// key, returning the customer and the subscription it left them with. A
+// change that was never made returns an empty customer ID.
+func findSubscription(customerID, key string) (string, *payment.Subscription, error) {
+	if customerID == "" {
+		customer, err := payments.FindCustomer(key)
+		if customer == nil || err != nil {
+			return "", nil, err
+		}
+
+		return customer.ID, customer.Subscription, nil
+	}
+
+	customer, err := payments.GetCustomer(customerID)
+	if err != nil {
+		return "", nil, err
+	}
+	if customer.Subscription == nil || customer.Subscription.IdempotencyKey != key {
+		return "", nil, nil
+	}
+
+	return customer.ID, customer.Subscription, nil
+}
+
+// takePayment records a payment in the ledger and makes it with charge,
+// unless it was already made under the same key. A payment that was
+// declined gives back its original error. One that was left pending may
+// have reached the provider without an answer, so it's looked up with find
+// before it's tried again, find reports whether it was made.
+func takePayment(p *db.Payment, charge func(p *db.Payment) error, find func(p *db.Payment) (bool, error)) (*db.Payment, error) {
+	now := time.Now()
+	p.Status = db.PaymentPending
+	p.LockedUntil = now.Add(paymentLease)
+	p.CreatedAt = now
+	p.UpdatedAt = now
+
+	retrying := false
+	err := store.SavePayment(p)
+	if mgo.IsDup(err) {
+		p, err = store.GetPayment(p.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch p.Status {
+		case db.PaymentSucceeded, db.PaymentRefunded:
+			return p, nil
+		case db.PaymentFailed:
+			return p, &payment.Error{Type: payment.CardError, Message: p.Error}
+		}
+
+		err = store.LockPayment(p.Key, now, paymentLease)
+		if err == mgo.ErrNotFound {
+			return p, errPaymentInProgress
+		}
+		retrying = err == nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	made := false
+	if retrying {
+		made, err = find(p)
+	}
+	if err == nil && !made {
+		err = charge(p)
+	}
+	p.UpdatedAt = time.Now()
+	p.Error = ""
+	switch {
+	case err == nil:
+		p.Status = db.PaymentSucceeded
+	case payment.IsTemporary(err):
+		p.Error = err.Error()
+		p.LockedUntil = time.Time{}
+	default:
+		p.Status = db.PaymentFailed
+		p.Error = err.Error()
+	}
+
+	if updateErr := store.UpdatePayment(p); err == nil {
+		err = updateErr
+	}
+
+	return p, err
+}
+
+// formatAmount writes an amount in a currency's smallest unit for people,
+// e.g. 2900 usd is 29.00 USD.
+func formatAmount(amount int64, currency string) string {
+	return fmt.Sprintf("%d.%02d %s", amount/100, amount%100, strings.ToUpper(currency))
+}
+
+// paymentKey derives an idempotency key for a developer's payment from the
+// parts that identify it.
+func paymentKey(d *schemas.Developer, parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return d.ID.Hex() + ":" + hex.EncodeToString(sum[:16])
+}
+
+// syncSubscription stores the state of a developer's subscription and
+// updates their isPaid, nextPaymentTime and stripeToken to match. A nil
+// subscription means the customer isn't subscribed to anything.
+func syncSubscription(d *schemas.Developer, customerID string, providerSub *payment.Subscription) (*db.Subscription, error) {
+	now := time.Now()
+	sub := &db.Subscription{
+		DeveloperID: d.ID,
+		CustomerID:  customerID,
+		Status:      db.SubscriptionCanceled,
+		UpdatedAt:   now,
+		AsOf:        now,
+	}
+	if providerSub != nil {
+		sub.Status = providerSub.Status
+		sub.PlanID = providerSub.PlanID
+		sub.Quantity = providerSub.Quantity
+		sub.CurrentPeriodEnd = providerSub.CurrentPeriodEnd
+		if !providerSub.AsOf.IsZero() {
+			sub.AsOf = providerSub.AsOf
+		}
+	}
+
+	if err := store.SaveSubscription(sub); err != nil {
+		return nil, err
+	}
+
+	d.StripeToken = customerID
+	d.IsPaid = sub.Active()
+	update := bson.M{"stripeToken": d.StripeToken, "isPaid": d.IsPaid}
+	if sub.Active() {
+		d.Expiration = sub.CurrentPeriodEnd
+		update["nextPaymentTime"] = d.Expiration
+	}
+
+	return sub, store.UpdateDeveloper(bson.M{"_id": d.ID}, update)
+}
+
+// GET /plans, lists the plans developers can subscribe to
+func PlansHandler(rw http.ResponseWriter, req *http.Request) {
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":      requests.StatusFound,
+		"plans":       conf.Billing.Plans,
+		"defaultPlan": conf.Billing.DefaultPlan,
+	})
+}
+
+// GET /developers/me/payments, lists the logged in developer's payments
+func PaymentsHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	ledger, err := store.GetPayments(d.ID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"payments": ledger,
+	})
+}
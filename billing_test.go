@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// billingTest sets up an empty store with a developer, and a fake payment
+// provider with the configured plans.
+func billingTest(t *testing.T) (*payment.Fake, *schemas.Developer, func()) {
+	provider, err := newPaymentProvider(conf)
+	if err != nil {
+		t.Fatal("Could not create payment provider:", err)
+	}
+
+	fake := provider.(*payment.Fake)
+	sharedStore, sharedPayments := store, payments
+	store, payments = db.NewMemoryStore(), fake
+	done := func() { store, payments = sharedStore, sharedPayments }
+
+	mock, err := db.MockDB(store)
+	if err != nil {
+		done()
+		t.Fatal("Could not Mock DB:", err)
+	}
+
+	return fake, mock, done
+}
+
+// pay posts a payment for the developer with the given token.
+func pay(t *testing.T, token string, body paymentReq) *httptest.ResponseRecorder {
+	return payWithKey(t, token, body, "")
+}
+
+// payWithKey posts a payment with an Idempotency-Key header.
+func payWithKey(t *testing.T, token string, body paymentReq, key string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(body)
+	req, err := http.NewRequest("POST", "http://broome.io/developers/"+token+"/pay", &buf)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	return res
+}
+
+func TestPlansHandler(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://broome.io/plans", nil)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	body := struct {
+		Plans []struct {
+			ID     string `json:"id"`
+			Amount int64  `json:"amount"`
+		} `json:"plans"`
+		DefaultPlan string `json:"defaultPlan"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+
+	if len(body.Plans) != len(conf.Billing.Plans) || body.DefaultPlan != conf.Billing.DefaultPlan {
+		t.Error("plans catalog not listed correctly.")
+	}
+}
+
+func TestPaymentHandlerUnknownPlan(t *testing.T) {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(paymentReq{StripeToken: "tok_visa", Plan: "gold"})
+	req, _ := http.NewRequest("POST", "http://broome.io/developers/"+mock.Token+"/pay", &body)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+}
+
+func TestSyncSubscription(t *testing.T) {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+
+	end := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	_, err = syncSubscription(mock, "cus_123", &payment.Subscription{
+		CustomerID:       "cus_123",
+		Status:           payment.StatusActive,
+		PlanID:           "bowery-monthly",
+		CurrentPeriodEnd: end,
+	})
+	if err != nil {
+		t.Fatal("Could not sync subscription:", err)
+	}
+
+	d, err := store.GetDeveloperById(mock.ID.Hex())
+	if err != nil {
+		t.Fatal("Could not get developer:", err)
+	}
+	if !d.IsPaid || d.StripeToken != "cus_123" || !d.Expiration.Equal(end) {
+		t.Error("developer not updated from the subscription.")
+	}
+
+	res, err := newDeveloperRes(d)
+	if err != nil {
+		t.Fatal("Could not get account state:", err)
+	}
+	if res.Subscription == nil || res.Subscription.PlanID != "bowery-monthly" || !res.Subscription.Active() {
+		t.Error("subscription should be part of the account state.")
+	}
+
+	// Canceled with the provider.
+	if _, err := syncSubscription(d, "cus_123", nil); err != nil {
+		t.Fatal("Could not sync subscription:", err)
+	}
+	d, _ = store.GetDeveloperById(mock.ID.Hex())
+	if d.IsPaid {
+		t.Error("developer without a subscription shouldn't be paid.")
+	}
+}
+
+func TestPaymentHandler(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	res := pay(t, mock.Token, paymentReq{StripeToken: payment.TestCard})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	sub, err := store.GetSubscription(mock.ID)
+	if err != nil {
+		t.Fatal("Could not get subscription:", err)
+	}
+	if !d.IsPaid || d.StripeToken == "" || sub.PlanID != conf.Billing.DefaultPlan || !sub.Active() {
+		t.Error("developer should be subscribed to the default plan.")
+	}
+
+	charges := fake.Charges(d.StripeToken)
+	if len(charges) != 1 || charges[0].Amount != 2900 {
+		t.Error("expected one charge for the default plan, got", charges)
+	}
+
+	// Switching plan keeps the customer.
+	res = pay(t, mock.Token, paymentReq{Plan: "crosby-annual"})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	sub, _ = store.GetSubscription(mock.ID)
+	if sub.PlanID != "crosby-annual" || sub.CustomerID != d.StripeToken {
+		t.Error("subscription should have changed plan.")
+	}
+}
+
+func TestPaymentHandlerDeclined(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	res := pay(t, mock.Token, paymentReq{StripeToken: payment.TestCardDeclined})
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	if d.IsPaid || d.StripeToken != "" {
+		t.Error("declined developer shouldn't be paid.")
+	}
+	if _, err := store.GetSubscription(mock.ID); err == nil {
+		t.Error("declined developer shouldn't have a subscription.")
+	}
+
+	fake.FailRequests(1)
+	res = pay(t, mock.Token, paymentReq{StripeToken: payment.TestCard})
+	if res.Code != http.StatusBadGateway {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	res = pay(t, mock.Token, paymentReq{StripeToken: payment.TestCard})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+}
+
+func TestPaymentHandlerRetry(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	// The response is lost, so the client tries again.
+	fake.DropResponses(1)
+	body := paymentReq{StripeToken: payment.TestCard}
+	if res := payWithKey(t, mock.Token, body, "order-1"); res.Code != http.StatusBadGateway {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	ledger, _ := store.GetPayments(mock.ID)
+	if len(ledger) != 1 || ledger[0].Status != db.PaymentPending {
+		t.Fatal("payment should be pending until the retry, got", ledger)
+	}
+
+	for i := 0; i < 2; i++ {
+		if res := payWithKey(t, mock.Token, body, "order-1"); res.Code != http.StatusOK {
+			t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+		}
+	}
+
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	if !d.IsPaid || len(fake.Charges(d.StripeToken)) != 1 {
+		t.Error("retries should only charge once.")
+	}
+
+	ledger, _ = store.GetPayments(mock.ID)
+	if len(ledger) != 1 || ledger[0].Status != db.PaymentSucceeded || ledger[0].Amount != 2900 || ledger[0].CustomerID != d.StripeToken {
+		t.Error("ledger should have the one payment, got", ledger)
+	}
+}
+
+func TestPaymentHandlerLostResponse(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	// The provider doesn't dedupe, so the retry has to find the customer
+	// the lost request created instead of creating another.
+	fake.IgnoreKeys()
+	fake.DropResponses(1)
+	body := paymentReq{StripeToken: payment.TestCard}
+	if res := payWithKey(t, mock.Token, body, "order-1"); res.Code != http.StatusBadGateway {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	if res := payWithKey(t, mock.Token, body, "order-1"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	if charges := fake.Charges(""); !d.IsPaid || len(charges) != 1 || charges[0].CustomerID != d.StripeToken {
+		t.Error("retry should find the first payment instead of charging again, got", charges)
+	}
+
+	ledger, _ := store.GetPayments(mock.ID)
+	if len(ledger) != 1 || ledger[0].Status != db.PaymentSucceeded || ledger[0].CustomerID != d.StripeToken {
+		t.Error("ledger should have the one payment, got", ledger)
+	}
+}
+
+func TestPaymentHandlerDeclinedRetry(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+
+	body := paymentReq{StripeToken: payment.TestCardDeclined}
+	for i := 0; i < 2; i++ {
+		if res := pay(t, mock.Token, body); res.Code != http.StatusBadRequest {
+			t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+		}
+	}
+
+	ledger, _ := store.GetPayments(mock.ID)
+	if len(ledger) != 1 || ledger[0].Status != db.PaymentFailed || ledger[0].Error == "" {
+		t.Error("declined payment should be in the ledger once, got", ledger)
+	}
+}
+
+func TestPaymentsHandler(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+
+	if res := pay(t, mock.Token, paymentReq{StripeToken: payment.TestCard}); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	req, _ := http.NewRequest("GET", "http://broome.io/developers/me/payments?token="+mock.Token, nil)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	body := struct {
+		Payments []*db.Payment `json:"payments"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+	if len(body.Payments) != 1 || body.Payments[0].PlanID != conf.Billing.DefaultPlan {
+		t.Error("payment should be listed, got", body.Payments)
+	}
+
+	req = adminRequest(t, "GET", "/admin/developers/"+mock.Token)
+	res = httptest.NewRecorder()
+	broomeServer(res, req)
+	if !strings.Contains(res.Body.String(), "29.00 USD") {
+		t.Error("payment should be on the admin developer page.")
+	}
+}
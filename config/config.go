@@ -0,0 +1,697 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the configuration for broome.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	keys "github.com/Bowery/gopackages/config"
+)
+
+// Config holds every setting that can change between deployments.
+type Config struct {
+	Env          string             `json:"-"`
+	Listen       string             `json:"listen"`
+	URL          string             `json:"url"`
+	DB           DBConfig           `json:"db"`
+	Stripe       StripeConfig       `json:"stripe"`
+	Mandrill     MandrillConfig     `json:"mandrill"`
+	Mailchimp    MailchimpConfig    `json:"mailchimp"`
+	Slack        SlackConfig        `json:"slack"`
+	StatHat      StatHatConfig      `json:"stathat"`
+	Password     PasswordConfig     `json:"password"`
+	Sessions     SessionsConfig     `json:"sessions"`
+	Reset        ResetConfig        `json:"reset"`
+	Verification VerificationConfig `json:"verification"`
+	Invitations  InvitationsConfig  `json:"invitations"`
+	TwoFactor    TwoFactorConfig    `json:"twoFactor"`
+	Login        LoginConfig        `json:"login"`
+	OAuth        OAuthConfig        `json:"oauth"`
+	OIDC         OIDCConfig         `json:"oidc"`
+	Mail         MailConfig         `json:"mail"`
+	Billing      BillingConfig      `json:"billing"`
+	License      LicenseConfig      `json:"license"`
+
+	// TrustedProxies are the addresses or CIDR ranges of the proxies in
+	// front of broome, X-Forwarded-For is only read from them.
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// DBConfig is the mongodb connection.
+type DBConfig struct {
+	Addr     string `json:"addr"`
+	Name     string `json:"name"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// StripeConfig is the Stripe account used for payments.
+type StripeConfig struct {
+	SecretKey string `json:"secretKey"`
+	PublicKey string `json:"publicKey"`
+
+	// WebhookSecret checks the signatures of webhook events, they're all
+	// rejected if it's empty.
+	WebhookSecret string `json:"webhookSecret"`
+}
+
+// MandrillConfig is the Mandrill account used for email.
+type MandrillConfig struct {
+	Key string `json:"key"`
+}
+
+// MailchimpConfig is the Mailchimp list new developers are subscribed to.
+type MailchimpConfig struct {
+	Key    string `json:"key"`
+	ListID string `json:"listId"`
+}
+
+// SlackConfig is where signups are announced.
+type SlackConfig struct {
+	Token    string `json:"token"`
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+}
+
+// StatHatConfig is the StatHat account used for request stats.
+type StatHatConfig struct {
+	Key string `json:"key"`
+}
+
+// PasswordConfig controls how passwords are hashed.
+type PasswordConfig struct {
+	// Algorithm is used for new hashes, one of bcrypt, scrypt or argon2id.
+	// Older hashes are upgraded to it on login.
+	Algorithm string `json:"algorithm"`
+}
+
+// SessionsConfig controls login sessions.
+type SessionsConfig struct {
+	// TTL is how long a session lasts after it's created.
+	TTL Duration `json:"ttl"`
+}
+
+// ResetConfig controls password reset links.
+type ResetConfig struct {
+	// TTL is how long a reset link can be used after it's sent.
+	TTL Duration `json:"ttl"`
+}
+
+// VerificationConfig controls email verification links.
+type VerificationConfig struct {
+	// Secret signs the links, if it's empty outside of production a random
+	// one is used.
+	Secret string `json:"secret"`
+
+	// TTL is how long a verification link can be used after it's sent.
+	TTL Duration `json:"ttl"`
+}
+
+// InvitationsConfig controls invitations to join organizations.
+type InvitationsConfig struct {
+	// TTL is how long an invitation can be answered after it's sent.
+	TTL Duration `json:"ttl"`
+}
+
+// TwoFactorConfig controls two-factor authentication with authenticator
+// apps.
+type TwoFactorConfig struct {
+	// Issuer is the name authenticator apps show the account under.
+	Issuer string `json:"issuer"`
+
+	// ChallengeTTL is how long a login has to be finished with a code
+	// after the password is checked.
+	ChallengeTTL Duration `json:"challengeTtl"`
+}
+
+// OAuthConfig controls broome's OAuth2 authorization server.
+type OAuthConfig struct {
+	// CodeTTL is how long an authorization code can be exchanged after
+	// it's given out.
+	CodeTTL Duration `json:"codeTtl"`
+
+	// AccessTokenTTL is how long an access token lasts.
+	AccessTokenTTL Duration `json:"accessTokenTtl"`
+
+	// DeviceCodeTTL is how long a device has to be approved after it asks,
+	// and DeviceInterval is how often it can check if it has been.
+	DeviceCodeTTL  Duration `json:"deviceCodeTtl"`
+	DeviceInterval Duration `json:"deviceInterval"`
+}
+
+// OIDCConfig controls the OpenID Connect ID tokens broome signs.
+type OIDCConfig struct {
+	// KeyRotation is how long a signing key is used before a new one is
+	// made. Old keys are still published until the tokens they signed
+	// expire.
+	KeyRotation Duration `json:"keyRotation"`
+
+	// IDTokenTTL is how long an ID token lasts.
+	IDTokenTTL Duration `json:"idTokenTtl"`
+}
+
+// LoginConfig controls how failed logins are throttled. Failures are
+// counted for each account and each address.
+type LoginConfig struct {
+	Account LoginLimit `json:"account"`
+	IP      LoginLimit `json:"ip"`
+
+	// Delay is the wait after the first failure past the free ones, it
+	// doubles with each failure after that up to MaxDelay.
+	Delay    Duration `json:"delay"`
+	MaxDelay Duration `json:"maxDelay"`
+
+	// Lockout is how long logins are refused after too many failures, and
+	// how long failures are remembered.
+	Lockout Duration `json:"lockout"`
+}
+
+// LoginLimit is how many failed logins are allowed.
+type LoginLimit struct {
+	// FreeFailures can be made without waiting between them.
+	FreeFailures int `json:"freeFailures"`
+
+	// MaxFailures locks out logins until the lockout is over.
+	MaxFailures int `json:"maxFailures"`
+}
+
+// LicenseConfig controls the signed licenses clients check offline.
+type LicenseConfig struct {
+	// PrivateKey is the base64 Ed25519 key licenses are signed with, if it's
+	// empty outside of production a random one is used.
+	PrivateKey string `json:"privateKey"`
+
+	// TTL is how long a license can be used offline before it's refreshed,
+	// it expires sooner if the developer's license does.
+	TTL Duration `json:"ttl"`
+}
+
+// MailConfig controls how email is sent.
+type MailConfig struct {
+	// Driver is mandrill, smtp, dir to write emails to Dir, or memory to
+	// keep them in memory.
+	Driver string     `json:"driver"`
+	Dir    string     `json:"dir"`
+	SMTP   SMTPConfig `json:"smtp"`
+}
+
+// SMTPConfig is the server used by the smtp mail driver.
+type SMTPConfig struct {
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// BillingConfig is the catalog of plans developers can subscribe to.
+type BillingConfig struct {
+	// Provider takes the payments, stripe or fake to keep them in memory.
+	Provider string `json:"provider"`
+
+	// DefaultPlan is used when a developer pays without choosing a plan.
+	DefaultPlan string `json:"defaultPlan"`
+
+	// RenewalPlan is what crosby customers from before subscriptions are
+	// charged for when their license renews.
+	RenewalPlan string `json:"renewalPlan"`
+
+	// RenewBefore is how long before a license expires it's renewed.
+	RenewBefore Duration      `json:"renewBefore"`
+	Dunning     DunningConfig `json:"dunning"`
+	Plans       []PlanConfig  `json:"plans"`
+}
+
+// DunningConfig is how a declined renewal is retried before the license is
+// downgraded.
+type DunningConfig struct {
+	// GracePeriod is how long a past due license keeps working after it
+	// expires.
+	GracePeriod Duration `json:"gracePeriod"`
+
+	// RetrySchedule is when each retry is made, counted from the first
+	// decline. The license is downgraded if the last retry is declined.
+	RetrySchedule []Duration `json:"retrySchedule"`
+}
+
+// Plan gets the plan with the given id.
+func (b *BillingConfig) Plan(id string) (*PlanConfig, bool) {
+	for i := range b.Plans {
+		if b.Plans[i].ID == id {
+			return &b.Plans[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// PlanConfig is a price for a product. The ID is the id of the matching
+// plan in Stripe, which has to be created there with the same price.
+type PlanConfig struct {
+	ID      string `json:"id"`
+	Product string `json:"product"`
+	Name    string `json:"name"`
+
+	// Amount is in the currency's smallest unit, e.g. cents.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+
+	// Interval is how often the plan is billed, day, week, month or year.
+	Interval string `json:"interval"`
+
+	// Seats is the most members an organization on the plan can have, 0
+	// for no limit. Organizations pay Amount for each member.
+	Seats int64 `json:"seats"`
+
+	// Overage lets organizations go past Seats, paying for the extra
+	// members at the same price.
+	Overage bool `json:"overage"`
+}
+
+// PeriodEnd gets when a billing period of the plan starting at start ends.
+func (p *PlanConfig) PeriodEnd(start time.Time) time.Time {
+	switch p.Interval {
+	case "day":
+		return start.AddDate(0, 0, 1)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "year":
+		return start.AddDate(1, 0, 0)
+	}
+
+	return start.AddDate(0, 1, 0)
+}
+
+// Duration is a time.Duration written as a string in the config, e.g. "720h".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+
+	dur, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = dur
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Default returns the config for the given environment before any file or
+// environment overrides are applied.
+func Default(env string) *Config {
+	if env == "" {
+		env = "development"
+	}
+
+	c := &Config{
+		Env:    env,
+		Listen: ":4000",
+		URL:    "http://localhost:4000",
+		DB: DBConfig{
+			Addr: "localhost:27017",
+			Name: "bowery",
+		},
+		Stripe: StripeConfig{
+			SecretKey: keys.StripeTestSecretKey,
+			PublicKey: keys.StripeTestPublicKey,
+		},
+		Mandrill: MandrillConfig{Key: keys.MandrillKey},
+		Mailchimp: MailchimpConfig{
+			Key:    keys.MailchimpKey,
+			ListID: "200e892f56",
+		},
+		Slack: SlackConfig{
+			Token:    keys.SlackToken,
+			Channel:  "#activity",
+			Username: "Drizzy Drake",
+		},
+		StatHat:      StatHatConfig{Key: keys.StatHatKey},
+		Password:     PasswordConfig{Algorithm: "argon2id"},
+		Sessions:     SessionsConfig{TTL: Duration{30 * 24 * time.Hour}},
+		Reset:        ResetConfig{TTL: Duration{time.Hour}},
+		Verification: VerificationConfig{TTL: Duration{7 * 24 * time.Hour}},
+		Invitations:  InvitationsConfig{TTL: Duration{7 * 24 * time.Hour}},
+		TwoFactor:    TwoFactorConfig{Issuer: "Bowery", ChallengeTTL: Duration{5 * time.Minute}},
+		OIDC:         OIDCConfig{KeyRotation: Duration{30 * 24 * time.Hour}, IDTokenTTL: Duration{time.Hour}},
+		Mail:         MailConfig{Driver: "dir", Dir: "tmp/mail"},
+		License:      LicenseConfig{TTL: Duration{7 * 24 * time.Hour}},
+		Login: LoginConfig{
+			Account:  LoginLimit{FreeFailures: 3, MaxFailures: 10},
+			IP:       LoginLimit{FreeFailures: 20, MaxFailures: 100},
+			Delay:    Duration{time.Second},
+			MaxDelay: Duration{time.Minute},
+			Lockout:  Duration{15 * time.Minute},
+		},
+		OAuth: OAuthConfig{
+			CodeTTL:        Duration{5 * time.Minute},
+			AccessTokenTTL: Duration{time.Hour},
+			DeviceCodeTTL:  Duration{10 * time.Minute},
+			DeviceInterval: Duration{5 * time.Second},
+		},
+		Billing: BillingConfig{
+			Provider:    "stripe",
+			DefaultPlan: "bowery-monthly",
+			RenewalPlan: "crosby-annual",
+			RenewBefore: Duration{3 * 24 * time.Hour},
+			Dunning: DunningConfig{
+				GracePeriod:   Duration{7 * 24 * time.Hour},
+				RetrySchedule: []Duration{{24 * time.Hour}, {3 * 24 * time.Hour}, {6 * 24 * time.Hour}},
+			},
+			Plans: []PlanConfig{
+				{ID: "bowery-monthly", Product: "bowery", Name: "Bowery 3", Amount: 2900, Currency: "usd", Interval: "month"},
+				{ID: "crosby-annual", Product: "crosby", Name: "Crosby Annual License", Amount: 2500, Currency: "usd", Interval: "year"},
+			},
+		},
+	}
+
+	// Production has no local database, it must be given explicitly.
+	if c.IsProduction() {
+		c.Listen = ":80"
+		c.URL = "http://broome.io"
+		c.Mail.Driver = "mandrill"
+		c.DB.Addr = ""
+		c.Stripe.SecretKey = keys.StripeLiveSecretKey
+		c.Stripe.PublicKey = keys.StripeLivePublicKey
+	}
+
+	return c
+}
+
+// Load reads the config for the current ENV. Settings in the file at path
+// replace the defaults, and BROOME_* environment variables replace both.
+// A missing file is only an error if required is true.
+func Load(path string, required bool) (*Config, error) {
+	c := Default(os.Getenv("ENV"))
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err == nil {
+			defer file.Close()
+
+			if err := c.decode(file); err != nil {
+				return nil, errors.New("config: " + path + ": " + err.Error())
+			}
+		} else if required || !os.IsNotExist(err) {
+			return nil, errors.New("config: " + err.Error())
+		}
+	}
+
+	for name, field := range c.envFields() {
+		if val := os.Getenv(name); val != "" {
+			*field = val
+		}
+	}
+
+	return c, c.Validate()
+}
+
+// decode reads a config file over the defaults. Lists in the file replace
+// the defaults instead of being merged into them item by item, so they're
+// cleared first and the defaults put back if the file leaves them out.
+func (c *Config) decode(r io.Reader) error {
+	plans, retries, proxies := c.Billing.Plans, c.Billing.Dunning.RetrySchedule, c.TrustedProxies
+	c.Billing.Plans, c.Billing.Dunning.RetrySchedule, c.TrustedProxies = nil, nil, nil
+
+	if err := json.NewDecoder(r).Decode(c); err != nil {
+		return err
+	}
+
+	if c.Billing.Plans == nil {
+		c.Billing.Plans = plans
+	}
+	if c.Billing.Dunning.RetrySchedule == nil {
+		c.Billing.Dunning.RetrySchedule = retries
+	}
+	if c.TrustedProxies == nil {
+		c.TrustedProxies = proxies
+	}
+
+	return nil
+}
+
+// Validate checks that every required setting is present.
+func (c *Config) Validate() error {
+	missing := []string{}
+	required := map[string]string{
+		"listen":           c.Listen,
+		"url":              c.URL,
+		"db.addr":          c.DB.Addr,
+		"db.name":          c.DB.Name,
+		"stripe.secretKey": c.Stripe.SecretKey,
+		"stripe.publicKey": c.Stripe.PublicKey,
+	}
+
+	switch c.Mail.Driver {
+	case "mandrill":
+		required["mandrill.key"] = c.Mandrill.Key
+	case "smtp":
+		required["mail.smtp.addr"] = c.Mail.SMTP.Addr
+	case "dir":
+		required["mail.dir"] = c.Mail.Dir
+	case "memory":
+	default:
+		return errors.New("config: mail.driver must be mandrill, smtp, dir or memory")
+	}
+
+	if c.IsProduction() {
+		required["mailchimp.key"] = c.Mailchimp.Key
+		required["mailchimp.listId"] = c.Mailchimp.ListID
+		required["slack.token"] = c.Slack.Token
+		required["verification.secret"] = c.Verification.Secret
+		required["stripe.webhookSecret"] = c.Stripe.WebhookSecret
+		required["license.privateKey"] = c.License.PrivateKey
+	}
+
+	for name, val := range required {
+		if val == "" {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.New("config: missing required settings " + strings.Join(missing, ", "))
+	}
+
+	if c.Sessions.TTL.Duration <= 0 {
+		return errors.New("config: sessions.ttl must be positive")
+	}
+
+	if c.Reset.TTL.Duration <= 0 {
+		return errors.New("config: reset.ttl must be positive")
+	}
+
+	if c.Verification.TTL.Duration <= 0 {
+		return errors.New("config: verification.ttl must be positive")
+	}
+
+	if c.Invitations.TTL.Duration <= 0 {
+		return errors.New("config: invitations.ttl must be positive")
+	}
+
+	if c.TwoFactor.Issuer == "" || c.TwoFactor.ChallengeTTL.Duration <= 0 {
+		return errors.New("config: twoFactor needs an issuer and a positive challengeTtl")
+	}
+
+	if c.OAuth.CodeTTL.Duration <= 0 || c.OAuth.AccessTokenTTL.Duration <= 0 ||
+		c.OAuth.DeviceCodeTTL.Duration <= 0 || c.OAuth.DeviceInterval.Duration <= 0 {
+		return errors.New("config: oauth.codeTtl, oauth.accessTokenTtl, oauth.deviceCodeTtl and oauth.deviceInterval must be positive")
+	}
+
+	if c.OIDC.KeyRotation.Duration <= 0 || c.OIDC.IDTokenTTL.Duration <= 0 {
+		return errors.New("config: oidc.keyRotation and oidc.idTokenTtl must be positive")
+	}
+
+	if err := c.Login.validate(); err != nil {
+		return err
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		if parseProxy(proxy) == nil {
+			return errors.New("config: trustedProxies must be addresses or CIDR ranges")
+		}
+	}
+
+	if c.License.TTL.Duration <= 0 {
+		return errors.New("config: license.ttl must be positive")
+	}
+
+	switch c.Password.Algorithm {
+	case "bcrypt", "scrypt", "argon2id":
+	default:
+		return errors.New("config: password.algorithm must be bcrypt, scrypt or argon2id")
+	}
+
+	if c.IsProduction() && c.Billing.Provider != "stripe" {
+		return errors.New("config: billing.provider must be stripe in production")
+	}
+
+	return c.Billing.validate()
+}
+
+// validate checks failures can be made before a lockout, and the waits are
+// positive.
+func (l *LoginConfig) validate() error {
+	for _, limit := range []LoginLimit{l.Account, l.IP} {
+		if limit.FreeFailures < 0 || limit.MaxFailures <= limit.FreeFailures {
+			return errors.New("config: login maxFailures must be more than freeFailures")
+		}
+	}
+
+	if l.Delay.Duration <= 0 || l.MaxDelay.Duration < l.Delay.Duration || l.Lockout.Duration <= 0 {
+		return errors.New("config: login needs a positive delay, maxDelay and lockout")
+	}
+
+	return nil
+}
+
+// validate checks the provider is known, every plan is complete, the
+// default and renewal plans exist and dunning is configured sensibly.
+func (b *BillingConfig) validate() error {
+	switch b.Provider {
+	case "stripe", "fake":
+	default:
+		return errors.New("config: billing.provider must be stripe or fake")
+	}
+
+	ids := map[string]bool{}
+	for _, plan := range b.Plans {
+		if plan.ID == "" || ids[plan.ID] {
+			return errors.New("config: billing.plans must have unique ids")
+		}
+		ids[plan.ID] = true
+
+		if plan.Product == "" || plan.Currency == "" || plan.Amount <= 0 {
+			return errors.New("config: billing plan " + plan.ID + " needs a product, currency and positive amount")
+		}
+
+		if plan.Seats < 0 {
+			return errors.New("config: billing plan " + plan.ID + " seats can't be negative")
+		}
+
+		switch plan.Interval {
+		case "day", "week", "month", "year":
+		default:
+			return errors.New("config: billing plan " + plan.ID + " interval must be day, week, month or year")
+		}
+	}
+
+	if !ids[b.DefaultPlan] {
+		return errors.New("config: billing.defaultPlan must be one of billing.plans")
+	}
+
+	if !ids[b.RenewalPlan] {
+		return errors.New("config: billing.renewalPlan must be one of billing.plans")
+	}
+
+	if b.RenewBefore.Duration < 0 {
+		return errors.New("config: billing.renewBefore can't be negative")
+	}
+
+	return b.Dunning.validate()
+}
+
+// validate checks retries are in order and made before the grace period
+// ends.
+func (d *DunningConfig) validate() error {
+	if d.GracePeriod.Duration < 0 {
+		return errors.New("config: billing.dunning.gracePeriod can't be negative")
+	}
+
+	var last time.Duration
+	for _, retry := range d.RetrySchedule {
+		if retry.Duration <= last {
+			return errors.New("config: billing.dunning.retrySchedule must be positive and increasing")
+		}
+		last = retry.Duration
+	}
+
+	if last > d.GracePeriod.Duration {
+		return errors.New("config: billing.dunning.retrySchedule must end within the grace period")
+	}
+
+	return nil
+}
+
+// TrustedProxy checks if an address is one of the trusted proxies.
+func (c *Config) TrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		if network := parseProxy(proxy); network != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseProxy gets the range a trusted proxy covers, a single address is a
+// range of one. It's nil if the proxy isn't valid.
+func parseProxy(proxy string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(proxy); err == nil {
+		return network
+	}
+
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// IsProduction checks if the config is for the production environment.
+func (c *Config) IsProduction() bool {
+	return c.Env == "production"
+}
+
+// envFields maps environment variable names to the settings they replace.
+func (c *Config) envFields() map[string]*string {
+	return map[string]*string{
+		"BROOME_LISTEN":                &c.Listen,
+		"BROOME_DB_ADDR":               &c.DB.Addr,
+		"BROOME_DB_NAME":               &c.DB.Name,
+		"BROOME_DB_USER":               &c.DB.User,
+		"BROOME_DB_PASSWORD":           &c.DB.Password,
+		"BROOME_STRIPE_SECRET_KEY":     &c.Stripe.SecretKey,
+		"BROOME_STRIPE_PUBLIC_KEY":     &c.Stripe.PublicKey,
+		"BROOME_STRIPE_WEBHOOK_SECRET": &c.Stripe.WebhookSecret,
+		"BROOME_MANDRILL_KEY":          &c.Mandrill.Key,
+		"BROOME_MAILCHIMP_KEY":         &c.Mailchimp.Key,
+		"BROOME_MAILCHIMP_LIST_ID":     &c.Mailchimp.ListID,
+		"BROOME_SLACK_TOKEN":           &c.Slack.Token,
+		"BROOME_SLACK_CHANNEL":         &c.Slack.Channel,
+		"BROOME_SLACK_USERNAME":        &c.Slack.Username,
+		"BROOME_STATHAT_KEY":           &c.StatHat.Key,
+		"BROOME_PASSWORD_ALGORITHM":    &c.Password.Algorithm,
+		"BROOME_VERIFICATION_SECRET":   &c.Verification.Secret,
+		"BROOME_MAIL_DRIVER":           &c.Mail.Driver,
+		"BROOME_MAIL_DIR":              &c.Mail.Dir,
+		"BROOME_SMTP_ADDR":             &c.Mail.SMTP.Addr,
+		"BROOME_SMTP_USERNAME":         &c.Mail.SMTP.Username,
+		"BROOME_SMTP_PASSWORD":         &c.Mail.SMTP.Password,
+		"BROOME_BILLING_PROVIDER":      &c.Billing.Provider,
+		"BROOME_LICENSE_PRIVATE_KEY":   &c.License.PrivateKey,
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2014 Bowery, Inc.
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "broome-config")
+	if err != nil {
+		t.Fatal("Unable to create temp dir:", err)
+	}
+
+	path := filepath.Join(dir, "broome.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal("Unable to write config:", err)
+	}
+
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	os.Setenv("ENV", "development")
+	defer os.Setenv("ENV", "")
+
+	c, err := Load("does-not-exist.json", false)
+	if err != nil {
+		t.Fatal("Unable to load config:", err)
+	}
+
+	if c.Listen != ":4000" || c.DB.Addr != "localhost:27017" || c.Mailchimp.ListID != "200e892f56" {
+		t.Error("development defaults not used.")
+	}
+}
+
+func TestLoadMissingRequiredFile(t *testing.T) {
+	if _, err := Load("does-not-exist.json", true); err == nil {
+		t.Error("a missing required config file should fail.")
+	}
+}
+
+func TestLoadFileAndEnv(t *testing.T) {
+	path := writeConfig(t, `{"listen": ":8080", "db": {"addr": "db1,db2", "user": "bowery"}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	os.Setenv("BROOME_DB_PASSWORD", "secret")
+	os.Setenv("BROOME_LISTEN", ":9090")
+	defer os.Setenv("BROOME_DB_PASSWORD", "")
+	defer os.Setenv("BROOME_LISTEN", "")
+
+	c, err := Load(path, true)
+	if err != nil {
+		t.Fatal("Unable to load config:", err)
+	}
+
+	if c.DB.Addr != "db1,db2" || c.DB.User != "bowery" || c.DB.Name != "bowery" {
+		t.Error("file settings not merged with defaults.", c.DB)
+	}
+
+	if c.DB.Password != "secret" || c.Listen != ":9090" {
+		t.Error("environment overrides not applied.")
+	}
+}
+
+func TestLoadListsReplaceDefaults(t *testing.T) {
+	path := writeConfig(t, `{"billing": {"defaultPlan": "team", "renewalPlan": "team", "plans": [
+		{"id": "team", "product": "crosby", "amount": 5000, "currency": "usd", "interval": "month", "seats": 10}
+	], "dunning": {"retrySchedule": ["12h"]}}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load(path, true)
+	if err != nil {
+		t.Fatal("Unable to load config:", err)
+	}
+
+	plans := c.Billing.Plans
+	if len(plans) != 1 || plans[0] != (PlanConfig{ID: "team", Product: "crosby", Amount: 5000, Currency: "usd", Interval: "month", Seats: 10}) {
+		t.Error("plans should replace the defaults, got", plans)
+	}
+	if retries := c.Billing.Dunning.RetrySchedule; len(retries) != 1 || retries[0].Duration != 12*time.Hour {
+		t.Error("retry schedule should replace the defaults, got", retries)
+	}
+	if c.Billing.Dunning.GracePeriod.Duration <= 0 {
+		t.Error("settings the file leaves out should keep their defaults.")
+	}
+}
+
+func TestLoadInvalidFile(t *testing.T) {
+	path := writeConfig(t, `{"listen": `)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := Load(path, true); err == nil {
+		t.Error("an invalid config file should fail.")
+	}
+}
+
+func TestValidateProduction(t *testing.T) {
+	c := Default("production")
+	c.Mandrill.Key = ""
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("production config without a database should fail.")
+	}
+
+	if !strings.Contains(err.Error(), "db.addr") || !strings.Contains(err.Error(), "mandrill.key") ||
+		!strings.Contains(err.Error(), "license.privateKey") {
+		t.Error("validation error doesn't name the missing settings:", err)
+	}
+}
+
+func TestLoadPlans(t *testing.T) {
+	path := writeConfig(t, `{"billing": {"defaultPlan": "team", "renewalPlan": "team", "plans": [
+		{"id": "team", "product": "bowery", "name": "Team", "amount": 9900, "currency": "usd", "interval": "month"}
+	]}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := Load(path, true)
+	if err != nil {
+		t.Fatal("Unable to load config:", err)
+	}
+
+	if len(c.Billing.Plans) != 1 {
+		t.Fatal("plans in the file should replace the default plans.")
+	}
+	if plan, ok := c.Billing.Plan("team"); !ok || plan.Amount != 9900 {
+		t.Error("plan not loaded correctly.")
+	}
+}
+
+func TestValidatePlans(t *testing.T) {
+	for name, edit := range map[string]func(c *Config){
+		"missing default": func(c *Config) { c.Billing.DefaultPlan = "gold" },
+		"missing renewal": func(c *Config) { c.Billing.RenewalPlan = "" },
+		"duplicate id":    func(c *Config) { c.Billing.Plans[1].ID = c.Billing.Plans[0].ID },
+		"free plan":       func(c *Config) { c.Billing.Plans[0].Amount = 0 },
+		"bad interval":    func(c *Config) { c.Billing.Plans[0].Interval = "fortnight" },
+		"negative seats":  func(c *Config) { c.Billing.Plans[0].Seats = -1 },
+		"bad provider":    func(c *Config) { c.Billing.Provider = "paypal" },
+		"negative renew":  func(c *Config) { c.Billing.RenewBefore.Duration = -time.Hour },
+		"negative grace":  func(c *Config) { c.Billing.Dunning.GracePeriod.Duration = -time.Hour },
+		"retry order": func(c *Config) {
+			c.Billing.Dunning.RetrySchedule = []Duration{{48 * time.Hour}, {24 * time.Hour}}
+		},
+		"retry past grace": func(c *Config) { c.Billing.Dunning.GracePeriod.Duration = 24 * time.Hour },
+	} {
+		c := Default("development")
+		edit(c)
+
+		if err := c.Validate(); err == nil {
+			t.Error(name, "should fail validation.")
+		}
+	}
+}
+
+func TestValidateLogin(t *testing.T) {
+	for name, edit := range map[string]func(c *Config){
+		"no free failures": func(c *Config) { c.Login.Account.FreeFailures = -1 },
+		"lockout too soon": func(c *Config) { c.Login.IP.MaxFailures = c.Login.IP.FreeFailures },
+		"no delay":         func(c *Config) { c.Login.Delay.Duration = 0 },
+		"max before delay": func(c *Config) { c.Login.MaxDelay.Duration = time.Millisecond },
+		"no lockout":       func(c *Config) { c.Login.Lockout.Duration = 0 },
+	} {
+		c := Default("development")
+		edit(c)
+
+		if err := c.Validate(); err == nil {
+			t.Error(name, "should fail validation.")
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	c := Default("development")
+	c.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1", "::1"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, trusted := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"::1":         true,
+		"203.0.113.9": false,
+		"nope":        false,
+	} {
+		if c.TrustedProxy(addr) != trusted {
+			t.Error(addr, "should be trusted:", trusted)
+		}
+	}
+
+	c.TrustedProxies = []string{"10.0.0.0/33"}
+	if err := c.Validate(); err == nil {
+		t.Error("bad proxy should fail validation.")
+	}
+}
@@ -2,31 +2,155 @@
 package db
 
 import (
-	"os"
+	"time"
 
 	"github.com/Bowery/gopackages/database"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
 )
 
-var Client *database.Client
+// Store is everything broome persists.
+type Store interface {
+	DeveloperStore
+	SessionStore
+	ResetTokenStore
+	VerificationStore
+	SettingsStore
+	EmailStore
+	SubscriptionStore
+	EventStore
+	PaymentStore
+	RenewalStore
+	OrganizationStore
+	InvitationStore
+	StaffStore
+	TwoFactorStore
+	LoginAttemptStore
+	OAuthStore
+	SigningKeyStore
+	DeviceStore
+}
 
-func init() {
-	dbAddr := ""
-	dbUsr := ""
-	dbPass := ""
+// DeveloperStore persists developer accounts. Queries and updates use the
+// same bson field names as the developers collection.
+type DeveloperStore interface {
+	// Save inserts a new developer, hashing its password if it has no salt.
+	Save(d *schemas.Developer) error
 
-	if os.Getenv("ENV") == "development" || os.Getenv("ENV") == "testing" {
-		dbAddr = "localhost:27017"
-	}
+	// GetDeveloper returns the first developer matching query.
+	GetDeveloper(query bson.M) (*schemas.Developer, error)
+
+	// GetDeveloperById returns the developer with the given hex id.
+	GetDeveloperById(id string) (*schemas.Developer, error)
+
+	// GetDevelopers returns every developer matching query.
+	GetDevelopers(query bson.M) ([]*schemas.Developer, error)
+
+	// GetExpiringDevelopers returns the paid developers with a payment
+	// customer whose license expires by before.
+	GetExpiringDevelopers(before time.Time) ([]*schemas.Developer, error)
+
+	// UpdateDeveloper sets the fields in update on the developer matching query.
+	UpdateDeveloper(query, update bson.M) error
+
+	// RemoveDeveloper deletes the developer matching query.
+	RemoveDeveloper(query bson.M) error
+}
 
-	if os.Getenv("ENV") == "production" {
-		dbAddr = "ec2-54-166-124-190.compute-1.amazonaws.com,ec2-54-211-48-143.compute-1.amazonaws.com,ec2-54-87-106-210.compute-1.amazonaws.com"
-		dbUsr = "bowery"
-		dbPass = "java$cript"
+// Dial connects to the named database at addr, which may be a comma
+// separated list of hosts.
+func Dial(addr, name, user, password string) (*database.Client, error) {
+	return database.NewClient(addr, name, user, password)
+}
+
+// MongoStore is a Store backed by mongodb, each kind of document is kept in
+// its own collection.
+type MongoStore struct {
+	db *mgo.Database
+}
+
+// NewMongoStore creates a MongoStore using the given database client.
+func NewMongoStore(client *database.Client) *MongoStore {
+	return &MongoStore{db: client.Db}
+}
+
+// EnsureIndexes creates the indexes the store's queries rely on.
+func (s *MongoStore) EnsureIndexes() error {
+	indexes := map[string][]mgo.Index{
+		"sessions": {
+			{Key: []string{"tokenHash"}, Unique: true},
+			{Key: []string{"developerId"}},
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+		"challenges": {
+			{Key: []string{"tokenHash"}, Unique: true},
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+		"logins": {
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+		"clients": {
+			{Key: []string{"name"}},
+		},
+		"authCodes": {
+			{Key: []string{"codeHash"}, Unique: true},
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+		"oauthTokens": {
+			{Key: []string{"tokenHash"}, Unique: true},
+			{Key: []string{"clientId"}},
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+		"devices": {
+			{Key: []string{"deviceCodeHash"}, Unique: true},
+			{Key: []string{"userCodeHash"}, Unique: true},
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+		"signingKeys": {
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+		"resetTokens": {
+			{Key: []string{"tokenHash"}, Unique: true},
+			{Key: []string{"developerId"}},
+			{Key: []string{"expiresAt"}, ExpireAfter: time.Second},
+		},
+		"emails": {
+			{Key: []string{"status", "nextAttemptAt"}},
+			{Key: []string{"status", "-createdAt"}},
+		},
+		"developers": {
+			{Key: []string{"isPaid", "nextPaymentTime"}},
+		},
+		"payments": {
+			{Key: []string{"developerId", "-createdAt"}},
+			{Key: []string{"chargeId"}},
+			{Key: []string{"invoiceId"}},
+		},
+		"renewals": {
+			{Key: []string{"status", "nextAttemptAt"}},
+		},
+		"organizations": {
+			{Key: []string{"customerId"}},
+			{Key: []string{"name"}},
+		},
+		"members": {
+			{Key: []string{"organizationId", "createdAt"}},
+			{Key: []string{"developerId", "createdAt"}},
+		},
+		"invitations": {
+			{Key: []string{"tokenHash"}, Unique: true},
+			{Key: []string{"organizationId", "status", "-createdAt"}},
+		},
 	}
 
-	var err error
-	Client, err = database.NewClient(dbAddr, "bowery", dbUsr, dbPass)
-	if err != nil {
-		panic(err)
+	for name, idxs := range indexes {
+		for _, idx := range idxs {
+			if err := s.db.C(name).EnsureIndex(idx); err != nil {
+				return err
+			}
+		}
 	}
+
+	return nil
 }
@@ -7,30 +7,22 @@ import (
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
+	"github.com/Bowery/broome/password"
 	"github.com/Bowery/gopackages/schemas"
-	"github.com/Bowery/gopackages/util"
 	"github.com/cenkalti/backoff"
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 )
 
-var devs *mgo.Collection
-
-func init() {
-	devs = Client.Db.C("developers")
-}
-
-func Save(d *schemas.Developer) error {
-	if d.Salt == "" {
-		d.Salt = uuid.New()
-		d.Password = util.HashPassword(d.Password, d.Salt)
+func (s *MongoStore) Save(d *schemas.Developer) error {
+	err := prepare(d)
+	if err != nil {
+		return err
 	}
 
-	var err error
 	b := backoff.NewTicker(backoff.NewExponentialBackOff()).C
 
 	for _ = range b {
-		if err = devs.Insert(d); err != nil {
+		if err = s.db.C("developers").Insert(d); err != nil {
 			continue
 		}
 
@@ -40,25 +32,111 @@ func Save(d *schemas.Developer) error {
 	return err
 }
 
-func GetDeveloper(query bson.M) (*schemas.Developer, error) {
+func (s *MongoStore) GetDeveloper(query bson.M) (*schemas.Developer, error) {
+	d := &schemas.Developer{}
+	return d, s.db.C("developers").Find(query).One(&d)
+}
+
+func (s *MongoStore) GetDeveloperById(id string) (*schemas.Developer, error) {
+	return s.GetDeveloper(bson.M{"_id": bson.ObjectIdHex(id)})
+}
+
+func (s *MongoStore) GetDevelopers(query bson.M) ([]*schemas.Developer, error) {
+	ds := []*schemas.Developer{}
+	return ds, s.db.C("developers").Find(query).All(&ds)
+}
+
+func (s *MongoStore) GetExpiringDevelopers(before time.Time) ([]*schemas.Developer, error) {
+	ds := []*schemas.Developer{}
+	return ds, s.db.C("developers").Find(bson.M{
+		"isPaid":          true,
+		"stripeToken":     bson.M{"$ne": ""},
+		"nextPaymentTime": bson.M{"$lte": before},
+	}).All(&ds)
+}
+
+func (s *MongoStore) UpdateDeveloper(query, update bson.M) error {
+	return s.db.C("developers").Update(query, bson.M{"$set": update})
+}
+
+func (s *MongoStore) RemoveDeveloper(query bson.M) error {
+	return s.db.C("developers").Remove(query)
+}
+
+func (s *MemoryStore) Save(d *schemas.Developer) error {
+	if err := prepare(d); err != nil {
+		return err
+	}
+
+	return s.insert("developers", d)
+}
+
+func (s *MemoryStore) GetDeveloper(query bson.M) (*schemas.Developer, error) {
 	d := &schemas.Developer{}
-	return d, devs.Find(query).One(&d)
+	return d, s.findOne("developers", query, d)
+}
+
+func (s *MemoryStore) GetDeveloperById(id string) (*schemas.Developer, error) {
+	return s.GetDeveloper(bson.M{"_id": bson.ObjectIdHex(id)})
 }
 
-func GetDeveloperById(id string) (*schemas.Developer, error) {
-	return GetDeveloper(bson.M{"_id": bson.ObjectIdHex(id)})
+func (s *MemoryStore) GetDevelopers(query bson.M) ([]*schemas.Developer, error) {
+	ds := []*schemas.Developer{}
+	return ds, s.findAll("developers", query, &ds)
 }
 
-func GetDevelopers(query bson.M) ([]*schemas.Developer, error) {
+func (s *MemoryStore) GetExpiringDevelopers(before time.Time) ([]*schemas.Developer, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
 	ds := []*schemas.Developer{}
-	return ds, devs.Find(query).All(&ds)
+	for _, doc := range s.collections["developers"] {
+		customer, _ := doc["stripeToken"].(string)
+		expiration, _ := doc["nextPaymentTime"].(time.Time)
+		if doc["isPaid"] != true || customer == "" || expiration.After(before) {
+			continue
+		}
+
+		d := &schemas.Developer{}
+		if err := fromDoc(doc, d); err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+
+	return ds, nil
 }
 
-func UpdateDeveloper(query, update bson.M) error {
-	return devs.Update(query, bson.M{"$set": update})
+func (s *MemoryStore) UpdateDeveloper(query, update bson.M) error {
+	return s.update("developers", query, update)
+}
+
+func (s *MemoryStore) RemoveDeveloper(query bson.M) error {
+	return s.remove("developers", query)
+}
+
+// prepare fills in the fields a developer needs before it's first saved.
+// The salt marks the password as hashed, new hashes carry their own salt.
+func prepare(d *schemas.Developer) error {
+	if d.ID == "" {
+		d.ID = bson.NewObjectId()
+	}
+
+	if d.Salt == "" {
+		hash, err := password.Hash(d.Password)
+		if err != nil {
+			return err
+		}
+
+		d.Salt = uuid.New()
+		d.Password = hash
+	}
+
+	return nil
 }
 
-func MockDB() (*schemas.Developer, error) {
+// MockDB resets the mock developer in the given store.
+func MockDB(store DeveloperStore) (*schemas.Developer, error) {
 	if os.Getenv("ENV") == "production" {
 		panic("DON'T RUN MOCKDB IN PRODUCTION!!!!")
 		return nil, errors.New("DON't RUN MOCKDB IN PRODUCTION!!!!")
@@ -80,8 +158,8 @@ func MockDB() (*schemas.Developer, error) {
 		Expiration:          t,
 	}
 
-	devs.Remove(bson.M{"_id": dev.ID})
-	if err := Save(dev); err != nil {
+	store.RemoveDeveloper(bson.M{"_id": dev.ID})
+	if err := store.Save(dev); err != nil {
 		return nil, err
 	}
 
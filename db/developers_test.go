@@ -2,17 +2,21 @@
 package db
 
 import (
-	"labix.org/v2/mgo/bson"
 	"testing"
+	"time"
+
+	"labix.org/v2/mgo/bson"
 )
 
+var store DeveloperStore = NewMemoryStore()
+
 func TestGetDeveloper(t *testing.T) {
-	mock, err := MockDB()
+	mock, err := MockDB(store)
 	if err != nil {
 		t.Fatal("Unable to Mock DB:", err)
 	}
 
-	dev, err := GetDeveloper(bson.M{"email": mock.Email})
+	dev, err := store.GetDeveloper(bson.M{"email": mock.Email})
 	if err != nil {
 		t.Fatal("Unable to get developer:", err)
 	}
@@ -23,18 +27,18 @@ func TestGetDeveloper(t *testing.T) {
 }
 
 func TestUpdateDeveloper(t *testing.T) {
-	mock, err := MockDB()
+	mock, err := MockDB(store)
 	if err != nil {
 		t.Fatal("Unable to Mock DB:", err)
 	}
 
 	testEmail := "testing@email.com"
 
-	if err = UpdateDeveloper(bson.M{"_id": mock.ID}, bson.M{"email": testEmail}); err != nil {
+	if err = store.UpdateDeveloper(bson.M{"_id": mock.ID}, bson.M{"email": testEmail}); err != nil {
 		t.Fatal("Unable to update developer:", err)
 	}
 
-	dev, err := GetDeveloperById(mock.ID.Hex())
+	dev, err := store.GetDeveloperById(mock.ID.Hex())
 	if err != nil {
 		t.Fatal("Unable to GetDeveloperById:", err)
 	}
@@ -45,7 +49,7 @@ func TestUpdateDeveloper(t *testing.T) {
 }
 
 func TestGetDeveloperById(t *testing.T) {
-	mock, err := MockDB()
+	mock, err := MockDB(store)
 	if err != nil {
 		t.Fatal("Unable to Mock DB:", err)
 	}
@@ -54,7 +58,7 @@ func TestGetDeveloperById(t *testing.T) {
 
 	id = mock.ID
 
-	dev, err := GetDeveloperById(id.Hex())
+	dev, err := store.GetDeveloperById(id.Hex())
 	if err != nil {
 		t.Fatal("Unable to GetDeveloperById:", err)
 	}
@@ -63,3 +67,37 @@ func TestGetDeveloperById(t *testing.T) {
 		t.Error("email not saved correctly.")
 	}
 }
+
+func TestGetExpiringDevelopers(t *testing.T) {
+	mem := NewMemoryStore()
+	mock, err := MockDB(mem)
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	before := mock.Expiration.Add(time.Hour)
+	ds, err := mem.GetExpiringDevelopers(before)
+	if err != nil {
+		t.Fatal("Unable to get expiring developers:", err)
+	}
+	if len(ds) != 0 {
+		t.Error("unpaid developer without a customer shouldn't be expiring.")
+	}
+
+	if err := mem.UpdateDeveloper(bson.M{"_id": mock.ID}, bson.M{"isPaid": true, "stripeToken": "cus_123"}); err != nil {
+		t.Fatal("Unable to update developer:", err)
+	}
+
+	ds, err = mem.GetExpiringDevelopers(before)
+	if err != nil {
+		t.Fatal("Unable to get expiring developers:", err)
+	}
+	if len(ds) != 1 || ds[0].ID != mock.ID {
+		t.Error("paid developer should be expiring.")
+	}
+
+	ds, _ = mem.GetExpiringDevelopers(mock.Expiration.Add(-time.Hour))
+	if len(ds) != 0 {
+		t.Error("developer shouldn't expire before their expiration.")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// The states of a device authorization.
+const (
+	DevicePending  = "pending"
+	DeviceApproved = "approved"
+	DeviceDenied   = "denied"
+)
+
+// DeviceAuthorization is a device, like the crosby CLI, waiting for a
+// developer to approve it in a browser. The device polls with the device
+// code, the developer types in the user code. Only hashes of the codes are
+// stored.
+type DeviceAuthorization struct {
+	ID             bson.ObjectId `bson:"_id" json:"-"`
+	DeviceCode     string        `bson:"-" json:"-"`
+	DeviceCodeHash string        `bson:"deviceCodeHash" json:"-"`
+	UserCode       string        `bson:"-" json:"-"`
+	UserCodeHash   string        `bson:"userCodeHash" json:"-"`
+	ClientID       string        `bson:"clientId" json:"-"`
+
+	// Name is what the device calls itself, the session it gets is shown
+	// under it.
+	Name string `bson:"name" json:"name"`
+
+	Status       string        `bson:"status" json:"status"`
+	DeveloperID  bson.ObjectId `bson:"developerId,omitempty" json:"-"`
+	LastPolledAt time.Time     `bson:"lastPolledAt" json:"-"`
+	CreatedAt    time.Time     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt    time.Time     `bson:"expiresAt" json:"expiresAt"`
+
+	// Interval is how long the device has to wait between polls, it grows
+	// each time the device is told to slow down.
+	Interval time.Duration `bson:"interval" json:"-"`
+}
+
+// DeviceStore persists devices waiting to be approved.
+type DeviceStore interface {
+	// SaveDeviceAuthorization inserts a device authorization, storing the
+	// hashes of its codes.
+	SaveDeviceAuthorization(a *DeviceAuthorization) error
+
+	// GetDeviceAuthorization returns the unexpired device authorization for
+	// a user code.
+	GetDeviceAuthorization(userCode string) (*DeviceAuthorization, error)
+
+	// PollDeviceAuthorization returns the unexpired device authorization
+	// for a device code as it was, and records that it was polled at now.
+	PollDeviceAuthorization(deviceCode string, now time.Time) (*DeviceAuthorization, error)
+
+	// SetDeviceInterval sets how long a device has to wait between polls.
+	SetDeviceInterval(id bson.ObjectId, interval time.Duration) error
+
+	// DecideDeviceAuthorization approves a pending device for a developer,
+	// or denies it with an empty devID. Returns mgo.ErrNotFound if it's
+	// already been decided.
+	DecideDeviceAuthorization(id bson.ObjectId, status string, devID bson.ObjectId) error
+
+	// RemoveDeviceAuthorization deletes a device authorization. Returns
+	// mgo.ErrNotFound if it's already gone, so only one poll can use it.
+	RemoveDeviceAuthorization(id bson.ObjectId) error
+}
+
+// prepareDeviceAuthorization fills in the fields a device authorization
+// needs before it's saved.
+func prepareDeviceAuthorization(a *DeviceAuthorization) {
+	if a.ID == "" {
+		a.ID = bson.NewObjectId()
+	}
+	if a.Status == "" {
+		a.Status = DevicePending
+	}
+	a.DeviceCodeHash = HashToken(a.DeviceCode)
+	a.UserCodeHash = HashToken(a.UserCode)
+}
+
+// deviceDecision gets the fields set when a device is decided on, denials
+// can come from anyone so they have no developer.
+func deviceDecision(status string, devID bson.ObjectId) bson.M {
+	set := bson.M{"status": status}
+	if devID != "" {
+		set["developerId"] = devID
+	}
+
+	return set
+}
+
+func (s *MongoStore) SaveDeviceAuthorization(a *DeviceAuthorization) error {
+	prepareDeviceAuthorization(a)
+	return s.db.C("devices").Insert(a)
+}
+
+func (s *MongoStore) GetDeviceAuthorization(userCode string) (*DeviceAuthorization, error) {
+	a := &DeviceAuthorization{}
+	err := s.db.C("devices").Find(bson.M{"userCodeHash": HashToken(userCode)}).One(a)
+	if err == nil && !time.Now().Before(a.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return a, err
+}
+
+func (s *MongoStore) PollDeviceAuthorization(deviceCode string, now time.Time) (*DeviceAuthorization, error) {
+	a := &DeviceAuthorization{}
+	_, err := s.db.C("devices").Find(bson.M{"deviceCodeHash": HashToken(deviceCode)}).
+		Apply(mgo.Change{Update: bson.M{"$set": bson.M{"lastPolledAt": now}}}, a)
+	if err == nil && !now.Before(a.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return a, err
+}
+
+func (s *MongoStore) SetDeviceInterval(id bson.ObjectId, interval time.Duration) error {
+	return s.db.C("devices").UpdateId(id, bson.M{"$set": bson.M{"interval": interval}})
+}
+
+func (s *MongoStore) DecideDeviceAuthorization(id bson.ObjectId, status string, devID bson.ObjectId) error {
+	return s.db.C("devices").Update(bson.M{"_id": id, "status": DevicePending},
+		bson.M{"$set": deviceDecision(status, devID)})
+}
+
+func (s *MongoStore) RemoveDeviceAuthorization(id bson.ObjectId) error {
+	return s.db.C("devices").RemoveId(id)
+}
+
+func (s *MemoryStore) SaveDeviceAuthorization(a *DeviceAuthorization) error {
+	prepareDeviceAuthorization(a)
+	return s.insert("devices", a)
+}
+
+func (s *MemoryStore) GetDeviceAuthorization(userCode string) (*DeviceAuthorization, error) {
+	a := &DeviceAuthorization{}
+	err := s.findOne("devices", bson.M{"userCodeHash": HashToken(userCode)}, a)
+	if err == nil && !time.Now().Before(a.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return a, err
+}
+
+func (s *MemoryStore) PollDeviceAuthorization(deviceCode string, now time.Time) (*DeviceAuthorization, error) {
+	a := &DeviceAuthorization{}
+	err := s.findOne("devices", bson.M{"deviceCodeHash": HashToken(deviceCode)}, a)
+	if err == nil {
+		err = s.update("devices", bson.M{"_id": a.ID}, bson.M{"lastPolledAt": now})
+	}
+	if err == nil && !now.Before(a.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return a, err
+}
+
+func (s *MemoryStore) SetDeviceInterval(id bson.ObjectId, interval time.Duration) error {
+	return s.update("devices", bson.M{"_id": id}, bson.M{"interval": interval})
+}
+
+func (s *MemoryStore) DecideDeviceAuthorization(id bson.ObjectId, status string, devID bson.ObjectId) error {
+	return s.update("devices", bson.M{"_id": id, "status": DevicePending}, deviceDecision(status, devID))
+}
+
+func (s *MemoryStore) RemoveDeviceAuthorization(id bson.ObjectId) error {
+	return s.remove("devices", bson.M{"_id": id})
+}
@@ -0,0 +1,183 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Bowery/broome/mail"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// The states a queued email can be in.
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailDead    = "dead"
+)
+
+// Email is an outbound message waiting to be sent, along with its delivery
+// state. Emails that keep failing are marked dead and kept for admins to
+// inspect and retry.
+//
+// Bodies are only kept until they're sent. Secret emails, with links that
+// reset passwords or accept invitations, are redacted once they're dead
+// too, so they can't be retried.
+type Email struct {
+	ID            bson.ObjectId `bson:"_id" json:"id"`
+	Message       *mail.Message `bson:"message" json:"message"`
+	Secret        bool          `bson:"secret" json:"secret"`
+	Redacted      bool          `bson:"redacted" json:"redacted"`
+	Status        string        `bson:"status" json:"status"`
+	Attempts      int           `bson:"attempts" json:"attempts"`
+	LastError     string        `bson:"lastError" json:"lastError,omitempty"`
+	CreatedAt     time.Time     `bson:"createdAt" json:"createdAt"`
+	NextAttemptAt time.Time     `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	SentAt        time.Time     `bson:"sentAt" json:"sentAt"`
+}
+
+// Redact clears the email's bodies, keeping who it's for and its subject.
+func (e *Email) Redact() {
+	e.Message.HTML, e.Message.Text = "", ""
+	e.Redacted = true
+}
+
+// EmailStore persists the outbound email queue.
+type EmailStore interface {
+	// QueueEmail inserts a new email to be sent right away.
+	QueueEmail(e *Email) error
+
+	// ClaimEmail returns the pending email that's been due the longest,
+	// counting the attempt and holding off other attempts for lease. Returns
+	// mgo.ErrNotFound if no email is due.
+	ClaimEmail(now time.Time, lease time.Duration) (*Email, error)
+
+	// GetEmail returns the email with the given id.
+	GetEmail(id bson.ObjectId) (*Email, error)
+
+	// GetEmails returns the emails in a state, newest first.
+	GetEmails(status string) ([]*Email, error)
+
+	// UpdateEmail replaces an email's delivery state.
+	UpdateEmail(e *Email) error
+}
+
+// prepareEmail fills in the fields an email needs before it's queued.
+func prepareEmail(e *Email) {
+	if e.ID == "" {
+		e.ID = bson.NewObjectId()
+	}
+
+	now := time.Now()
+	e.Status = EmailPending
+	e.CreatedAt = now
+	e.NextAttemptAt = now
+}
+
+// byCreated sorts emails newest first.
+type byCreated []*Email
+
+func (e byCreated) Len() int           { return len(e) }
+func (e byCreated) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byCreated) Less(i, j int) bool { return e[i].CreatedAt.After(e[j].CreatedAt) }
+
+func (s *MongoStore) QueueEmail(e *Email) error {
+	prepareEmail(e)
+	return s.db.C("emails").Insert(e)
+}
+
+func (s *MongoStore) ClaimEmail(now time.Time, lease time.Duration) (*Email, error) {
+	e := &Email{}
+	_, err := s.db.C("emails").Find(bson.M{
+		"status":        EmailPending,
+		"nextAttemptAt": bson.M{"$lte": now},
+	}).Sort("nextAttemptAt").Apply(mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{"nextAttemptAt": now.Add(lease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}, e)
+
+	return e, err
+}
+
+func (s *MongoStore) GetEmail(id bson.ObjectId) (*Email, error) {
+	e := &Email{}
+	return e, s.db.C("emails").FindId(id).One(e)
+}
+
+func (s *MongoStore) GetEmails(status string) ([]*Email, error) {
+	emails := []*Email{}
+	return emails, s.db.C("emails").Find(bson.M{"status": status}).Sort("-createdAt").All(&emails)
+}
+
+func (s *MongoStore) UpdateEmail(e *Email) error {
+	return s.db.C("emails").UpdateId(e.ID, e)
+}
+
+func (s *MemoryStore) QueueEmail(e *Email) error {
+	prepareEmail(e)
+	return s.insert("emails", e)
+}
+
+func (s *MemoryStore) ClaimEmail(now time.Time, lease time.Duration) (*Email, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	claimed := -1
+	var due time.Time
+	for i, doc := range s.collections["emails"] {
+		next, _ := doc["nextAttemptAt"].(time.Time)
+		if doc["status"] != EmailPending || next.After(now) {
+			continue
+		}
+
+		if claimed < 0 || next.Before(due) {
+			claimed, due = i, next
+		}
+	}
+	if claimed < 0 {
+		return nil, mgo.ErrNotFound
+	}
+
+	e := &Email{}
+	if err := fromDoc(s.collections["emails"][claimed], e); err != nil {
+		return nil, err
+	}
+	e.Attempts++
+	e.NextAttemptAt = now.Add(lease)
+
+	doc, err := toDoc(e)
+	if err != nil {
+		return nil, err
+	}
+	s.collections["emails"][claimed] = doc
+
+	return e, nil
+}
+
+func (s *MemoryStore) GetEmail(id bson.ObjectId) (*Email, error) {
+	e := &Email{}
+	return e, s.findOne("emails", bson.M{"_id": id}, e)
+}
+
+func (s *MemoryStore) GetEmails(status string) ([]*Email, error) {
+	emails := []*Email{}
+	if err := s.findAll("emails", bson.M{"status": status}, &emails); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byCreated(emails))
+	return emails, nil
+}
+
+func (s *MemoryStore) UpdateEmail(e *Email) error {
+	doc, err := toDoc(e)
+	if err != nil {
+		return err
+	}
+
+	return s.update("emails", bson.M{"_id": e.ID}, doc)
+}
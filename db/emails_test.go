@@ -0,0 +1,73 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/mail"
+	"labix.org/v2/mgo"
+)
+
+func TestClaimEmail(t *testing.T) {
+	mem := NewMemoryStore()
+	e := &Email{Message: &mail.Message{Subject: "Hello"}}
+	if err := mem.QueueEmail(e); err != nil {
+		t.Fatal("Unable to queue email:", err)
+	}
+
+	now := time.Now().Add(time.Second)
+	claimed, err := mem.ClaimEmail(now, time.Minute)
+	if err != nil {
+		t.Fatal("Unable to claim email:", err)
+	}
+	if claimed.ID != e.ID || claimed.Attempts != 1 || claimed.Message.Subject != "Hello" {
+		t.Error("email not claimed correctly.")
+	}
+
+	if _, err := mem.ClaimEmail(now, time.Minute); err != mgo.ErrNotFound {
+		t.Error("claimed email shouldn't be claimed again during its lease, got", err)
+	}
+
+	if _, err := mem.ClaimEmail(now.Add(2*time.Minute), time.Minute); err != nil {
+		t.Error("email should be claimable once its lease is up, got", err)
+	}
+}
+
+func TestGetEmails(t *testing.T) {
+	mem := NewMemoryStore()
+	for _, subject := range []string{"first", "second"} {
+		if err := mem.QueueEmail(&Email{Message: &mail.Message{Subject: subject}}); err != nil {
+			t.Fatal("Unable to queue email:", err)
+		}
+		time.Sleep(time.Millisecond * 2)
+	}
+
+	emails, err := mem.GetEmails(EmailPending)
+	if err != nil {
+		t.Fatal("Unable to get emails:", err)
+	}
+	if len(emails) != 2 || emails[0].Message.Subject != "second" {
+		t.Fatal("pending emails should be listed newest first.")
+	}
+
+	emails[0].Status = EmailDead
+	if err := mem.UpdateEmail(emails[0]); err != nil {
+		t.Fatal("Unable to update email:", err)
+	}
+
+	dead, err := mem.GetEmails(EmailDead)
+	if err != nil {
+		t.Fatal("Unable to get emails:", err)
+	}
+	if len(dead) != 1 || dead[0].ID != emails[0].ID {
+		t.Error("dead email not listed.")
+	}
+
+	if _, err := mem.ClaimEmail(time.Now(), time.Minute); err != nil {
+		t.Fatal("pending email should still be claimable, got", err)
+	}
+	if _, err := mem.ClaimEmail(time.Now(), time.Minute); err != mgo.ErrNotFound {
+		t.Error("dead email shouldn't be claimed, got", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Event is a webhook event received from Stripe. Events are kept by their
+// Stripe id so each one is only processed once, however often it's sent.
+type Event struct {
+	ID          string    `bson:"_id" json:"id"`
+	Type        string    `bson:"type" json:"type"`
+	Payload     string    `bson:"payload" json:"-"`
+	Processed   bool      `bson:"processed" json:"processed"`
+	Error       string    `bson:"error" json:"error,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+	ReceivedAt  time.Time `bson:"receivedAt" json:"receivedAt"`
+	ProcessedAt time.Time `bson:"processedAt" json:"processedAt"`
+
+	// LockedUntil holds off other deliveries while the event is processed.
+	LockedUntil time.Time `bson:"lockedUntil" json:"-"`
+}
+
+// EventStore persists webhook events.
+type EventStore interface {
+	// SaveEvent inserts a new event, failing with an error mgo.IsDup
+	// recognizes if it's already been received.
+	SaveEvent(e *Event) error
+
+	// GetEvent returns the event with the given id.
+	GetEvent(id string) (*Event, error)
+
+	// LockEvent holds an event that hasn't been processed for lease, so
+	// only one delivery processes it. Returns mgo.ErrNotFound if it's been
+	// processed or is held by another delivery.
+	LockEvent(id string, now time.Time, lease time.Duration) error
+
+	// UpdateEvent replaces an event's processing state.
+	UpdateEvent(e *Event) error
+}
+
+func (s *MongoStore) SaveEvent(e *Event) error {
+	return s.db.C("events").Insert(e)
+}
+
+func (s *MongoStore) GetEvent(id string) (*Event, error) {
+	e := &Event{}
+	return e, s.db.C("events").FindId(id).One(e)
+}
+
+func (s *MongoStore) LockEvent(id string, now time.Time, lease time.Duration) error {
+	return s.db.C("events").Update(bson.M{
+		"_id":         id,
+		"processed":   false,
+		"lockedUntil": bson.M{"$lte": now},
+	}, bson.M{"$set": bson.M{"lockedUntil": now.Add(lease)}})
+}
+
+func (s *MongoStore) UpdateEvent(e *Event) error {
+	return s.db.C("events").UpdateId(e.ID, e)
+}
+
+func (s *MemoryStore) SaveEvent(e *Event) error {
+	return s.insert("events", e)
+}
+
+func (s *MemoryStore) GetEvent(id string) (*Event, error) {
+	e := &Event{}
+	return e, s.findOne("events", bson.M{"_id": id}, e)
+}
+
+func (s *MemoryStore) LockEvent(id string, now time.Time, lease time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, doc := range s.collections["events"] {
+		if doc["_id"] != id {
+			continue
+		}
+
+		lockedUntil, _ := doc["lockedUntil"].(time.Time)
+		if doc["processed"] == true || lockedUntil.After(now) {
+			break
+		}
+
+		doc["lockedUntil"] = now.Add(lease)
+		return nil
+	}
+
+	return mgo.ErrNotFound
+}
+
+func (s *MemoryStore) UpdateEvent(e *Event) error {
+	doc, err := toDoc(e)
+	if err != nil {
+		return err
+	}
+
+	return s.update("events", bson.M{"_id": e.ID}, doc)
+}
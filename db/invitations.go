@@ -0,0 +1,132 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// The states of an invitation.
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+)
+
+// Invitation asks whoever has an email address to join an organization.
+// Only a hash of the token is stored, and it can only be answered once.
+type Invitation struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	OrganizationID bson.ObjectId `bson:"organizationId" json:"organizationId"`
+	Email          string        `bson:"email" json:"email"`
+	Role           string        `bson:"role" json:"role"`
+	InvitedBy      bson.ObjectId `bson:"invitedBy" json:"invitedBy"`
+	Token          string        `bson:"-" json:"-"`
+	TokenHash      string        `bson:"tokenHash" json:"-"`
+	Status         string        `bson:"status" json:"status"`
+	CreatedAt      time.Time     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt      time.Time     `bson:"expiresAt" json:"expiresAt"`
+	RespondedAt    time.Time     `bson:"respondedAt" json:"respondedAt"`
+}
+
+// Expired checks if the invitation can no longer be answered.
+func (i *Invitation) Expired() bool {
+	return !time.Now().Before(i.ExpiresAt)
+}
+
+// InvitationStore persists invitations to organizations.
+type InvitationStore interface {
+	// SaveInvitation inserts a new pending invitation, storing the hash of
+	// its token.
+	SaveInvitation(i *Invitation) error
+
+	// GetInvitation returns the unexpired invitation for a token.
+	GetInvitation(token string) (*Invitation, error)
+
+	// GetInvitations returns an organization's invitations with a status,
+	// newest first.
+	GetInvitations(orgID bson.ObjectId, status string) ([]*Invitation, error)
+
+	// RespondToInvitation moves a pending invitation to status. Returns
+	// mgo.ErrNotFound if it's already been answered.
+	RespondToInvitation(id bson.ObjectId, status string, now time.Time) error
+}
+
+// invitationsByCreated sorts invitations newest first.
+type invitationsByCreated []*Invitation
+
+func (i invitationsByCreated) Len() int           { return len(i) }
+func (i invitationsByCreated) Swap(a, b int)      { i[a], i[b] = i[b], i[a] }
+func (i invitationsByCreated) Less(a, b int) bool { return i[a].CreatedAt.After(i[b].CreatedAt) }
+
+// prepareInvitation fills in the fields an invitation needs before it's
+// saved.
+func prepareInvitation(i *Invitation) {
+	if i.ID == "" {
+		i.ID = bson.NewObjectId()
+	}
+	i.TokenHash = HashToken(i.Token)
+	i.Status = InvitationPending
+}
+
+func (s *MongoStore) SaveInvitation(i *Invitation) error {
+	prepareInvitation(i)
+	return s.db.C("invitations").Insert(i)
+}
+
+func (s *MongoStore) GetInvitation(token string) (*Invitation, error) {
+	i := &Invitation{}
+	err := s.db.C("invitations").Find(bson.M{"tokenHash": HashToken(token)}).One(i)
+	if err == nil && i.Expired() {
+		err = mgo.ErrNotFound
+	}
+
+	return i, err
+}
+
+func (s *MongoStore) GetInvitations(orgID bson.ObjectId, status string) ([]*Invitation, error) {
+	invitations := []*Invitation{}
+	return invitations, s.db.C("invitations").Find(bson.M{"organizationId": orgID, "status": status}).
+		Sort("-createdAt").All(&invitations)
+}
+
+func (s *MongoStore) RespondToInvitation(id bson.ObjectId, status string, now time.Time) error {
+	return s.db.C("invitations").Update(bson.M{"_id": id, "status": InvitationPending},
+		bson.M{"$set": bson.M{"status": status, "respondedAt": now}})
+}
+
+func (s *MemoryStore) SaveInvitation(i *Invitation) error {
+	prepareInvitation(i)
+	return s.insert("invitations", i)
+}
+
+func (s *MemoryStore) GetInvitation(token string) (*Invitation, error) {
+	i := &Invitation{}
+	err := s.findOne("invitations", bson.M{"tokenHash": HashToken(token)}, i)
+	if err == nil && i.Expired() {
+		err = mgo.ErrNotFound
+	}
+
+	return i, err
+}
+
+func (s *MemoryStore) GetInvitations(orgID bson.ObjectId, status string) ([]*Invitation, error) {
+	invitations := []*Invitation{}
+	err := s.findAll("invitations", bson.M{"organizationId": orgID, "status": status}, &invitations)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(invitationsByCreated(invitations))
+	return invitations, nil
+}
+
+func (s *MemoryStore) RespondToInvitation(id bson.ObjectId, status string, now time.Time) error {
+	return s.update("invitations", bson.M{"_id": id, "status": InvitationPending}, bson.M{
+		"status":      status,
+		"respondedAt": now,
+	})
+}
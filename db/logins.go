@@ -0,0 +1,133 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// LoginAttempts counts the failed logins for a key, which names an account
+// or an address. It's forgotten once it expires.
+type LoginAttempts struct {
+	Key         string    `bson:"_id" json:"-"`
+	Failures    int       `bson:"failures" json:"failures"`
+	LastFailure time.Time `bson:"lastFailure" json:"lastFailure"`
+	LockedUntil time.Time `bson:"lockedUntil" json:"lockedUntil"`
+	ExpiresAt   time.Time `bson:"expiresAt" json:"-"`
+}
+
+// LoginAttemptStore persists failed logins so they can be throttled.
+type LoginAttemptStore interface {
+	// GetLoginAttempts returns the failed logins for a key. Returns
+	// mgo.ErrNotFound if there are none or they've expired.
+	GetLoginAttempts(key string) (*LoginAttempts, error)
+
+	// FailLogin counts a failed login for a key at now, starting over if
+	// the earlier failures have expired, and keeps them until expires.
+	FailLogin(key string, now, expires time.Time) (*LoginAttempts, error)
+
+	// LockLogin refuses logins for a key until until, and starts its
+	// failures over.
+	LockLogin(key string, until time.Time) error
+
+	// RemoveLoginAttempts forgets the failed logins for a key, unlocking
+	// it.
+	RemoveLoginAttempts(key string) error
+}
+
+func (s *MongoStore) GetLoginAttempts(key string) (*LoginAttempts, error) {
+	a := &LoginAttempts{}
+	err := s.db.C("logins").FindId(key).One(a)
+	if err == nil && !time.Now().Before(a.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return a, err
+}
+
+func (s *MongoStore) FailLogin(key string, now, expires time.Time) (*LoginAttempts, error) {
+	// The TTL index only removes expired failures once a minute.
+	_, err := s.db.C("logins").RemoveAll(bson.M{"_id": key, "expiresAt": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, err
+	}
+
+	a := &LoginAttempts{}
+	_, err = s.db.C("logins").FindId(key).Apply(mgo.Change{
+		Update: bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"lastFailure": now, "expiresAt": expires},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, a)
+
+	return a, err
+}
+
+func (s *MongoStore) LockLogin(key string, until time.Time) error {
+	return s.db.C("logins").UpdateId(key, bson.M{"$set": bson.M{
+		"failures":    0,
+		"lockedUntil": until,
+		"expiresAt":   until,
+	}})
+}
+
+func (s *MongoStore) RemoveLoginAttempts(key string) error {
+	return s.db.C("logins").RemoveId(key)
+}
+
+func (s *MemoryStore) GetLoginAttempts(key string) (*LoginAttempts, error) {
+	a := &LoginAttempts{}
+	err := s.findOne("logins", bson.M{"_id": key}, a)
+	if err == nil && !time.Now().Before(a.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return a, err
+}
+
+func (s *MemoryStore) FailLogin(key string, now, expires time.Time) (*LoginAttempts, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	a := &LoginAttempts{Key: key}
+	i := s.find("logins", bson.M{"_id": key})
+	if i >= 0 {
+		if err := fromDoc(s.collections["logins"][i], a); err != nil {
+			return nil, err
+		}
+		if !now.Before(a.ExpiresAt) {
+			a = &LoginAttempts{Key: key}
+		}
+	}
+	a.Failures++
+	a.LastFailure = now
+	a.ExpiresAt = expires
+
+	doc, err := toDoc(a)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		s.collections["logins"] = append(s.collections["logins"], doc)
+	} else {
+		s.collections["logins"][i] = doc
+	}
+
+	return a, nil
+}
+
+func (s *MemoryStore) LockLogin(key string, until time.Time) error {
+	return s.update("logins", bson.M{"_id": key}, bson.M{
+		"failures":    0,
+		"lockedUntil": until,
+		"expiresAt":   until,
+	})
+}
+
+func (s *MemoryStore) RemoveLoginAttempts(key string) error {
+	return s.remove("logins", bson.M{"_id": key})
+}
@@ -0,0 +1,56 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo"
+)
+
+func TestFailLogin(t *testing.T) {
+	mem := NewMemoryStore()
+	now := time.Now()
+
+	if _, err := mem.GetLoginAttempts("account:byrd@bowery.io"); err != mgo.ErrNotFound {
+		t.Error("no failures should be found before any logins.")
+	}
+
+	for i := 1; i <= 3; i++ {
+		a, err := mem.FailLogin("account:byrd@bowery.io", now, now.Add(time.Hour))
+		if err != nil {
+			t.Fatal("Unable to fail login:", err)
+		}
+		if a.Failures != i {
+			t.Errorf("expected %d failures, got %d", i, a.Failures)
+		}
+	}
+
+	if err := mem.LockLogin("account:byrd@bowery.io", now.Add(time.Minute)); err != nil {
+		t.Fatal("Unable to lock login:", err)
+	}
+	a, err := mem.GetLoginAttempts("account:byrd@bowery.io")
+	if err != nil {
+		t.Fatal("Unable to get login attempts:", err)
+	}
+	if a.Failures != 0 || !a.LockedUntil.After(now) {
+		t.Error("lock should start failures over, got", a)
+	}
+
+	// Failures after they've expired start over.
+	later := now.Add(2 * time.Minute)
+	a, err = mem.FailLogin("account:byrd@bowery.io", later, later.Add(time.Hour))
+	if err != nil {
+		t.Fatal("Unable to fail login:", err)
+	}
+	if a.Failures != 1 || !a.LockedUntil.IsZero() {
+		t.Error("expired failures should be forgotten, got", a)
+	}
+
+	if err := mem.RemoveLoginAttempts("account:byrd@bowery.io"); err != nil {
+		t.Fatal("Unable to remove login attempts:", err)
+	}
+	if _, err := mem.GetLoginAttempts("account:byrd@bowery.io"); err != mgo.ErrNotFound {
+		t.Error("removed failures shouldn't be found.")
+	}
+}
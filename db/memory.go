@@ -0,0 +1,298 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"reflect"
+	"sync"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// MemoryStore is a Store that keeps every collection in memory. Queries
+// match documents by field equality, which covers the lookups broome does.
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	collections map[string][]bson.M
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{collections: map[string][]bson.M{}}
+}
+
+// insert adds a document to the named collection, failing if its _id is
+// already taken.
+func (s *MemoryStore) insert(name string, v interface{}) error {
+	doc, err := toDoc(v)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Matches the error mongo gives, so mgo.IsDup works with either store.
+	if id, ok := doc["_id"]; ok && s.find(name, bson.M{"_id": id}) >= 0 {
+		return &mgo.LastError{Code: 11000, Err: "duplicate key: " + name + "._id"}
+	}
+	s.collections[name] = append(s.collections[name], doc)
+
+	return nil
+}
+
+// findOne decodes the first document matching query into result.
+func (s *MemoryStore) findOne(name string, query bson.M, result interface{}) error {
+	query, err := toDoc(query)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	i := s.find(name, query)
+	if i < 0 {
+		return mgo.ErrNotFound
+	}
+
+	return fromDoc(s.collections[name][i], result)
+}
+
+// findAll decodes every document matching query into result, which must be
+// a pointer to a slice.
+func (s *MemoryStore) findAll(name string, query bson.M, result interface{}) error {
+	query, err := toDoc(query)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	slice := reflect.ValueOf(result).Elem()
+	elemType := slice.Type().Elem()
+	slice.Set(reflect.MakeSlice(slice.Type(), 0, 0))
+
+	for _, doc := range s.collections[name] {
+		if !matches(doc, query) {
+			continue
+		}
+
+		var elem reflect.Value
+		if elemType.Kind() == reflect.Ptr {
+			elem = reflect.New(elemType.Elem())
+		} else {
+			elem = reflect.New(elemType)
+		}
+
+		if err := fromDoc(doc, elem.Interface()); err != nil {
+			return err
+		}
+
+		if elemType.Kind() != reflect.Ptr {
+			elem = elem.Elem()
+		}
+		slice.Set(reflect.Append(slice, elem))
+	}
+
+	return nil
+}
+
+// update sets the fields in set on the first document matching query.
+func (s *MemoryStore) update(name string, query, set bson.M) error {
+	n, err := s.updateN(name, query, set, 1)
+	if err == nil && n == 0 {
+		err = mgo.ErrNotFound
+	}
+
+	return err
+}
+
+// updateAll sets the fields in set on every document matching query.
+func (s *MemoryStore) updateAll(name string, query, set bson.M) (int, error) {
+	return s.updateN(name, query, set, -1)
+}
+
+// updateN sets the fields in set on at most limit documents matching query,
+// a negative limit updates every match.
+func (s *MemoryStore) updateN(name string, query, set bson.M, limit int) (int, error) {
+	// Matches the error mongo gives for an empty $set, so callers have to
+	// skip updates with nothing to change with either store.
+	if len(set) == 0 {
+		return 0, &mgo.LastError{Code: 9, Err: "'$set' is empty. You must specify a field like so: {$set: {<field>: ...}}"}
+	}
+
+	query, err := toDoc(query)
+	if err != nil {
+		return 0, err
+	}
+
+	set, err = toDoc(set)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := 0
+	for i, doc := range s.collections[name] {
+		if n == limit {
+			break
+		}
+		if !matches(doc, query) {
+			continue
+		}
+
+		updated := bson.M{}
+		for key, val := range doc {
+			updated[key] = val
+		}
+		for key, val := range set {
+			updated[key] = val
+		}
+
+		s.collections[name][i] = updated
+		n++
+	}
+
+	return n, nil
+}
+
+// upsert replaces the first document matching query with v, inserting v if
+// nothing matches.
+func (s *MemoryStore) upsert(name string, query bson.M, v interface{}) error {
+	query, err := toDoc(query)
+	if err != nil {
+		return err
+	}
+
+	doc, err := toDoc(v)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.find(name, query)
+	if i < 0 {
+		s.collections[name] = append(s.collections[name], doc)
+		return nil
+	}
+
+	s.collections[name][i] = doc
+	return nil
+}
+
+// remove deletes the first document matching query.
+func (s *MemoryStore) remove(name string, query bson.M) error {
+	query, err := toDoc(query)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.find(name, query)
+	if i < 0 {
+		return mgo.ErrNotFound
+	}
+
+	docs := s.collections[name]
+	s.collections[name] = append(docs[:i:i], docs[i+1:]...)
+
+	return nil
+}
+
+// findAndRemove decodes the first document matching query into result and
+// deletes it, so only one caller can ever get it.
+func (s *MemoryStore) findAndRemove(name string, query bson.M, result interface{}) error {
+	query, err := toDoc(query)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := s.find(name, query)
+	if i < 0 {
+		return mgo.ErrNotFound
+	}
+
+	docs := s.collections[name]
+	doc := docs[i]
+	s.collections[name] = append(docs[:i:i], docs[i+1:]...)
+
+	return fromDoc(doc, result)
+}
+
+// removeAll deletes every document matching query.
+func (s *MemoryStore) removeAll(name string, query bson.M) (int, error) {
+	query, err := toDoc(query)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kept := []bson.M{}
+	for _, doc := range s.collections[name] {
+		if !matches(doc, query) {
+			kept = append(kept, doc)
+		}
+	}
+
+	n := len(s.collections[name]) - len(kept)
+	s.collections[name] = kept
+
+	return n, nil
+}
+
+// find returns the index of the first document matching query, or -1.
+func (s *MemoryStore) find(name string, query bson.M) int {
+	for i, doc := range s.collections[name] {
+		if matches(doc, query) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// matches checks if every field in query is equal in doc.
+func matches(doc, query bson.M) bool {
+	for key, val := range query {
+		if !reflect.DeepEqual(doc[key], val) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// toDoc converts a value to a bson document, normalizing its field types the
+// same way a round trip through mongo would.
+func toDoc(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := bson.M{}
+	return doc, bson.Unmarshal(data, &doc)
+}
+
+// fromDoc decodes a bson document into v.
+func fromDoc(doc bson.M, v interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(data, v)
+}
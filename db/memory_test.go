@@ -0,0 +1,77 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestMemoryStoreSave(t *testing.T) {
+	mem := NewMemoryStore()
+	dev := &schemas.Developer{Email: "steve@bowery.io", Password: "secret"}
+
+	if err := mem.Save(dev); err != nil {
+		t.Fatal("Unable to save developer:", err)
+	}
+
+	if dev.ID == "" || dev.Salt == "" || dev.Password == "secret" {
+		t.Error("developer not prepared before saving.")
+	}
+
+	if err := mem.Save(dev); err == nil {
+		t.Error("saving a duplicate developer should fail.")
+	}
+}
+
+func TestMemoryStoreGetDevelopers(t *testing.T) {
+	mem := NewMemoryStore()
+	for _, email := range []string{"steve@bowery.io", "larz@bowery.io"} {
+		if err := mem.Save(&schemas.Developer{Email: email, IsAdmin: true}); err != nil {
+			t.Fatal("Unable to save developer:", err)
+		}
+	}
+	if err := mem.Save(&schemas.Developer{Email: "user@example.com"}); err != nil {
+		t.Fatal("Unable to save developer:", err)
+	}
+
+	ds, err := mem.GetDevelopers(bson.M{"isAdmin": true})
+	if err != nil {
+		t.Fatal("Unable to get developers:", err)
+	}
+
+	if len(ds) != 2 || ds[0].Email != "steve@bowery.io" || ds[1].Email != "larz@bowery.io" {
+		t.Error("developers not queried correctly.")
+	}
+}
+
+func TestMemoryStoreEmptyUpdate(t *testing.T) {
+	mem := NewMemoryStore()
+	mock, err := MockDB(mem)
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	// Mongo rejects an empty $set, so the memory store does too.
+	if err := mem.UpdateDeveloper(bson.M{"_id": mock.ID}, bson.M{}); err == nil {
+		t.Error("empty update should fail.")
+	}
+}
+
+func TestMemoryStoreRemoveDeveloper(t *testing.T) {
+	mem := NewMemoryStore()
+	mock, err := MockDB(mem)
+	if err != nil {
+		t.Fatal("Unable to Mock DB:", err)
+	}
+
+	if err := mem.RemoveDeveloper(bson.M{"_id": mock.ID}); err != nil {
+		t.Fatal("Unable to remove developer:", err)
+	}
+
+	if _, err := mem.GetDeveloperById(mock.ID.Hex()); err != mgo.ErrNotFound {
+		t.Error("removed developer should not be found, got", err)
+	}
+}
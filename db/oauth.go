@@ -0,0 +1,256 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// OAuthClient is a Bowery product that signs developers in through broome.
+// Public clients, like apps that can't keep a secret, have no secret and
+// rely on PKCE alone. Only a hash of the secret is stored.
+type OAuthClient struct {
+	ID           string    `bson:"_id" json:"id"`
+	Name         string    `bson:"name" json:"name"`
+	Secret       string    `bson:"-" json:"secret,omitempty"`
+	SecretHash   string    `bson:"secretHash" json:"-"`
+	RedirectURIs []string  `bson:"redirectUris" json:"redirectUris"`
+	Scopes       []string  `bson:"scopes" json:"scopes"`
+	CreatedAt    time.Time `bson:"createdAt" json:"createdAt"`
+
+	// Devices lets the client sign devices in with the device flow, which
+	// gives them a full session rather than a scoped token.
+	Devices bool `bson:"devices" json:"devices"`
+}
+
+// Public checks if the client has no secret.
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AuthorizationCode is a developer's consent to a client, waiting to be
+// exchanged for an access token. Only a hash of the code is stored.
+type AuthorizationCode struct {
+	ID            bson.ObjectId `bson:"_id" json:"-"`
+	Code          string        `bson:"-" json:"-"`
+	CodeHash      string        `bson:"codeHash" json:"-"`
+	ClientID      string        `bson:"clientId" json:"-"`
+	DeveloperID   bson.ObjectId `bson:"developerId" json:"-"`
+	RedirectURI   string        `bson:"redirectUri" json:"-"`
+	Scopes        []string      `bson:"scopes" json:"-"`
+	CodeChallenge string        `bson:"codeChallenge" json:"-"`
+	CreatedAt     time.Time     `bson:"createdAt" json:"-"`
+	ExpiresAt     time.Time     `bson:"expiresAt" json:"-"`
+
+	// Nonce is from an OpenID Connect client, it's put in the ID token so
+	// the client can tell the token was made for its request.
+	Nonce string `bson:"nonce" json:"-"`
+
+	// RedirectURIDefaulted is set when the client left the redirect URI out
+	// and its only registered one was used, so it can leave it out when
+	// exchanging the code too.
+	RedirectURIDefaulted bool `bson:"redirectUriDefaulted" json:"-"`
+}
+
+// OAuthToken is an access token a client got for a developer. Only a hash
+// of the token is stored.
+type OAuthToken struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	Token       string        `bson:"-" json:"-"`
+	TokenHash   string        `bson:"tokenHash" json:"-"`
+	ClientID    string        `bson:"clientId" json:"clientId"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Scopes      []string      `bson:"scopes" json:"scopes"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt   time.Time     `bson:"expiresAt" json:"expiresAt"`
+}
+
+// OAuthStore persists the clients that sign developers in through broome,
+// and the codes and tokens they're given.
+type OAuthStore interface {
+	// SaveOAuthClient inserts a client, storing the hash of its secret.
+	SaveOAuthClient(c *OAuthClient) error
+
+	// GetOAuthClient returns a client by its id.
+	GetOAuthClient(id string) (*OAuthClient, error)
+
+	// GetOAuthClients returns every client, sorted by name.
+	GetOAuthClients() ([]*OAuthClient, error)
+
+	// RemoveOAuthClient deletes a client and every token it was given.
+	RemoveOAuthClient(id string) error
+
+	// SaveAuthorizationCode inserts an authorization code, storing the
+	// hash of the code.
+	SaveAuthorizationCode(c *AuthorizationCode) error
+
+	// UseAuthorizationCode removes and returns the unexpired authorization
+	// code for code, so it can only be exchanged once.
+	UseAuthorizationCode(code string) (*AuthorizationCode, error)
+
+	// SaveOAuthToken inserts an access token, storing the hash of the
+	// token.
+	SaveOAuthToken(t *OAuthToken) error
+
+	// GetOAuthToken returns the unexpired access token for token.
+	GetOAuthToken(token string) (*OAuthToken, error)
+
+	// RemoveOAuthToken deletes an access token.
+	RemoveOAuthToken(id bson.ObjectId) error
+}
+
+// byClientName sorts clients by name.
+type byClientName []*OAuthClient
+
+func (c byClientName) Len() int           { return len(c) }
+func (c byClientName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byClientName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+
+// prepareOAuthClient fills in the fields a client needs before it's saved.
+func prepareOAuthClient(c *OAuthClient) {
+	if c.Secret != "" {
+		c.SecretHash = HashToken(c.Secret)
+	}
+}
+
+// prepareAuthorizationCode fills in the fields a code needs before it's
+// saved.
+func prepareAuthorizationCode(c *AuthorizationCode) {
+	if c.ID == "" {
+		c.ID = bson.NewObjectId()
+	}
+	c.CodeHash = HashToken(c.Code)
+}
+
+// prepareOAuthToken fills in the fields a token needs before it's saved.
+func prepareOAuthToken(t *OAuthToken) {
+	if t.ID == "" {
+		t.ID = bson.NewObjectId()
+	}
+	t.TokenHash = HashToken(t.Token)
+}
+
+func (s *MongoStore) SaveOAuthClient(c *OAuthClient) error {
+	prepareOAuthClient(c)
+	return s.db.C("clients").Insert(c)
+}
+
+func (s *MongoStore) GetOAuthClient(id string) (*OAuthClient, error) {
+	c := &OAuthClient{}
+	return c, s.db.C("clients").FindId(id).One(c)
+}
+
+func (s *MongoStore) GetOAuthClients() ([]*OAuthClient, error) {
+	clients := []*OAuthClient{}
+	return clients, s.db.C("clients").Find(nil).Sort("name").All(&clients)
+}
+
+func (s *MongoStore) RemoveOAuthClient(id string) error {
+	if err := s.db.C("clients").RemoveId(id); err != nil {
+		return err
+	}
+
+	_, err := s.db.C("oauthTokens").RemoveAll(bson.M{"clientId": id})
+	return err
+}
+
+func (s *MongoStore) SaveAuthorizationCode(c *AuthorizationCode) error {
+	prepareAuthorizationCode(c)
+	return s.db.C("authCodes").Insert(c)
+}
+
+func (s *MongoStore) UseAuthorizationCode(code string) (*AuthorizationCode, error) {
+	c := &AuthorizationCode{}
+	_, err := s.db.C("authCodes").Find(bson.M{"codeHash": HashToken(code)}).
+		Apply(mgo.Change{Remove: true}, c)
+	if err == nil && !time.Now().Before(c.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return c, err
+}
+
+func (s *MongoStore) SaveOAuthToken(t *OAuthToken) error {
+	prepareOAuthToken(t)
+	return s.db.C("oauthTokens").Insert(t)
+}
+
+func (s *MongoStore) GetOAuthToken(token string) (*OAuthToken, error) {
+	t := &OAuthToken{}
+	err := s.db.C("oauthTokens").Find(bson.M{"tokenHash": HashToken(token)}).One(t)
+	if err == nil && !time.Now().Before(t.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return t, err
+}
+
+func (s *MongoStore) RemoveOAuthToken(id bson.ObjectId) error {
+	return s.db.C("oauthTokens").RemoveId(id)
+}
+
+func (s *MemoryStore) SaveOAuthClient(c *OAuthClient) error {
+	prepareOAuthClient(c)
+	return s.insert("clients", c)
+}
+
+func (s *MemoryStore) GetOAuthClient(id string) (*OAuthClient, error) {
+	c := &OAuthClient{}
+	return c, s.findOne("clients", bson.M{"_id": id}, c)
+}
+
+func (s *MemoryStore) GetOAuthClients() ([]*OAuthClient, error) {
+	clients := []*OAuthClient{}
+	if err := s.findAll("clients", bson.M{}, &clients); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byClientName(clients))
+	return clients, nil
+}
+
+func (s *MemoryStore) RemoveOAuthClient(id string) error {
+	if err := s.remove("clients", bson.M{"_id": id}); err != nil {
+		return err
+	}
+
+	_, err := s.removeAll("oauthTokens", bson.M{"clientId": id})
+	return err
+}
+
+func (s *MemoryStore) SaveAuthorizationCode(c *AuthorizationCode) error {
+	prepareAuthorizationCode(c)
+	return s.insert("authCodes", c)
+}
+
+func (s *MemoryStore) UseAuthorizationCode(code string) (*AuthorizationCode, error) {
+	c := &AuthorizationCode{}
+	err := s.findAndRemove("authCodes", bson.M{"codeHash": HashToken(code)}, c)
+	if err == nil && !time.Now().Before(c.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return c, err
+}
+
+func (s *MemoryStore) SaveOAuthToken(t *OAuthToken) error {
+	prepareOAuthToken(t)
+	return s.insert("oauthTokens", t)
+}
+
+func (s *MemoryStore) GetOAuthToken(token string) (*OAuthToken, error) {
+	t := &OAuthToken{}
+	err := s.findOne("oauthTokens", bson.M{"tokenHash": HashToken(token)}, t)
+	if err == nil && !time.Now().Before(t.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return t, err
+}
+
+func (s *MemoryStore) RemoveOAuthToken(id bson.ObjectId) error {
+	return s.remove("oauthTokens", bson.M{"_id": id})
+}
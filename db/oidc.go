@@ -0,0 +1,67 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// SigningKey is a key ID tokens are signed with. A new key is made each
+// rotation, and old ones are kept until the last tokens they signed have
+// expired, so they can still be checked.
+type SigningKey struct {
+	ID         string    `bson:"_id" json:"id"`
+	PrivateKey string    `bson:"privateKey" json:"-"`
+	CreatedAt  time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt  time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// SigningKeyStore persists the keys ID tokens are signed with.
+type SigningKeyStore interface {
+	// SaveSigningKey inserts a signing key.
+	SaveSigningKey(k *SigningKey) error
+
+	// GetSigningKeys returns the unexpired signing keys, newest first.
+	GetSigningKeys() ([]*SigningKey, error)
+}
+
+// bySigningKeyAge sorts signing keys newest first.
+type bySigningKeyAge []*SigningKey
+
+func (k bySigningKeyAge) Len() int           { return len(k) }
+func (k bySigningKeyAge) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k bySigningKeyAge) Less(i, j int) bool { return k[i].CreatedAt.After(k[j].CreatedAt) }
+
+func (s *MongoStore) SaveSigningKey(k *SigningKey) error {
+	return s.db.C("signingKeys").Insert(k)
+}
+
+func (s *MongoStore) GetSigningKeys() ([]*SigningKey, error) {
+	keys := []*SigningKey{}
+	return keys, s.db.C("signingKeys").Find(bson.M{"expiresAt": bson.M{"$gt": time.Now()}}).
+		Sort("-createdAt").All(&keys)
+}
+
+func (s *MemoryStore) SaveSigningKey(k *SigningKey) error {
+	return s.insert("signingKeys", k)
+}
+
+func (s *MemoryStore) GetSigningKeys() ([]*SigningKey, error) {
+	all := []*SigningKey{}
+	if err := s.findAll("signingKeys", bson.M{}, &all); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	keys := []*SigningKey{}
+	for _, k := range all {
+		if now.Before(k.ExpiresAt) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Sort(bySigningKeyAge(keys))
+	return keys, nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// The roles a developer can have in an organization. Owners manage billing
+// and the other owners, admins manage members.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Organization is a company that pays for its developers in one place.
+type Organization struct {
+	ID   bson.ObjectId `bson:"_id" json:"id"`
+	Name string        `bson:"name" json:"name"`
+
+	// The organization's subscription, as last reported by the payment
+	// provider. BillingContactID is the developer who set it up, and Seats
+	// is how many members it's billed for.
+	CustomerID       string        `bson:"customerId" json:"-"`
+	BillingContactID bson.ObjectId `bson:"billingContactId,omitempty" json:"billingContactId,omitempty"`
+	PlanID           string        `bson:"planId" json:"plan,omitempty"`
+	Status           string        `bson:"status" json:"status,omitempty"`
+	Seats            int64         `bson:"seats" json:"seats"`
+	CurrentPeriodEnd time.Time     `bson:"currentPeriodEnd" json:"currentPeriodEnd"`
+
+	// AsOf is when the subscription was reported, webhook events from
+	// before it are out of date.
+	AsOf time.Time `bson:"asOf" json:"-"`
+
+	// SeatsOutOfSync is set when billing for a member joining or leaving
+	// failed, so the renewal worker tries again.
+	SeatsOutOfSync bool `bson:"seatsOutOfSync" json:"-"`
+
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// Active checks if the organization's subscription is paid up.
+func (o *Organization) Active() bool {
+	return o.Status == SubscriptionActive || o.Status == SubscriptionTrialing
+}
+
+// Member is a developer's membership in an organization. A developer is
+// only ever a member once, the id is made from both ids.
+type Member struct {
+	ID             string        `bson:"_id" json:"-"`
+	OrganizationID bson.ObjectId `bson:"organizationId" json:"organizationId"`
+	DeveloperID    bson.ObjectId `bson:"developerId" json:"developerId"`
+	Role           string        `bson:"role" json:"role"`
+	CreatedAt      time.Time     `bson:"createdAt" json:"createdAt"`
+}
+
+// OrganizationStore persists organizations and their members.
+type OrganizationStore interface {
+	// SaveOrganization inserts a new organization.
+	SaveOrganization(o *Organization) error
+
+	// GetOrganization returns the organization with the given id.
+	GetOrganization(id bson.ObjectId) (*Organization, error)
+
+	// GetOrganizations returns every organization, sorted by name.
+	GetOrganizations() ([]*Organization, error)
+
+	// GetOrganizationByCustomer returns the organization that's a payment
+	// provider customer.
+	GetOrganizationByCustomer(customerID string) (*Organization, error)
+
+	// UpdateOrganization replaces an organization.
+	UpdateOrganization(o *Organization) error
+
+	// SetSeatsOutOfSync sets whether an organization's seats need billing
+	// again.
+	SetSeatsOutOfSync(id bson.ObjectId, outOfSync bool) error
+
+	// GetOrganizationsOutOfSync returns the organizations whose seats need
+	// billing again.
+	GetOrganizationsOutOfSync() ([]*Organization, error)
+
+	// SaveMember inserts a new member, failing with an error mgo.IsDup
+	// recognizes if the developer is already a member.
+	SaveMember(m *Member) error
+
+	// GetMember returns a developer's membership in an organization.
+	GetMember(orgID, devID bson.ObjectId) (*Member, error)
+
+	// GetMembers returns an organization's members, oldest first.
+	GetMembers(orgID bson.ObjectId) ([]*Member, error)
+
+	// GetMemberships returns the organizations a developer is a member of,
+	// oldest first.
+	GetMemberships(devID bson.ObjectId) ([]*Member, error)
+
+	// UpdateMember replaces a member's role.
+	UpdateMember(m *Member) error
+
+	// RemoveMember deletes a developer's membership in an organization.
+	RemoveMember(orgID, devID bson.ObjectId) error
+}
+
+// organizationsByName sorts organizations by name.
+type organizationsByName []*Organization
+
+func (o organizationsByName) Len() int           { return len(o) }
+func (o organizationsByName) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o organizationsByName) Less(i, j int) bool { return o[i].Name < o[j].Name }
+
+// membersByCreated sorts members oldest first.
+type membersByCreated []*Member
+
+func (m membersByCreated) Len() int           { return len(m) }
+func (m membersByCreated) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m membersByCreated) Less(i, j int) bool { return m[i].CreatedAt.Before(m[j].CreatedAt) }
+
+// memberID is the id of a developer's membership in an organization.
+func memberID(orgID, devID bson.ObjectId) string {
+	return orgID.Hex() + ":" + devID.Hex()
+}
+
+// prepareOrganization fills in the fields an organization needs before it's
+// saved.
+func prepareOrganization(o *Organization) {
+	if o.ID == "" {
+		o.ID = bson.NewObjectId()
+	}
+}
+
+func (s *MongoStore) SaveOrganization(o *Organization) error {
+	prepareOrganization(o)
+	return s.db.C("organizations").Insert(o)
+}
+
+func (s *MongoStore) GetOrganization(id bson.ObjectId) (*Organization, error) {
+	o := &Organization{}
+	return o, s.db.C("organizations").FindId(id).One(o)
+}
+
+func (s *MongoStore) GetOrganizations() ([]*Organization, error) {
+	organizations := []*Organization{}
+	return organizations, s.db.C("organizations").Find(nil).Sort("name").All(&organizations)
+}
+
+func (s *MongoStore) GetOrganizationByCustomer(customerID string) (*Organization, error) {
+	o := &Organization{}
+	return o, s.db.C("organizations").Find(bson.M{"customerId": customerID}).One(o)
+}
+
+func (s *MongoStore) UpdateOrganization(o *Organization) error {
+	return s.db.C("organizations").UpdateId(o.ID, o)
+}
+
+func (s *MongoStore) SetSeatsOutOfSync(id bson.ObjectId, outOfSync bool) error {
+	return s.db.C("organizations").UpdateId(id, bson.M{"$set": bson.M{"seatsOutOfSync": outOfSync}})
+}
+
+func (s *MongoStore) GetOrganizationsOutOfSync() ([]*Organization, error) {
+	organizations := []*Organization{}
+	return organizations, s.db.C("organizations").Find(bson.M{"seatsOutOfSync": true}).All(&organizations)
+}
+
+func (s *MongoStore) SaveMember(m *Member) error {
+	m.ID = memberID(m.OrganizationID, m.DeveloperID)
+	return s.db.C("members").Insert(m)
+}
+
+func (s *MongoStore) GetMember(orgID, devID bson.ObjectId) (*Member, error) {
+	m := &Member{}
+	return m, s.db.C("members").FindId(memberID(orgID, devID)).One(m)
+}
+
+func (s *MongoStore) GetMembers(orgID bson.ObjectId) ([]*Member, error) {
+	members := []*Member{}
+	return members, s.db.C("members").Find(bson.M{"organizationId": orgID}).Sort("createdAt").All(&members)
+}
+
+func (s *MongoStore) GetMemberships(devID bson.ObjectId) ([]*Member, error) {
+	members := []*Member{}
+	return members, s.db.C("members").Find(bson.M{"developerId": devID}).Sort("createdAt").All(&members)
+}
+
+func (s *MongoStore) UpdateMember(m *Member) error {
+	return s.db.C("members").UpdateId(memberID(m.OrganizationID, m.DeveloperID), bson.M{"$set": bson.M{"role": m.Role}})
+}
+
+func (s *MongoStore) RemoveMember(orgID, devID bson.ObjectId) error {
+	return s.db.C("members").RemoveId(memberID(orgID, devID))
+}
+
+func (s *MemoryStore) SaveOrganization(o *Organization) error {
+	prepareOrganization(o)
+	return s.insert("organizations", o)
+}
+
+func (s *MemoryStore) GetOrganization(id bson.ObjectId) (*Organization, error) {
+	o := &Organization{}
+	return o, s.findOne("organizations", bson.M{"_id": id}, o)
+}
+
+func (s *MemoryStore) GetOrganizations() ([]*Organization, error) {
+	organizations := []*Organization{}
+	if err := s.findAll("organizations", bson.M{}, &organizations); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(organizationsByName(organizations))
+	return organizations, nil
+}
+
+func (s *MemoryStore) GetOrganizationByCustomer(customerID string) (*Organization, error) {
+	o := &Organization{}
+	return o, s.findOne("organizations", bson.M{"customerId": customerID}, o)
+}
+
+func (s *MemoryStore) UpdateOrganization(o *Organization) error {
+	doc, err := toDoc(o)
+	if err != nil {
+		return err
+	}
+
+	return s.update("organizations", bson.M{"_id": o.ID}, doc)
+}
+
+func (s *MemoryStore) SetSeatsOutOfSync(id bson.ObjectId, outOfSync bool) error {
+	return s.update("organizations", bson.M{"_id": id}, bson.M{"seatsOutOfSync": outOfSync})
+}
+
+func (s *MemoryStore) GetOrganizationsOutOfSync() ([]*Organization, error) {
+	organizations := []*Organization{}
+	return organizations, s.findAll("organizations", bson.M{"seatsOutOfSync": true}, &organizations)
+}
+
+func (s *MemoryStore) SaveMember(m *Member) error {
+	m.ID = memberID(m.OrganizationID, m.DeveloperID)
+	return s.insert("members", m)
+}
+
+func (s *MemoryStore) GetMember(orgID, devID bson.ObjectId) (*Member, error) {
+	m := &Member{}
+	return m, s.findOne("members", bson.M{"_id": memberID(orgID, devID)}, m)
+}
+
+func (s *MemoryStore) GetMembers(orgID bson.ObjectId) ([]*Member, error) {
+	members := []*Member{}
+	if err := s.findAll("members", bson.M{"organizationId": orgID}, &members); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(membersByCreated(members))
+	return members, nil
+}
+
+func (s *MemoryStore) GetMemberships(devID bson.ObjectId) ([]*Member, error) {
+	members := []*Member{}
+	if err := s.findAll("members", bson.M{"developerId": devID}, &members); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(membersByCreated(members))
+	return members, nil
+}
+
+func (s *MemoryStore) UpdateMember(m *Member) error {
+	return s.update("members", bson.M{"_id": memberID(m.OrganizationID, m.DeveloperID)}, bson.M{"role": m.Role})
+}
+
+func (s *MemoryStore) RemoveMember(orgID, devID bson.ObjectId) error {
+	return s.remove("members", bson.M{"_id": memberID(orgID, devID)})
+}
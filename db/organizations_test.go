@@ -0,0 +1,94 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestMembers(t *testing.T) {
+	mem := NewMemoryStore()
+	o := &Organization{Name: "Bowery"}
+	if err := mem.SaveOrganization(o); err != nil || o.ID == "" {
+		t.Fatal("Unable to save organization:", err)
+	}
+
+	owner, dev := bson.NewObjectId(), bson.NewObjectId()
+	now := time.Now()
+	for i, devID := range []bson.ObjectId{owner, dev} {
+		m := &Member{OrganizationID: o.ID, DeveloperID: devID, Role: RoleMember, CreatedAt: now.Add(time.Duration(i) * time.Second)}
+		if err := mem.SaveMember(m); err != nil {
+			t.Fatal("Unable to save member:", err)
+		}
+	}
+
+	if err := mem.SaveMember(&Member{OrganizationID: o.ID, DeveloperID: dev, Role: RoleOwner}); !mgo.IsDup(err) {
+		t.Error("developer should only be a member once, got", err)
+	}
+
+	if err := mem.UpdateMember(&Member{OrganizationID: o.ID, DeveloperID: owner, Role: RoleOwner}); err != nil {
+		t.Fatal("Unable to update member:", err)
+	}
+
+	members, err := mem.GetMembers(o.ID)
+	if err != nil || len(members) != 2 || members[0].DeveloperID != owner || members[0].Role != RoleOwner {
+		t.Fatal("members should be listed oldest first with their roles.", err)
+	}
+
+	if err := mem.RemoveMember(o.ID, dev); err != nil {
+		t.Fatal("Unable to remove member:", err)
+	}
+	if memberships, _ := mem.GetMemberships(dev); len(memberships) != 0 {
+		t.Error("removed member still has a membership.")
+	}
+}
+
+func TestGetOrganizations(t *testing.T) {
+	mem := NewMemoryStore()
+	for _, name := range []string{"Bowery", "Acme"} {
+		if err := mem.SaveOrganization(&Organization{Name: name}); err != nil {
+			t.Fatal("Unable to save organization:", err)
+		}
+	}
+
+	organizations, err := mem.GetOrganizations()
+	if err != nil || len(organizations) != 2 || organizations[0].Name != "Acme" {
+		t.Error("organizations should be sorted by name.", err)
+	}
+}
+
+func TestRespondToInvitation(t *testing.T) {
+	mem := NewMemoryStore()
+	i := &Invitation{
+		OrganizationID: bson.NewObjectId(),
+		Email:          "steve@bowery.io",
+		Role:           RoleMember,
+		InvitedBy:      bson.NewObjectId(),
+		Token:          "invite",
+		ExpiresAt:      time.Now().Add(time.Hour),
+	}
+	if err := mem.SaveInvitation(i); err != nil {
+		t.Fatal("Unable to save invitation:", err)
+	}
+
+	found, err := mem.GetInvitation("invite")
+	if err != nil || found.ID != i.ID || found.Status != InvitationPending {
+		t.Fatal("Unable to get invitation:", err)
+	}
+
+	if err := mem.RespondToInvitation(i.ID, InvitationAccepted, time.Now()); err != nil {
+		t.Fatal("Unable to accept invitation:", err)
+	}
+	if err := mem.RespondToInvitation(i.ID, InvitationDeclined, time.Now()); err != mgo.ErrNotFound {
+		t.Error("invitation should only be answered once, got", err)
+	}
+
+	expired := &Invitation{OrganizationID: i.OrganizationID, InvitedBy: i.InvitedBy, Token: "expired", ExpiresAt: time.Now().Add(-time.Second)}
+	mem.SaveInvitation(expired)
+	if _, err := mem.GetInvitation("expired"); err != mgo.ErrNotFound {
+		t.Error("expired invitation shouldn't be found, got", err)
+	}
+}
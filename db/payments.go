@@ -0,0 +1,181 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// The states a payment can be in.
+const (
+	PaymentPending   = "pending"
+	PaymentSucceeded = "succeeded"
+	PaymentFailed    = "failed"
+	PaymentRefunded  = "refunded"
+)
+
+// Payment is an entry in the ledger of what developers have been charged.
+// Payments are kept by their idempotency key, the same key is sent to the
+// payment provider so a payment is only ever made once.
+type Payment struct {
+	Key         string        `bson:"_id" json:"key"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Description string        `bson:"description" json:"description"`
+	PlanID      string        `bson:"plan" json:"plan,omitempty"`
+
+	// OrganizationID is set when the developer paid for an organization.
+	OrganizationID bson.ObjectId `bson:"organizationId,omitempty" json:"organizationId,omitempty"`
+
+	// Amount is in the currency's smallest unit, e.g. cents.
+	Amount   int64  `bson:"amount" json:"amount"`
+	Currency string `bson:"currency" json:"currency"`
+
+	// The ids the payment has with the provider, whichever are known.
+	CustomerID string `bson:"customerId" json:"customerId,omitempty"`
+	ChargeID   string `bson:"chargeId" json:"chargeId,omitempty"`
+	InvoiceID  string `bson:"invoiceId" json:"invoiceId,omitempty"`
+
+	Status string `bson:"status" json:"status"`
+	Error  string `bson:"error" json:"error,omitempty"`
+
+	// PeriodEnd is the end of the period the payment paid for, if it's
+	// known.
+	PeriodEnd time.Time `bson:"periodEnd,omitempty" json:"periodEnd,omitempty"`
+
+	// LockedUntil holds off other attempts while the payment is being made.
+	LockedUntil time.Time `bson:"lockedUntil" json:"-"`
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// PaymentStore persists the payments ledger.
+type PaymentStore interface {
+	// SavePayment inserts a new payment, failing with an error mgo.IsDup
+	// recognizes if its key is taken.
+	SavePayment(p *Payment) error
+
+	// GetPayment returns the payment with the given key.
+	GetPayment(key string) (*Payment, error)
+
+	// GetPaymentByCharge returns the payment made by a provider charge.
+	GetPaymentByCharge(chargeID string) (*Payment, error)
+
+	// GetPaymentByInvoice returns the payment a provider invoice was for.
+	GetPaymentByInvoice(invoiceID string) (*Payment, error)
+
+	// GetPayments returns a developer's payments, newest first.
+	GetPayments(developerID bson.ObjectId) ([]*Payment, error)
+
+	// LockPayment holds a pending payment for lease, so only one attempt to
+	// make it runs at a time. Returns mgo.ErrNotFound if it isn't pending
+	// or is already held.
+	LockPayment(key string, now time.Time, lease time.Duration) error
+
+	// UpdatePayment replaces a payment's state.
+	UpdatePayment(p *Payment) error
+}
+
+// paymentsByCreated sorts payments newest first.
+type paymentsByCreated []*Payment
+
+func (p paymentsByCreated) Len() int           { return len(p) }
+func (p paymentsByCreated) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p paymentsByCreated) Less(i, j int) bool { return p[i].CreatedAt.After(p[j].CreatedAt) }
+
+func (s *MongoStore) SavePayment(p *Payment) error {
+	return s.db.C("payments").Insert(p)
+}
+
+func (s *MongoStore) GetPayment(key string) (*Payment, error) {
+	p := &Payment{}
+	return p, s.db.C("payments").FindId(key).One(p)
+}
+
+func (s *MongoStore) GetPaymentByCharge(chargeID string) (*Payment, error) {
+	p := &Payment{}
+	return p, s.db.C("payments").Find(bson.M{"chargeId": chargeID}).One(p)
+}
+
+func (s *MongoStore) GetPaymentByInvoice(invoiceID string) (*Payment, error) {
+	p := &Payment{}
+	return p, s.db.C("payments").Find(bson.M{"invoiceId": invoiceID}).One(p)
+}
+
+func (s *MongoStore) GetPayments(developerID bson.ObjectId) ([]*Payment, error) {
+	payments := []*Payment{}
+	return payments, s.db.C("payments").Find(bson.M{"developerId": developerID}).Sort("-createdAt").All(&payments)
+}
+
+func (s *MongoStore) LockPayment(key string, now time.Time, lease time.Duration) error {
+	return s.db.C("payments").Update(bson.M{
+		"_id":         key,
+		"status":      PaymentPending,
+		"lockedUntil": bson.M{"$lte": now},
+	}, bson.M{"$set": bson.M{"lockedUntil": now.Add(lease)}})
+}
+
+func (s *MongoStore) UpdatePayment(p *Payment) error {
+	return s.db.C("payments").UpdateId(p.Key, p)
+}
+
+func (s *MemoryStore) SavePayment(p *Payment) error {
+	return s.insert("payments", p)
+}
+
+func (s *MemoryStore) GetPayment(key string) (*Payment, error) {
+	p := &Payment{}
+	return p, s.findOne("payments", bson.M{"_id": key}, p)
+}
+
+func (s *MemoryStore) GetPaymentByCharge(chargeID string) (*Payment, error) {
+	p := &Payment{}
+	return p, s.findOne("payments", bson.M{"chargeId": chargeID}, p)
+}
+
+func (s *MemoryStore) GetPaymentByInvoice(invoiceID string) (*Payment, error) {
+	p := &Payment{}
+	return p, s.findOne("payments", bson.M{"invoiceId": invoiceID}, p)
+}
+
+func (s *MemoryStore) GetPayments(developerID bson.ObjectId) ([]*Payment, error) {
+	payments := []*Payment{}
+	if err := s.findAll("payments", bson.M{"developerId": developerID}, &payments); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(paymentsByCreated(payments))
+	return payments, nil
+}
+
+func (s *MemoryStore) LockPayment(key string, now time.Time, lease time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, doc := range s.collections["payments"] {
+		if doc["_id"] != key {
+			continue
+		}
+
+		lockedUntil, _ := doc["lockedUntil"].(time.Time)
+		if doc["status"] != PaymentPending || lockedUntil.After(now) {
+			break
+		}
+
+		doc["lockedUntil"] = now.Add(lease)
+		return nil
+	}
+
+	return mgo.ErrNotFound
+}
+
+func (s *MemoryStore) UpdatePayment(p *Payment) error {
+	doc, err := toDoc(p)
+	if err != nil {
+		return err
+	}
+
+	return s.update("payments", bson.M{"_id": p.Key}, doc)
+}
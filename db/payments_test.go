@@ -0,0 +1,77 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestSavePayment(t *testing.T) {
+	mem := NewMemoryStore()
+	devID := bson.NewObjectId()
+	for i, key := range []string{"first", "second"} {
+		p := &Payment{
+			Key:         key,
+			DeveloperID: devID,
+			Amount:      2900,
+			Currency:    "usd",
+			ChargeID:    "ch_" + key,
+			Status:      PaymentSucceeded,
+			CreatedAt:   time.Now().Add(time.Duration(i) * time.Second),
+		}
+		if err := mem.SavePayment(p); err != nil {
+			t.Fatal("Unable to save payment:", err)
+		}
+	}
+
+	if err := mem.SavePayment(&Payment{Key: "first", DeveloperID: devID}); !mgo.IsDup(err) {
+		t.Error("payment with a used key should be a duplicate, got", err)
+	}
+
+	payments, err := mem.GetPayments(devID)
+	if err != nil {
+		t.Fatal("Unable to get payments:", err)
+	}
+	if len(payments) != 2 || payments[0].Key != "second" {
+		t.Fatal("payments should be listed newest first.")
+	}
+
+	p, err := mem.GetPaymentByCharge("ch_first")
+	if err != nil || p.Key != "first" {
+		t.Error("payment not found by charge.", err)
+	}
+}
+
+func TestLockPayment(t *testing.T) {
+	mem := NewMemoryStore()
+	now := time.Now()
+	p := &Payment{
+		Key:         "renewal",
+		DeveloperID: bson.NewObjectId(),
+		Status:      PaymentPending,
+		LockedUntil: now.Add(time.Minute),
+	}
+	if err := mem.SavePayment(p); err != nil {
+		t.Fatal("Unable to save payment:", err)
+	}
+
+	if err := mem.LockPayment("renewal", now, time.Minute); err != mgo.ErrNotFound {
+		t.Error("held payment shouldn't be locked again, got", err)
+	}
+
+	later := now.Add(2 * time.Minute)
+	if err := mem.LockPayment("renewal", later, time.Minute); err != nil {
+		t.Error("payment should be lockable once its lease is up, got", err)
+	}
+
+	p.Status = PaymentSucceeded
+	if err := mem.UpdatePayment(p); err != nil {
+		t.Fatal("Unable to update payment:", err)
+	}
+	if err := mem.LockPayment("renewal", later.Add(time.Hour), time.Minute); err != mgo.ErrNotFound {
+		t.Error("finished payment shouldn't be locked, got", err)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// The outcomes of renewing a license. A declined renewal is past due until
+// it's paid or runs out of retries and is downgraded.
+const (
+	RenewalRenewed    = "renewed"
+	RenewalWaiting    = "waiting"
+	RenewalFailed     = "failed"
+	RenewalPastDue    = "past_due"
+	RenewalDowngraded = "downgraded"
+)
+
+// Renewal is the outcome of the latest attempt to renew a developer's
+// license before it expires. Expiration is the expiration being renewed, a
+// new one starts a new renewal.
+type Renewal struct {
+	DeveloperID   bson.ObjectId `bson:"_id" json:"-"`
+	Expiration    time.Time     `bson:"expiration" json:"expiration"`
+	Status        string        `bson:"status" json:"status"`
+	Error         string        `bson:"error" json:"error,omitempty"`
+	Attempts      int           `bson:"attempts" json:"attempts"`
+	Declines      int           `bson:"declines" json:"declines"`
+	AttemptedAt   time.Time     `bson:"attemptedAt" json:"attemptedAt"`
+	NextAttemptAt time.Time     `bson:"nextAttemptAt" json:"nextAttemptAt"`
+
+	// When the first decline happened, and when the license stops working
+	// if the renewal is still past due.
+	FailedAt    time.Time `bson:"failedAt" json:"failedAt,omitempty"`
+	GraceEndsAt time.Time `bson:"graceEndsAt" json:"graceEndsAt,omitempty"`
+}
+
+// RenewalStore persists license renewals.
+type RenewalStore interface {
+	// SaveRenewal inserts or replaces a developer's renewal.
+	SaveRenewal(r *Renewal) error
+
+	// GetRenewal returns a developer's renewal.
+	GetRenewal(devID bson.ObjectId) (*Renewal, error)
+
+	// GetRenewals returns the renewals with a status, the next to be
+	// attempted first.
+	GetRenewals(status string) ([]*Renewal, error)
+}
+
+// renewalsByNextAttempt sorts renewals by when they're next attempted.
+type renewalsByNextAttempt []*Renewal
+
+func (r renewalsByNextAttempt) Len() int      { return len(r) }
+func (r renewalsByNextAttempt) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r renewalsByNextAttempt) Less(i, j int) bool {
+	return r[i].NextAttemptAt.Before(r[j].NextAttemptAt)
+}
+
+func (s *MongoStore) SaveRenewal(r *Renewal) error {
+	_, err := s.db.C("renewals").UpsertId(r.DeveloperID, r)
+	return err
+}
+
+func (s *MongoStore) GetRenewal(devID bson.ObjectId) (*Renewal, error) {
+	r := &Renewal{}
+	return r, s.db.C("renewals").FindId(devID).One(r)
+}
+
+func (s *MongoStore) GetRenewals(status string) ([]*Renewal, error) {
+	renewals := []*Renewal{}
+	return renewals, s.db.C("renewals").Find(bson.M{"status": status}).Sort("nextAttemptAt").All(&renewals)
+}
+
+func (s *MemoryStore) SaveRenewal(r *Renewal) error {
+	return s.upsert("renewals", bson.M{"_id": r.DeveloperID}, r)
+}
+
+func (s *MemoryStore) GetRenewal(devID bson.ObjectId) (*Renewal, error) {
+	r := &Renewal{}
+	return r, s.findOne("renewals", bson.M{"_id": devID}, r)
+}
+
+func (s *MemoryStore) GetRenewals(status string) ([]*Renewal, error) {
+	renewals := []*Renewal{}
+	if err := s.findAll("renewals", bson.M{"status": status}, &renewals); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(renewalsByNextAttempt(renewals))
+	return renewals, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// ResetToken lets a developer set a new password without knowing their old
+// one. Only a hash of the token is stored, and it can only be used once.
+type ResetToken struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Token       string        `bson:"-" json:"-"`
+	TokenHash   string        `bson:"tokenHash" json:"-"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	ExpiresAt   time.Time     `bson:"expiresAt" json:"expiresAt"`
+}
+
+// Expired checks if the reset token can no longer be used.
+func (r *ResetToken) Expired() bool {
+	return !time.Now().Before(r.ExpiresAt)
+}
+
+// ResetTokenStore persists password reset tokens.
+type ResetTokenStore interface {
+	// SaveResetToken inserts a new reset token, storing the hash of its token.
+	SaveResetToken(r *ResetToken) error
+
+	// GetResetToken returns the unexpired reset token for a token without
+	// using it up.
+	GetResetToken(token string) (*ResetToken, error)
+
+	// ConsumeResetToken returns the unexpired reset token for a token and
+	// deletes it, along with every other reset token for the developer.
+	ConsumeResetToken(token string) (*ResetToken, error)
+}
+
+// prepareResetToken fills in the fields a reset token needs before it's saved.
+func prepareResetToken(r *ResetToken) {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	r.TokenHash = HashToken(r.Token)
+}
+
+func (s *MongoStore) SaveResetToken(r *ResetToken) error {
+	prepareResetToken(r)
+	return s.db.C("resetTokens").Insert(r)
+}
+
+func (s *MongoStore) GetResetToken(token string) (*ResetToken, error) {
+	r := &ResetToken{}
+	err := s.db.C("resetTokens").Find(bson.M{"tokenHash": HashToken(token)}).One(r)
+	if err == nil && r.Expired() {
+		err = mgo.ErrNotFound
+	}
+
+	return r, err
+}
+
+func (s *MongoStore) ConsumeResetToken(token string) (*ResetToken, error) {
+	r := &ResetToken{}
+	_, err := s.db.C("resetTokens").Find(bson.M{"tokenHash": HashToken(token)}).
+		Apply(mgo.Change{Remove: true}, r)
+	if err != nil {
+		return r, err
+	}
+	if r.Expired() {
+		return r, mgo.ErrNotFound
+	}
+
+	_, err = s.db.C("resetTokens").RemoveAll(bson.M{"developerId": r.DeveloperID})
+	return r, err
+}
+
+func (s *MemoryStore) SaveResetToken(r *ResetToken) error {
+	prepareResetToken(r)
+	return s.insert("resetTokens", r)
+}
+
+func (s *MemoryStore) GetResetToken(token string) (*ResetToken, error) {
+	r := &ResetToken{}
+	err := s.findOne("resetTokens", bson.M{"tokenHash": HashToken(token)}, r)
+	if err == nil && r.Expired() {
+		err = mgo.ErrNotFound
+	}
+
+	return r, err
+}
+
+func (s *MemoryStore) ConsumeResetToken(token string) (*ResetToken, error) {
+	r := &ResetToken{}
+	err := s.findAndRemove("resetTokens", bson.M{"tokenHash": HashToken(token)}, r)
+	if err != nil {
+		return r, err
+	}
+	if r.Expired() {
+		return r, mgo.ErrNotFound
+	}
+
+	_, err = s.removeAll("resetTokens", bson.M{"developerId": r.DeveloperID})
+	return r, err
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestConsumeResetToken(t *testing.T) {
+	mem := NewMemoryStore()
+	devID := bson.NewObjectId()
+	now := time.Now()
+
+	first := &ResetToken{DeveloperID: devID, Token: "first", ExpiresAt: now.Add(time.Hour)}
+	second := &ResetToken{DeveloperID: devID, Token: "second", ExpiresAt: now.Add(time.Hour)}
+	for _, r := range []*ResetToken{first, second} {
+		if err := mem.SaveResetToken(r); err != nil {
+			t.Fatal("Unable to save reset token:", err)
+		}
+	}
+
+	if _, err := mem.GetResetToken("first"); err != nil {
+		t.Fatal("Unable to get reset token:", err)
+	}
+
+	r, err := mem.ConsumeResetToken("first")
+	if err != nil {
+		t.Fatal("Unable to consume reset token:", err)
+	}
+	if r.DeveloperID != devID {
+		t.Error("reset token not retrieved correctly.")
+	}
+
+	for _, token := range []string{"first", "second"} {
+		if _, err := mem.ConsumeResetToken(token); err != mgo.ErrNotFound {
+			t.Error("reset token", token, "should be used up, got", err)
+		}
+	}
+}
+
+func TestConsumeResetTokenExpired(t *testing.T) {
+	mem := NewMemoryStore()
+	r := &ResetToken{DeveloperID: bson.NewObjectId(), Token: "expired", ExpiresAt: time.Now().Add(-time.Second)}
+	if err := mem.SaveResetToken(r); err != nil {
+		t.Fatal("Unable to save reset token:", err)
+	}
+
+	if _, err := mem.GetResetToken("expired"); err != mgo.ErrNotFound {
+		t.Error("expired reset token shouldn't be found.")
+	}
+
+	if _, err := mem.ConsumeResetToken("expired"); err != mgo.ErrNotFound {
+		t.Error("expired reset token shouldn't be usable.")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Session is a login from a single device. Only a hash of the session's
+// token is stored. Sessions for devices approved in a browser are named
+// after the device.
+type Session struct {
+	ID          bson.ObjectId `bson:"_id" json:"id"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"developerId"`
+	Token       string        `bson:"-" json:"-"`
+	TokenHash   string        `bson:"tokenHash" json:"-"`
+	Name        string        `bson:"name,omitempty" json:"name,omitempty"`
+	IP          string        `bson:"ip" json:"ip"`
+	UserAgent   string        `bson:"userAgent" json:"userAgent"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"createdAt"`
+	LastSeenAt  time.Time     `bson:"lastSeenAt" json:"lastSeenAt"`
+	ExpiresAt   time.Time     `bson:"expiresAt" json:"expiresAt"`
+	Current     bool          `bson:"-" json:"current"`
+}
+
+// Expired checks if the session can no longer be used.
+func (s *Session) Expired() bool {
+	return !time.Now().Before(s.ExpiresAt)
+}
+
+// SessionStore persists developer sessions.
+type SessionStore interface {
+	// SaveSession inserts a new session, storing the hash of its token.
+	SaveSession(s *Session) error
+
+	// GetSession returns the unexpired session for a token.
+	GetSession(token string) (*Session, error)
+
+	// GetSessions returns every session for a developer.
+	GetSessions(devID bson.ObjectId) ([]*Session, error)
+
+	// TouchSession updates when a session was last used.
+	TouchSession(id bson.ObjectId, seen time.Time) error
+
+	// RemoveSession deletes one of a developer's sessions.
+	RemoveSession(devID, id bson.ObjectId) error
+
+	// RemoveSessions deletes every session for a developer.
+	RemoveSessions(devID bson.ObjectId) error
+}
+
+// HashToken gets the hash a token is stored as.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// prepareSession fills in the fields a session needs before it's saved.
+func prepareSession(s *Session) {
+	if s.ID == "" {
+		s.ID = bson.NewObjectId()
+	}
+	s.TokenHash = HashToken(s.Token)
+}
+
+func (s *MongoStore) SaveSession(session *Session) error {
+	prepareSession(session)
+	return s.db.C("sessions").Insert(session)
+}
+
+func (s *MongoStore) GetSession(token string) (*Session, error) {
+	session := &Session{}
+	err := s.db.C("sessions").Find(bson.M{"tokenHash": HashToken(token)}).One(session)
+	if err == nil && session.Expired() {
+		err = mgo.ErrNotFound
+	}
+
+	return session, err
+}
+
+func (s *MongoStore) GetSessions(devID bson.ObjectId) ([]*Session, error) {
+	sessions := []*Session{}
+	return sessions, s.db.C("sessions").Find(bson.M{
+		"developerId": devID,
+		"expiresAt":   bson.M{"$gt": time.Now()},
+	}).Sort("-lastSeenAt").All(&sessions)
+}
+
+func (s *MongoStore) TouchSession(id bson.ObjectId, seen time.Time) error {
+	return s.db.C("sessions").UpdateId(id, bson.M{"$set": bson.M{"lastSeenAt": seen}})
+}
+
+func (s *MongoStore) RemoveSession(devID, id bson.ObjectId) error {
+	return s.db.C("sessions").Remove(bson.M{"_id": id, "developerId": devID})
+}
+
+func (s *MongoStore) RemoveSessions(devID bson.ObjectId) error {
+	_, err := s.db.C("sessions").RemoveAll(bson.M{"developerId": devID})
+	return err
+}
+
+func (s *MemoryStore) SaveSession(session *Session) error {
+	prepareSession(session)
+	return s.insert("sessions", session)
+}
+
+func (s *MemoryStore) GetSession(token string) (*Session, error) {
+	session := &Session{}
+	err := s.findOne("sessions", bson.M{"tokenHash": HashToken(token)}, session)
+	if err == nil && session.Expired() {
+		err = mgo.ErrNotFound
+	}
+
+	return session, err
+}
+
+func (s *MemoryStore) GetSessions(devID bson.ObjectId) ([]*Session, error) {
+	all := []*Session{}
+	if err := s.findAll("sessions", bson.M{"developerId": devID}, &all); err != nil {
+		return nil, err
+	}
+
+	sessions := []*Session{}
+	for _, session := range all {
+		if !session.Expired() {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.Sort(byLastSeen(sessions))
+	return sessions, nil
+}
+
+func (s *MemoryStore) TouchSession(id bson.ObjectId, seen time.Time) error {
+	return s.update("sessions", bson.M{"_id": id}, bson.M{"lastSeenAt": seen})
+}
+
+func (s *MemoryStore) RemoveSession(devID, id bson.ObjectId) error {
+	return s.remove("sessions", bson.M{"_id": id, "developerId": devID})
+}
+
+func (s *MemoryStore) RemoveSessions(devID bson.ObjectId) error {
+	_, err := s.removeAll("sessions", bson.M{"developerId": devID})
+	return err
+}
+
+// byLastSeen sorts sessions with the most recently used first.
+type byLastSeen []*Session
+
+func (s byLastSeen) Len() int           { return len(s) }
+func (s byLastSeen) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastSeen) Less(i, j int) bool { return s[i].LastSeenAt.After(s[j].LastSeenAt) }
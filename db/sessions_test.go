@@ -0,0 +1,77 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"testing"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestGetSession(t *testing.T) {
+	mem := NewMemoryStore()
+	devID := bson.NewObjectId()
+	now := time.Now()
+
+	session := &Session{DeveloperID: devID, Token: "token", ExpiresAt: now.Add(time.Hour)}
+	if err := mem.SaveSession(session); err != nil {
+		t.Fatal("Unable to save session:", err)
+	}
+
+	if session.TokenHash == "" || session.TokenHash == "token" {
+		t.Error("session token should be stored hashed.")
+	}
+
+	found, err := mem.GetSession("token")
+	if err != nil {
+		t.Fatal("Unable to get session:", err)
+	}
+
+	if found.ID != session.ID || found.DeveloperID != devID {
+		t.Error("session not retrieved correctly.")
+	}
+
+	if _, err := mem.GetSession(session.TokenHash); err != mgo.ErrNotFound {
+		t.Error("session shouldn't be found by its hash.")
+	}
+}
+
+func TestGetSessionsExpired(t *testing.T) {
+	mem := NewMemoryStore()
+	devID := bson.NewObjectId()
+	now := time.Now()
+
+	sessions := []*Session{
+		{DeveloperID: devID, Token: "old", LastSeenAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)},
+		{DeveloperID: devID, Token: "new", LastSeenAt: now, ExpiresAt: now.Add(time.Hour)},
+		{DeveloperID: devID, Token: "expired", LastSeenAt: now, ExpiresAt: now.Add(-time.Second)},
+		{DeveloperID: bson.NewObjectId(), Token: "other", ExpiresAt: now.Add(time.Hour)},
+	}
+	for _, session := range sessions {
+		if err := mem.SaveSession(session); err != nil {
+			t.Fatal("Unable to save session:", err)
+		}
+	}
+
+	if _, err := mem.GetSession("expired"); err != mgo.ErrNotFound {
+		t.Error("expired session shouldn't be found.")
+	}
+
+	found, err := mem.GetSessions(devID)
+	if err != nil {
+		t.Fatal("Unable to get sessions:", err)
+	}
+
+	if len(found) != 2 || found[0].ID != sessions[1].ID || found[1].ID != sessions[0].ID {
+		t.Error("sessions should be unexpired and most recently used first.")
+	}
+
+	if err := mem.RemoveSessions(devID); err != nil {
+		t.Fatal("Unable to remove sessions:", err)
+	}
+
+	if _, err := mem.GetSession("other"); err != nil {
+		t.Error("other developers' sessions shouldn't be removed.")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// settingsID is the id of the only settings document.
+const settingsID = "broome"
+
+// Settings are the options admins can change while broome is running.
+type Settings struct {
+	ID string `bson:"_id" json:"-"`
+
+	// RequireEmailVerification stops unverified developers from logging in
+	// or paying.
+	RequireEmailVerification bool `bson:"requireEmailVerification" json:"requireEmailVerification"`
+
+	// RequireStaffTwoFactor stops developers with a staff role from using
+	// it until they turn on two-factor authentication.
+	RequireStaffTwoFactor bool `bson:"requireStaffTwoFactor" json:"requireStaffTwoFactor"`
+}
+
+// SettingsStore persists the admin settings.
+type SettingsStore interface {
+	// GetSettings returns the current settings, or the defaults if they've
+	// never been saved.
+	GetSettings() (*Settings, error)
+
+	// SaveSettings replaces the current settings.
+	SaveSettings(settings *Settings) error
+}
+
+func (s *MongoStore) GetSettings() (*Settings, error) {
+	settings := &Settings{}
+	err := s.db.C("settings").FindId(settingsID).One(settings)
+	if err == mgo.ErrNotFound {
+		return &Settings{ID: settingsID}, nil
+	}
+
+	return settings, err
+}
+
+func (s *MongoStore) SaveSettings(settings *Settings) error {
+	settings.ID = settingsID
+	_, err := s.db.C("settings").UpsertId(settingsID, settings)
+	return err
+}
+
+func (s *MemoryStore) GetSettings() (*Settings, error) {
+	settings := &Settings{}
+	err := s.findOne("settings", bson.M{"_id": settingsID}, settings)
+	if err == mgo.ErrNotFound {
+		return &Settings{ID: settingsID}, nil
+	}
+
+	return settings, err
+}
+
+func (s *MemoryStore) SaveSettings(settings *Settings) error {
+	settings.ID = settingsID
+	return s.upsert("settings", bson.M{"_id": settingsID}, settings)
+}
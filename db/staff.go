@@ -0,0 +1,45 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Staff is the roles a developer has in running broome, as opposed to
+// their roles in an organization.
+type Staff struct {
+	DeveloperID bson.ObjectId `bson:"_id" json:"developerId"`
+	Roles       []string      `bson:"roles" json:"roles"`
+	UpdatedBy   bson.ObjectId `bson:"updatedBy,omitempty" json:"updatedBy,omitempty"`
+	UpdatedAt   time.Time     `bson:"updatedAt" json:"updatedAt"`
+}
+
+// StaffStore persists the roles of broome's staff.
+type StaffStore interface {
+	// GetStaff returns a developer's staff roles.
+	GetStaff(devID bson.ObjectId) (*Staff, error)
+
+	// SaveStaff replaces a developer's staff roles.
+	SaveStaff(staff *Staff) error
+}
+
+func (s *MongoStore) GetStaff(devID bson.ObjectId) (*Staff, error) {
+	staff := &Staff{}
+	return staff, s.db.C("staff").FindId(devID).One(staff)
+}
+
+func (s *MongoStore) SaveStaff(staff *Staff) error {
+	_, err := s.db.C("staff").UpsertId(staff.DeveloperID, staff)
+	return err
+}
+
+func (s *MemoryStore) GetStaff(devID bson.ObjectId) (*Staff, error) {
+	staff := &Staff{}
+	return staff, s.findOne("staff", bson.M{"_id": devID}, staff)
+}
+
+func (s *MemoryStore) SaveStaff(staff *Staff) error {
+	return s.upsert("staff", bson.M{"_id": staff.DeveloperID}, staff)
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// The states of a subscription, the same as Stripe's.
+const (
+	SubscriptionTrialing = "trialing"
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionCanceled = "canceled"
+	SubscriptionUnpaid   = "unpaid"
+)
+
+// Subscription is a developer's subscription to a plan, as last reported
+// by Stripe.
+type Subscription struct {
+	DeveloperID      bson.ObjectId `bson:"_id" json:"-"`
+	CustomerID       string        `bson:"customerId" json:"customerId"`
+	PlanID           string        `bson:"planId" json:"plan"`
+	Status           string        `bson:"status" json:"status"`
+	Quantity         int64         `bson:"quantity" json:"quantity"`
+	CurrentPeriodEnd time.Time     `bson:"currentPeriodEnd" json:"currentPeriodEnd"`
+	UpdatedAt        time.Time     `bson:"updatedAt" json:"updatedAt"`
+
+	// AsOf is when Stripe reported this state, webhook events from before
+	// it are out of date.
+	AsOf time.Time `bson:"asOf" json:"-"`
+}
+
+// Active checks if the subscription is paid up.
+func (s *Subscription) Active() bool {
+	return s.Status == SubscriptionActive || s.Status == SubscriptionTrialing
+}
+
+// SubscriptionStore persists developers' subscriptions.
+type SubscriptionStore interface {
+	// SaveSubscription inserts or replaces a developer's subscription.
+	SaveSubscription(sub *Subscription) error
+
+	// GetSubscription returns a developer's subscription.
+	GetSubscription(devID bson.ObjectId) (*Subscription, error)
+}
+
+func (s *MongoStore) SaveSubscription(sub *Subscription) error {
+	_, err := s.db.C("subscriptions").UpsertId(sub.DeveloperID, sub)
+	return err
+}
+
+func (s *MongoStore) GetSubscription(devID bson.ObjectId) (*Subscription, error) {
+	sub := &Subscription{}
+	return sub, s.db.C("subscriptions").FindId(devID).One(sub)
+}
+
+func (s *MemoryStore) SaveSubscription(sub *Subscription) error {
+	return s.upsert("subscriptions", bson.M{"_id": sub.DeveloperID}, sub)
+}
+
+func (s *MemoryStore) GetSubscription(devID bson.ObjectId) (*Subscription, error) {
+	sub := &Subscription{}
+	return sub, s.findOne("subscriptions", bson.M{"_id": devID}, sub)
+}
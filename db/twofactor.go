@@ -0,0 +1,193 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// TwoFactor is a developer's authenticator app. It's only used to log in
+// once it's been confirmed with a first code. Recovery codes are stored
+// hashed and each can be used once.
+type TwoFactor struct {
+	DeveloperID   bson.ObjectId `bson:"_id" json:"-"`
+	Secret        string        `bson:"secret" json:"-"`
+	Enabled       bool          `bson:"enabled" json:"enabled"`
+	RecoveryCodes []string      `bson:"recoveryCodes" json:"-"`
+
+	// LastCounter is the time step of the last code used, codes for it and
+	// earlier steps are refused so a code can't be replayed.
+	LastCounter int64 `bson:"lastCounter" json:"-"`
+
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+	ConfirmedAt time.Time `bson:"confirmedAt" json:"confirmedAt"`
+}
+
+// LoginChallenge is a login that's checked the password and is waiting for
+// a two-factor code. Only a hash of the token is stored.
+type LoginChallenge struct {
+	ID          bson.ObjectId `bson:"_id" json:"-"`
+	Token       string        `bson:"-" json:"-"`
+	TokenHash   string        `bson:"tokenHash" json:"-"`
+	DeveloperID bson.ObjectId `bson:"developerId" json:"-"`
+	Attempts    int           `bson:"attempts" json:"-"`
+	CreatedAt   time.Time     `bson:"createdAt" json:"-"`
+	ExpiresAt   time.Time     `bson:"expiresAt" json:"expiresAt"`
+}
+
+// TwoFactorStore persists developers' two-factor settings and the logins
+// waiting on them.
+type TwoFactorStore interface {
+	// GetTwoFactor returns a developer's two-factor settings.
+	GetTwoFactor(devID bson.ObjectId) (*TwoFactor, error)
+
+	// SaveTwoFactor replaces a developer's two-factor settings.
+	SaveTwoFactor(t *TwoFactor) error
+
+	// RemoveTwoFactor turns off two-factor authentication for a developer.
+	RemoveTwoFactor(devID bson.ObjectId) error
+
+	// UseTwoFactorCode moves the last used time step from last to counter.
+	// Returns mgo.ErrNotFound if another login used a code first.
+	UseTwoFactorCode(devID bson.ObjectId, last, counter int64) error
+
+	// UseRecoveryCode removes a recovery code by its hash. Returns
+	// mgo.ErrNotFound if it's not one of the developer's codes.
+	UseRecoveryCode(devID bson.ObjectId, hash string) error
+
+	// SaveLoginChallenge inserts a login challenge, storing the hash of its
+	// token.
+	SaveLoginChallenge(c *LoginChallenge) error
+
+	// GetLoginChallenge returns the unexpired login challenge for a token.
+	GetLoginChallenge(token string) (*LoginChallenge, error)
+
+	// FailLoginChallenge moves a challenge's attempts from attempts to one
+	// more. Returns mgo.ErrNotFound if it's changed since.
+	FailLoginChallenge(id bson.ObjectId, attempts int) error
+
+	// RemoveLoginChallenge deletes a login challenge. Returns
+	// mgo.ErrNotFound if it's already gone, so only one login can use it.
+	RemoveLoginChallenge(id bson.ObjectId) error
+}
+
+// prepareLoginChallenge fills in the fields a challenge needs before it's
+// saved.
+func prepareLoginChallenge(c *LoginChallenge) {
+	if c.ID == "" {
+		c.ID = bson.NewObjectId()
+	}
+	c.TokenHash = HashToken(c.Token)
+}
+
+func (s *MongoStore) GetTwoFactor(devID bson.ObjectId) (*TwoFactor, error) {
+	t := &TwoFactor{}
+	return t, s.db.C("twofactor").FindId(devID).One(t)
+}
+
+func (s *MongoStore) SaveTwoFactor(t *TwoFactor) error {
+	_, err := s.db.C("twofactor").UpsertId(t.DeveloperID, t)
+	return err
+}
+
+func (s *MongoStore) RemoveTwoFactor(devID bson.ObjectId) error {
+	return s.db.C("twofactor").RemoveId(devID)
+}
+
+func (s *MongoStore) UseTwoFactorCode(devID bson.ObjectId, last, counter int64) error {
+	return s.db.C("twofactor").Update(bson.M{"_id": devID, "lastCounter": last},
+		bson.M{"$set": bson.M{"lastCounter": counter}})
+}
+
+func (s *MongoStore) UseRecoveryCode(devID bson.ObjectId, hash string) error {
+	return s.db.C("twofactor").Update(bson.M{"_id": devID, "recoveryCodes": hash},
+		bson.M{"$pull": bson.M{"recoveryCodes": hash}})
+}
+
+func (s *MongoStore) SaveLoginChallenge(c *LoginChallenge) error {
+	prepareLoginChallenge(c)
+	return s.db.C("challenges").Insert(c)
+}
+
+func (s *MongoStore) GetLoginChallenge(token string) (*LoginChallenge, error) {
+	c := &LoginChallenge{}
+	err := s.db.C("challenges").Find(bson.M{"tokenHash": HashToken(token)}).One(c)
+	if err == nil && !time.Now().Before(c.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return c, err
+}
+
+func (s *MongoStore) FailLoginChallenge(id bson.ObjectId, attempts int) error {
+	return s.db.C("challenges").Update(bson.M{"_id": id, "attempts": attempts},
+		bson.M{"$set": bson.M{"attempts": attempts + 1}})
+}
+
+func (s *MongoStore) RemoveLoginChallenge(id bson.ObjectId) error {
+	return s.db.C("challenges").RemoveId(id)
+}
+
+func (s *MemoryStore) GetTwoFactor(devID bson.ObjectId) (*TwoFactor, error) {
+	t := &TwoFactor{}
+	return t, s.findOne("twofactor", bson.M{"_id": devID}, t)
+}
+
+func (s *MemoryStore) SaveTwoFactor(t *TwoFactor) error {
+	return s.upsert("twofactor", bson.M{"_id": t.DeveloperID}, t)
+}
+
+func (s *MemoryStore) RemoveTwoFactor(devID bson.ObjectId) error {
+	return s.remove("twofactor", bson.M{"_id": devID})
+}
+
+func (s *MemoryStore) UseTwoFactorCode(devID bson.ObjectId, last, counter int64) error {
+	return s.update("twofactor", bson.M{"_id": devID, "lastCounter": last}, bson.M{"lastCounter": counter})
+}
+
+// UseRecoveryCode swaps the codes for the ones left, as long as nothing's
+// changed them in between, since the memory store can't query inside a
+// list.
+func (s *MemoryStore) UseRecoveryCode(devID bson.ObjectId, hash string) error {
+	t, err := s.GetTwoFactor(devID)
+	if err != nil {
+		return err
+	}
+
+	left := []string{}
+	for _, code := range t.RecoveryCodes {
+		if code != hash {
+			left = append(left, code)
+		}
+	}
+	if len(left) == len(t.RecoveryCodes) {
+		return mgo.ErrNotFound
+	}
+
+	return s.update("twofactor", bson.M{"_id": devID, "recoveryCodes": t.RecoveryCodes}, bson.M{"recoveryCodes": left})
+}
+
+func (s *MemoryStore) SaveLoginChallenge(c *LoginChallenge) error {
+	prepareLoginChallenge(c)
+	return s.insert("challenges", c)
+}
+
+func (s *MemoryStore) GetLoginChallenge(token string) (*LoginChallenge, error) {
+	c := &LoginChallenge{}
+	err := s.findOne("challenges", bson.M{"tokenHash": HashToken(token)}, c)
+	if err == nil && !time.Now().Before(c.ExpiresAt) {
+		err = mgo.ErrNotFound
+	}
+
+	return c, err
+}
+
+func (s *MemoryStore) FailLoginChallenge(id bson.ObjectId, attempts int) error {
+	return s.update("challenges", bson.M{"_id": id, "attempts": attempts}, bson.M{"attempts": attempts + 1})
+}
+
+func (s *MemoryStore) RemoveLoginChallenge(id bson.ObjectId) error {
+	return s.remove("challenges", bson.M{"_id": id})
+}
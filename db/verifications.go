@@ -0,0 +1,46 @@
+// Copyright 2014 Bowery, Inc.
+package db
+
+import (
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Verification tracks whether a developer has confirmed their email address.
+// Developers without one signed up before verification and count as verified.
+type Verification struct {
+	DeveloperID bson.ObjectId `bson:"_id" json:"developerId"`
+	Email       string        `bson:"email" json:"email"`
+	Verified    bool          `bson:"verified" json:"verified"`
+	VerifiedAt  time.Time     `bson:"verifiedAt" json:"verifiedAt"`
+	SentAt      time.Time     `bson:"sentAt" json:"sentAt"`
+}
+
+// VerificationStore persists email verifications.
+type VerificationStore interface {
+	// SaveVerification inserts or replaces a developer's verification.
+	SaveVerification(v *Verification) error
+
+	// GetVerification returns a developer's verification.
+	GetVerification(devID bson.ObjectId) (*Verification, error)
+}
+
+func (s *MongoStore) SaveVerification(v *Verification) error {
+	_, err := s.db.C("verifications").UpsertId(v.DeveloperID, v)
+	return err
+}
+
+func (s *MongoStore) GetVerification(devID bson.ObjectId) (*Verification, error) {
+	v := &Verification{}
+	return v, s.db.C("verifications").FindId(devID).One(v)
+}
+
+func (s *MemoryStore) SaveVerification(v *Verification) error {
+	return s.upsert("verifications", bson.M{"_id": v.DeveloperID}, v)
+}
+
+func (s *MemoryStore) GetVerification(devID bson.ObjectId) (*Verification, error) {
+	v := &Verification{}
+	return v, s.findOne("verifications", bson.M{"_id": devID}, v)
+}
@@ -0,0 +1,319 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the OAuth2 device flow (RFC 8628), which signs in devices like
+// the crosby CLI through a browser instead of taking a password.
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// deviceGrantType is the grant_type a device polls for its session with.
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// The device flow's errors, from RFC 8628.
+const (
+	oauthAuthorizationPending = "authorization_pending"
+	oauthSlowDown             = "slow_down"
+	oauthExpiredToken         = "expired_token"
+	oauthUnauthorizedClient   = "unauthorized_client"
+)
+
+// User codes are typed in by hand, so they're short and use consonants
+// that can't be confused or spell words.
+const (
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLen      = 8
+)
+
+// maxDeviceName is the longest a device's name can be.
+const maxDeviceName = 100
+
+// slowDownStep is how much longer a device has to wait between polls each
+// time it's told to slow down.
+const slowDownStep = 5 * time.Second
+
+var errNoDevice = errors.New("That code is wrong or has expired.")
+
+// generateUserCode creates a random user code.
+func generateUserCode() (string, error) {
+	code := make([]byte, userCodeLen)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+// normalizeUserCode gets a user code as it's stored, ignoring case and the
+// dash it's shown with.
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+
+		return r
+	}, strings.ToUpper(code))
+}
+
+// formatUserCode gets a user code as it's shown, split in half so it's
+// easier to type.
+func formatUserCode(code string) string {
+	if len(code) != userCodeLen {
+		return code
+	}
+
+	return code[:userCodeLen/2] + "-" + code[userCodeLen/2:]
+}
+
+// renderDevice renders the page devices are approved on.
+func renderDevice(rw http.ResponseWriter, status int, data map[string]interface{}, err error) {
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+
+	rw.WriteHeader(status)
+	if err := RenderTemplate(rw, "device", data); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// pendingDevice gets the device waiting to be approved with a user code,
+// and the client it's signing in with. Returns errNoDevice if there isn't
+// one.
+func pendingDevice(userCode string) (*db.DeviceAuthorization, *db.OAuthClient, error) {
+	a, err := store.GetDeviceAuthorization(normalizeUserCode(userCode))
+	var client *db.OAuthClient
+	if err == nil {
+		client, err = store.GetOAuthClient(a.ClientID)
+	}
+	if err == nil && a.Status != db.DevicePending {
+		err = mgo.ErrNotFound
+	}
+	if err == mgo.ErrNotFound {
+		err = errNoDevice
+	}
+
+	return a, client, err
+}
+
+// renderDeviceError renders the device page for an error finding or
+// deciding on a device.
+func renderDeviceError(rw http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if err == errNoDevice {
+		status = http.StatusNotFound
+	}
+
+	renderDevice(rw, status, map[string]interface{}{}, err)
+}
+
+// exchangeDeviceCode answers a device polling for its session, creating
+// the session once the developer has approved it.
+func exchangeDeviceCode(rw http.ResponseWriter, req *http.Request, client *db.OAuthClient) {
+	now := time.Now()
+	a, err := store.PollDeviceAuthorization(req.PostFormValue("device_code"), now)
+	if err == nil && a.ClientID != client.ID {
+		err = mgo.ErrNotFound
+	}
+	if err == mgo.ErrNotFound {
+		renderOAuthError(rw, http.StatusBadRequest, &oauthError{oauthExpiredToken, "The device code is wrong or has expired."})
+		return
+	}
+	if err != nil {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Devices from before intervals were stored wait the configured one.
+	interval := a.Interval
+	if interval == 0 {
+		interval = conf.OAuth.DeviceInterval.Duration
+	}
+	if now.Sub(a.LastPolledAt) < interval {
+		err = store.SetDeviceInterval(a.ID, interval+slowDownStep)
+		if err != nil {
+			renderOAuthError(rw, http.StatusInternalServerError, err)
+			return
+		}
+
+		renderOAuthError(rw, http.StatusBadRequest, &oauthError{oauthSlowDown, "Polling too often."})
+		return
+	}
+
+	switch a.Status {
+	case db.DevicePending:
+		renderOAuthError(rw, http.StatusBadRequest, &oauthError{oauthAuthorizationPending, ""})
+		return
+	case db.DeviceDenied:
+		store.RemoveDeviceAuthorization(a.ID)
+		renderOAuthError(rw, http.StatusBadRequest, &oauthError{oauthAccessDenied, "The device wasn't approved."})
+		return
+	}
+
+	// Removing it first means only one poll gets the session.
+	err = store.RemoveDeviceAuthorization(a.ID)
+	if err == mgo.ErrNotFound {
+		renderOAuthError(rw, http.StatusBadRequest, &oauthError{oauthExpiredToken, "The device code has already been used."})
+		return
+	}
+
+	var d *schemas.Developer
+	if err == nil {
+		d, err = store.GetDeveloperById(a.DeveloperID.Hex())
+	}
+	var session *db.Session
+	if err == nil {
+		session, err = createSession(req, d, a.Name)
+	}
+	if err != nil {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"access_token": session.Token,
+		"token_type":   "Bearer",
+		"expires_in":   int(conf.Sessions.TTL.Seconds()),
+	})
+}
+
+// POST /oauth/device, starts signing in a device, returning the code the
+// developer types in at the verification page and the code the device
+// polls /oauth/token with
+func DeviceAuthorizationHandler(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+
+	client, err := authenticateClient(req)
+	if err != nil {
+		renderOAuthError(rw, http.StatusUnauthorized, err)
+		return
+	}
+	if !client.Devices {
+		renderOAuthError(rw, http.StatusBadRequest, &oauthError{oauthUnauthorizedClient, "The client can't sign in devices."})
+		return
+	}
+
+	name := strings.TrimSpace(req.PostFormValue("name"))
+	if name == "" {
+		name = client.Name
+	}
+	if len(name) > maxDeviceName {
+		name = name[:maxDeviceName]
+	}
+
+	userCode, err := generateUserCode()
+	if err != nil {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	now := time.Now()
+	a := &db.DeviceAuthorization{
+		DeviceCode: util.HashToken(),
+		UserCode:   userCode,
+		ClientID:   client.ID,
+		Name:       name,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(conf.OAuth.DeviceCodeTTL.Duration),
+		Interval:   conf.OAuth.DeviceInterval.Duration,
+	}
+	if err := store.SaveDeviceAuthorization(a); err != nil {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	verification := issuer() + "/device"
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"device_code":               a.DeviceCode,
+		"user_code":                 formatUserCode(a.UserCode),
+		"verification_uri":          verification,
+		"verification_uri_complete": verification + "?" + url.Values{"user_code": {formatUserCode(a.UserCode)}}.Encode(),
+		"expires_in":                int(conf.OAuth.DeviceCodeTTL.Seconds()),
+		"interval":                  int(conf.OAuth.DeviceInterval.Seconds()),
+	})
+}
+
+// GET /device, asks for the code a device shows, then for the developer to
+// log in and approve it
+func DeviceHandler(rw http.ResponseWriter, req *http.Request) {
+	userCode := req.FormValue("user_code")
+	if userCode == "" {
+		renderDevice(rw, http.StatusOK, map[string]interface{}{}, nil)
+		return
+	}
+
+	a, client, err := pendingDevice(userCode)
+	if err != nil {
+		renderDeviceError(rw, err)
+		return
+	}
+
+	renderDevice(rw, http.StatusOK, map[string]interface{}{
+		"Device":   a,
+		"Client":   client,
+		"UserCode": formatUserCode(a.UserCode),
+	}, nil)
+}
+
+// POST /device, logs the developer in and approves the device with the
+// code, or denies it
+func ApproveDeviceHandler(rw http.ResponseWriter, req *http.Request) {
+	a, client, err := pendingDevice(req.PostFormValue("user_code"))
+	if err != nil {
+		renderDeviceError(rw, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Device":   a,
+		"Client":   client,
+		"UserCode": formatUserCode(a.UserCode),
+		"Email":    req.PostFormValue("email"),
+	}
+
+	// Anyone with the code can deny it, approving it needs a login.
+	decision, devID := db.DeviceDenied, bson.ObjectId("")
+	if req.PostFormValue("decision") == "allow" {
+		d, status, err := checkFormLogin(req)
+		if err != nil {
+			renderDevice(rw, status, data, err)
+			return
+		}
+
+		decision, devID = db.DeviceApproved, d.ID
+	}
+
+	err = store.DecideDeviceAuthorization(a.ID, decision, devID)
+	if err == mgo.ErrNotFound {
+		err = errNoDevice
+	}
+	if err != nil {
+		renderDeviceError(rw, err)
+		return
+	}
+
+	renderDevice(rw, http.StatusOK, map[string]interface{}{
+		"Device":   a,
+		"Approved": decision == db.DeviceApproved,
+		"Done":     true,
+	}, nil)
+}
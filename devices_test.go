@@ -0,0 +1,212 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// deviceTest swaps in a device polling interval for a test, returning a
+// func restoring it.
+func deviceTest(interval time.Duration) func() {
+	shared := conf.OAuth.DeviceInterval
+	conf.OAuth.DeviceInterval.Duration = interval
+	return func() { conf.OAuth.DeviceInterval = shared }
+}
+
+// newDeviceClient registers a public client that signs in devices.
+func newDeviceClient(t *testing.T, admin *schemas.Developer) *db.OAuthClient {
+	res := staffRequest(t, admin, "POST", "/admin/clients", url.Values{
+		"name":    {"crosby"},
+		"public":  {"on"},
+		"devices": {"on"},
+	})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	body := struct{ Client *db.OAuthClient }{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+	return body.Client
+}
+
+// startDevice asks to sign in a device, returning the device and user
+// codes.
+func startDevice(t *testing.T, client *db.OAuthClient) (string, string) {
+	res := formRequest(t, "/oauth/device", client, url.Values{"client_id": {client.ID}, "name": {"byrd's laptop"}})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	body := map[string]interface{}{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+	if body["verification_uri"] != conf.URL+"/device" {
+		t.Error("device should be sent to the verification page, got", body)
+	}
+	return body["device_code"].(string), body["user_code"].(string)
+}
+
+// pollDevice polls for a device's session.
+func pollDevice(t *testing.T, client *db.OAuthClient, deviceCode string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	res := formRequest(t, "/oauth/token", client, url.Values{
+		"grant_type":  {deviceGrantType},
+		"client_id":   {client.ID},
+		"device_code": {deviceCode},
+	})
+
+	body := map[string]interface{}{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+	return res, body
+}
+
+// decideDevice logs in on the device page and allows or denies it.
+func decideDevice(t *testing.T, userCode, decision string) *httptest.ResponseRecorder {
+	return formRequest(t, "/device", nil, url.Values{
+		"user_code": {userCode},
+		"email":     {"byrd@bowery.io"},
+		"password":  {"java$cript"},
+		"decision":  {decision},
+	})
+}
+
+func TestDeviceFlow(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	defer deviceTest(time.Nanosecond)()
+	client := newDeviceClient(t, admin)
+
+	deviceCode, userCode := startDevice(t, client)
+	if res, body := pollDevice(t, client, deviceCode); res.Code != http.StatusBadRequest || body["error"] != oauthAuthorizationPending {
+		t.Error("device should wait for approval, got", res.Code, body)
+	}
+
+	// The code can be typed in without its dash, in any case.
+	typed := strings.ToLower(strings.Replace(userCode, "-", "", 1))
+	req, _ := http.NewRequest("GET", "http://broome.io/device?user_code="+typed, nil)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "byrd&#39;s laptop") {
+		t.Fatalf("device page should show the device, got %v", res.Code)
+	}
+
+	if res := decideDevice(t, typed, "allow"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	res, body := pollDevice(t, client, deviceCode)
+	if res.Code != http.StatusOK || body["token_type"] != "Bearer" {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	token := body["access_token"].(string)
+	if dev, code := currentDeveloper(token); code != http.StatusOK || dev.ID != admin.ID {
+		t.Fatal("device should get a session for the developer, got", code)
+	}
+
+	if res, body := pollDevice(t, client, deviceCode); body["error"] != oauthExpiredToken {
+		t.Error("device code should only be used once, got", res.Code, body)
+	}
+
+	var deviceID string
+	for _, session := range listSessions(t, token) {
+		if session.Name == "byrd's laptop" {
+			deviceID = session.ID.Hex()
+		}
+	}
+	if deviceID == "" {
+		t.Fatal("device should be listed as a named session")
+	}
+
+	req, _ = http.NewRequest("DELETE", "http://broome.io/developers/me/sessions/"+deviceID+"?token="+admin.Token, nil)
+	res = httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if _, code := currentDeveloper(token); code == http.StatusOK {
+		t.Error("revoked device should be signed out")
+	}
+}
+
+func TestDeviceDeny(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	defer deviceTest(time.Nanosecond)()
+	client := newDeviceClient(t, admin)
+
+	deviceCode, userCode := startDevice(t, client)
+	res := formRequest(t, "/device", nil, url.Values{"user_code": {userCode}, "decision": {"deny"}})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	if res, body := pollDevice(t, client, deviceCode); body["error"] != oauthAccessDenied {
+		t.Error("denied device shouldn't get a session, got", res.Code, body)
+	}
+
+	// A decided code can't be approved.
+	if res := decideDevice(t, userCode, "allow"); res.Code != http.StatusNotFound {
+		t.Error("denied code shouldn't be found, got", res.Code)
+	}
+}
+
+func TestDeviceLimits(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	defer deviceTest(time.Hour)()
+	client := newDeviceClient(t, admin)
+
+	deviceCode, userCode := startDevice(t, client)
+	pollDevice(t, client, deviceCode)
+	if _, body := pollDevice(t, client, deviceCode); body["error"] != oauthSlowDown {
+		t.Error("polling too often should slow down, got", body)
+	}
+
+	a, err := store.GetDeviceAuthorization(normalizeUserCode(userCode))
+	if err != nil || a.Interval != time.Hour+slowDownStep {
+		t.Error("slowing down should lengthen the device's interval, got", a.Interval, err)
+	}
+
+	res := formRequest(t, "/device", nil, url.Values{
+		"user_code": {userCode},
+		"email":     {"byrd@bowery.io"},
+		"password":  {"python"},
+		"decision":  {"allow"},
+	})
+	if res.Code != http.StatusUnauthorized {
+		t.Error("wrong password shouldn't approve the device, got", res.Code)
+	}
+
+	// Clients have to be allowed to sign in devices.
+	other := newClient(t, admin, true)
+	res = formRequest(t, "/oauth/device", other, url.Values{"client_id": {other.ID}})
+	if res.Code != http.StatusBadRequest {
+		t.Error("client without devices shouldn't sign them in, got", res.Code)
+	}
+}
+
+func TestDeviceSlowDown(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	defer deviceTest(50 * time.Millisecond)()
+	client := newDeviceClient(t, admin)
+
+	deviceCode, _ := startDevice(t, client)
+	pollDevice(t, client, deviceCode)
+	if _, body := pollDevice(t, client, deviceCode); body["error"] != oauthSlowDown {
+		t.Fatal("polling too often should slow down, got", body)
+	}
+
+	// Waiting the configured interval isn't enough once told to slow down.
+	time.Sleep(100 * time.Millisecond)
+	if _, body := pollDevice(t, client, deviceCode); body["error"] != oauthSlowDown {
+		t.Error("device should wait its slowed down interval, got", body)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 Bowery, Inc.
+// Contains dunning, retrying declined renewals until they're paid or the
+// license is downgraded.
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// Where a developer's license is in billing.
+const (
+	billingActive     = "active"
+	billingExpired    = "expired"
+	billingPastDue    = db.RenewalPastDue
+	billingDowngraded = db.RenewalDowngraded
+)
+
+// dun records a declined renewal, declined is always a card error, failing
+// to reach the provider isn't the developer's fault. The first decline
+// makes the renewal past due and starts the grace period, each one
+// schedules the next retry and tells the developer, and once the retries
+// run out the license is downgraded.
+func dun(d *schemas.Developer, r *db.Renewal, declined error, now time.Time) error {
+	dunning := conf.Billing.Dunning
+	if r.Status != db.RenewalPastDue {
+		r.Status = db.RenewalPastDue
+		r.FailedAt = now
+		r.GraceEndsAt = r.Expiration
+		if r.GraceEndsAt.Before(now) {
+			r.GraceEndsAt = now
+		}
+		r.GraceEndsAt = r.GraceEndsAt.Add(dunning.GracePeriod.Duration)
+	}
+
+	r.Declines++
+	r.Error = declined.Error()
+	if r.Declines > len(dunning.RetrySchedule) {
+		downgraded, err := downgrade(d, r, now)
+		if !downgraded || err != nil {
+			return err
+		}
+
+		return sendEmail(supportAddress, d, "account_downgraded", map[string]interface{}{
+			"name": d.Name,
+			"link": conf.URL + "/admin/signup/" + d.ID.Hex(),
+		})
+	}
+
+	r.NextAttemptAt = r.FailedAt.Add(dunning.RetrySchedule[r.Declines-1].Duration)
+	return sendEmail(supportAddress, d, "payment_failed", map[string]interface{}{
+		"name":        d.Name,
+		"nextAttempt": r.NextAttemptAt.Format("January 2"),
+		"graceEnds":   r.GraceEndsAt.Format("January 2"),
+		"link":        conf.URL + "/admin/signup/" + d.ID.Hex(),
+	})
+}
+
+// downgrade takes a developer off their paid plan once dunning is over,
+// canceling their subscription, and reports whether it did. The time
+// they've paid for isn't taken away. A subscription that can't be canceled
+// would keep billing a downgraded developer, so the renewal stays past due
+// with the error shown on /admin/dunning, and is tried again later.
+func downgrade(d *schemas.Developer, r *db.Renewal, now time.Time) (bool, error) {
+	sub, err := store.GetSubscription(d.ID)
+	if err != nil && err != mgo.ErrNotFound {
+		return false, err
+	}
+	if err == nil && sub.Status != db.SubscriptionCanceled {
+		providerSub, err := payments.CancelSubscription(sub.CustomerID)
+		if err != nil {
+			r.Error = "Unable to cancel subscription: " + err.Error()
+			r.NextAttemptAt = now.Add(renewalRetryDelay)
+			return false, nil
+		}
+
+		if _, err := syncSubscription(d, sub.CustomerID, providerSub); err != nil {
+			return false, err
+		}
+	}
+
+	r.Status = db.RenewalDowngraded
+	r.NextAttemptAt = time.Time{}
+	d.IsPaid = false
+	return true, store.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{"isPaid": d.IsPaid})
+}
+
+// billingStatus gets where a developer's license is in billing. Past due
+// licenses keep working until the returned end of their grace period.
+func billingStatus(d *schemas.Developer, now time.Time) (string, time.Time, error) {
+	r, err := store.GetRenewal(d.ID)
+	if err != nil && err != mgo.ErrNotFound {
+		return "", time.Time{}, err
+	}
+
+	// Renewals of an earlier expiration are over.
+	if err == nil && r.Expiration.Equal(d.Expiration) {
+		switch r.Status {
+		case db.RenewalPastDue:
+			return billingPastDue, r.GraceEndsAt, nil
+		case db.RenewalDowngraded:
+			return billingDowngraded, time.Time{}, nil
+		}
+	}
+
+	if d.Expiration.After(now) {
+		return billingActive, time.Time{}, nil
+	}
+	return billingExpired, time.Time{}, nil
+}
+
+// dunningAccount is a developer along with their renewal.
+type dunningAccount struct {
+	*schemas.Developer
+	Renewal *db.Renewal
+}
+
+// GET /admin/dunning, Lists the accounts in dunning, or with ?status=downgraded
+// the ones it's downgraded
+func DunningHandler(rw http.ResponseWriter, req *http.Request) {
+	status := req.FormValue("status")
+	if status == "" {
+		status = db.RenewalPastDue
+	}
+
+	renewals, err := store.GetRenewals(status)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	accounts := make([]*dunningAccount, 0, len(renewals))
+	for _, r := range renewals {
+		d, err := store.GetDeveloperById(r.DeveloperID.Hex())
+		if err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+
+		accounts = append(accounts, &dunningAccount{Developer: d, Renewal: r})
+	}
+
+	if err := RenderTemplate(rw, "dunning", map[string]interface{}{
+		"Status":   status,
+		"Statuses": []string{db.RenewalPastDue, db.RenewalDowngraded},
+		"Retries":  len(conf.Billing.Dunning.RetrySchedule),
+		"Accounts": accounts,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
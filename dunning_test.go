@@ -0,0 +1,289 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// queuedEmails counts the pending emails with a subject containing subject.
+func queuedEmails(t *testing.T, subject string) int {
+	pending, err := store.GetEmails(db.EmailPending)
+	if err != nil {
+		t.Fatal("Could not get emails:", err)
+	}
+
+	n := 0
+	for _, e := range pending {
+		if strings.Contains(e.Message.Subject, subject) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// accountStatus gets a developer's billing status.
+func accountStatus(t *testing.T, d *schemas.Developer) string {
+	d, err := store.GetDeveloperById(d.ID.Hex())
+	if err != nil {
+		t.Fatal("Could not get developer:", err)
+	}
+
+	res, err := newDeveloperRes(d)
+	if err != nil {
+		t.Fatal("Could not get account state:", err)
+	}
+
+	return res.BillingStatus
+}
+
+func TestDunning(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now().Truncate(time.Second)
+	d := legacyCustomer(t, fake, mock, payment.TestCardDeclined, now.Add(-time.Hour))
+	schedule := conf.Billing.Dunning.RetrySchedule
+
+	if _, err := renewLicenses(now); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := store.GetRenewal(d.ID)
+	if err != nil || r.Status != db.RenewalPastDue {
+		t.Fatal("declined renewal should be past due.", err)
+	}
+	if !r.NextAttemptAt.Equal(now.Add(schedule[0].Duration)) || !r.GraceEndsAt.Equal(now.Add(conf.Billing.Dunning.GracePeriod.Duration)) {
+		t.Error("retry and grace period not scheduled, got", r.NextAttemptAt, r.GraceEndsAt)
+	}
+	if status := accountStatus(t, d); status != billingPastDue {
+		t.Error("account should be past due, got", status)
+	}
+	if queuedEmails(t, "payment didn't go through") != 1 {
+		t.Error("developer should be told the payment failed.")
+	}
+
+	// The expired license works through the grace period.
+	if status := getSession(t, d); status != requests.StatusFound {
+		t.Error("past due license should be found, got", status)
+	}
+
+	for i, retry := range schedule {
+		if _, err := renewLicenses(now.Add(retry.Duration)); err != nil {
+			t.Fatal(err)
+		}
+
+		r, _ = store.GetRenewal(d.ID)
+		if r.Declines != i+2 {
+			t.Fatal("retry", i, "not made, got", r.Declines, "declines")
+		}
+	}
+
+	if r.Status != db.RenewalDowngraded || !r.NextAttemptAt.IsZero() {
+		t.Fatal("account should be downgraded after the last retry, got", r.Status)
+	}
+	if queuedEmails(t, "payment didn't go through") != len(schedule) || queuedEmails(t, "wasn't renewed") != 1 {
+		t.Error("developer should be emailed at each stage.")
+	}
+
+	d, _ = store.GetDeveloperById(d.ID.Hex())
+	if d.IsPaid || accountStatus(t, d) != billingDowngraded {
+		t.Error("developer should be downgraded.")
+	}
+	if status := getSession(t, d); status != requests.StatusExpired {
+		t.Error("downgraded license should be expired, got", status)
+	}
+
+	if _, err := renewLicenses(now.Add(30 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.GetRenewal(d.ID); again.Attempts != r.Attempts {
+		t.Error("downgraded account shouldn't be retried.")
+	}
+}
+
+func TestDunningRecovers(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now().Truncate(time.Second)
+	d := legacyCustomer(t, fake, mock, payment.TestCardDeclined, now.Add(time.Hour))
+
+	renewLicenses(now)
+	r, _ := store.GetRenewal(d.ID)
+
+	fake.SetCard(d.StripeToken, payment.TestCard)
+	if n, err := renewLicenses(r.NextAttemptAt); n != 1 || err != nil {
+		t.Fatal("retry with a working card should renew, got", n, err)
+	}
+	if status := accountStatus(t, d); status != billingActive {
+		t.Error("renewed account should be active, got", status)
+	}
+}
+
+func TestDunningSubscription(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+	defer func() { fake.Now = time.Now }()
+
+	if res := pay(t, mock.Token, paymentReq{StripeToken: payment.TestCard}); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	fake.SetCard(d.StripeToken, payment.TestCardDeclined)
+
+	// The provider's renewal is declined once the period ends, leaving the
+	// subscription unpaid.
+	now := d.Expiration
+	fake.Now = func() time.Time { return now }
+	if _, err := renewLicenses(now); err != nil {
+		t.Fatal(err)
+	}
+	if status := accountStatus(t, d); status != billingPastDue {
+		t.Fatal("account should be past due, got", status)
+	}
+
+	// Past due subscriptions are retried even though they aren't paid.
+	for _, retry := range conf.Billing.Dunning.RetrySchedule {
+		now = d.Expiration.Add(retry.Duration)
+		if _, err := renewLicenses(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if status := accountStatus(t, d); status != billingDowngraded {
+		t.Fatal("account should be downgraded, got", status)
+	}
+
+	customer, _ := fake.GetCustomer(d.StripeToken)
+	sub, _ := store.GetSubscription(d.ID)
+	if customer.Subscription.Status != payment.StatusCanceled || sub.Status != db.SubscriptionCanceled {
+		t.Error("downgrading should cancel the subscription.")
+	}
+}
+
+var errProviderDown = &payment.Error{Type: payment.APIError, Message: "stripe: Internal Server Error", Status: http.StatusInternalServerError}
+
+// providerDown fails to get customers, like Stripe having an outage.
+type providerDown struct {
+	payment.Provider
+}
+
+func (p *providerDown) GetCustomer(id string) (*payment.Customer, error) {
+	return nil, errProviderDown
+}
+
+// cancelDown fails to cancel subscriptions.
+type cancelDown struct {
+	payment.Provider
+}
+
+func (c *cancelDown) CancelSubscription(customerID string) (*payment.Subscription, error) {
+	return nil, errProviderDown
+}
+
+func TestDunningProviderDown(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now().Truncate(time.Second)
+	d := legacyCustomer(t, fake, mock, payment.TestCardDeclined, now.Add(-time.Hour))
+	renewLicenses(now)
+
+	// The provider failing isn't a decline, it's retried without emailing
+	// the developer or running out their retries.
+	payments = &providerDown{Provider: fake}
+	for _, retry := range conf.Billing.Dunning.RetrySchedule {
+		if _, err := renewLicenses(now.Add(retry.Duration)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, _ := store.GetRenewal(d.ID)
+	if r.Status != db.RenewalPastDue || r.Declines != 1 || r.Error != errProviderDown.Error() {
+		t.Error("outage shouldn't count as a decline, got", r.Status, r.Declines, r.Error)
+	}
+	if queuedEmails(t, "payment didn't go through") != 1 || queuedEmails(t, "wasn't renewed") != 0 {
+		t.Error("developer shouldn't be emailed about an outage.")
+	}
+}
+
+func TestDunningCancelFails(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+	defer func() { fake.Now = time.Now }()
+
+	if res := pay(t, mock.Token, paymentReq{StripeToken: payment.TestCard}); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	fake.SetCard(d.StripeToken, payment.TestCardDeclined)
+
+	now := d.Expiration
+	fake.Now = func() time.Time { return now }
+	if _, err := renewLicenses(now); err != nil {
+		t.Fatal(err)
+	}
+
+	schedule := conf.Billing.Dunning.RetrySchedule
+	for i, retry := range schedule {
+		if i == len(schedule)-1 {
+			payments = &cancelDown{Provider: fake}
+		}
+
+		now = d.Expiration.Add(retry.Duration)
+		if _, err := renewLicenses(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The developer isn't downgraded while they're still subscribed.
+	r, _ := store.GetRenewal(d.ID)
+	if status := accountStatus(t, d); status != billingPastDue || !strings.Contains(r.Error, "cancel") {
+		t.Fatal("account should stay past due until it's canceled, got", status, r.Error)
+	}
+	if queuedEmails(t, "wasn't renewed") != 0 {
+		t.Error("developer shouldn't be told they're downgraded.")
+	}
+
+	payments = fake
+	now = r.NextAttemptAt
+	if _, err := renewLicenses(now); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, _ := store.GetSubscription(d.ID)
+	if status := accountStatus(t, d); status != billingDowngraded || sub.Status != db.SubscriptionCanceled {
+		t.Error("account should be downgraded once it's canceled, got", status, sub.Status)
+	}
+}
+
+func TestDunningHandler(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now().Truncate(time.Second)
+	d := legacyCustomer(t, fake, mock, payment.TestCardDeclined, now.Add(time.Hour))
+	renewLicenses(now)
+
+	res := httptest.NewRecorder()
+	broomeServer(res, adminRequest(t, "GET", "/admin/dunning"))
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), d.Email) {
+		t.Errorf("past due account should be listed, got %v\tbody: %v", res.Code, res.Body)
+	}
+
+	res = httptest.NewRecorder()
+	broomeServer(res, adminRequest(t, "GET", "/admin/dunning?status=downgraded"))
+	if res.Code != http.StatusOK || strings.Contains(res.Body.String(), d.Email) {
+		t.Errorf("only downgraded accounts should be listed, got %v\tbody: %v", res.Code, res.Body)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the outbound email queue and its admin routes.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/mail"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/cenkalti/backoff"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// How often the queue is checked for emails that are due.
+	emailPollInterval = 5 * time.Second
+
+	// How long an email being sent is held from other workers.
+	emailLease = 5 * time.Minute
+
+	// How many times an email is tried before it's marked dead.
+	maxEmailAttempts = 8
+)
+
+var supportAddress = mail.Address{Email: "support@bowery.io", Name: "Bowery Support"}
+
+// emailSamples is the data each email is previewed with.
+var emailSamples = map[string]map[string]interface{}{
+	"welcome": {
+		"name":     "Steve",
+		"engineer": map[string]string{"Name": "David Byrd", "Email": "byrd@bowery.io"},
+	},
+	"reset_password": {
+		"name": "Steve",
+		"link": "http://broome.io/developers/reset/sample-token/52e7cc4308bcfd732f000028",
+	},
+	"verify": {
+		"name": "Steve",
+		"link": "http://broome.io/developers/verify/sample-token",
+	},
+	"invitation": {
+		"name":         "Steve",
+		"organization": "Bowery",
+		"role":         "member",
+		"link":         "http://broome.io/invitations/sample-token",
+	},
+	"payment_failed": {
+		"name":        "Steve",
+		"nextAttempt": "June 3",
+		"graceEnds":   "June 9",
+		"link":        "http://broome.io/admin/signup/52e7cc4308bcfd732f000028",
+	},
+	"account_downgraded": {
+		"name": "Steve",
+		"link": "http://broome.io/admin/signup/52e7cc4308bcfd732f000028",
+	},
+}
+
+// secretEmails have links that log in or accept something, so they're
+// redacted once they can't be sent.
+var secretEmails = map[string]bool{
+	"reset_password": true,
+	"verify":         true,
+	"invitation":     true,
+}
+
+// newMailer creates the mailer for the configured driver.
+func newMailer(c *config.MailConfig) (mail.Mailer, error) {
+	switch c.Driver {
+	case "mandrill":
+		return mail.NewMandrillMailer(conf.Mandrill.Key)
+	case "smtp":
+		return mail.NewSMTPMailer(c.SMTP.Addr, c.SMTP.Username, c.SMTP.Password)
+	case "dir":
+		return mail.NewDirMailer(c.Dir)
+	case "memory":
+		return mail.NewMemoryMailer(), nil
+	}
+
+	return nil, errors.New("unknown mail driver " + c.Driver)
+}
+
+// sendEmail renders the named email with data and queues it to be sent to a
+// developer.
+func sendEmail(from mail.Address, to *schemas.Developer, name string, data interface{}) error {
+	msg, err := RenderEmail(name, data)
+	if err != nil {
+		return err
+	}
+
+	msg.From = from
+	msg.To = []mail.Address{{Email: to.Email, Name: to.Name}}
+	return store.QueueEmail(&db.Email{Message: msg, Secret: secretEmails[name]})
+}
+
+// processEmails sends queued emails as they become due, forever.
+func processEmails() {
+	for _ = range time.Tick(emailPollInterval) {
+		if _, err := deliverEmails(); err != nil {
+			fmt.Fprintln(os.Stderr, "email:", err)
+		}
+	}
+}
+
+// deliverEmails tries every queued email that's due, returning how many
+// were sent.
+func deliverEmails() (int, error) {
+	sent := 0
+
+	for {
+		e, err := store.ClaimEmail(time.Now(), emailLease)
+		if err == mgo.ErrNotFound {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+
+		if err := deliverEmail(e); err != nil {
+			return sent, err
+		}
+		if e.Status == db.EmailSent {
+			sent++
+		}
+	}
+}
+
+// deliverEmail sends a claimed email, scheduling another attempt if it
+// fails or marking it dead once it's out of attempts. Sent emails are
+// redacted, and so are dead secret ones.
+func deliverEmail(e *db.Email) error {
+	err := mailer.Send(e.Message)
+	now := time.Now()
+
+	switch {
+	case err == nil:
+		e.Status = db.EmailSent
+		e.SentAt = now
+		e.LastError = ""
+		e.Redact()
+	case e.Attempts >= maxEmailAttempts:
+		e.Status = db.EmailDead
+		e.LastError = err.Error()
+		if e.Secret {
+			e.Redact()
+		}
+	default:
+		e.LastError = err.Error()
+		e.NextAttemptAt = now.Add(emailRetryDelay(e.Attempts))
+	}
+
+	return store.UpdateEmail(e)
+}
+
+// emailRetryDelay gets how long to wait after an email's nth failed attempt.
+func emailRetryDelay(attempts int) time.Duration {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 30 * time.Second
+	b.MaxInterval = 2 * time.Hour
+	b.MaxElapsedTime = 0
+
+	delay := b.InitialInterval
+	for i := 0; i < attempts; i++ {
+		delay = b.NextBackOff()
+	}
+
+	return delay
+}
+
+// GET /admin/emails, Admin interface for emails in the queue, by default the
+// dead ones
+func EmailsHandler(rw http.ResponseWriter, req *http.Request) {
+	status := req.FormValue("status")
+	if status == "" {
+		status = db.EmailDead
+	}
+
+	emails, err := store.GetEmails(status)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderTemplate(rw, "emails", map[string]interface{}{
+		"Status":   status,
+		"Statuses": []string{db.EmailPending, db.EmailSent, db.EmailDead},
+		"Previews": emailNames(),
+		"Emails":   emails,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// GET /admin/emails/preview/{name}, Renders an email with sample data, as
+// HTML or with ?format=text as plain text
+func PreviewEmailHandler(rw http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	data, ok := emailSamples[name]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		RenderTemplate(rw, "error", map[string]string{"Error": "no such email " + name})
+		return
+	}
+
+	msg, err := RenderEmail(name, data)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if req.FormValue("format") == "text" {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(rw, "Subject: %s\n\n%s\n", msg.Subject, msg.Text)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(rw, msg.HTML)
+}
+
+// emailNames gets the names of the emails that can be previewed.
+func emailNames() []string {
+	names := make([]string, 0, len(emailSamples))
+	for name := range emailSamples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// POST /admin/emails/{id}/retry, puts a dead email back in the queue
+func RetryEmailHandler(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid email id",
+		})
+		return
+	}
+
+	e, err := store.GetEmail(bson.ObjectIdHex(id))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == mgo.ErrNotFound {
+			status = http.StatusNotFound
+			err = errors.New("no such email")
+		}
+
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if e.Status != db.EmailDead {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "only dead emails can be retried",
+		})
+		return
+	}
+	if e.Redacted {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "this email's link was redacted, the developer has to ask for another",
+		})
+		return
+	}
+
+	e.Status = db.EmailPending
+	e.Attempts = 0
+	e.NextAttemptAt = time.Now()
+	if err := store.UpdateEmail(e); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"email":  e,
+	})
+}
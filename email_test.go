@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/mail"
+	"labix.org/v2/mgo/bson"
+)
+
+// failingMailer fails to send every email.
+type failingMailer struct{}
+
+func (m failingMailer) Send(msg *mail.Message) error {
+	return errors.New("mandrill is down")
+}
+
+// adminRequest creates a request authenticated as the mock developer.
+func adminRequest(t *testing.T, method, path string) *http.Request {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+
+	req, err := http.NewRequest(method, "http://broome.io"+path, nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	req.SetBasicAuth(mock.Token, "")
+
+	return req
+}
+
+func TestDeliverEmailsRetries(t *testing.T) {
+	working, shared := mailer, store
+	mailer, store = failingMailer{}, db.NewMemoryStore()
+	defer func() { mailer, store = working, shared }()
+
+	dev := signup(t, "retry@example.com")
+
+	// Delivery problems shouldn't be visible to the developer signing up.
+	if dev == nil {
+		t.Fatal("signup should succeed while email is failing.")
+	}
+
+	if _, err := deliverEmails(); err != nil {
+		t.Fatal("Could not deliver emails:", err)
+	}
+
+	pending, err := store.GetEmails(db.EmailPending)
+	if err != nil {
+		t.Fatal("Could not get emails:", err)
+	}
+	if len(pending) == 0 {
+		t.Fatal("failed emails should stay queued.")
+	}
+	for _, e := range pending {
+		if e.Attempts != 1 || e.LastError == "" || !e.NextAttemptAt.After(time.Now()) {
+			t.Error("failed email should be scheduled for another attempt.")
+		}
+	}
+
+	// Run through the rest of the attempts.
+	for _, e := range pending {
+		for e.Status == db.EmailPending {
+			e.Attempts++
+			if err := deliverEmail(e); err != nil {
+				t.Fatal("Could not deliver email:", err)
+			}
+		}
+
+		if e.Status != db.EmailDead || e.Attempts != maxEmailAttempts {
+			t.Error("email should be dead after", maxEmailAttempts, "attempts.")
+		}
+	}
+
+	// The verification link isn't kept, the welcome can still be retried.
+	var welcome, verify *db.Email
+	for _, e := range pending {
+		if e.Secret {
+			verify = e
+		} else {
+			welcome = e
+		}
+	}
+	if verify == nil || !verify.Redacted || verify.Message.HTML != "" || verify.Message.Text != "" {
+		t.Fatal("dead verification email should be redacted, got", verify)
+	}
+	if welcome == nil || welcome.Redacted || welcome.Message.HTML == "" {
+		t.Fatal("dead welcome email should be kept, got", welcome)
+	}
+
+	req := adminRequest(t, "GET", "/admin/emails")
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), welcome.Message.Subject) {
+		t.Fatalf("dead emails should be listed: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	mailer = working
+	req = adminRequest(t, "POST", "/admin/emails/"+verify.ID.Hex()+"/retry")
+	res = httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Error("redacted email shouldn't be retried, got", res.Code)
+	}
+
+	req = adminRequest(t, "POST", "/admin/emails/"+welcome.ID.Hex()+"/retry")
+	res = httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	if _, err := deliverEmails(); err != nil {
+		t.Fatal("Could not deliver emails:", err)
+	}
+
+	e, err := store.GetEmail(welcome.ID)
+	if err != nil {
+		t.Fatal("Could not get email:", err)
+	}
+	if e.Status != db.EmailSent || !e.Redacted || e.Message.HTML != "" || e.Message.Text != "" {
+		t.Error("retried email should be sent and redacted, got", e.Status, e.Redacted)
+	}
+}
+
+func TestRetryEmailHandlerNotDead(t *testing.T) {
+	e := &db.Email{Message: &mail.Message{Subject: "Hello"}}
+	if err := store.QueueEmail(e); err != nil {
+		t.Fatal("Could not queue email:", err)
+	}
+
+	for id, code := range map[string]int{
+		e.ID.Hex():               http.StatusBadRequest,
+		bson.NewObjectId().Hex(): http.StatusNotFound,
+	} {
+		req := adminRequest(t, "POST", "/admin/emails/"+id+"/retry")
+		res := httptest.NewRecorder()
+		broomeServer(res, req)
+		if res.Code != code {
+			t.Errorf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+		}
+	}
+}
+
+func TestEmailRetryDelay(t *testing.T) {
+	if emailRetryDelay(1) <= 0 || emailRetryDelay(6) <= emailRetryDelay(1) {
+		t.Error("retry delay should grow with each attempt.")
+	}
+}
+
+func TestRenderEmail(t *testing.T) {
+	for name, data := range emailSamples {
+		msg, err := RenderEmail(name, data)
+		if err != nil {
+			t.Fatal("Could not render", name, err)
+		}
+
+		if msg.Subject == "" || strings.Contains(msg.Subject, "\n") {
+			t.Error(name, "should have a one line subject, got", msg.Subject)
+		}
+		if !strings.Contains(msg.HTML, "support@bowery.io") || !strings.Contains(msg.Text, "support@bowery.io") {
+			t.Error(name, "should be wrapped in the email layouts.")
+		}
+		if strings.Contains(msg.Text, "<") {
+			t.Error(name, "text body shouldn't have html in it.")
+		}
+	}
+}
+
+func TestPreviewEmailHandler(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/admin/emails/preview/verify":             "<a href=\"http://broome.io/developers/verify/sample-token\">",
+		"/admin/emails/preview/verify?format=text": "Subject: Verify your Bowery email address",
+	} {
+		res := httptest.NewRecorder()
+		broomeServer(res, adminRequest(t, "GET", path))
+		if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), expected) {
+			t.Errorf("%s should have %s: %v\tbody: %v", path, expected, res.Code, res.Body)
+		}
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, adminRequest(t, "GET", "/admin/emails/preview/missing"))
+	if res.Code != http.StatusNotFound {
+		t.Error("Non-expected status code:", res.Code)
+	}
+}
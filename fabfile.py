@@ -20,8 +20,8 @@ def restart():
   with cd('/home/ubuntu/gocode/src/github.com/Bowery/' + project):
     run('git pull')
     sudo('GOPATH=/home/ubuntu/gocode go get -d')
-    sudo('GOPATH=/home/ubuntu/gocode go build')
     run('myth static/style.css static/out.css')
+    sudo('GOPATH=/home/ubuntu/gocode go build')
 
     sudo('cp -f ' + project + '.conf /etc/init/' + project + '.conf')
     sudo('initctl reload-configuration')
@@ -0,0 +1,168 @@
+// Copyright 2014 Bowery, Inc.
+// Contains JSON Web Tokens signed with RS256 (RFC 7519), and the JSON Web
+// Keys (RFC 7517) they're checked with.
+package jwt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Algorithm is the only signing algorithm used, it's the one every OpenID
+// Connect library supports.
+const Algorithm = "RS256"
+
+// keyBits is the size of generated keys.
+const keyBits = 2048
+
+var (
+	ErrMalformed  = errors.New("jwt: malformed token")
+	ErrAlgorithm  = errors.New("jwt: unsupported algorithm")
+	ErrUnknownKey = errors.New("jwt: signed by an unknown key")
+	ErrSignature  = errors.New("jwt: invalid signature")
+	ErrKey        = errors.New("jwt: invalid key")
+)
+
+var encoding = base64.RawURLEncoding
+
+// header is the first part of a token.
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// JWK is a public key in the form clients fetch to check tokens.
+type JWK struct {
+	Type      string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// NewJWK gets the JWK for a public key.
+func NewJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		Type:      "RSA",
+		Use:       "sig",
+		Algorithm: Algorithm,
+		KeyID:     kid,
+		N:         encoding.EncodeToString(key.N.Bytes()),
+		E:         encoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// PublicKey gets the public key a JWK is for.
+func (k JWK) PublicKey() (*rsa.PublicKey, error) {
+	n, err := encoding.DecodeString(k.N)
+	if err != nil || k.Type != "RSA" {
+		return nil, ErrKey
+	}
+	e, err := encoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, ErrKey
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// GenerateKey creates a new signing key.
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, keyBits)
+}
+
+// EncodePrivateKey encodes a signing key as PEM, so it can be stored.
+func EncodePrivateKey(key *rsa.PrivateKey) string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}))
+}
+
+// ParsePrivateKey decodes a signing key from EncodePrivateKey.
+func ParsePrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, ErrKey
+	}
+
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// Sign creates a token for claims, signed with key under the key ID kid.
+func Sign(key *rsa.PrivateKey, kid string, claims interface{}) (string, error) {
+	h, err := json.Marshal(header{Algorithm: Algorithm, Type: "JWT", KeyID: kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + encoding.EncodeToString(sig), nil
+}
+
+// Verify checks a token was signed by one of keys, by key ID, and decodes
+// its claims. Checking the claims themselves, like when it expires, is up
+// to the caller.
+func Verify(token string, keys map[string]*rsa.PublicKey, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformed
+	}
+
+	var h header
+	b, err := encoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(b, &h)
+	}
+	if err != nil {
+		return ErrMalformed
+	}
+	if h.Algorithm != Algorithm {
+		return ErrAlgorithm
+	}
+
+	key, ok := keys[h.KeyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrMalformed
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+		return ErrSignature
+	}
+
+	payload, err := encoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(payload, claims)
+	}
+	if err != nil {
+		return ErrMalformed
+	}
+
+	return nil
+}
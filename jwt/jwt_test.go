@@ -0,0 +1,70 @@
+// Copyright 2014 Bowery, Inc.
+package jwt
+
+import (
+	"crypto/rsa"
+	"strings"
+	"testing"
+)
+
+type testClaims struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email"`
+}
+
+func TestSignAndVerify(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := GenerateKey()
+
+	token, err := Sign(key, "a", testClaims{Subject: "52e7cc4308bcfd732f000028", Email: "byrd@bowery.io"})
+	if err != nil {
+		t.Fatal("Unable to sign token:", err)
+	}
+
+	// The key is found through its JWK, the way clients do.
+	pub, err := NewJWK("a", &key.PublicKey).PublicKey()
+	if err != nil {
+		t.Fatal("Unable to decode JWK:", err)
+	}
+
+	var claims testClaims
+	keys := map[string]*rsa.PublicKey{"a": pub, "b": &other.PublicKey}
+	if err := Verify(token, keys, &claims); err != nil {
+		t.Fatal("token didn't verify:", err)
+	}
+	if claims.Email != "byrd@bowery.io" {
+		t.Error("claims should be decoded, got", claims)
+	}
+
+	if err := Verify(token, map[string]*rsa.PublicKey{"b": &other.PublicKey}, &claims); err != ErrUnknownKey {
+		t.Error("unknown key id should fail, got", err)
+	}
+	if err := Verify(token, map[string]*rsa.PublicKey{"a": &other.PublicKey}, &claims); err != ErrSignature {
+		t.Error("wrong key should fail, got", err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged, _ := Sign(other, "a", testClaims{Subject: "x"})
+	if err := Verify(parts[0]+"."+strings.Split(forged, ".")[1]+"."+parts[2], keys, &claims); err != ErrSignature {
+		t.Error("changed claims should fail, got", err)
+	}
+}
+
+func TestPrivateKeyEncoding(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParsePrivateKey(EncodePrivateKey(key))
+	if err != nil || parsed.N.Cmp(key.N) != 0 {
+		t.Error("key should round trip, got", err)
+	}
+
+	if _, err := ParsePrivateKey("nope"); err != ErrKey {
+		t.Error("garbage shouldn't parse, got", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the signed licenses clients check offline.
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/broome/license"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+)
+
+// licenseKey signs the licenses broome issues.
+var licenseKey ed25519.PrivateKey
+
+// newLicenseKey gets the configured license key, or a random one if there
+// isn't one.
+func newLicenseKey(c *config.Config) (ed25519.PrivateKey, error) {
+	if c.License.PrivateKey == "" {
+		return license.GenerateKey()
+	}
+
+	return license.ParsePrivateKey(c.License.PrivateKey)
+}
+
+// issueLicense signs what an account is entitled to at now, returning an
+// empty license if it isn't entitled to anything. Licenses expire after
+// the configured TTL so clients refresh them, or sooner if the developer's
+// license or their organization's subscription ends first.
+func issueLicense(res *developerRes, now time.Time) (string, error) {
+	l := &license.License{
+		DeveloperID: res.ID.Hex(),
+		Seats:       1,
+		IssuedAt:    now.UTC().Truncate(time.Second),
+	}
+
+	// The developer's own license comes first, customers from before
+	// subscriptions have the renewal plan.
+	var end time.Time
+	var planID string
+	if o := res.payingOrganization(now); res.ownLicense(now) {
+		end = res.Expiration
+		if res.GraceEndsAt != nil {
+			end = *res.GraceEndsAt
+		}
+
+		planID = conf.Billing.RenewalPlan
+		if res.Subscription != nil {
+			planID = res.Subscription.PlanID
+			if res.Subscription.Quantity > 0 {
+				l.Seats = res.Subscription.Quantity
+			}
+		}
+	} else if o != nil {
+		end, planID = o.CurrentPeriodEnd, o.PlanID
+		if o.Seats > 0 {
+			l.Seats = o.Seats
+		}
+	} else {
+		return "", nil
+	}
+
+	l.ExpiresAt = l.IssuedAt.Add(conf.License.TTL.Duration)
+	if end.Before(l.ExpiresAt) {
+		l.ExpiresAt = end.UTC()
+	}
+	if plan, ok := conf.Billing.Plan(planID); ok {
+		l.Products = []string{plan.Product}
+	}
+
+	return license.Sign(licenseKey, l)
+}
+
+// licenseHolder gets the developer a request for a license is made by, from
+// the bearer token or the token param. Session tokens are taken as is, OAuth
+// access tokens need the license scope. A request without a token gives a
+// nil developer.
+func licenseHolder(req *http.Request) (*schemas.Developer, error) {
+	token := req.FormValue("token")
+	if auth := req.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		token = strings.TrimSpace(auth[7:])
+	}
+	if token == "" {
+		return nil, nil
+	}
+
+	d, _, sessionErr := developerByToken(token)
+	if sessionErr == nil {
+		return d, nil
+	}
+
+	t, err := store.GetOAuthToken(token)
+	if err == nil && !hasString(t.Scopes, "license") {
+		err = mgo.ErrNotFound
+	}
+	if err == nil {
+		d, err = store.GetDeveloperById(t.DeveloperID.Hex())
+	}
+	if err == mgo.ErrNotFound {
+		err = sessionErr
+	}
+
+	return d, err
+}
+
+// GET /license/key, Gets the public key licenses are signed with
+func LicenseKeyHandler(rw http.ResponseWriter, req *http.Request) {
+	pub := licenseKey.Public().(ed25519.PublicKey)
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status":    requests.StatusFound,
+		"keyId":     license.KeyID(pub),
+		"publicKey": license.EncodePublicKey(pub),
+	})
+}
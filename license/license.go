@@ -0,0 +1,201 @@
+// Copyright 2014 Bowery, Inc.
+// Contains signed license documents that can be checked offline.
+package license
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// version starts every document, it's part of what's signed.
+const version = "v1"
+
+var (
+	ErrMalformed  = errors.New("license: malformed document")
+	ErrUnknownKey = errors.New("license: signed by an unknown key")
+	ErrSignature  = errors.New("license: invalid signature")
+	ErrExpired    = errors.New("license: expired")
+	ErrProduct    = errors.New("license: product not included")
+	ErrDeveloper  = errors.New("license: issued to another developer")
+)
+
+// Client is used to refresh licenses.
+var Client = &http.Client{Timeout: 30 * time.Second}
+
+// License is what a developer is entitled to, until it expires.
+type License struct {
+	KeyID       string    `json:"keyId"`
+	DeveloperID string    `json:"developerId"`
+	Products    []string  `json:"products"`
+	Seats       int64     `json:"seats"`
+	IssuedAt    time.Time `json:"issuedAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// Entitled checks the license includes product and hasn't expired at now.
+func (l *License) Entitled(product string, now time.Time) error {
+	if !now.Before(l.ExpiresAt) {
+		return ErrExpired
+	}
+
+	for _, p := range l.Products {
+		if p == product {
+			return nil
+		}
+	}
+
+	return ErrProduct
+}
+
+// GenerateKey creates a new signing key.
+func GenerateKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// ParsePrivateKey decodes a base64 signing key, either its 32 byte seed or
+// the full 64 byte key.
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	}
+
+	return nil, errors.New("license: private key must be 32 or 64 bytes")
+}
+
+// EncodePublicKey encodes a public key as base64.
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// ParsePublicKey decodes a base64 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("license: public key must be 32 bytes")
+	}
+
+	return ed25519.PublicKey(b), nil
+}
+
+// KeyID identifies a public key, so documents can say which key to check
+// them with while keys are being replaced.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sign encodes l into a document signed by key. The document is the
+// version, the license as JSON and the signature, joined by dots.
+func Sign(key ed25519.PrivateKey, l *License) (string, error) {
+	l.KeyID = KeyID(key.Public().(ed25519.PublicKey))
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+
+	signed := version + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig := ed25519.Sign(key, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verify decodes a document, checking it's signed by one of keys. It doesn't
+// check what the license allows, use Entitled for that.
+func Verify(doc string, keys ...ed25519.PublicKey) (*License, error) {
+	parts := strings.Split(doc, ".")
+	if len(parts) != 3 || parts[0] != version {
+		return nil, ErrMalformed
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	l := &License{}
+	if err := json.Unmarshal(payload, l); err != nil {
+		return nil, ErrMalformed
+	}
+
+	for _, pub := range keys {
+		if KeyID(pub) != l.KeyID {
+			continue
+		}
+
+		if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+			return nil, ErrSignature
+		}
+		return l, nil
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// Refresh gets a new document for a developer from the broome at addr, and
+// verifies it with keys. token is the developer's session token or an OAuth
+// access token with the license scope, licenses aren't issued without one.
+// Clients keep the document to check offline until they can refresh it
+// again.
+func Refresh(addr, developerID, token string, keys ...ed25519.PublicKey) (string, *License, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/session/"+developerID, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := Client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	body := struct {
+		Status    string `json:"status"`
+		Error     string `json:"error"`
+		Developer struct {
+			License string `json:"license"`
+		} `json:"developer"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", nil, errors.New("license: " + body.Error)
+	}
+	if body.Developer.License == "" {
+		return "", nil, ErrExpired
+	}
+
+	l, err := Verify(body.Developer.License, keys...)
+	if err != nil {
+		return "", nil, err
+	}
+	if l.DeveloperID != developerID {
+		return "", nil, ErrDeveloper
+	}
+
+	return body.Developer.License, l, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2014 Bowery, Inc.
+package license
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLicense() *License {
+	now := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	return &License{
+		DeveloperID: "52e7cc4308bcfd732f000028",
+		Products:    []string{"crosby"},
+		Seats:       1,
+		IssuedAt:    now,
+		ExpiresAt:   now.AddDate(0, 0, 7),
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := GenerateKey()
+
+	doc, err := Sign(key, testLicense())
+	if err != nil {
+		t.Fatal("Unable to sign license:", err)
+	}
+
+	l, err := Verify(doc, other.Public().(ed25519.PublicKey), key.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal("license didn't verify:", err)
+	}
+	if l.DeveloperID != "52e7cc4308bcfd732f000028" || l.Seats != 1 {
+		t.Error("license not decoded, got", l)
+	}
+
+	if _, err := Verify(doc, other.Public().(ed25519.PublicKey)); err != ErrUnknownKey {
+		t.Error("license should need its own key, got", err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	key, _ := GenerateKey()
+	pub := key.Public().(ed25519.PublicKey)
+	doc, _ := Sign(key, testLicense())
+	parts := strings.Split(doc, ".")
+
+	// Claim another product under the same signature.
+	forged := testLicense()
+	forged.Products = []string{"crosby", "bowery"}
+	forgedDoc, _ := Sign(key, forged)
+	tampered := parts[0] + "." + strings.Split(forgedDoc, ".")[1] + "." + parts[2]
+
+	if _, err := Verify(tampered, pub); err != ErrSignature {
+		t.Error("tampered license should fail, got", err)
+	}
+	if _, err := Verify("v1.nope", pub); err != ErrMalformed {
+		t.Error("malformed license should fail, got", err)
+	}
+}
+
+func TestEntitled(t *testing.T) {
+	l := testLicense()
+
+	if err := l.Entitled("crosby", l.IssuedAt); err != nil {
+		t.Error("license should include crosby:", err)
+	}
+	if err := l.Entitled("bowery", l.IssuedAt); err != ErrProduct {
+		t.Error("license shouldn't include bowery, got", err)
+	}
+	if err := l.Entitled("crosby", l.ExpiresAt); err != ErrExpired {
+		t.Error("license should expire, got", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key, _ := GenerateKey()
+
+	parsed, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(key.Seed()))
+	if err != nil || !parsed.Equal(key) {
+		t.Error("seed should parse to the same key:", err)
+	}
+
+	pub, err := ParsePublicKey(EncodePublicKey(key.Public().(ed25519.PublicKey)))
+	if err != nil || !pub.Equal(key.Public()) {
+		t.Error("public key should round trip:", err)
+	}
+
+	if _, err := ParsePublicKey(base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+		t.Error("short public key should fail.")
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	key, _ := GenerateKey()
+	l := testLicense()
+	l.ExpiresAt = time.Now().Add(time.Hour)
+	doc, _ := Sign(key, l)
+
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auth = req.Header.Get("Authorization")
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"status":    "found",
+			"developer": map[string]string{"license": doc},
+		})
+	}))
+	defer server.Close()
+	pub := key.Public().(ed25519.PublicKey)
+
+	if _, got, err := Refresh(server.URL, l.DeveloperID, "session-token", pub); err != nil || got.DeveloperID != l.DeveloperID {
+		t.Fatal("license should refresh, got", got, err)
+	}
+	if auth != "Bearer session-token" {
+		t.Error("refresh should send the token, got", auth)
+	}
+
+	// A valid license for someone else isn't the developer's.
+	if _, _, err := Refresh(server.URL, "52e7cc4308bcfd732f000029", "session-token", pub); err != ErrDeveloper {
+		t.Error("license for another developer should be rejected, got", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/license"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// publicLicenseKey gets the key licenses are signed with from broome.
+func publicLicenseKey(t *testing.T) ed25519.PublicKey {
+	req, err := http.NewRequest("GET", "http://broome.io/license/key", nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	body := map[string]string{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+
+	pub, err := license.ParsePublicKey(body["publicKey"])
+	if err != nil || body["keyId"] != license.KeyID(pub) {
+		t.Fatal("Could not parse public key:", err)
+	}
+
+	return pub
+}
+
+func TestSessionLicense(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	server := httptest.NewServer(http.HandlerFunc(broomeServer))
+	defer server.Close()
+	pub := publicLicenseKey(t)
+
+	d := legacyCustomer(t, fake, mock, payment.TestCard, time.Now().Add(30*24*time.Hour))
+	doc, l, err := license.Refresh(server.URL, d.ID.Hex(), d.Token, pub)
+	if err != nil {
+		t.Fatal("Could not refresh license:", err)
+	}
+	if l.DeveloperID != d.ID.Hex() || l.Seats != 1 || l.Entitled("crosby", time.Now()) != nil {
+		t.Error("license doesn't match the account, got", l)
+	}
+
+	// Licenses are refreshed before the account expires.
+	if l.ExpiresAt.After(time.Now().Add(conf.License.TTL.Duration)) {
+		t.Error("license should expire after the TTL, got", l.ExpiresAt)
+	}
+	if _, err := license.Verify(doc, pub); err != nil {
+		t.Error("license should verify offline:", err)
+	}
+
+	d = legacyCustomer(t, fake, mock, payment.TestCard, time.Now().Add(-time.Hour))
+	if _, _, err := license.Refresh(server.URL, d.ID.Hex(), mock.Token, pub); err != license.ErrExpired {
+		t.Error("expired account shouldn't get a license, got", err)
+	}
+}
+
+// sessionLicense gets the session info for a developer with a bearer
+// token, returning the status code and the developer in the response.
+func sessionLicense(t *testing.T, d *schemas.Developer, token string) (int, map[string]interface{}) {
+	req, err := http.NewRequest("GET", "http://broome.io/session/"+d.ID.Hex(), nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	body := struct {
+		Developer map[string]interface{} `json:"developer"`
+	}{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+	return res.Code, body.Developer
+}
+
+func TestSessionLicenseAuth(t *testing.T) {
+	fake, admin, done := billingTest(t)
+	defer done()
+
+	d := legacyCustomer(t, fake, admin, payment.TestCard, time.Now().Add(30*24*time.Hour))
+	code, dev := sessionLicense(t, d, "")
+	if code != http.StatusOK || dev["license"] != d.License || dev["billingStatus"] != nil || dev["organizations"] != nil {
+		t.Error("anonymous request should only get the developer, got", code, dev)
+	}
+	if dev["token"] != nil || dev["password"] != nil {
+		t.Error("anonymous request shouldn't get the developer's credentials, got", dev)
+	}
+
+	if code, dev = sessionLicense(t, d, d.Token); code != http.StatusOK || dev["license"] == nil {
+		t.Error("developer should get their license, got", code, dev)
+	}
+
+	other := newDeveloper(t, "other@bowery.io")
+	if code, _ = sessionLicense(t, d, other.Token); code != http.StatusForbidden {
+		t.Error("other developers shouldn't get the license, got", code)
+	}
+	if code, _ = sessionLicense(t, d, "nope"); code != http.StatusUnauthorized {
+		t.Error("unknown token should be unauthorized, got", code)
+	}
+
+	// OAuth clients need the license scope.
+	client := newClient(t, admin, true, "profile", "license")
+	code, _ = sessionLicense(t, d, oauthAccessToken(t, client, "profile"))
+	if code != http.StatusUnauthorized {
+		t.Error("token without the license scope shouldn't get the license, got", code)
+	}
+	if code, dev = sessionLicense(t, d, oauthAccessToken(t, client, "license")); code != http.StatusOK || dev["license"] == nil {
+		t.Error("token with the license scope should get the license, got", code, dev)
+	}
+}
+
+// oauthAccessToken gets an access token for the developer logging in on the
+// consent page, with the given scope.
+func oauthAccessToken(t *testing.T, client *db.OAuthClient, scope string) string {
+	values := authorizeValues(client)
+	values.Set("scope", scope)
+	code := authorize(t, values, "allow").Query().Get("code")
+	_, token := exchange(t, client, code, testVerifier)
+
+	access, _ := token["access_token"].(string)
+	return access
+}
+
+func TestSubscriptionLicense(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+
+	server := httptest.NewServer(http.HandlerFunc(broomeServer))
+	defer server.Close()
+
+	if res := pay(t, mock.Token, paymentReq{StripeToken: payment.TestCard}); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	_, l, err := license.Refresh(server.URL, mock.ID.Hex(), mock.Token, publicLicenseKey(t))
+	if err != nil {
+		t.Fatal("Could not refresh license:", err)
+	}
+	if l.Entitled("bowery", time.Now()) != nil || l.Entitled("crosby", time.Now()) != license.ErrProduct {
+		t.Error("license should be for the subscribed product, got", l.Products)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the throttling of failed logins, for each account and each
+// address.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/broome/password"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	errInvalidLogin = errors.New("Invalid email or password.")
+	errLoginLimit   = errors.New("Too many failed logins, try again later.")
+)
+
+var (
+	// dummyHash is checked against when there's no developer for an email,
+	// so a login takes as long whether or not the email exists.
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// loginLimit is a key failed logins are counted under, and how many it's
+// allowed.
+type loginLimit struct {
+	key   string
+	limit config.LoginLimit
+}
+
+// loginLimits gets the keys a login for email is counted under, the account
+// and the address it's from.
+func loginLimits(req *http.Request, email string) []loginLimit {
+	return []loginLimit{
+		{"account:" + accountKey(email), conf.Login.Account},
+		{"ip:" + remoteIP(req), conf.Login.IP},
+	}
+}
+
+// accountKey is the part of the key for an email's account, ignoring case
+// so the same account can't be guessed at under different spellings.
+func accountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginWait gets how long until a login can be tried again, zero if it can
+// be tried now. Each failure past the free ones doubles the wait.
+func loginWait(req *http.Request, email string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	for _, l := range loginLimits(req, email) {
+		a, err := store.GetLoginAttempts(l.key)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		next := a.LockedUntil
+		if a.Failures >= l.limit.FreeFailures {
+			delay := conf.Login.Delay.Duration
+			for i := l.limit.FreeFailures; i < a.Failures && delay < conf.Login.MaxDelay.Duration; i++ {
+				delay *= 2
+			}
+			if delay > conf.Login.MaxDelay.Duration {
+				delay = conf.Login.MaxDelay.Duration
+			}
+
+			if a.LastFailure.Add(delay).After(next) {
+				next = a.LastFailure.Add(delay)
+			}
+		}
+
+		if next.Sub(now) > wait {
+			wait = next.Sub(now)
+		}
+	}
+
+	return wait, nil
+}
+
+// failLogin counts a failed login, locking the account or address once it
+// has too many. Errors are logged since the login has failed either way.
+func failLogin(req *http.Request, email string, now time.Time) {
+	for _, l := range loginLimits(req, email) {
+		a, err := store.FailLogin(l.key, now, now.Add(conf.Login.Lockout.Duration))
+		if err == nil && a.Failures >= l.limit.MaxFailures {
+			err = store.LockLogin(l.key, now.Add(conf.Login.Lockout.Duration))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "login throttle:", err)
+		}
+	}
+}
+
+// succeedLogin forgets an account's failed logins once it's logged in to,
+// after the two-factor code if it's on. The address keeps its failures, so
+// logging in to one account doesn't allow more guesses at others.
+func succeedLogin(email string) {
+	err := store.RemoveLoginAttempts("account:" + accountKey(email))
+	if err != nil && err != mgo.ErrNotFound {
+		fmt.Fprintln(os.Stderr, "login throttle:", err)
+	}
+}
+
+// checkLogin checks an email and password, counting a failure towards the
+// limits. A missing developer and a wrong password both give
+// errInvalidLogin, so it doesn't show which emails have accounts. A
+// positive wait means the login was throttled and the password wasn't
+// checked. The password is only part of the login, so callers call
+// succeedLogin once the rest of it, like a two-factor code, has passed.
+func checkLogin(req *http.Request, email, pass string) (*schemas.Developer, time.Duration, error) {
+	now := time.Now()
+	wait, err := loginWait(req, email, now)
+	if err != nil || wait > 0 {
+		return nil, wait, err
+	}
+
+	d, err := store.GetDeveloper(bson.M{"email": email})
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, 0, err
+	}
+	if err == mgo.ErrNotFound {
+		checkNoDeveloper(pass)
+	}
+
+	if err != nil || d.ID == "" || !checkPassword(d, pass) {
+		failLogin(req, email, now)
+		return nil, 0, errInvalidLogin
+	}
+
+	return d, 0, nil
+}
+
+// checkNoDeveloper spends the time checking a password would, for a login
+// to an email with no developer.
+func checkNoDeveloper(pass string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = password.Hash("broome")
+	})
+
+	password.Verify(pass, dummyHash, "")
+}
+
+// renderLoginLimit writes the response for a throttled login, along with
+// when it can be tried again.
+func renderLoginLimit(rw http.ResponseWriter, wait time.Duration) {
+	rw.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	renderer.JSON(rw, http.StatusTooManyRequests, map[string]string{
+		"status": requests.StatusFailed,
+		"error":  errLoginLimit.Error(),
+	})
+}
+
+// POST /admin/developers/{token}/unlock, forgets a developer's failed
+// logins so they can log in straight away
+func UnlockDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
+	d, err := store.GetDeveloper(map[string]interface{}{"token": mux.Vars(req)["token"]})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == mgo.ErrNotFound {
+			status = http.StatusNotFound
+			err = errors.New("no such developer")
+		}
+
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	err = store.RemoveLoginAttempts("account:" + accountKey(d.Email))
+	if err != nil && err != mgo.ErrNotFound {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
@@ -0,0 +1,201 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/gopackages/requests"
+)
+
+// loginTest swaps in login limits for a test, returning a func restoring
+// them.
+func loginTest(login config.LoginConfig) func() {
+	shared := conf.Login
+	conf.Login = login
+	return func() { conf.Login = shared }
+}
+
+// testProxy is the trusted proxy the tests log in through.
+const testProxy = "192.0.2.1"
+
+// loginFrom logs in from an address, through the trusted proxy.
+func loginFrom(t *testing.T, ip, email, pass string) *httptest.ResponseRecorder {
+	return loginVia(t, testProxy, ip, email, pass)
+}
+
+// loginVia logs in from a peer, with the X-Forwarded-For it sends.
+func loginVia(t *testing.T, peer, forwarded, email, pass string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(requests.LoginReq{Email: email, Password: pass})
+	req, err := http.NewRequest("POST", "http://broome.io/developers/token", &buf)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	req.RemoteAddr = peer + ":41234"
+	req.Header.Set("X-Forwarded-For", forwarded)
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	return res
+}
+
+func TestLoginUniformErrors(t *testing.T) {
+	_, _, done := billingTest(t)
+	defer done()
+
+	missing := loginFrom(t, "10.0.0.1", "nobody@bowery.io", "java$cript")
+	wrong := loginFrom(t, "10.0.0.1", "byrd@bowery.io", "python")
+	if missing.Code != http.StatusUnauthorized || wrong.Code != missing.Code {
+		t.Error("failed logins should be unauthorized, got", missing.Code, wrong.Code)
+	}
+	if missing.Body.String() != wrong.Body.String() {
+		t.Errorf("failed logins should look the same, got %q and %q", missing.Body, wrong.Body)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	defer loginTest(config.LoginConfig{
+		Account:  config.LoginLimit{FreeFailures: 2, MaxFailures: 4},
+		IP:       config.LoginLimit{FreeFailures: 100, MaxFailures: 200},
+		Delay:    config.Duration{time.Hour},
+		MaxDelay: config.Duration{time.Hour},
+		Lockout:  config.Duration{time.Hour},
+	})()
+
+	for i := 0; i < 2; i++ {
+		if res := loginFrom(t, "10.0.0.1", "byrd@bowery.io", "python"); res.Code != http.StatusUnauthorized {
+			t.Fatal("free failures shouldn't wait, got", res.Code)
+		}
+	}
+
+	res := loginFrom(t, "10.0.0.1", "BYRD@bowery.io", "java$cript")
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "3600" {
+		t.Errorf("login should wait after the free failures, got %v, retry after %q", res.Code, res.Header().Get("Retry-After"))
+	}
+
+	// Other accounts aren't slowed down.
+	d := newDeveloper(t, "steve@bowery.io")
+	if res := loginFrom(t, "10.0.0.1", d.Email, "python"); res.Code != http.StatusUnauthorized {
+		t.Error("other accounts shouldn't wait, got", res.Code)
+	}
+
+	res = staffRequest(t, admin, "POST", adminPath(t, admin)+"/unlock", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if res := loginFrom(t, "10.0.0.1", "byrd@bowery.io", "java$cript"); res.Code != http.StatusOK {
+		t.Error("unlocked account should log in, got", res.Code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	defer loginTest(config.LoginConfig{
+		Account:  config.LoginLimit{FreeFailures: 1, MaxFailures: 3},
+		IP:       config.LoginLimit{FreeFailures: 100, MaxFailures: 200},
+		Delay:    config.Duration{time.Nanosecond},
+		MaxDelay: config.Duration{time.Nanosecond},
+		Lockout:  config.Duration{time.Hour},
+	})()
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond)
+		if res := loginFrom(t, "10.0.0.1", "byrd@bowery.io", "python"); res.Code != http.StatusUnauthorized {
+			t.Fatal("failures before the lockout should be unauthorized, got", res.Code)
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	if res := loginFrom(t, "10.0.0.2", "byrd@bowery.io", "java$cript"); res.Code != http.StatusTooManyRequests {
+		t.Error("locked account shouldn't log in from anywhere, got", res.Code)
+	}
+	req, _ := http.NewRequest("GET", "http://broome.io/admin", nil)
+	if ok, _ := AuthHandler(req, "byrd@bowery.io", "java$cript"); ok {
+		t.Error("locked account shouldn't pass basic auth")
+	}
+
+	check, _ := jsonRequest(t, "POST", "/developers/check-admin", requests.LoginReq{Email: "byrd@bowery.io", Password: "java$cript"})
+	if check.Code != http.StatusTooManyRequests {
+		t.Error("locked account shouldn't pass check-admin, got", check.Code)
+	}
+
+	// Tokens still work, so staff can unlock their own account.
+	res := staffRequest(t, admin, "POST", adminPath(t, admin)+"/unlock", nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if res := loginFrom(t, "10.0.0.1", "byrd@bowery.io", "java$cript"); res.Code != http.StatusOK {
+		t.Error("unlocked account should log in, got", res.Code)
+	}
+}
+
+func TestLoginIPLockout(t *testing.T) {
+	_, _, done := billingTest(t)
+	defer done()
+	defer loginTest(config.LoginConfig{
+		Account:  config.LoginLimit{FreeFailures: 100, MaxFailures: 200},
+		IP:       config.LoginLimit{FreeFailures: 2, MaxFailures: 3},
+		Delay:    config.Duration{time.Nanosecond},
+		MaxDelay: config.Duration{time.Nanosecond},
+		Lockout:  config.Duration{time.Hour},
+	})()
+
+	for _, email := range []string{"a@bowery.io", "b@bowery.io", "c@bowery.io"} {
+		time.Sleep(time.Millisecond)
+		if res := loginFrom(t, "10.0.0.1", email, "python"); res.Code != http.StatusUnauthorized {
+			t.Fatal("failures before the lockout should be unauthorized, got", res.Code)
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	if res := loginFrom(t, "10.0.0.1", "byrd@bowery.io", "java$cript"); res.Code != http.StatusTooManyRequests {
+		t.Error("locked address shouldn't log in, got", res.Code)
+	}
+	if res := loginFrom(t, "10.0.0.2", "byrd@bowery.io", "java$cript"); res.Code != http.StatusOK {
+		t.Error("other addresses should log in, got", res.Code)
+	}
+}
+
+func TestLoginForwardedFor(t *testing.T) {
+	_, _, done := billingTest(t)
+	defer done()
+	defer loginTest(config.LoginConfig{
+		Account:  config.LoginLimit{FreeFailures: 100, MaxFailures: 200},
+		IP:       config.LoginLimit{FreeFailures: 2, MaxFailures: 3},
+		Delay:    config.Duration{time.Nanosecond},
+		MaxDelay: config.Duration{time.Nanosecond},
+		Lockout:  config.Duration{time.Hour},
+	})()
+
+	for _, email := range []string{"a@bowery.io", "b@bowery.io", "c@bowery.io"} {
+		time.Sleep(time.Millisecond)
+		if res := loginFrom(t, "10.0.0.1", email, "python"); res.Code != http.StatusUnauthorized {
+			t.Fatal("failures before the lockout should be unauthorized, got", res.Code)
+		}
+	}
+
+	// Only the hop the trusted proxy saw counts, whatever the client sends.
+	time.Sleep(time.Millisecond)
+	for _, c := range []struct {
+		name, peer, forwarded string
+		code                  int
+	}{
+		{"untrusted peer", "10.0.0.1", "10.0.0.2", http.StatusTooManyRequests},
+		{"spoofed hop", testProxy, "10.0.0.2, 10.0.0.1", http.StatusTooManyRequests},
+		{"trusted hop", testProxy, "10.0.0.2, 10.0.0.1, " + testProxy, http.StatusTooManyRequests},
+		{"other address", testProxy, "10.0.0.1, 10.0.0.2", http.StatusOK},
+	} {
+		if res := loginVia(t, c.peer, c.forwarded, "byrd@bowery.io", "java$cript"); res.Code != c.code {
+			t.Error(c.name, "should get", c.code, "got", res.Code)
+		}
+	}
+}
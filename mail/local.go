@@ -0,0 +1,100 @@
+// Copyright 2014 Bowery, Inc.
+package mail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DirMailer writes each email to a directory instead of sending it, as an
+// .eml file that mail clients can open and a .json file with its fields.
+type DirMailer struct {
+	dir   string
+	mutex sync.Mutex
+	count int
+}
+
+// NewDirMailer creates a DirMailer writing to dir, creating it if needed.
+func NewDirMailer(dir string) (*DirMailer, error) {
+	if err := os.MkdirAll(dir, os.ModePerm|os.ModeDir); err != nil {
+		return nil, err
+	}
+
+	return &DirMailer{dir: dir}, nil
+}
+
+func (m *DirMailer) Send(msg *Message) error {
+	m.mutex.Lock()
+	m.count++
+	name := time.Now().Format("20060102T150405.000") + "-" + strconv.Itoa(m.count)
+	m.mutex.Unlock()
+
+	data, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(m.dir, name)
+	if err := ioutil.WriteFile(path+".json", data, 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path+".eml", msg.Bytes(), 0644)
+}
+
+// MemoryMailer records every email it's asked to send.
+type MemoryMailer struct {
+	mutex    sync.Mutex
+	messages []*Message
+}
+
+// NewMemoryMailer creates an empty MemoryMailer.
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{messages: []*Message{}}
+}
+
+func (m *MemoryMailer) Send(msg *Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	copied := *msg
+	m.messages = append(m.messages, &copied)
+	return nil
+}
+
+// Messages gets the emails sent so far, oldest first.
+func (m *MemoryMailer) Messages() []*Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]*Message{}, m.messages...)
+}
+
+// Last gets the most recent email sent to an address, or nil.
+func (m *MemoryMailer) Last(email string) *Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		for _, to := range m.messages[i].To {
+			if to.Email == email {
+				return m.messages[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reset forgets every email sent so far.
+func (m *MemoryMailer) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.messages = []*Message{}
+}
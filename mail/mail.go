@@ -0,0 +1,104 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the mailers used to send email.
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Address is an email recipient or sender.
+type Address struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// String formats the address for a message header.
+func (a Address) String() string {
+	return (&mail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+// Message is a single email, with an HTML body and an optional plain text
+// alternative.
+type Message struct {
+	From    Address   `json:"from"`
+	To      []Address `json:"to"`
+	Subject string    `json:"subject"`
+	HTML    string    `json:"html"`
+	Text    string    `json:"text"`
+}
+
+// Recipients gets the email addresses the message is sent to.
+func (m *Message) Recipients() []string {
+	emails := make([]string, len(m.To))
+	for i, to := range m.To {
+		emails[i] = to.Email
+	}
+
+	return emails
+}
+
+// Bytes encodes the message in RFC 822 format, with a multipart body if it
+// has both HTML and text.
+func (m *Message) Bytes() []byte {
+	var buf bytes.Buffer
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		to[i] = addr.String()
+	}
+
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if m.Text == "" || m.HTML == "" {
+		contentType, body := "text/html", m.HTML
+		if m.HTML == "" {
+			contentType, body = "text/plain", m.Text
+		}
+
+		writePart(&buf, contentType, body)
+		return buf.Bytes()
+	}
+
+	boundary := newBoundary()
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	writePart(&buf, "text/plain", m.Text)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	writePart(&buf, "text/html", m.HTML)
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+
+	return buf.Bytes()
+}
+
+// writePart writes the headers and quoted-printable body of a single part.
+func writePart(buf *bytes.Buffer, contentType, body string) {
+	fmt.Fprintf(buf, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(buf)
+	qp.Write([]byte(body))
+	qp.Close()
+}
+
+// newBoundary generates a random multipart boundary.
+func newBoundary() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(msg *Message) error
+}
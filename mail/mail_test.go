@@ -0,0 +1,103 @@
+// Copyright 2014 Bowery, Inc.
+package mail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testMessage() *Message {
+	return &Message{
+		From:    Address{Email: "support@bowery.io", Name: "Bowery Support"},
+		To:      []Address{{Email: "steve@bowery.io", Name: "Steve Kaliski"}},
+		Subject: "Hello",
+		HTML:    "<p>Hello Steve</p>",
+		Text:    "Hello Steve",
+	}
+}
+
+func TestBytesMultipart(t *testing.T) {
+	data := string(testMessage().Bytes())
+
+	for _, expected := range []string{
+		"From: \"Bowery Support\" <support@bowery.io>\r\n",
+		"To: \"Steve Kaliski\" <steve@bowery.io>\r\n",
+		"Content-Type: multipart/alternative; boundary=",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Type: text/html; charset=utf-8",
+		"<p>Hello Steve</p>",
+	} {
+		if !strings.Contains(data, expected) {
+			t.Error("message missing", expected)
+		}
+	}
+}
+
+func TestBytesHTMLOnly(t *testing.T) {
+	msg := testMessage()
+	msg.Text = ""
+	data := string(msg.Bytes())
+
+	if strings.Contains(data, "multipart") {
+		t.Error("html only message shouldn't be multipart")
+	}
+	if !strings.Contains(data, "Content-Type: text/html; charset=utf-8") {
+		t.Error("html only message should be text/html")
+	}
+}
+
+func TestDirMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broome-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mailer, err := NewDirMailer(filepath.Join(dir, "mail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mailer.Send(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.Send(testMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{"*.eml", "*.json"} {
+		files, err := filepath.Glob(filepath.Join(dir, "mail", ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Errorf("expected 2 %s files, got %d", ext, len(files))
+		}
+	}
+}
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := NewMemoryMailer()
+
+	msg := testMessage()
+	if err := mailer.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.Subject = "Changed"
+
+	last := mailer.Last("steve@bowery.io")
+	if last == nil || last.Subject != "Hello" {
+		t.Error("expected the sent message to be recorded unchanged")
+	}
+	if mailer.Last("byrd@bowery.io") != nil {
+		t.Error("expected no message for an unknown address")
+	}
+
+	mailer.Reset()
+	if len(mailer.Messages()) != 0 {
+		t.Error("expected no messages after reset")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2014 Bowery, Inc.
+package mail
+
+import (
+	"errors"
+
+	"github.com/mattbaird/gochimp"
+)
+
+// MandrillMailer sends email through Mandrill.
+type MandrillMailer struct {
+	api *gochimp.MandrillAPI
+}
+
+// NewMandrillMailer creates a MandrillMailer using the given API key.
+func NewMandrillMailer(key string) (*MandrillMailer, error) {
+	api, err := gochimp.NewMandrill(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MandrillMailer{api: api}, nil
+}
+
+func (m *MandrillMailer) Send(msg *Message) error {
+	to := make([]gochimp.Recipient, len(msg.To))
+	for i, addr := range msg.To {
+		to[i] = gochimp.Recipient{Email: addr.Email, Name: addr.Name}
+	}
+
+	res, err := m.api.MessageSend(gochimp.Message{
+		Subject:   msg.Subject,
+		FromEmail: msg.From.Email,
+		FromName:  msg.From.Name,
+		To:        to,
+		Html:      msg.HTML,
+		Text:      msg.Text,
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range res {
+		if r.Status == "rejected" || r.Status == "invalid" {
+			return errors.New("mandrill: message to " + r.Email + " " + r.Status + " " + r.RejectedReason)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+// Copyright 2014 Bowery, Inc.
+package mail
+
+import (
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer sends email through an SMTP server.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer creates an SMTPMailer for the server at addr, a host:port.
+// Plain auth is used if a username is given.
+func NewSMTPMailer(addr, username, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SMTPMailer{addr: addr}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	return smtp.SendMail(m.addr, m.auth, msg.From.Email, msg.Recipients(), msg.Bytes())
+}
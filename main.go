@@ -3,29 +3,57 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 
-	"github.com/Bowery/gopackages/config"
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/broome/db"
 	"github.com/Bowery/gopackages/web"
-	"github.com/Bowery/slack"
 )
 
 var (
-	slackC *slack.Client
+	configPath = flag.String("config", "", "path to the JSON config file (default broome.json if it exists)")
+	reload     = flag.Bool("reload", false, "read templates and static files from disk on every request")
 )
 
 func main() {
-	slackC = slack.NewClient(config.SlackToken)
+	flag.Parse()
 
-	port := ":4000"
-	if os.Getenv("ENV") == "production" {
-		port = ":80"
+	path, required := *configPath, true
+	if path == "" {
+		path, required = "broome.json", false
 	}
 
-	server := web.NewServer(port, []web.Handler{
+	conf, err := config.Load(path, required)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	reloadAssets = *reload
+	if err := configure(conf); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	client, err := db.Dial(conf.DB.Addr, conf.DB.Name, conf.DB.User, conf.DB.Password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "db:", err)
+		os.Exit(1)
+	}
+	mongo := db.NewMongoStore(client)
+	if err := mongo.EnsureIndexes(); err != nil {
+		fmt.Fprintln(os.Stderr, "db:", err)
+		os.Exit(1)
+	}
+	store = mongo
+	go processEmails()
+	go processRenewals()
+
+	server := web.NewServer(conf.Listen, []web.Handler{
 		new(web.SlashHandler),
 		new(web.CorsHandler),
-		&web.StatHandler{Key: config.StatHatKey, Name: "broome"},
+		&web.StatHandler{Key: conf.StatHat.Key, Name: "broome"},
 	}, Routes)
 	server.AuthHandler = &web.AuthHandler{Auth: AuthHandler}
 	server.ListenAndServe()
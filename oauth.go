@@ -0,0 +1,616 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the OAuth2 authorization server Bowery products sign developers
+// in through, using the authorization code flow with PKCE.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
+)
+
+// The OAuth2 errors, from RFC 6749.
+const (
+	oauthInvalidRequest          = "invalid_request"
+	oauthInvalidClient           = "invalid_client"
+	oauthInvalidGrant            = "invalid_grant"
+	oauthInvalidScope            = "invalid_scope"
+	oauthAccessDenied            = "access_denied"
+	oauthUnsupportedResponseType = "unsupported_response_type"
+	oauthUnsupportedGrantType    = "unsupported_grant_type"
+	oauthServerError             = "server_error"
+)
+
+var (
+	errNoClient         = errors.New("Unknown client.")
+	errBadRedirectURI   = errors.New("The redirect URI isn't registered for this client.")
+	errInvalidClientReq = errors.New("clients need a name, known scopes and a redirect URI unless they only sign in devices")
+)
+
+// oauthScopes are the scopes clients can ask for, with how they're shown on
+// the consent page.
+var oauthScopes = map[string]string{
+	"profile": "Your name",
+	"email":   "Your email address",
+	"license": "Your license and whether you've paid",
+	"openid":  "Who you are on Bowery",
+}
+
+// codeChallengePattern is a PKCE code challenge or verifier, RFC 7636.
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// oauthError is an error in the form OAuth2 clients expect.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// authorizeReq is a client asking a developer for consent.
+type authorizeReq struct {
+	Client        *db.OAuthClient
+	RedirectURI   string
+	Defaulted     bool
+	Scopes        []string
+	State         string
+	CodeChallenge string
+	Nonce         string
+}
+
+// Values gets the fields the consent page posts back. A defaulted redirect
+// URI is left out, so it's still defaulted when they're posted.
+func (a *authorizeReq) Values() url.Values {
+	values := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.Client.ID},
+		"scope":                 {strings.Join(a.Scopes, " ")},
+		"state":                 {a.State},
+		"code_challenge":        {a.CodeChallenge},
+		"code_challenge_method": {"S256"},
+		"nonce":                 {a.Nonce},
+	}
+	if !a.Defaulted {
+		values.Set("redirect_uri", a.RedirectURI)
+	}
+
+	return values
+}
+
+// redirect sends the developer back to the client with the given values,
+// along with the state the client sent.
+func (a *authorizeReq) redirect(rw http.ResponseWriter, req *http.Request, values url.Values) {
+	if a.State != "" {
+		values.Set("state", a.State)
+	}
+
+	u, _ := url.Parse(a.RedirectURI)
+	query := u.Query()
+	for key, vals := range values {
+		query[key] = vals
+	}
+	u.RawQuery = query.Encode()
+
+	http.Redirect(rw, req, u.String(), http.StatusFound)
+}
+
+// parseAuthorizeReq checks a request for consent. If there's no
+// authorizeReq the client or redirect URI is wrong and the developer can't
+// be sent back to it, otherwise any error is sent back to the client.
+func parseAuthorizeReq(req *http.Request) (*authorizeReq, error) {
+	client, err := store.GetOAuthClient(req.FormValue("client_id"))
+	if err == mgo.ErrNotFound {
+		err = errNoClient
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := &authorizeReq{
+		Client:      client,
+		RedirectURI: req.FormValue("redirect_uri"),
+		State:       req.FormValue("state"),
+		Nonce:       req.FormValue("nonce"),
+	}
+	if a.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		a.RedirectURI = client.RedirectURIs[0]
+		a.Defaulted = true
+	}
+	if !hasString(client.RedirectURIs, a.RedirectURI) {
+		return nil, errBadRedirectURI
+	}
+
+	if req.FormValue("response_type") != "code" {
+		return a, &oauthError{oauthUnsupportedResponseType, "Only the code response type is supported."}
+	}
+
+	a.Scopes, err = parseScopes(client, req.FormValue("scope"))
+	if err != nil {
+		return a, err
+	}
+
+	a.CodeChallenge = req.FormValue("code_challenge")
+	if req.FormValue("code_challenge_method") != "S256" || !codeChallengePattern.MatchString(a.CodeChallenge) {
+		return a, &oauthError{oauthInvalidRequest, "A S256 code_challenge is required."}
+	}
+
+	return a, nil
+}
+
+// parseScopes gets the scopes a client asks for, all it's allowed if it
+// doesn't ask for any.
+func parseScopes(client *db.OAuthClient, scope string) ([]string, error) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		scopes = append(scopes, client.Scopes...)
+	}
+
+	seen := map[string]bool{}
+	parsed := []string{}
+	for _, s := range scopes {
+		if !hasString(client.Scopes, s) {
+			return nil, &oauthError{oauthInvalidScope, "The client can't ask for " + s + "."}
+		}
+		if !seen[s] {
+			seen[s] = true
+			parsed = append(parsed, s)
+		}
+	}
+
+	sort.Strings(parsed)
+	return parsed, nil
+}
+
+// hasString checks if list contains s.
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renderConsent renders the consent page, with an error from a previous
+// try if there was one.
+func renderConsent(rw http.ResponseWriter, status int, a *authorizeReq, email string, err error) {
+	scopes := make([]string, len(a.Scopes))
+	for i, s := range a.Scopes {
+		scopes[i] = oauthScopes[s]
+	}
+
+	data := map[string]interface{}{
+		"Client": a.Client,
+		"Scopes": scopes,
+		"Values": a.Values(),
+		"Email":  email,
+	}
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+
+	rw.WriteHeader(status)
+	if err := RenderTemplate(rw, "authorize", data); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// checkFormLogin logs a developer in from the email, password and
+// two-factor code in a page's form. If it fails the status is the one to
+// show the error with.
+func checkFormLogin(req *http.Request) (*schemas.Developer, int, error) {
+	d, wait, err := checkLogin(req, req.PostFormValue("email"), req.PostFormValue("password"))
+	if wait > 0 {
+		return nil, http.StatusTooManyRequests, errLoginLimit
+	}
+	if err == nil {
+		err = requireVerified(d)
+	}
+
+	var twoFactor *db.TwoFactor
+	if err == nil {
+		twoFactor, err = getTwoFactor(d)
+	}
+	if err == nil && twoFactor != nil {
+		now := time.Now()
+		err = checkTwoFactorCode(twoFactor, req.PostFormValue("code"), now)
+		if err == errInvalidCode {
+			failLogin(req, d.Email, now)
+		}
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case errInvalidLogin, errInvalidCode:
+			status = http.StatusUnauthorized
+		case errNotVerified:
+			status = http.StatusForbidden
+		}
+
+		return nil, status, err
+	}
+	succeedLogin(d.Email)
+
+	return d, http.StatusOK, nil
+}
+
+// renderOAuthError writes an error in the form OAuth2 clients expect.
+// Errors that aren't OAuth2 errors are server errors.
+func renderOAuthError(rw http.ResponseWriter, status int, err error) {
+	e, ok := err.(*oauthError)
+	if !ok {
+		status, e = http.StatusInternalServerError, &oauthError{oauthServerError, err.Error()}
+	}
+
+	renderer.JSON(rw, status, e)
+}
+
+// authenticateClient gets the client making a request, from basic auth or
+// the form. Clients with a secret have to give it, public clients can't.
+func authenticateClient(req *http.Request) (*db.OAuthClient, error) {
+	id, secret, ok := req.BasicAuth()
+	if !ok {
+		id, secret = req.PostFormValue("client_id"), req.PostFormValue("client_secret")
+	}
+
+	client, err := store.GetOAuthClient(id)
+	if err == mgo.ErrNotFound {
+		return nil, &oauthError{oauthInvalidClient, errNoClient.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	given := ""
+	if secret != "" {
+		given = db.HashToken(secret)
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(client.SecretHash)) != 1 {
+		return nil, &oauthError{oauthInvalidClient, "Invalid client secret."}
+	}
+
+	return client, nil
+}
+
+// checkCodeVerifier checks a PKCE verifier matches the challenge it was
+// made from.
+func checkCodeVerifier(verifier, challenge string) bool {
+	if !codeChallengePattern.MatchString(verifier) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// issueOAuthToken creates an access token for a client to use for a
+// developer.
+func issueOAuthToken(client *db.OAuthClient, d *schemas.Developer, scopes []string) (*db.OAuthToken, error) {
+	now := time.Now()
+	t := &db.OAuthToken{
+		Token:       util.HashToken(),
+		ClientID:    client.ID,
+		DeveloperID: d.ID,
+		Scopes:      scopes,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(conf.OAuth.AccessTokenTTL.Duration),
+	}
+
+	return t, store.SaveOAuthToken(t)
+}
+
+// GET /oauth/authorize, asks the developer to log in and allow a client
+// access to their account
+func AuthorizeHandler(rw http.ResponseWriter, req *http.Request) {
+	a, err := parseAuthorizeReq(req)
+	if a == nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	if e, ok := err.(*oauthError); ok {
+		a.redirect(rw, req, url.Values{"error": {e.Code}, "error_description": {e.Description}})
+		return
+	}
+
+	renderConsent(rw, http.StatusOK, a, "", nil)
+}
+
+// POST /oauth/authorize, logs the developer in and sends them back to the
+// client with an authorization code, or with an error if they didn't allow
+// it
+func ConsentHandler(rw http.ResponseWriter, req *http.Request) {
+	a, err := parseAuthorizeReq(req)
+	if a == nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+	if e, ok := err.(*oauthError); ok {
+		a.redirect(rw, req, url.Values{"error": {e.Code}, "error_description": {e.Description}})
+		return
+	}
+
+	if req.PostFormValue("decision") != "allow" {
+		a.redirect(rw, req, url.Values{"error": {oauthAccessDenied}})
+		return
+	}
+
+	d, status, err := checkFormLogin(req)
+	if err != nil {
+		renderConsent(rw, status, a, req.PostFormValue("email"), err)
+		return
+	}
+
+	code := &db.AuthorizationCode{
+		Code:          util.HashToken(),
+		ClientID:      a.Client.ID,
+		DeveloperID:   d.ID,
+		RedirectURI:   a.RedirectURI,
+		Scopes:        a.Scopes,
+		CodeChallenge: a.CodeChallenge,
+		Nonce:         a.Nonce,
+		CreatedAt:     time.Now(),
+		ExpiresAt:     time.Now().Add(conf.OAuth.CodeTTL.Duration),
+
+		RedirectURIDefaulted: a.Defaulted,
+	}
+	if err := store.SaveAuthorizationCode(code); err != nil {
+		a.redirect(rw, req, url.Values{"error": {oauthServerError}})
+		return
+	}
+
+	a.redirect(rw, req, url.Values{"code": {code.Code}})
+}
+
+// POST /oauth/token, exchanges an authorization code and its PKCE verifier
+// for an access token, or a device code for a session
+func OAuthTokenHandler(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+
+	client, err := authenticateClient(req)
+	if err != nil {
+		renderOAuthError(rw, http.StatusUnauthorized, err)
+		return
+	}
+
+	switch req.PostFormValue("grant_type") {
+	case "authorization_code":
+	case deviceGrantType:
+		exchangeDeviceCode(rw, req, client)
+		return
+	default:
+		renderOAuthError(rw, http.StatusBadRequest, &oauthError{oauthUnsupportedGrantType, "Only authorization_code and device_code are supported."})
+		return
+	}
+
+	// The code is used up even if it's sent with the wrong verifier, so it
+	// can't be guessed at. The redirect URI only has to be sent if it was
+	// sent when asking for consent.
+	code, err := store.UseAuthorizationCode(req.PostFormValue("code"))
+	redirectURI := req.PostFormValue("redirect_uri")
+	if err == nil && redirectURI == "" && code.RedirectURIDefaulted {
+		redirectURI = code.RedirectURI
+	}
+	if err == nil && (code.ClientID != client.ID || code.RedirectURI != redirectURI ||
+		!checkCodeVerifier(req.PostFormValue("code_verifier"), code.CodeChallenge)) {
+		err = mgo.ErrNotFound
+	}
+
+	var d *schemas.Developer
+	if err == nil {
+		d, err = store.GetDeveloperById(code.DeveloperID.Hex())
+	}
+	if err == mgo.ErrNotFound {
+		renderOAuthError(rw, http.StatusBadRequest, &oauthError{oauthInvalidGrant, "Invalid or expired authorization code."})
+		return
+	}
+
+	var token *db.OAuthToken
+	if err == nil {
+		token, err = issueOAuthToken(client, d, code.Scopes)
+	}
+
+	// OpenID Connect clients get an ID token along with the access token.
+	var idToken string
+	if err == nil && hasString(code.Scopes, "openid") {
+		idToken, err = signIDToken(client, d, code, time.Now())
+	}
+	if err != nil {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := map[string]interface{}{
+		"access_token": token.Token,
+		"token_type":   "Bearer",
+		"expires_in":   int(conf.OAuth.AccessTokenTTL.Seconds()),
+		"scope":        strings.Join(token.Scopes, " "),
+	}
+	if idToken != "" {
+		res["id_token"] = idToken
+	}
+
+	renderer.JSON(rw, http.StatusOK, res)
+}
+
+// POST /oauth/introspect, tells a client with a secret whether an access
+// token is active and who it's for, RFC 7662
+func IntrospectHandler(rw http.ResponseWriter, req *http.Request) {
+	client, err := authenticateClient(req)
+	if err == nil && client.Public() {
+		err = &oauthError{oauthInvalidClient, "Only clients with a secret can introspect tokens."}
+	}
+	if err != nil {
+		renderOAuthError(rw, http.StatusUnauthorized, err)
+		return
+	}
+
+	token, err := store.GetOAuthToken(req.PostFormValue("token"))
+	var d *schemas.Developer
+	if err == nil {
+		d, err = store.GetDeveloperById(token.DeveloperID.Hex())
+	}
+	if err == mgo.ErrNotFound {
+		renderer.JSON(rw, http.StatusOK, map[string]bool{"active": false})
+		return
+	}
+	if err != nil {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"active":     true,
+		"scope":      strings.Join(token.Scopes, " "),
+		"client_id":  token.ClientID,
+		"username":   d.Email,
+		"sub":        d.ID.Hex(),
+		"token_type": "Bearer",
+		"iat":        token.CreatedAt.Unix(),
+		"exp":        token.ExpiresAt.Unix(),
+	})
+}
+
+// POST /oauth/revoke, revokes one of a client's access tokens, RFC 7009
+func RevokeHandler(rw http.ResponseWriter, req *http.Request) {
+	client, err := authenticateClient(req)
+	if err != nil {
+		renderOAuthError(rw, http.StatusUnauthorized, err)
+		return
+	}
+
+	// Unknown tokens aren't an error, so there's nothing to learn from
+	// revoking them.
+	token, err := store.GetOAuthToken(req.PostFormValue("token"))
+	if err == nil && token.ClientID == client.ID {
+		err = store.RemoveOAuthToken(token.ID)
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{})
+}
+
+// GET /admin/clients, Lists the OAuth clients and a form to add one
+func ClientsHandler(rw http.ResponseWriter, req *http.Request) {
+	clients, err := store.GetOAuthClients()
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	scopes := make([]string, 0, len(oauthScopes))
+	for s := range oauthScopes {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+
+	if err := RenderTemplate(rw, "clients", map[string]interface{}{
+		"Clients": clients,
+		"Scopes":  scopes,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// POST /admin/clients, registers an OAuth client, returning its secret
+// once unless it's public
+func CreateClientHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	client := &db.OAuthClient{
+		ID:           util.HashToken(),
+		Name:         strings.TrimSpace(req.PostFormValue("name")),
+		RedirectURIs: strings.Fields(req.PostFormValue("redirectUris")),
+		Scopes:       req.PostForm["scopes"],
+		CreatedAt:    time.Now(),
+	}
+	if val := req.PostFormValue("public"); val != "on" && val != "true" {
+		client.Secret = util.HashToken()
+	}
+	if val := req.PostFormValue("devices"); val == "on" || val == "true" {
+		client.Devices = true
+	}
+
+	valid := client.Name != "" && (len(client.RedirectURIs) > 0 || client.Devices)
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		valid = valid && err == nil && u.IsAbs() && u.Fragment == ""
+	}
+	for _, s := range client.Scopes {
+		_, ok := oauthScopes[s]
+		valid = valid && ok
+	}
+	if !valid {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errInvalidClientReq.Error(),
+		})
+		return
+	}
+
+	if err := store.SaveOAuthClient(client); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"client": client,
+	})
+}
+
+// DELETE /admin/clients/{id}, removes an OAuth client and revokes its
+// tokens
+func RemoveClientHandler(rw http.ResponseWriter, req *http.Request) {
+	err := store.RemoveOAuthClient(mux.Vars(req)["id"])
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == mgo.ErrNotFound {
+			status = http.StatusNotFound
+			err = errNoClient
+		}
+
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
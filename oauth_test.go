@@ -0,0 +1,294 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWEFyvyk"
+
+// newClient registers an OAuth client as the admin, allowed profile and
+// email if no scopes are given.
+func newClient(t *testing.T, admin *schemas.Developer, public bool, scopes ...string) *db.OAuthClient {
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+
+	form := url.Values{
+		"name":         {"Crosby"},
+		"redirectUris": {"https://crosby.io/callback"},
+		"scopes":       scopes,
+	}
+	if public {
+		form.Set("public", "on")
+	}
+
+	res := staffRequest(t, admin, "POST", "/admin/clients", form)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	body := struct{ Client *db.OAuthClient }{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal("Could not decode client:", err)
+	}
+	return body.Client
+}
+
+// formRequest posts a form, authenticating as the client if it has a
+// secret.
+func formRequest(t *testing.T, path string, client *db.OAuthClient, form url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "http://broome.io"+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if client != nil && client.Secret != "" {
+		req.SetBasicAuth(client.ID, client.Secret)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	return res
+}
+
+// authorizeValues gets the query a client sends to /oauth/authorize.
+func authorizeValues(client *db.OAuthClient) url.Values {
+	sum := sha256.Sum256([]byte(testVerifier))
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ID},
+		"redirect_uri":          {"https://crosby.io/callback"},
+		"scope":                 {"profile email"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// authorize logs in on the consent page for a client's request, returning
+// where it redirects.
+func authorize(t *testing.T, form url.Values, decision string) *url.URL {
+	form.Set("email", "byrd@bowery.io")
+	form.Set("password", "java$cript")
+	form.Set("decision", decision)
+
+	res := formRequest(t, "/oauth/authorize", nil, form)
+	if res.Code != http.StatusFound {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	u, err := url.Parse(res.Header().Get("Location"))
+	if err != nil {
+		t.Fatal("Could not parse redirect:", err)
+	}
+	return u
+}
+
+// exchange trades a code for an access token.
+func exchange(t *testing.T, client *db.OAuthClient, code, verifier string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	res := formRequest(t, "/oauth/token", client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"code":          {code},
+		"redirect_uri":  {"https://crosby.io/callback"},
+		"code_verifier": {verifier},
+	})
+
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal("Could not decode token response:", err)
+	}
+	return res, body
+}
+
+func TestOAuthFlow(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	client := newClient(t, admin, false)
+	if client.Secret == "" {
+		t.Fatal("confidential client should get a secret")
+	}
+
+	req, _ := http.NewRequest("GET", "http://broome.io/oauth/authorize?"+authorizeValues(client).Encode(), nil)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "Crosby") {
+		t.Fatalf("consent page should show the client, got %v", res.Code)
+	}
+
+	u := authorize(t, authorizeValues(client), "allow")
+	if u.Host != "crosby.io" || u.Query().Get("state") != "xyz" || u.Query().Get("code") == "" {
+		t.Fatal("consent should redirect with a code, got", u)
+	}
+	code := u.Query().Get("code")
+
+	tokenRes, token := exchange(t, client, code, testVerifier)
+	if tokenRes.Code != http.StatusOK || token["token_type"] != "Bearer" || token["scope"] != "email profile" {
+		t.Fatalf("Non-expected token response: %v\tbody: %v", tokenRes.Code, tokenRes.Body)
+	}
+	if tokenRes.Header().Get("Cache-Control") != "no-store" {
+		t.Error("token response shouldn't be cached")
+	}
+	access := token["access_token"].(string)
+
+	if res, _ := exchange(t, client, code, testVerifier); res.Code != http.StatusBadRequest {
+		t.Error("code should only be exchanged once, got", res.Code)
+	}
+
+	res = formRequest(t, "/oauth/introspect", client, url.Values{"token": {access}})
+	info := map[string]interface{}{}
+	json.Unmarshal(res.Body.Bytes(), &info)
+	if info["active"] != true || info["username"] != "byrd@bowery.io" || info["client_id"] != client.ID {
+		t.Fatal("token should be active for the developer, got", info)
+	}
+
+	res = formRequest(t, "/oauth/revoke", client, url.Values{"token": {access}})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	res = formRequest(t, "/oauth/introspect", client, url.Values{"token": {access}})
+	info = map[string]interface{}{}
+	json.Unmarshal(res.Body.Bytes(), &info)
+	if info["active"] != false {
+		t.Error("revoked token shouldn't be active, got", info)
+	}
+}
+
+func TestOAuthBadExchange(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	client := newClient(t, admin, true)
+
+	code := authorize(t, authorizeValues(client), "allow").Query().Get("code")
+	if res, body := exchange(t, client, code, strings.Repeat("a", 43)); res.Code != http.StatusBadRequest || body["error"] != oauthInvalidGrant {
+		t.Error("wrong verifier should be an invalid grant, got", res.Code, body)
+	}
+
+	// The failed exchange used the code up.
+	if res, _ := exchange(t, client, code, testVerifier); res.Code != http.StatusBadRequest {
+		t.Error("code should be used up by a failed exchange, got", res.Code)
+	}
+
+	code = authorize(t, authorizeValues(client), "allow").Query().Get("code")
+	res, token := exchange(t, client, code, testVerifier)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	// Public clients can't introspect.
+	res = formRequest(t, "/oauth/introspect", client, url.Values{
+		"client_id": {client.ID},
+		"token":     {token["access_token"].(string)},
+	})
+	if res.Code != http.StatusUnauthorized {
+		t.Error("public client shouldn't introspect, got", res.Code)
+	}
+}
+
+func TestOAuthRedirectURI(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	client := newClient(t, admin, true)
+
+	// A client with one redirect URI can leave it out of both requests.
+	values := authorizeValues(client)
+	values.Del("redirect_uri")
+	code := authorize(t, values, "allow").Query().Get("code")
+	res := formRequest(t, "/oauth/token", client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"code":          {code},
+		"code_verifier": {testVerifier},
+	})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	// Once it's sent it has to be sent again.
+	code = authorize(t, authorizeValues(client), "allow").Query().Get("code")
+	res = formRequest(t, "/oauth/token", client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"code":          {code},
+		"code_verifier": {testVerifier},
+	})
+	if res.Code != http.StatusBadRequest {
+		t.Error("redirect URI sent for consent should be required, got", res.Code)
+	}
+}
+
+func TestOAuthDeny(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	client := newClient(t, admin, false)
+
+	u := authorize(t, authorizeValues(client), "deny")
+	if u.Query().Get("error") != oauthAccessDenied || u.Query().Get("state") != "xyz" {
+		t.Error("denying should redirect with access_denied, got", u)
+	}
+}
+
+func TestOAuthTwoFactorThrottle(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	defer loginTest(twoFactorLimits)()
+	client := newClient(t, admin, false)
+	secret, _ := enableTwoFactor(t, admin)
+
+	form := authorizeValues(client)
+	form.Set("email", "byrd@bowery.io")
+	form.Set("password", "java$cript")
+	form.Set("decision", "allow")
+	for i := 0; i < 2; i++ {
+		form.Set("code", "000000")
+		if res := formRequest(t, "/oauth/authorize", nil, form); res.Code != http.StatusUnauthorized {
+			t.Fatal("wrong code should be refused, got", res.Code)
+		}
+	}
+
+	form.Set("code", code(t, secret, 0))
+	if res := formRequest(t, "/oauth/authorize", nil, form); res.Code != http.StatusTooManyRequests {
+		t.Error("wrong codes should throttle the consent page, got", res.Code)
+	}
+}
+
+func TestOAuthBadClient(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	client := newClient(t, admin, false)
+
+	// Bad clients and redirect URIs are never redirected to.
+	for _, values := range []url.Values{
+		{"client_id": {"nope"}, "redirect_uri": {"https://crosby.io/callback"}},
+		{"client_id": {client.ID}, "redirect_uri": {"https://evil.io/callback"}},
+	} {
+		req, _ := http.NewRequest("GET", "http://broome.io/oauth/authorize?"+values.Encode(), nil)
+		res := httptest.NewRecorder()
+		broomeServer(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Error("bad client should get the error page, got", res.Code)
+		}
+	}
+
+	// Other errors go back to the client.
+	values := authorizeValues(client)
+	values.Del("code_challenge")
+	req, _ := http.NewRequest("GET", "http://broome.io/oauth/authorize?"+values.Encode(), nil)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	u, _ := url.Parse(res.Header().Get("Location"))
+	if res.Code != http.StatusFound || u.Query().Get("error") != oauthInvalidRequest {
+		t.Error("missing PKCE should redirect with invalid_request, got", res.Code, u)
+	}
+}
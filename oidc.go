@@ -0,0 +1,213 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the OpenID Connect layer on top of the OAuth2 server, so other
+// services can trust broome with an off-the-shelf OIDC library.
+package main
+
+import (
+	"crypto/rsa"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/jwt"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"labix.org/v2/mgo"
+)
+
+// signingKeyMutex keeps concurrent logins from each making a new key when
+// the current one is due to be rotated.
+var signingKeyMutex sync.Mutex
+
+// issuer gets broome's OpenID Connect issuer, which endpoints are relative
+// to.
+func issuer() string {
+	return strings.TrimRight(conf.URL, "/")
+}
+
+// currentSigningKey gets the key to sign ID tokens with, making a new one
+// once the newest is older than the rotation. Keys are kept until the last
+// token they could have signed expires.
+func currentSigningKey(now time.Time) (*db.SigningKey, *rsa.PrivateKey, error) {
+	signingKeyMutex.Lock()
+	defer signingKeyMutex.Unlock()
+
+	keys, err := store.GetSigningKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys) > 0 && now.Before(keys[0].CreatedAt.Add(conf.OIDC.KeyRotation.Duration)) {
+		key, err := jwt.ParsePrivateKey(keys[0].PrivateKey)
+		return keys[0], key, err
+	}
+
+	key, err := jwt.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	k := &db.SigningKey{
+		ID:         util.HashToken(),
+		PrivateKey: jwt.EncodePrivateKey(key),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(conf.OIDC.KeyRotation.Duration + conf.OIDC.IDTokenTTL.Duration),
+	}
+	return k, key, store.SaveSigningKey(k)
+}
+
+// developerClaims gets the claims about a developer that scopes allow a
+// client to see.
+func developerClaims(d *schemas.Developer, scopes []string) (map[string]interface{}, error) {
+	claims := map[string]interface{}{"sub": d.ID.Hex()}
+
+	if hasString(scopes, "profile") {
+		roles, err := getStaffRoles(d)
+		if err != nil {
+			return nil, err
+		}
+
+		claims["name"] = d.Name
+		claims["admin"] = len(roles) > 0
+		claims["roles"] = roles
+	}
+
+	if hasString(scopes, "email") {
+		verified, _, err := isVerified(d)
+		if err != nil {
+			return nil, err
+		}
+
+		claims["email"] = d.Email
+		claims["email_verified"] = verified
+	}
+
+	if hasString(scopes, "license") {
+		claims["is_paid"] = d.IsPaid
+		if !d.Expiration.IsZero() {
+			claims["next_payment_time"] = d.Expiration.Unix()
+		}
+	}
+
+	return claims, nil
+}
+
+// signIDToken creates the ID token a client gets for a code, with the
+// developer's claims for the code's scopes.
+func signIDToken(client *db.OAuthClient, d *schemas.Developer, code *db.AuthorizationCode, now time.Time) (string, error) {
+	claims, err := developerClaims(d, code.Scopes)
+	if err != nil {
+		return "", err
+	}
+
+	claims["iss"] = issuer()
+	claims["aud"] = client.ID
+	claims["exp"] = now.Add(conf.OIDC.IDTokenTTL.Duration).Unix()
+	claims["iat"] = now.Unix()
+	claims["auth_time"] = code.CreatedAt.Unix()
+	if code.Nonce != "" {
+		claims["nonce"] = code.Nonce
+	}
+
+	k, key, err := currentSigningKey(now)
+	if err != nil {
+		return "", err
+	}
+
+	return jwt.Sign(key, k.ID, claims)
+}
+
+// GET /.well-known/openid-configuration, describes broome's OpenID Connect
+// endpoints and what they support
+func DiscoveryHandler(rw http.ResponseWriter, req *http.Request) {
+	scopes := make([]string, 0, len(oauthScopes))
+	for s := range oauthScopes {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer(),
+		"authorization_endpoint":                issuer() + "/oauth/authorize",
+		"token_endpoint":                        issuer() + "/oauth/token",
+		"userinfo_endpoint":                     issuer() + "/oauth/userinfo",
+		"jwks_uri":                              issuer() + "/.well-known/jwks.json",
+		"introspection_endpoint":                issuer() + "/oauth/introspect",
+		"revocation_endpoint":                   issuer() + "/oauth/revoke",
+		"device_authorization_endpoint":         issuer() + "/oauth/device",
+		"scopes_supported":                      scopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", deviceGrantType},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{jwt.Algorithm},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name", "admin",
+			"roles", "email", "email_verified", "is_paid", "next_payment_time",
+		},
+	})
+}
+
+// GET /.well-known/jwks.json, lists the public keys ID tokens are signed
+// with, including rotated keys whose tokens haven't expired
+func JWKSHandler(rw http.ResponseWriter, req *http.Request) {
+	keys, err := store.GetSigningKeys()
+	if err != nil {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	jwks := []jwt.JWK{}
+	for _, k := range keys {
+		key, err := jwt.ParsePrivateKey(k.PrivateKey)
+		if err != nil {
+			renderOAuthError(rw, http.StatusInternalServerError, err)
+			return
+		}
+
+		jwks = append(jwks, jwt.NewJWK(k.ID, &key.PublicKey))
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{"keys": jwks})
+}
+
+// GET /oauth/userinfo, returns the claims about the developer an access
+// token is for, limited to its scopes
+func UserInfoHandler(rw http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="broome"`)
+		renderOAuthError(rw, http.StatusUnauthorized, &oauthError{oauthInvalidRequest, "An access token is required."})
+		return
+	}
+
+	token, err := store.GetOAuthToken(strings.TrimSpace(auth[7:]))
+	var d *schemas.Developer
+	if err == nil {
+		d, err = store.GetDeveloperById(token.DeveloperID.Hex())
+	}
+	if err == mgo.ErrNotFound {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="broome", error="invalid_token"`)
+		renderOAuthError(rw, http.StatusUnauthorized, &oauthError{"invalid_token", "Invalid or expired access token."})
+		return
+	}
+
+	var claims map[string]interface{}
+	if err == nil && !hasString(token.Scopes, "openid") {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="broome", error="insufficient_scope", scope="openid"`)
+		renderOAuthError(rw, http.StatusForbidden, &oauthError{"insufficient_scope", "The token needs the openid scope."})
+		return
+	}
+	if err == nil {
+		claims, err = developerClaims(d, token.Scopes)
+	}
+	if err != nil {
+		renderOAuthError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, claims)
+}
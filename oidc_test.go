@@ -0,0 +1,154 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/jwt"
+)
+
+// getJSON gets a path with an optional bearer token, decoding the response
+// into body.
+func getJSON(t *testing.T, path, token string, body interface{}) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "http://broome.io"+path, nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if err := json.Unmarshal(res.Body.Bytes(), body); err != nil {
+		t.Fatal("Could not decode response:", err)
+	}
+	return res
+}
+
+// jwks gets the published signing keys by key ID.
+func jwks(t *testing.T) map[string]*rsa.PublicKey {
+	var body struct{ Keys []jwt.JWK }
+	getJSON(t, "/.well-known/jwks.json", "", &body)
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range body.Keys {
+		key, err := k.PublicKey()
+		if err != nil {
+			t.Fatal("Could not decode JWK:", err)
+		}
+		keys[k.KeyID] = key
+	}
+	return keys
+}
+
+func TestDiscovery(t *testing.T) {
+	var body map[string]interface{}
+	res := getJSON(t, "/.well-known/openid-configuration", "", &body)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if body["issuer"] != conf.URL || body["jwks_uri"] != conf.URL+"/.well-known/jwks.json" {
+		t.Error("discovery should be relative to the issuer, got", body)
+	}
+
+	scopes, _ := body["scopes_supported"].([]interface{})
+	found := false
+	for _, s := range scopes {
+		found = found || s == "openid"
+	}
+	if !found {
+		t.Error("openid should be a supported scope, got", scopes)
+	}
+}
+
+func TestIDToken(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	client := newClient(t, admin, true, "openid", "profile", "email")
+
+	values := authorizeValues(client)
+	values.Set("scope", "openid profile email")
+	values.Set("nonce", "n-0S6_WzA2Mj")
+	code := authorize(t, values, "allow").Query().Get("code")
+	res, token := exchange(t, client, code, testVerifier)
+	if res.Code != http.StatusOK || token["id_token"] == nil {
+		t.Fatalf("Non-expected token response: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	var claims map[string]interface{}
+	if err := jwt.Verify(token["id_token"].(string), jwks(t), &claims); err != nil {
+		t.Fatal("ID token should verify with the published keys:", err)
+	}
+	if claims["iss"] != conf.URL || claims["aud"] != client.ID || claims["sub"] != admin.ID.Hex() ||
+		claims["nonce"] != "n-0S6_WzA2Mj" {
+		t.Error("ID token should be for the client and developer, got", claims)
+	}
+	if claims["email"] != admin.Email || claims["name"] != admin.Name || claims["admin"] != true {
+		t.Error("ID token should have the developer's claims, got", claims)
+	}
+
+	var info map[string]interface{}
+	res = getJSON(t, "/oauth/userinfo", token["access_token"].(string), &info)
+	if res.Code != http.StatusOK || info["sub"] != admin.ID.Hex() || info["email"] != admin.Email {
+		t.Errorf("userinfo should have the developer's claims, got %v %v", res.Code, info)
+	}
+	if _, ok := info["is_paid"]; ok {
+		t.Error("userinfo shouldn't have claims outside the scopes, got", info)
+	}
+
+	res = getJSON(t, "/oauth/userinfo", "nope", &info)
+	if res.Code != http.StatusUnauthorized || res.Header().Get("WWW-Authenticate") == "" {
+		t.Error("unknown token should be unauthorized, got", res.Code)
+	}
+}
+
+func TestUserInfoNeedsOpenID(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+	client := newClient(t, admin, true)
+
+	code := authorize(t, authorizeValues(client), "allow").Query().Get("code")
+	_, token := exchange(t, client, code, testVerifier)
+	if token["id_token"] != nil {
+		t.Error("plain OAuth clients shouldn't get an ID token")
+	}
+
+	var info map[string]interface{}
+	if res := getJSON(t, "/oauth/userinfo", token["access_token"].(string), &info); res.Code != http.StatusForbidden {
+		t.Error("token without openid shouldn't get userinfo, got", res.Code)
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	_, _, done := billingTest(t)
+	defer done()
+
+	now := time.Now()
+	first, _, err := currentSigningKey(now)
+	if err != nil {
+		t.Fatal("Unable to get signing key:", err)
+	}
+	if same, _, _ := currentSigningKey(now.Add(time.Minute)); same.ID != first.ID {
+		t.Error("key shouldn't rotate before it's due")
+	}
+
+	next, _, err := currentSigningKey(now.Add(conf.OIDC.KeyRotation.Duration))
+	if err != nil {
+		t.Fatal("Unable to get signing key:", err)
+	}
+	if next.ID == first.ID {
+		t.Fatal("key should rotate once it's due")
+	}
+
+	// Tokens signed by the old key can still be checked.
+	keys := jwks(t)
+	if keys[first.ID] == nil || keys[next.ID] == nil {
+		t.Error("old and new keys should be published, got", len(keys))
+	}
+}
@@ -0,0 +1,982 @@
+// Copyright 2014 Bowery, Inc.
+// Contains organizations, their members and invitations, and their billing.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	errNoOrganization   = errors.New("no such organization")
+	errNoMember         = errors.New("no such member")
+	errNotMember        = errors.New("You aren't a member of this organization.")
+	errRoleForbidden    = errors.New("Your role in this organization doesn't allow that.")
+	errInvalidRole      = errors.New("role must be owner, admin or member")
+	errLastOwner        = errors.New("An organization needs at least one owner.")
+	errAlreadyMember    = errors.New("They're already a member of this organization.")
+	errNoInvitation     = errors.New("This invitation doesn't exist or has expired.")
+	errInvitationUsed   = errors.New("This invitation has already been answered.")
+	errWrongInvitee     = errors.New("This invitation is for a different email address.")
+	errOrganizationName = errors.New("name is required")
+	errSeatLimit        = errors.New("The organization has no seats left on its plan.")
+)
+
+// roleRanks orders the roles, each can do everything the ones below it can.
+var roleRanks = map[string]int{
+	db.RoleMember: 1,
+	db.RoleAdmin:  2,
+	db.RoleOwner:  3,
+}
+
+// organizationReq is the body of a new organization.
+type organizationReq struct {
+	Name string `json:"name"`
+}
+
+// invitationReq is the body of an invitation, the role defaults to member.
+type invitationReq struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// memberReq is the body of a change to a member's role.
+type memberReq struct {
+	Role string `json:"role"`
+}
+
+// memberRes is a member along with who they are.
+type memberRes struct {
+	*db.Member
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// membershipRes is an organization a developer belongs to, with their role.
+type membershipRes struct {
+	*db.Organization
+	Role string `json:"role"`
+}
+
+// seatUsage is how many of an organization's seats are taken. Pending
+// invitations hold a seat until they're answered or expire.
+type seatUsage struct {
+	Used    int64 `json:"used"`
+	Pending int64 `json:"pending"`
+	Billed  int64 `json:"billed"`
+	Limit   int64 `json:"limit"`
+	Overage bool  `json:"overage"`
+}
+
+// full checks if there's no room for another member once reserved seats
+// are taken.
+func (u *seatUsage) full(reserved int64) bool {
+	return u.Limit > 0 && !u.Overage && u.Used+reserved >= u.Limit
+}
+
+// orgRequest is a developer making a request to one of their organizations.
+type orgRequest struct {
+	dev    *schemas.Developer
+	org    *db.Organization
+	member *db.Member
+}
+
+// can checks if the developer's role is at least role.
+func (r *orgRequest) can(role string) bool {
+	return roleRanks[r.member.Role] >= roleRanks[role]
+}
+
+// loadOrgRequest gets the logged in developer and the organization in the
+// request's path, checking the developer's role is at least role. Failures
+// come with the status to respond with.
+func loadOrgRequest(req *http.Request, role string) (*orgRequest, int, error) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		return nil, http.StatusNotFound, errNoOrganization
+	}
+
+	o, err := store.GetOrganization(bson.ObjectIdHex(id))
+	if err == mgo.ErrNotFound {
+		return nil, http.StatusNotFound, errNoOrganization
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	m, err := store.GetMember(o.ID, d.ID)
+	if err == mgo.ErrNotFound {
+		return nil, http.StatusForbidden, errNotMember
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	r := &orgRequest{dev: d, org: o, member: m}
+	if !r.can(role) {
+		return nil, http.StatusForbidden, errRoleForbidden
+	}
+
+	return r, http.StatusOK, nil
+}
+
+// getMemberships gets the organizations a developer belongs to.
+func getMemberships(d *schemas.Developer) ([]*membershipRes, error) {
+	members, err := store.GetMemberships(d.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := make([]*membershipRes, 0, len(members))
+	for _, m := range members {
+		o, err := store.GetOrganization(m.OrganizationID)
+		if err != nil {
+			return nil, err
+		}
+
+		memberships = append(memberships, &membershipRes{Organization: o, Role: m.Role})
+	}
+
+	return memberships, nil
+}
+
+// getMembers gets an organization's members along with who they are.
+func getMembers(o *db.Organization) ([]*memberRes, error) {
+	members, err := store.GetMembers(o.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*memberRes, 0, len(members))
+	for _, m := range members {
+		d, err := store.GetDeveloperById(m.DeveloperID.Hex())
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, &memberRes{Member: m, Name: d.Name, Email: d.Email})
+	}
+
+	return res, nil
+}
+
+// getSeatUsage gets how many seats an organization is using, the limit
+// comes from its plan.
+func getSeatUsage(o *db.Organization) (*seatUsage, error) {
+	members, err := store.GetMembers(o.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	invitations, err := store.GetInvitations(o.ID, db.InvitationPending)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &seatUsage{Used: int64(len(members)), Billed: o.Seats}
+	for _, i := range invitations {
+		if !i.Expired() {
+			u.Pending++
+		}
+	}
+	if plan, ok := conf.Billing.Plan(o.PlanID); ok {
+		u.Limit, u.Overage = plan.Seats, plan.Overage
+	}
+
+	return u, nil
+}
+
+// seatsFor gets how many seats an organization needs on a plan, failing if
+// its members don't fit.
+func seatsFor(o *db.Organization, plan *config.PlanConfig) (int64, error) {
+	members, err := store.GetMembers(o.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	seats := int64(len(members))
+	if plan.Seats > 0 && !plan.Overage && seats > plan.Seats {
+		return 0, errors.New(plan.Name + " is limited to " + strconv.FormatInt(plan.Seats, 10) + " members.")
+	}
+
+	return seats, nil
+}
+
+// updateSeats bills an organization for its current members after someone
+// joins or leaves, prorating the change. Lapsed subscriptions are left
+// alone, paying again bills for the members at the time.
+func updateSeats(o *db.Organization) error {
+	if o.CustomerID == "" || !o.Active() {
+		return seatsInSync(o)
+	}
+
+	members, err := store.GetMembers(o.ID)
+	if err != nil {
+		return err
+	}
+
+	seats := int64(len(members))
+	if seats == o.Seats {
+		return seatsInSync(o)
+	}
+
+	// Setting the quantity is idempotent on its own, so there's no key.
+	sub, err := payments.UpdateSubscription(o.CustomerID, &payment.SubscriptionParams{
+		PlanID:   o.PlanID,
+		Quantity: seats,
+		Prorate:  true,
+	})
+	if err != nil {
+		return err
+	}
+
+	o.SeatsOutOfSync = false
+	return syncOrganization(o, o.CustomerID, sub)
+}
+
+// seatsInSync clears an organization's seats needing billing again.
+func seatsInSync(o *db.Organization) error {
+	if !o.SeatsOutOfSync {
+		return nil
+	}
+
+	o.SeatsOutOfSync = false
+	return store.SetSeatsOutOfSync(o.ID, false)
+}
+
+// billSeats updates the seats an organization's billed for after a member
+// joins or leaves. The membership has already changed, so a failure marks
+// the seats for the renewal worker to bill instead of failing the request.
+func billSeats(o *db.Organization) {
+	err := updateSeats(o)
+	if err == nil {
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, "seats:", err)
+	if err := store.SetSeatsOutOfSync(o.ID, true); err != nil {
+		fmt.Fprintln(os.Stderr, "seats:", err)
+	}
+}
+
+// checkOwnersLeft makes sure an organization keeps an owner if the member
+// stops being one.
+func checkOwnersLeft(m *db.Member) error {
+	if m.Role != db.RoleOwner {
+		return nil
+	}
+
+	members, err := store.GetMembers(m.OrganizationID)
+	if err != nil {
+		return err
+	}
+
+	owners := 0
+	for _, member := range members {
+		if member.Role == db.RoleOwner {
+			owners++
+		}
+	}
+	if owners <= 1 {
+		return errLastOwner
+	}
+
+	return nil
+}
+
+// subscribeOrganization puts an organization on a plan for a number of
+// seats, paid for by one of its owners. It works like subscribe, the
+// payment is recorded in the payer's ledger and only happens once for the
+// same request key and subscription state.
+func subscribeOrganization(o *db.Organization, payer *schemas.Developer, plan *config.PlanConfig, seats int64, token, requestKey string) error {
+	parts := []string{"organization", o.ID.Hex(), plan.ID, strconv.FormatInt(seats, 10), token, requestKey,
+		o.PlanID, o.Status, strconv.FormatInt(o.Seats, 10), o.CurrentPeriodEnd.UTC().Format(time.RFC3339)}
+
+	// Only the card or seats are changing, the seats are prorated.
+	if o.Active() && o.PlanID == plan.ID {
+		return updateOrganizationSubscription(o, payer, plan, seats, token, paymentKey(payer, append(parts, "card")...))
+	}
+
+	p := &db.Payment{
+		Key:            paymentKey(payer, parts...),
+		DeveloperID:    payer.ID,
+		OrganizationID: o.ID,
+		Description:    "Subscription to " + plan.Name + " for " + o.Name,
+		PlanID:         plan.ID,
+		Amount:         plan.Amount * seats,
+		Currency:       plan.Currency,
+		CustomerID:     o.CustomerID,
+	}
+
+	charged := false
+	_, err := takePayment(p, func(p *db.Payment) error {
+		charged = true
+		err := updateOrganizationSubscription(o, payer, plan, seats, token, p.Key)
+		p.CustomerID = o.CustomerID
+		p.PeriodEnd = o.CurrentPeriodEnd
+		return err
+	}, func(p *db.Payment) (bool, error) {
+		customerID, sub, err := findSubscription(o.CustomerID, p.Key)
+		if customerID == "" || err != nil {
+			return false, err
+		}
+
+		charged = true
+		o.BillingContactID = payer.ID
+		p.CustomerID = customerID
+		err = syncOrganization(o, customerID, sub)
+		p.PeriodEnd = o.CurrentPeriodEnd
+		return true, err
+	})
+	if err != nil || charged {
+		return err
+	}
+
+	// It was paid for by an earlier attempt, which updated the organization.
+	paid, err := store.GetOrganization(o.ID)
+	if err != nil {
+		return err
+	}
+	*o = *paid
+
+	return nil
+}
+
+// updateOrganizationSubscription puts an organization on a plan for a
+// number of seats with the payment provider.
+func updateOrganizationSubscription(o *db.Organization, payer *schemas.Developer, plan *config.PlanConfig, seats int64, token, key string) error {
+	o.BillingContactID = payer.ID
+	if o.CustomerID == "" {
+		customer, err := payments.CreateCustomer(&payment.CustomerParams{
+			Email:          payer.Email,
+			Description:    o.Name,
+			Card:           token,
+			PlanID:         plan.ID,
+			Quantity:       seats,
+			IdempotencyKey: key,
+		})
+		if err != nil {
+			return err
+		}
+
+		return syncOrganization(o, customer.ID, customer.Subscription)
+	}
+
+	sub, err := payments.UpdateSubscription(o.CustomerID, &payment.SubscriptionParams{
+		PlanID:         plan.ID,
+		Card:           token,
+		Quantity:       seats,
+		Prorate:        true,
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		return err
+	}
+
+	return syncOrganization(o, o.CustomerID, sub)
+}
+
+// syncOrganization stores the state of an organization's subscription. A
+// nil subscription means the customer isn't subscribed to anything.
+func syncOrganization(o *db.Organization, customerID string, sub *payment.Subscription) error {
+	o.CustomerID = customerID
+	o.Status = db.SubscriptionCanceled
+	o.UpdatedAt = time.Now()
+	o.AsOf = o.UpdatedAt
+	if sub != nil {
+		o.Status = sub.Status
+		o.PlanID = sub.PlanID
+		o.Seats = sub.Quantity
+		o.CurrentPeriodEnd = sub.CurrentPeriodEnd
+		if !sub.AsOf.IsZero() {
+			o.AsOf = sub.AsOf
+		}
+	}
+
+	return store.UpdateOrganization(o)
+}
+
+// organizationByCustomer finds the organization for a Stripe customer, or
+// nil if it isn't one of ours.
+func organizationByCustomer(customerID string) (*db.Organization, error) {
+	if customerID == "" {
+		return nil, nil
+	}
+
+	o, err := store.GetOrganizationByCustomer(customerID)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+
+	return o, err
+}
+
+// POST /organizations, creates an organization owned by the logged in
+// developer
+func CreateOrganizationHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var body organizationReq
+	err = json.NewDecoder(req.Body).Decode(&body)
+	if err == nil && strings.TrimSpace(body.Name) == "" {
+		err = errOrganizationName
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	o := &db.Organization{Name: strings.TrimSpace(body.Name), CreatedAt: now, UpdatedAt: now}
+	err = store.SaveOrganization(o)
+	if err == nil {
+		err = store.SaveMember(&db.Member{
+			OrganizationID: o.ID,
+			DeveloperID:    d.ID,
+			Role:           db.RoleOwner,
+			CreatedAt:      now,
+		})
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusCreated,
+		"organization": o,
+	})
+}
+
+// GET /organizations/{id}, gets an organization and its members, admins also
+// get the pending invitations and seat usage
+func GetOrganizationHandler(rw http.ResponseWriter, req *http.Request) {
+	r, status, err := loadOrgRequest(req, db.RoleMember)
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	members, err := getMembers(r.org)
+	invitations := []*db.Invitation{}
+	var seats *seatUsage
+	if err == nil && r.can(db.RoleAdmin) {
+		invitations, err = store.GetInvitations(r.org.ID, db.InvitationPending)
+		if err == nil {
+			seats, err = getSeatUsage(r.org)
+		}
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusFound,
+		"organization": r.org,
+		"role":         r.member.Role,
+		"members":      members,
+		"invitations":  invitations,
+		"seats":        seats,
+	})
+}
+
+// POST /organizations/{id}/invitations, emails an invitation to join the
+// organization, admins can invite admins and members while there are seats
+// left
+func InviteHandler(rw http.ResponseWriter, req *http.Request) {
+	r, status, err := loadOrgRequest(req, db.RoleAdmin)
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var body invitationReq
+	err = json.NewDecoder(req.Body).Decode(&body)
+	if body.Role == "" {
+		body.Role = db.RoleMember
+	}
+	if err == nil && body.Email == "" {
+		err = errors.New("email is required")
+	}
+	if _, ok := roleRanks[body.Role]; err == nil && !ok {
+		err = errInvalidRole
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if !r.can(body.Role) {
+		renderer.JSON(rw, http.StatusForbidden, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errRoleForbidden.Error(),
+		})
+		return
+	}
+
+	invitee, err := store.GetDeveloper(bson.M{"email": body.Email})
+	if err == nil {
+		_, err = store.GetMember(r.org.ID, invitee.ID)
+		if err == nil {
+			renderer.JSON(rw, http.StatusConflict, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  errAlreadyMember.Error(),
+			})
+			return
+		}
+	}
+	var seats *seatUsage
+	if err == nil || err == mgo.ErrNotFound {
+		seats, err = getSeatUsage(r.org)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if seats.full(seats.Pending) {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errSeatLimit.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	i := &db.Invitation{
+		OrganizationID: r.org.ID,
+		Email:          body.Email,
+		Role:           body.Role,
+		InvitedBy:      r.dev.ID,
+		Token:          util.HashToken(),
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(conf.Invitations.TTL.Duration),
+	}
+	err = store.SaveInvitation(i)
+	if err == nil {
+		err = sendEmail(supportAddress, &schemas.Developer{Email: i.Email}, "invitation", map[string]interface{}{
+			"name":         r.dev.Name,
+			"organization": r.org.Name,
+			"role":         i.Role,
+			"link":         conf.URL + "/invitations/" + i.Token,
+		})
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusCreated,
+		"invitation": i,
+	})
+}
+
+// GET /invitations/{invite}, gets an invitation and the organization it's to
+func GetInvitationHandler(rw http.ResponseWriter, req *http.Request) {
+	i, err := store.GetInvitation(mux.Vars(req)["invite"])
+	if err == mgo.ErrNotFound {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errNoInvitation.Error(),
+		})
+		return
+	}
+
+	var o *db.Organization
+	if err == nil {
+		o, err = store.GetOrganization(i.OrganizationID)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusFound,
+		"invitation":   i,
+		"organization": map[string]string{"id": o.ID.Hex(), "name": o.Name},
+	})
+}
+
+// POST /invitations/{invite}/accept, makes the logged in developer a member,
+// the invitation has to be to their email address and there has to be a
+// seat left
+func AcceptInvitationHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	i, err := store.GetInvitation(mux.Vars(req)["invite"])
+	status := http.StatusInternalServerError
+	var o *db.Organization
+	var seats *seatUsage
+	switch {
+	case err == mgo.ErrNotFound:
+		status, err = http.StatusNotFound, errNoInvitation
+	case err == nil && !strings.EqualFold(i.Email, d.Email):
+		status, err = http.StatusForbidden, errWrongInvitee
+	case err == nil:
+		o, err = store.GetOrganization(i.OrganizationID)
+		if err == nil {
+			seats, err = getSeatUsage(o)
+		}
+		if err == nil && seats.full(0) {
+			status, err = http.StatusConflict, errSeatLimit
+		}
+		if err == nil {
+			err = store.RespondToInvitation(i.ID, db.InvitationAccepted, time.Now())
+			if err == mgo.ErrNotFound {
+				status, err = http.StatusConflict, errInvitationUsed
+			}
+		}
+	}
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	m := &db.Member{
+		OrganizationID: i.OrganizationID,
+		DeveloperID:    d.ID,
+		Role:           i.Role,
+		CreatedAt:      time.Now(),
+	}
+	err = store.SaveMember(m)
+
+	// Already being a member keeps the role they have.
+	if mgo.IsDup(err) {
+		m, err = store.GetMember(i.OrganizationID, d.ID)
+	} else if err == nil {
+		billSeats(o)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusSuccess,
+		"member": m,
+	})
+}
+
+// POST /invitations/{invite}/decline, turns down an invitation
+func DeclineInvitationHandler(rw http.ResponseWriter, req *http.Request) {
+	i, err := store.GetInvitation(mux.Vars(req)["invite"])
+	if err == nil {
+		err = store.RespondToInvitation(i.ID, db.InvitationDeclined, time.Now())
+		if err == mgo.ErrNotFound {
+			renderer.JSON(rw, http.StatusConflict, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  errInvitationUsed.Error(),
+			})
+			return
+		}
+	} else if err == mgo.ErrNotFound {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errNoInvitation.Error(),
+		})
+		return
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// PUT /organizations/{id}/members/{developerId}, changes a member's role,
+// only owners can change owners or make new ones
+func UpdateMemberHandler(rw http.ResponseWriter, req *http.Request) {
+	r, status, err := loadOrgRequest(req, db.RoleAdmin)
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var body memberReq
+	err = json.NewDecoder(req.Body).Decode(&body)
+	if _, ok := roleRanks[body.Role]; err == nil && !ok {
+		err = errInvalidRole
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	m, status, err := memberInPath(req)
+	if err == nil && (!r.can(m.Role) || !r.can(body.Role)) {
+		status, err = http.StatusForbidden, errRoleForbidden
+	}
+	if err == nil && body.Role != db.RoleOwner {
+		status = http.StatusConflict
+		err = checkOwnersLeft(m)
+	}
+	if err == nil {
+		m.Role = body.Role
+		status = http.StatusInternalServerError
+		err = store.UpdateMember(m)
+	}
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusUpdated,
+		"member": m,
+	})
+}
+
+// DELETE /organizations/{id}/members/{developerId}, removes a member, admins
+// can remove others and anyone can leave
+func RemoveMemberHandler(rw http.ResponseWriter, req *http.Request) {
+	r, status, err := loadOrgRequest(req, db.RoleMember)
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	m, status, err := memberInPath(req)
+	leaving := err == nil && m.DeveloperID == r.dev.ID
+	if err == nil && !leaving && (!r.can(db.RoleAdmin) || !r.can(m.Role)) {
+		status, err = http.StatusForbidden, errRoleForbidden
+	}
+	if err == nil {
+		status = http.StatusConflict
+		err = checkOwnersLeft(m)
+	}
+	if err == nil {
+		status = http.StatusInternalServerError
+		err = store.RemoveMember(m.OrganizationID, m.DeveloperID)
+	}
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	billSeats(r.org)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// memberInPath gets the member in the request's path. Failures come with
+// the status to respond with.
+func memberInPath(req *http.Request) (*db.Member, int, error) {
+	vars := mux.Vars(req)
+	if !bson.IsObjectIdHex(vars["developerId"]) {
+		return nil, http.StatusNotFound, errNoMember
+	}
+
+	m, err := store.GetMember(bson.ObjectIdHex(vars["id"]), bson.ObjectIdHex(vars["developerId"]))
+	if err == mgo.ErrNotFound {
+		return nil, http.StatusNotFound, errNoMember
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return m, http.StatusOK, nil
+}
+
+// POST /organizations/{id}/pay, subscribes the organization to a plan with a
+// seat for each member, only owners can pay
+func OrganizationPaymentHandler(rw http.ResponseWriter, req *http.Request) {
+	r, status, err := loadOrgRequest(req, db.RoleOwner)
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var body paymentReq
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if body.Plan == "" {
+		body.Plan = conf.Billing.DefaultPlan
+	}
+	plan, ok := conf.Billing.Plan(body.Plan)
+	if !ok {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "no such plan " + body.Plan,
+		})
+		return
+	}
+
+	seats, err := seatsFor(r.org, plan)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := requireVerified(r.dev); err != nil {
+		status := http.StatusInternalServerError
+		if err == errNotVerified {
+			status = http.StatusForbidden
+		}
+
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	err = subscribeOrganization(r.org, r.dev, plan, seats, body.StripeToken, req.Header.Get("Idempotency-Key"))
+	if err != nil {
+		status := http.StatusBadRequest
+		if payment.IsTemporary(err) {
+			status = http.StatusBadGateway
+		} else if err == errPaymentInProgress {
+			status = http.StatusConflict
+		}
+
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":       requests.StatusSuccess,
+		"organization": r.org,
+	})
+}
+
+// seatsAccount is an organization along with its seat usage.
+type seatsAccount struct {
+	*db.Organization
+	Seats *seatUsage
+	Full  bool
+}
+
+// GET /admin/organizations, Lists organizations and how many of their seats
+// are used
+func OrganizationsHandler(rw http.ResponseWriter, req *http.Request) {
+	organizations, err := store.GetOrganizations()
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	accounts := make([]*seatsAccount, 0, len(organizations))
+	for _, o := range organizations {
+		seats, err := getSeatUsage(o)
+		if err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+
+		accounts = append(accounts, &seatsAccount{Organization: o, Seats: seats, Full: seats.full(seats.Pending)})
+	}
+
+	if err := RenderTemplate(rw, "organizations", map[string]interface{}{
+		"Organizations": accounts,
+	}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
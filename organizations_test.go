@@ -0,0 +1,402 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/license"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"labix.org/v2/mgo/bson"
+)
+
+var invitationLink = regexp.MustCompile(`/invitations/([^"<\s]+)`)
+
+// jsonRequest sends a request with a JSON body, returning the response and
+// its decoded body.
+func jsonRequest(t *testing.T, method, path string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+
+	req, err := http.NewRequest(method, "http://broome.io"+path, &buf)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+
+	resBody := map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &resBody); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+
+	return res, resBody
+}
+
+// newDeveloper saves a developer with the given email.
+func newDeveloper(t *testing.T, email string) *schemas.Developer {
+	d := &schemas.Developer{
+		ID:    bson.NewObjectId(),
+		Name:  "Steve Kaliski",
+		Email: email,
+		Token: util.HashToken(),
+		Salt:  "a1681ed1-8830-11e3-84be-0d701751111b",
+	}
+	if err := store.Save(d); err != nil {
+		t.Fatal("Could not save developer:", err)
+	}
+
+	return d
+}
+
+// newOrganization creates an organization owned by the developer with token.
+func newOrganization(t *testing.T, token string) string {
+	res, body := jsonRequest(t, "POST", "/organizations?token="+token, organizationReq{Name: "Bowery"})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	return body["organization"].(map[string]interface{})["id"].(string)
+}
+
+// addMember makes a developer a member of an organization with role.
+func addMember(t *testing.T, orgID string, d *schemas.Developer, role string) {
+	err := store.SaveMember(&db.Member{
+		OrganizationID: bson.ObjectIdHex(orgID),
+		DeveloperID:    d.ID,
+		Role:           role,
+		CreatedAt:      time.Now(),
+	})
+	if err != nil {
+		t.Fatal("Could not save member:", err)
+	}
+}
+
+func TestOrganizationInvitations(t *testing.T) {
+	_, owner, done := billingTest(t)
+	defer done()
+
+	id := newOrganization(t, owner.Token)
+	invitee := newDeveloper(t, "steve@bowery.io")
+
+	res, _ := jsonRequest(t, "POST", "/organizations/"+id+"/invitations?token="+owner.Token, invitationReq{Email: invitee.Email})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	pending, _ := store.GetEmails(db.EmailPending)
+	if len(pending) != 1 || pending[0].Message.To[0].Email != invitee.Email {
+		t.Fatal("invitation should be emailed to the invitee.")
+	}
+	match := invitationLink.FindStringSubmatch(pending[0].Message.Text)
+	if match == nil {
+		t.Fatal("invitation email has no link:", pending[0].Message.Text)
+	}
+	invite := match[1]
+
+	if res, body := jsonRequest(t, "GET", "/invitations/"+invite, nil); res.Code != http.StatusOK ||
+		body["organization"].(map[string]interface{})["name"] != "Bowery" {
+		t.Errorf("invitation should be found, got %v\tbody: %v", res.Code, res.Body)
+	}
+
+	if res, _ := jsonRequest(t, "POST", "/invitations/"+invite+"/accept?token="+owner.Token, nil); res.Code != http.StatusForbidden {
+		t.Error("invitation should only be accepted by the invitee, got", res.Code)
+	}
+	if res, _ := jsonRequest(t, "POST", "/invitations/"+invite+"/accept?token="+invitee.Token, nil); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if res, _ := jsonRequest(t, "POST", "/invitations/"+invite+"/decline", nil); res.Code != http.StatusConflict {
+		t.Error("invitation should only be answered once, got", res.Code)
+	}
+
+	_, body := jsonRequest(t, "GET", "/developers/me?token="+invitee.Token, nil)
+	orgs, _ := body["developer"].(map[string]interface{})["organizations"].([]interface{})
+	if len(orgs) != 1 || orgs[0].(map[string]interface{})["role"] != db.RoleMember {
+		t.Error("membership should be in /developers/me, got", orgs)
+	}
+
+	// Members can't invite.
+	res, _ = jsonRequest(t, "POST", "/organizations/"+id+"/invitations?token="+invitee.Token, invitationReq{Email: "new@bowery.io"})
+	if res.Code != http.StatusForbidden {
+		t.Error("members shouldn't invite, got", res.Code)
+	}
+	res, _ = jsonRequest(t, "POST", "/organizations/"+id+"/invitations?token="+owner.Token, invitationReq{Email: invitee.Email})
+	if res.Code != http.StatusConflict {
+		t.Error("members shouldn't be invited again, got", res.Code)
+	}
+}
+
+func TestDeclineInvitation(t *testing.T) {
+	_, owner, done := billingTest(t)
+	defer done()
+
+	id := newOrganization(t, owner.Token)
+	i := &db.Invitation{
+		OrganizationID: bson.ObjectIdHex(id),
+		Email:          "steve@bowery.io",
+		Role:           db.RoleMember,
+		InvitedBy:      owner.ID,
+		Token:          "invite",
+		ExpiresAt:      time.Now().Add(time.Hour),
+	}
+	if err := store.SaveInvitation(i); err != nil {
+		t.Fatal("Could not save invitation:", err)
+	}
+
+	if res, _ := jsonRequest(t, "POST", "/invitations/invite/decline", nil); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	invitee := newDeveloper(t, i.Email)
+	if res, _ := jsonRequest(t, "POST", "/invitations/invite/accept?token="+invitee.Token, nil); res.Code != http.StatusConflict {
+		t.Error("declined invitation shouldn't be accepted, got", res.Code)
+	}
+	if res, _ := jsonRequest(t, "POST", "/invitations/nope/decline", nil); res.Code != http.StatusNotFound {
+		t.Error("unknown invitation should be not found, got", res.Code)
+	}
+}
+
+func TestOrganizationRoles(t *testing.T) {
+	_, owner, done := billingTest(t)
+	defer done()
+
+	id := newOrganization(t, owner.Token)
+	admin := newDeveloper(t, "admin@bowery.io")
+	member := newDeveloper(t, "member@bowery.io")
+	addMember(t, id, admin, db.RoleMember)
+	addMember(t, id, member, db.RoleMember)
+	members := "/organizations/" + id + "/members/"
+
+	for _, c := range []struct {
+		method, path, token string
+		body                interface{}
+		code                int
+	}{
+		{"PUT", members + admin.ID.Hex(), member.Token, memberReq{Role: db.RoleAdmin}, http.StatusForbidden},
+		{"PUT", members + admin.ID.Hex(), owner.Token, memberReq{Role: "boss"}, http.StatusBadRequest},
+		{"PUT", members + admin.ID.Hex(), owner.Token, memberReq{Role: db.RoleAdmin}, http.StatusOK},
+		{"PUT", members + member.ID.Hex(), admin.Token, memberReq{Role: db.RoleOwner}, http.StatusForbidden},
+		{"PUT", members + owner.ID.Hex(), owner.Token, memberReq{Role: db.RoleMember}, http.StatusConflict},
+		{"DELETE", members + owner.ID.Hex(), admin.Token, nil, http.StatusForbidden},
+		{"DELETE", members + owner.ID.Hex(), owner.Token, nil, http.StatusConflict},
+		{"DELETE", members + admin.ID.Hex(), member.Token, nil, http.StatusForbidden},
+		{"DELETE", members + member.ID.Hex(), admin.Token, nil, http.StatusOK},
+		{"DELETE", members + admin.ID.Hex(), admin.Token, nil, http.StatusOK},
+		{"GET", "/organizations/" + id, admin.Token, nil, http.StatusForbidden},
+	} {
+		if res, _ := jsonRequest(t, c.method, c.path+"?token="+c.token, c.body); res.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %v\tbody: %v", c.method, c.path, c.code, res.Code, res.Body)
+		}
+	}
+
+	_, body := jsonRequest(t, "GET", "/organizations/"+id+"?token="+owner.Token, nil)
+	if list := body["members"].([]interface{}); len(list) != 1 {
+		t.Error("only the owner should be left, got", list)
+	}
+}
+
+func TestOrganizationBilling(t *testing.T) {
+	_, owner, done := billingTest(t)
+	defer done()
+
+	server := httptest.NewServer(http.HandlerFunc(broomeServer))
+	defer server.Close()
+
+	id := newOrganization(t, owner.Token)
+	member := newDeveloper(t, "steve@bowery.io")
+	addMember(t, id, member, db.RoleMember)
+
+	if status := getSession(t, member); status != requests.StatusExpired {
+		t.Error("member of an unpaid organization shouldn't be licensed, got", status)
+	}
+
+	pay := paymentReq{StripeToken: payment.TestCard}
+	if res, _ := jsonRequest(t, "POST", "/organizations/"+id+"/pay?token="+member.Token, pay); res.Code != http.StatusForbidden {
+		t.Error("only owners should pay, got", res.Code)
+	}
+	res, body := jsonRequest(t, "POST", "/organizations/"+id+"/pay?token="+owner.Token, pay)
+	if res.Code != http.StatusOK || body["organization"].(map[string]interface{})["status"] != db.SubscriptionActive {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	_, l, err := license.Refresh(server.URL, member.ID.Hex(), member.Token, publicLicenseKey(t))
+	if err != nil || l.Entitled("bowery", time.Now()) != nil {
+		t.Error("member should be licensed by the organization:", err)
+	}
+
+	ledger, _ := store.GetPayments(owner.ID)
+	if len(ledger) != 1 || ledger[0].OrganizationID.Hex() != id {
+		t.Error("organization payment should be in the payer's ledger, got", ledger)
+	}
+	if d, _ := store.GetDeveloperById(member.ID.Hex()); d.IsPaid || d.StripeToken != "" {
+		t.Error("organization billing shouldn't touch the member's own billing.")
+	}
+}
+
+// invite invites an email to an organization as the developer with token.
+func invite(t *testing.T, id, token, email string) *httptest.ResponseRecorder {
+	res, _ := jsonRequest(t, "POST", "/organizations/"+id+"/invitations?token="+token, invitationReq{Email: email})
+	return res
+}
+
+func TestSeatBilling(t *testing.T) {
+	plans := conf.Billing.Plans
+	defer func() { conf.Billing.Plans = plans }()
+	team := config.PlanConfig{ID: "bowery-team", Product: "bowery", Name: "Bowery 3 Team",
+		Amount: 2000, Currency: "usd", Interval: "month", Seats: 2}
+	conf.Billing.Plans = append(append([]config.PlanConfig{}, plans...), team)
+
+	_, owner, done := billingTest(t)
+	defer done()
+
+	id := newOrganization(t, owner.Token)
+	res, _ := jsonRequest(t, "POST", "/organizations/"+id+"/pay?token="+owner.Token,
+		paymentReq{StripeToken: payment.TestCard, Plan: team.ID})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if ledger, _ := store.GetPayments(owner.ID); len(ledger) != 1 || ledger[0].Amount != team.Amount {
+		t.Error("organization should pay for one seat, got", ledger)
+	}
+
+	if res := invite(t, id, owner.Token, "steve@bowery.io"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if res := invite(t, id, owner.Token, "david@bowery.io"); res.Code != http.StatusConflict {
+		t.Error("pending invitations should hold the last seat, got", res.Code)
+	}
+
+	_, body := jsonRequest(t, "GET", "/organizations/"+id+"?token="+owner.Token, nil)
+	seats, _ := body["seats"].(map[string]interface{})
+	if seats["used"] != 1.0 || seats["pending"] != 1.0 || seats["limit"] != 2.0 || seats["billed"] != 1.0 {
+		t.Error("admins should see seat usage, got", seats)
+	}
+
+	// Joining and leaving changes the seats billed.
+	steve := newDeveloper(t, "steve@bowery.io")
+	pending, _ := store.GetEmails(db.EmailPending)
+	var link string
+	for _, e := range pending {
+		if match := invitationLink.FindStringSubmatch(e.Message.Text); match != nil {
+			link = match[1]
+		}
+	}
+	if res, _ := jsonRequest(t, "POST", "/invitations/"+link+"/accept?token="+steve.Token, nil); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	o, _ := store.GetOrganization(bson.ObjectIdHex(id))
+	customer, err := payments.GetCustomer(o.CustomerID)
+	if err != nil || o.Seats != 2 || customer.Subscription.Quantity != 2 {
+		t.Error("new member should be billed for, got", o.Seats, err)
+	}
+
+	res, _ = jsonRequest(t, "DELETE", "/organizations/"+id+"/members/"+steve.ID.Hex()+"?token="+steve.Token, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if o, _ := store.GetOrganization(bson.ObjectIdHex(id)); o.Seats != 1 {
+		t.Error("member that left should stop being billed for, got", o.Seats)
+	}
+
+	// The admin UI shows it too.
+	res = httptest.NewRecorder()
+	broomeServer(res, adminRequest(t, "GET", "/admin/organizations"))
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "billed for 1") {
+		t.Errorf("organization should be listed, got %v\tbody: %v", res.Code, res.Body)
+	}
+
+	// Overage lets them go past the limit.
+	conf.Billing.Plans[len(conf.Billing.Plans)-1].Overage = true
+	for _, email := range []string{"david@bowery.io", "matt@bowery.io"} {
+		if res := invite(t, id, owner.Token, email); res.Code != http.StatusOK {
+			t.Error("plan with overage shouldn't limit invitations, got", res.Code)
+		}
+	}
+}
+
+func TestSeatSyncRetry(t *testing.T) {
+	plans := conf.Billing.Plans
+	defer func() { conf.Billing.Plans = plans }()
+	team := config.PlanConfig{ID: "bowery-team", Product: "bowery", Name: "Bowery 3 Team",
+		Amount: 2000, Currency: "usd", Interval: "month", Seats: 2}
+	conf.Billing.Plans = append(append([]config.PlanConfig{}, plans...), team)
+
+	fake, owner, done := billingTest(t)
+	defer done()
+
+	id := newOrganization(t, owner.Token)
+	res, _ := jsonRequest(t, "POST", "/organizations/"+id+"/pay?token="+owner.Token,
+		paymentReq{StripeToken: payment.TestCard, Plan: team.ID})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	steve := newDeveloper(t, "steve@bowery.io")
+	addMember(t, id, steve, db.RoleMember)
+	o, _ := store.GetOrganization(bson.ObjectIdHex(id))
+	if err := updateSeats(o); err != nil || o.Seats != 2 {
+		t.Fatal("Could not update seats:", o.Seats, err)
+	}
+
+	// Stripe being down doesn't stop them leaving, the seats are billed later.
+	fake.FailRequests(1)
+	res, _ = jsonRequest(t, "DELETE", "/organizations/"+id+"/members/"+steve.ID.Hex()+"?token="+owner.Token, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if o, _ := store.GetOrganization(o.ID); !o.SeatsOutOfSync || o.Seats != 2 {
+		t.Fatal("failed seat update should be marked for a retry, got", o.Seats, o.SeatsOutOfSync)
+	}
+
+	if n, err := syncSeats(); n != 1 || err != nil {
+		t.Fatal("seats should be billed again, got", n, err)
+	}
+	o, _ = store.GetOrganization(o.ID)
+	customer, err := payments.GetCustomer(o.CustomerID)
+	if err != nil || o.SeatsOutOfSync || o.Seats != 1 || customer.Subscription.Quantity != 1 {
+		t.Error("retry should bill for the members left, got", o.Seats, o.SeatsOutOfSync, err)
+	}
+
+	if n, _ := syncSeats(); n != 0 {
+		t.Error("synced seats shouldn't be billed again, got", n)
+	}
+}
+
+func TestSeatLimitPayment(t *testing.T) {
+	plans := conf.Billing.Plans
+	defer func() { conf.Billing.Plans = plans }()
+	team := config.PlanConfig{ID: "bowery-team", Product: "bowery", Name: "Bowery 3 Team",
+		Amount: 2000, Currency: "usd", Interval: "month", Seats: 1}
+	conf.Billing.Plans = append(append([]config.PlanConfig{}, plans...), team)
+
+	_, owner, done := billingTest(t)
+	defer done()
+
+	id := newOrganization(t, owner.Token)
+	addMember(t, id, newDeveloper(t, "steve@bowery.io"), db.RoleMember)
+
+	res, _ := jsonRequest(t, "POST", "/organizations/"+id+"/pay?token="+owner.Token,
+		paymentReq{StripeToken: payment.TestCard, Plan: team.ID})
+	if res.Code != http.StatusBadRequest {
+		t.Error("members past the plan's seats shouldn't be paid for, got", res.Code)
+	}
+
+	res, body := jsonRequest(t, "POST", "/organizations/"+id+"/pay?token="+owner.Token, paymentReq{StripeToken: payment.TestCard})
+	if res.Code != http.StatusOK || body["organization"].(map[string]interface{})["seats"] != 2.0 {
+		t.Errorf("every member should be paid for, got %v\tbody: %v", res.Code, res.Body)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2014 Bowery, Inc.
+// Contains versioned password hashing.
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Bowery/gopackages/util"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Names of the supported algorithms.
+const (
+	Bcrypt   = "bcrypt"
+	Scrypt   = "scrypt"
+	Argon2id = "argon2id"
+)
+
+const saltLen = 16
+
+var (
+	ErrUnknownAlgorithm = errors.New("password: unknown algorithm")
+	ErrMalformedHash    = errors.New("password: malformed hash")
+)
+
+// algorithm hashes passwords into a self describing string. Every encoded
+// hash starts with "$" followed by the algorithm's prefix.
+type algorithm interface {
+	// hash encodes pass with the current parameters.
+	hash(pass string) (string, error)
+
+	// verify checks pass against an encoded hash, and reports if the hash
+	// was made with outdated parameters.
+	verify(pass, encoded string) (ok bool, outdated bool, err error)
+}
+
+var (
+	algorithms = map[string]algorithm{
+		Bcrypt:   bcryptAlgorithm{cost: bcrypt.DefaultCost},
+		Scrypt:   scryptAlgorithm{logN: 15, r: 8, p: 1, keyLen: 32},
+		Argon2id: argon2Algorithm{time: 1, memory: 64 * 1024, threads: 4, keyLen: 32},
+	}
+	current = Argon2id
+)
+
+// SetDefault sets the algorithm new hashes are created with.
+func SetDefault(name string) error {
+	if _, ok := algorithms[name]; !ok {
+		return ErrUnknownAlgorithm
+	}
+
+	current = name
+	return nil
+}
+
+// Hash encodes pass with the default algorithm.
+func Hash(pass string) (string, error) {
+	return algorithms[current].hash(pass)
+}
+
+// Verify checks pass against an encoded hash. Hashes from before the
+// versioned format are verified with their separately stored salt. The
+// returned rehash is true if the hash should be replaced with a new one
+// from Hash, either because it uses an older algorithm or older parameters.
+func Verify(pass, encoded, salt string) (ok bool, rehash bool, err error) {
+	name, err := algorithmName(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	// Legacy hashes have no prefix, they're a hex HMAC keyed by the salt.
+	if name == "" {
+		ok := hmac.Equal([]byte(util.HashPassword(pass, salt)), []byte(encoded))
+		return ok, ok, nil
+	}
+
+	alg, exists := algorithms[name]
+	if !exists {
+		return false, false, ErrUnknownAlgorithm
+	}
+
+	ok, outdated, err := alg.verify(pass, encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+
+	return true, outdated || name != current, nil
+}
+
+// algorithmName gets the name of the algorithm an encoded hash uses, or an
+// empty string for legacy hashes.
+func algorithmName(encoded string) (string, error) {
+	if !strings.HasPrefix(encoded, "$") {
+		return "", nil
+	}
+
+	parts := strings.SplitN(encoded[1:], "$", 2)
+	if len(parts) != 2 {
+		return "", ErrMalformedHash
+	}
+
+	// bcrypt uses its own version prefixes, e.g. $2a$.
+	if strings.HasPrefix(parts[0], "2") {
+		return Bcrypt, nil
+	}
+
+	return parts[0], nil
+}
+
+// newSalt generates a random salt.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLen)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+var b64 = base64.RawStdEncoding
+
+// bcryptAlgorithm encodes hashes in bcrypt's own format, e.g.
+// $2a$10$<salt and hash>.
+type bcryptAlgorithm struct {
+	cost int
+}
+
+func (a bcryptAlgorithm) hash(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), a.cost)
+	return string(hash), err
+}
+
+func (a bcryptAlgorithm) verify(pass, encoded string) (bool, bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pass))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return true, cost != a.cost, err
+}
+
+// scryptAlgorithm encodes hashes as $scrypt$ln=15,r=8,p=1$<salt>$<hash>.
+type scryptAlgorithm struct {
+	logN, r, p, keyLen int
+}
+
+func (a scryptAlgorithm) hash(pass string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(pass), salt, 1<<uint(a.logN), a.r, a.p, a.keyLen)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("$%s$ln=%d,r=%d,p=%d$%s$%s", Scrypt, a.logN, a.r, a.p,
+		b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (a scryptAlgorithm) verify(pass, encoded string) (bool, bool, error) {
+	var params scryptAlgorithm
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return false, false, ErrMalformedHash
+	}
+
+	_, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.logN, &params.r, &params.p)
+	if err != nil {
+		return false, false, ErrMalformedHash
+	}
+
+	salt, key, err := decodeSaltAndKey(parts[3], parts[4])
+	if err != nil {
+		return false, false, err
+	}
+	params.keyLen = len(key)
+
+	other, err := scrypt.Key([]byte(pass), salt, 1<<uint(params.logN), params.r, params.p, params.keyLen)
+	if err != nil {
+		return false, false, err
+	}
+
+	return subtle.ConstantTimeCompare(key, other) == 1, params != a, nil
+}
+
+// argon2Algorithm encodes hashes in the PHC format used by the reference
+// implementation, $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>.
+type argon2Algorithm struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+func (a argon2Algorithm) hash(pass string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(pass), salt, a.time, a.memory, a.threads, a.keyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version,
+		a.memory, a.time, a.threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (a argon2Algorithm) verify(pass, encoded string) (bool, bool, error) {
+	var (
+		params  argon2Algorithm
+		version int
+	)
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, ErrMalformedHash
+	}
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false, ErrMalformedHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return false, false, ErrMalformedHash
+	}
+
+	salt, key, err := decodeSaltAndKey(parts[4], parts[5])
+	if err != nil {
+		return false, false, err
+	}
+	params.keyLen = uint32(len(key))
+
+	other := argon2.IDKey([]byte(pass), salt, params.time, params.memory, params.threads, params.keyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1, params != a, nil
+}
+
+// decodeSaltAndKey decodes the base64 salt and key of an encoded hash.
+func decodeSaltAndKey(encodedSalt, encodedKey string) ([]byte, []byte, error) {
+	salt, err := b64.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, nil, ErrMalformedHash
+	}
+
+	key, err := b64.DecodeString(encodedKey)
+	if err != nil || len(key) == 0 {
+		return nil, nil, ErrMalformedHash
+	}
+
+	return salt, key, nil
+}
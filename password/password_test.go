@@ -0,0 +1,99 @@
+// Copyright 2014 Bowery, Inc.
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Bowery/gopackages/util"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	defer SetDefault(Argon2id)
+
+	for _, name := range []string{Bcrypt, Scrypt, Argon2id} {
+		if err := SetDefault(name); err != nil {
+			t.Fatal("Unable to set default algorithm:", err)
+		}
+
+		hash, err := Hash("java$cript")
+		if err != nil {
+			t.Fatal("Unable to hash password with", name, err)
+		}
+
+		ok, rehash, err := Verify("java$cript", hash, "")
+		if err != nil || !ok || rehash {
+			t.Error(name, "hash didn't verify:", ok, rehash, err)
+		}
+
+		ok, _, err = Verify("javascript", hash, "")
+		if err != nil || ok {
+			t.Error(name, "hash verified the wrong password:", err)
+		}
+	}
+}
+
+func TestVerifyLegacy(t *testing.T) {
+	salt := "a1681ed1-8830-11e3-84be-0d701751111b"
+	hash := util.HashPassword("java$cript", salt)
+
+	ok, rehash, err := Verify("java$cript", hash, salt)
+	if err != nil || !ok {
+		t.Fatal("legacy hash didn't verify:", err)
+	}
+	if !rehash {
+		t.Error("legacy hashes should always be rehashed.")
+	}
+
+	ok, rehash, err = Verify("javascript", hash, salt)
+	if err != nil || ok || rehash {
+		t.Error("legacy hash verified the wrong password.")
+	}
+}
+
+func TestVerifyOtherAlgorithm(t *testing.T) {
+	defer SetDefault(Argon2id)
+
+	SetDefault(Bcrypt)
+	hash, err := Hash("java$cript")
+	if err != nil {
+		t.Fatal("Unable to hash password:", err)
+	}
+
+	SetDefault(Argon2id)
+	ok, rehash, err := Verify("java$cript", hash, "")
+	if err != nil || !ok || !rehash {
+		t.Error("hashes from another algorithm should verify and be rehashed.")
+	}
+}
+
+func TestVerifyOutdatedParams(t *testing.T) {
+	old := argon2Algorithm{time: 1, memory: 32 * 1024, threads: 4, keyLen: 32}
+	hash, err := old.hash("java$cript")
+	if err != nil {
+		t.Fatal("Unable to hash password:", err)
+	}
+
+	if !strings.Contains(hash, "m=32768,") {
+		t.Fatal("hash doesn't record its parameters:", hash)
+	}
+
+	ok, rehash, err := Verify("java$cript", hash, "")
+	if err != nil || !ok || !rehash {
+		t.Error("hashes with older parameters should be rehashed.", err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	for _, hash := range []string{"$argon2id", "$argon2id$v=19$m=1,t=1,p=1$!!$!!", "$md5$abc$def"} {
+		if ok, _, err := Verify("java$cript", hash, ""); ok || err == nil {
+			t.Error("malformed hash", hash, "should fail to verify.")
+		}
+	}
+}
+
+func TestSetDefaultUnknown(t *testing.T) {
+	if err := SetDefault("md5"); err != ErrUnknownAlgorithm {
+		t.Error("unknown algorithms should be rejected.")
+	}
+}
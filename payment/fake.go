@@ -0,0 +1,467 @@
+// Copyright 2014 Bowery, Inc.
+package payment
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cards the fake knows, any other token is treated as a working card.
+const (
+	TestCard         = "tok_visa"
+	TestCardDeclined = "tok_chargeDeclined"
+)
+
+// The subscription states the fake uses, they match Stripe's.
+const (
+	StatusActive   = "active"
+	StatusPastDue  = "past_due"
+	StatusCanceled = "canceled"
+)
+
+var (
+	errDeclined = &Error{Type: CardError, Message: "Your card was declined."}
+	errNoCard   = &Error{Type: CardError, Message: "This customer has no attached card."}
+	errNetwork  = &Error{Type: ConnectionError, Message: "fake: connection reset by peer"}
+	errKeyReuse = &Error{Type: APIError, Message: "Keys for idempotent requests can only be used for the same request."}
+)
+
+// Plan is a plan the fake can subscribe customers to.
+type Plan struct {
+	ID       string
+	Amount   int64
+	Currency string
+	Interval string
+}
+
+// Fake is a Provider that keeps everything in memory, for tests and offline
+// development. Subscriptions are charged up front when they start or change
+// plan, and renewed when a customer is retrieved after their period ends.
+type Fake struct {
+	// Now is the fake's clock, tests can move it to renew subscriptions.
+	Now func() time.Time
+
+	mutex         sync.Mutex
+	plans         map[string]*Plan
+	customers     map[string]*fakeCustomer
+	charges       []*Charge
+	chargeKeys    map[string]string
+	declined      map[string]bool
+	results       map[string]*fakeResult
+	ignoreKeys    bool
+	failRequests  int
+	dropResponses int
+	ids           int
+}
+
+type fakeCustomer struct {
+	id   string
+	key  string
+	card string
+	sub  *Subscription
+}
+
+// fakeResult is what a request with an idempotency key returned.
+type fakeResult struct {
+	request string
+	value   interface{}
+	err     error
+}
+
+// NewFake creates a Fake with the given plans.
+func NewFake(plans ...Plan) *Fake {
+	f := &Fake{
+		Now:        time.Now,
+		plans:      make(map[string]*Plan),
+		customers:  make(map[string]*fakeCustomer),
+		chargeKeys: make(map[string]string),
+		declined:   map[string]bool{TestCardDeclined: true},
+		results:    make(map[string]*fakeResult),
+	}
+
+	for i := range plans {
+		f.plans[plans[i].ID] = &plans[i]
+	}
+
+	return f
+}
+
+// Decline makes charges to a card fail from now on.
+func (f *Fake) Decline(card string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.declined[card] = true
+}
+
+// SetCard replaces a customer's card.
+func (f *Fake) SetCard(customerID, card string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if c, ok := f.customers[customerID]; ok {
+		c.card = card
+	}
+}
+
+// FailRequests makes the next n requests fail with a connection error
+// before they reach the fake.
+func (f *Fake) FailRequests(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failRequests = n
+}
+
+// IgnoreKeys makes the fake carry out every request again, like a provider
+// that doesn't dedupe idempotency keys. The keys are still kept with what
+// the requests create so they can be found.
+func (f *Fake) IgnoreKeys() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.ignoreKeys = true
+}
+
+// DropResponses makes the next n requests go through but fail with a
+// connection error, like a timeout after the provider got the request.
+func (f *Fake) DropResponses(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.dropResponses = n
+}
+
+// Charges gets the successful charges made to a customer, oldest first. An
+// empty customerID gets the charges made to everyone.
+func (f *Fake) Charges(customerID string) []*Charge {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	charges := []*Charge{}
+	for _, charge := range f.charges {
+		if (customerID == "" || charge.CustomerID == customerID) && charge.Paid {
+			c := *charge
+			charges = append(charges, &c)
+		}
+	}
+
+	return charges
+}
+
+func (f *Fake) CreateCustomer(params *CustomerParams) (*Customer, error) {
+	res, err := f.do("CreateCustomer", params.IdempotencyKey, func() (interface{}, error) {
+		c := &fakeCustomer{id: f.newID("cus"), key: params.IdempotencyKey, card: params.Card}
+		if params.PlanID != "" {
+			sub, err := f.subscribe(c, params.PlanID, params.Quantity)
+			if err != nil {
+				return nil, err
+			}
+			sub.IdempotencyKey = params.IdempotencyKey
+			c.sub = sub
+		}
+
+		f.customers[c.id] = c
+		return c.customer(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	customer := *res.(*Customer)
+	return &customer, nil
+}
+
+func (f *Fake) GetCustomer(id string) (*Customer, error) {
+	res, err := f.do("GetCustomer", "", func() (interface{}, error) {
+		c, ok := f.customers[id]
+		if !ok {
+			return nil, &Error{Type: APIError, Message: "No such customer: " + id}
+		}
+
+		f.renew(c)
+		return c.customer(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*Customer), nil
+}
+
+func (f *Fake) UpdateSubscription(customerID string, params *SubscriptionParams) (*Subscription, error) {
+	res, err := f.do("UpdateSubscription", params.IdempotencyKey, func() (interface{}, error) {
+		c, ok := f.customers[customerID]
+		if !ok {
+			return nil, &Error{Type: APIError, Message: "No such customer: " + customerID}
+		}
+
+		card := c.card
+		if params.Card != "" {
+			c.card = params.Card
+		}
+
+		planID := params.PlanID
+		if planID == "" && c.sub != nil {
+			planID = c.sub.PlanID
+		}
+
+		// Changing plan or restarting a lapsed subscription starts a new
+		// period, anything else keeps the current one.
+		if c.sub != nil && c.sub.PlanID == planID && c.sub.Status == StatusActive {
+			if params.Quantity > 0 {
+				c.sub.Quantity = params.Quantity
+			}
+			c.sub.IdempotencyKey = params.IdempotencyKey
+			return copySubscription(c.sub), nil
+		}
+
+		sub, err := f.subscribe(c, planID, params.Quantity)
+		if err != nil {
+			c.card = card
+			return nil, err
+		}
+		sub.IdempotencyKey = params.IdempotencyKey
+		c.sub = sub
+
+		return copySubscription(c.sub), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return copySubscription(res.(*Subscription)), nil
+}
+
+func (f *Fake) CancelSubscription(customerID string) (*Subscription, error) {
+	res, err := f.do("CancelSubscription", "", func() (interface{}, error) {
+		c, ok := f.customers[customerID]
+		if !ok || c.sub == nil {
+			return nil, &Error{Type: APIError, Message: "No active subscription for customer: " + customerID}
+		}
+
+		c.sub.Status = StatusCanceled
+		return copySubscription(c.sub), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return copySubscription(res.(*Subscription)), nil
+}
+
+func (f *Fake) CreateCharge(params *ChargeParams) (*Charge, error) {
+	res, err := f.do("CreateCharge", params.IdempotencyKey, func() (interface{}, error) {
+		card := params.Card
+		if params.CustomerID != "" {
+			c, ok := f.customers[params.CustomerID]
+			if !ok {
+				return nil, &Error{Type: APIError, Message: "No such customer: " + params.CustomerID}
+			}
+			if card == "" {
+				card = c.card
+			}
+		}
+		if params.Amount <= 0 {
+			return nil, &Error{Type: APIError, Message: "Amount must be positive."}
+		}
+
+		return f.charge(params.CustomerID, card, params.Amount, params.Currency, params.Description, params.IdempotencyKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	charge := *res.(*Charge)
+	return &charge, nil
+}
+
+func (f *Fake) GetCharge(id string) (*Charge, error) {
+	res, err := f.do("GetCharge", "", func() (interface{}, error) {
+		for _, charge := range f.charges {
+			if charge.ID == id {
+				c := *charge
+				return &c, nil
+			}
+		}
+
+		return nil, &Error{Type: APIError, Message: "No such charge: " + id}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*Charge), nil
+}
+
+func (f *Fake) FindCustomer(idempotencyKey string) (*Customer, error) {
+	res, err := f.do("FindCustomer", "", func() (interface{}, error) {
+		for _, c := range f.customers {
+			if idempotencyKey != "" && c.key == idempotencyKey {
+				return c.customer(), nil
+			}
+		}
+
+		return (*Customer)(nil), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*Customer), nil
+}
+
+func (f *Fake) FindCharge(customerID, idempotencyKey string) (*Charge, error) {
+	res, err := f.do("FindCharge", "", func() (interface{}, error) {
+		for _, charge := range f.charges {
+			if idempotencyKey != "" && charge.CustomerID == customerID && f.chargeKeys[charge.ID] == idempotencyKey {
+				c := *charge
+				return &c, nil
+			}
+		}
+
+		return (*Charge)(nil), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(*Charge), nil
+}
+
+// do runs a request, injecting failures and replaying the result of an
+// earlier request with the same idempotency key unless keys are ignored.
+func (f *Fake) do(request, key string, fn func() (interface{}, error)) (interface{}, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failRequests > 0 {
+		f.failRequests--
+		return nil, errNetwork
+	}
+
+	res, ok := f.results[key]
+	if key == "" || f.ignoreKeys || !ok {
+		value, err := fn()
+		res = &fakeResult{request: request, value: value, err: err}
+		if key != "" {
+			f.results[key] = res
+		}
+	}
+	if res.request != request {
+		return nil, errKeyReuse
+	}
+
+	if f.dropResponses > 0 {
+		f.dropResponses--
+		return nil, errNetwork
+	}
+
+	return res.value, res.err
+}
+
+// subscribe charges a customer for the first period of a plan.
+func (f *Fake) subscribe(c *fakeCustomer, planID string, quantity int64) (*Subscription, error) {
+	plan, ok := f.plans[planID]
+	if !ok {
+		return nil, &Error{Type: APIError, Message: "No such plan: " + planID}
+	}
+	if quantity <= 0 {
+		quantity = 1
+	}
+
+	_, err := f.charge(c.id, c.card, plan.Amount*quantity, plan.Currency, "Subscription to "+plan.ID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Subscription{
+		CustomerID:       c.id,
+		PlanID:           plan.ID,
+		Status:           StatusActive,
+		Quantity:         quantity,
+		CurrentPeriodEnd: addInterval(f.Now().Truncate(time.Second), plan.Interval),
+	}, nil
+}
+
+// renew charges for each period of a customer's subscription that has
+// ended, leaving it past due if their card is declined.
+func (f *Fake) renew(c *fakeCustomer) {
+	if c.sub == nil || c.sub.Status == StatusCanceled {
+		return
+	}
+
+	plan, ok := f.plans[c.sub.PlanID]
+	if !ok {
+		return
+	}
+
+	for !f.Now().Before(c.sub.CurrentPeriodEnd) {
+		_, err := f.charge(c.id, c.card, plan.Amount*c.sub.Quantity, plan.Currency, "Renewal of "+plan.ID, "")
+		if err != nil {
+			c.sub.Status = StatusPastDue
+			return
+		}
+
+		c.sub.Status = StatusActive
+		c.sub.CurrentPeriodEnd = addInterval(c.sub.CurrentPeriodEnd, plan.Interval)
+	}
+}
+
+// charge records a charge to a card made with an idempotency key, failing
+// if it's declined.
+func (f *Fake) charge(customerID, card string, amount int64, currency, desc, key string) (*Charge, error) {
+	if card == "" {
+		return nil, errNoCard
+	}
+
+	charge := &Charge{
+		ID:          f.newID("ch"),
+		CustomerID:  customerID,
+		Amount:      amount,
+		Currency:    currency,
+		Description: desc,
+		Paid:        !f.declined[card],
+	}
+	f.charges = append(f.charges, charge)
+	f.chargeKeys[charge.ID] = key
+	if !charge.Paid {
+		return nil, errDeclined
+	}
+
+	c := *charge
+	return &c, nil
+}
+
+func (f *Fake) newID(prefix string) string {
+	f.ids++
+	return fmt.Sprintf("%s_fake%d", prefix, f.ids)
+}
+
+func (c *fakeCustomer) customer() *Customer {
+	return &Customer{ID: c.id, Subscription: copySubscription(c.sub)}
+}
+
+func copySubscription(sub *Subscription) *Subscription {
+	if sub == nil {
+		return nil
+	}
+
+	s := *sub
+	return &s
+}
+
+// addInterval moves t forward by a plan interval.
+func addInterval(t time.Time, interval string) time.Time {
+	switch interval {
+	case "day":
+		return t.AddDate(0, 0, 1)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "year":
+		return t.AddDate(1, 0, 0)
+	}
+
+	return t.AddDate(0, 1, 0)
+}
@@ -0,0 +1,174 @@
+// Copyright 2014 Bowery, Inc.
+package payment
+
+import (
+	"testing"
+	"time"
+)
+
+func testFake() *Fake {
+	return NewFake(
+		Plan{ID: "monthly", Amount: 2900, Currency: "usd", Interval: "month"},
+		Plan{ID: "annual", Amount: 2500, Currency: "usd", Interval: "year"},
+	)
+}
+
+func TestFakeSubscribe(t *testing.T) {
+	f := testFake()
+	now := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	f.Now = func() time.Time { return now }
+
+	customer, err := f.CreateCustomer(&CustomerParams{Card: TestCard, PlanID: "monthly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := customer.Subscription
+	if sub == nil || sub.Status != StatusActive || sub.PlanID != "monthly" {
+		t.Fatal("customer not subscribed", sub)
+	}
+	if !sub.CurrentPeriodEnd.Equal(now.AddDate(0, 1, 0)) {
+		t.Error("period ends", sub.CurrentPeriodEnd)
+	}
+
+	charges := f.Charges(customer.ID)
+	if len(charges) != 1 || charges[0].Amount != 2900 {
+		t.Fatal("expected one charge for the plan", charges)
+	}
+
+	sub, err = f.UpdateSubscription(customer.ID, &SubscriptionParams{PlanID: "annual"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.PlanID != "annual" || !sub.CurrentPeriodEnd.Equal(now.AddDate(1, 0, 0)) {
+		t.Error("plan not changed", sub)
+	}
+	if len(f.Charges(customer.ID)) != 2 {
+		t.Error("plan change wasn't charged")
+	}
+}
+
+func TestFakeDeclined(t *testing.T) {
+	f := testFake()
+
+	_, err := f.CreateCustomer(&CustomerParams{Card: TestCardDeclined, PlanID: "monthly"})
+	if !IsCardError(err) {
+		t.Fatal("expected a card error, got", err)
+	}
+
+	_, err = f.CreateCharge(&ChargeParams{Card: TestCardDeclined, Amount: 500, Currency: "usd"})
+	if !IsCardError(err) {
+		t.Fatal("expected a card error, got", err)
+	}
+}
+
+func TestFakeRenew(t *testing.T) {
+	f := testFake()
+	now := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	f.Now = func() time.Time { return now }
+
+	customer, err := f.CreateCustomer(&CustomerParams{Card: TestCard, PlanID: "monthly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.AddDate(0, 2, 1)
+	customer, err = f.GetCustomer(customer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !customer.Subscription.CurrentPeriodEnd.Equal(time.Date(2014, 9, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("not renewed", customer.Subscription.CurrentPeriodEnd)
+	}
+	if len(f.Charges(customer.ID)) != 3 {
+		t.Error("expected a charge for each renewal")
+	}
+
+	f.SetCard(customer.ID, TestCardDeclined)
+	now = now.AddDate(0, 1, 0)
+	customer, err = f.GetCustomer(customer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if customer.Subscription.Status != StatusPastDue {
+		t.Error("declined renewal should be past due", customer.Subscription.Status)
+	}
+
+	sub, err := f.CancelSubscription(customer.ID)
+	if err != nil || sub.Status != StatusCanceled {
+		t.Fatal("subscription not canceled", err)
+	}
+
+	// Canceled subscriptions aren't renewed.
+	now = now.AddDate(0, 1, 0)
+	charges := len(f.Charges(customer.ID))
+	f.SetCard(customer.ID, TestCard)
+	if _, err := f.GetCustomer(customer.ID); err != nil || len(f.Charges(customer.ID)) != charges {
+		t.Error("canceled subscription was charged", err)
+	}
+}
+
+func TestFakeNetworkErrors(t *testing.T) {
+	f := testFake()
+	f.FailRequests(1)
+
+	_, err := f.CreateCharge(&ChargeParams{Card: TestCard, Amount: 500, Currency: "usd"})
+	if !IsTemporary(err) {
+		t.Fatal("expected a temporary error, got", err)
+	}
+
+	charge, err := f.CreateCharge(&ChargeParams{Card: TestCard, Amount: 500, Currency: "usd"})
+	if err != nil || !charge.Paid {
+		t.Fatal("retry failed", err)
+	}
+}
+
+func TestFakeIdempotentRetry(t *testing.T) {
+	f := testFake()
+	customer, err := f.CreateCustomer(&CustomerParams{Card: TestCard})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := &ChargeParams{CustomerID: customer.ID, Amount: 500, Currency: "usd", IdempotencyKey: "order-1"}
+	f.DropResponses(1)
+	if _, err := f.CreateCharge(params); !IsTemporary(err) {
+		t.Fatal("expected a temporary error, got", err)
+	}
+
+	charge, err := f.CreateCharge(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	charges := f.Charges(customer.ID)
+	if len(charges) != 1 || charges[0].ID != charge.ID {
+		t.Error("retry charged again", charges)
+	}
+}
+
+func TestFakeIgnoreKeys(t *testing.T) {
+	f := testFake()
+	f.IgnoreKeys()
+	customer, err := f.CreateCustomer(&CustomerParams{Card: TestCard, IdempotencyKey: "signup-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := &ChargeParams{CustomerID: customer.ID, Amount: 500, Currency: "usd", IdempotencyKey: "order-1"}
+	f.CreateCharge(params)
+	f.CreateCharge(params)
+	if charges := f.Charges(customer.ID); len(charges) != 2 {
+		t.Fatal("retry should charge again when keys are ignored, got", charges)
+	}
+
+	if found, err := f.FindCustomer("signup-1"); err != nil || found == nil || found.ID != customer.ID {
+		t.Error("customer should be found by its key, got", found, err)
+	}
+	if charge, err := f.FindCharge(customer.ID, "order-1"); err != nil || charge == nil {
+		t.Error("charge should be found by its key, got", charge, err)
+	}
+	if charge, err := f.FindCharge(customer.ID, "order-2"); err != nil || charge != nil {
+		t.Error("unknown key shouldn't find a charge, got", charge, err)
+	}
+}
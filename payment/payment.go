@@ -0,0 +1,140 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the payment providers used for billing.
+package payment
+
+import (
+	"net/http"
+	"time"
+)
+
+// The kinds of errors a provider returns.
+const (
+	// CardError is a card being declined or invalid, retrying won't help.
+	CardError = "card_error"
+
+	// ConnectionError is a failure talking to the provider, the request may
+	// or may not have gone through so it should be retried with the same
+	// idempotency key.
+	ConnectionError = "connection_error"
+
+	// APIError is anything else the provider rejects, like a bad key or a
+	// request it doesn't understand. It's only worth retrying if the
+	// provider was rate limiting or failing itself.
+	APIError = "api_error"
+)
+
+// Error is an error from a payment provider.
+type Error struct {
+	Type    string
+	Message string
+
+	// Status is the provider's HTTP status, if it answered.
+	Status int
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// IsCardError checks if err is a declined or invalid card.
+func IsCardError(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Type == CardError
+}
+
+// IsTemporary checks if err is a failure that's worth retrying, a failure
+// to reach the provider, a rate limit or the provider failing.
+func IsTemporary(err error) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+
+	return e.Type == ConnectionError ||
+		(e.Type == APIError && (e.Status == http.StatusTooManyRequests || e.Status >= 500))
+}
+
+// Customer is someone with a card on file.
+type Customer struct {
+	ID           string
+	Subscription *Subscription
+}
+
+// Subscription is a customer's subscription to a plan, the provider bills
+// it every interval.
+type Subscription struct {
+	CustomerID       string
+	PlanID           string
+	Status           string
+	Quantity         int64
+	CurrentPeriodEnd time.Time
+
+	// IdempotencyKey is the key of the request that last changed it.
+	IdempotencyKey string
+
+	// AsOf is when the provider reported it, zero if it's just been
+	// fetched.
+	AsOf time.Time
+}
+
+// Charge is a single payment.
+type Charge struct {
+	ID          string
+	CustomerID  string
+	Amount      int64
+	Currency    string
+	Description string
+	Paid        bool
+	Refunded    bool
+}
+
+// CustomerParams creates a customer, subscribing them to PlanID if it's set.
+type CustomerParams struct {
+	Email          string
+	Description    string
+	Card           string
+	PlanID         string
+	Quantity       int64
+	IdempotencyKey string
+}
+
+// SubscriptionParams changes a customer's subscription, replacing their card
+// if Card is set.
+type SubscriptionParams struct {
+	PlanID         string
+	Card           string
+	Quantity       int64
+	Prorate        bool
+	IdempotencyKey string
+}
+
+// ChargeParams charges a customer, or a card if there's no customer.
+type ChargeParams struct {
+	CustomerID     string
+	Card           string
+	Amount         int64
+	Currency       string
+	Description    string
+	IdempotencyKey string
+}
+
+// Provider takes payments. Requests with the same idempotency key are only
+// carried out once for at least 24 hours, retries get the original result.
+// The key is also kept with what the request created, so a request whose
+// response was lost can be looked up instead of being made again.
+type Provider interface {
+	CreateCustomer(params *CustomerParams) (*Customer, error)
+	GetCustomer(id string) (*Customer, error)
+	UpdateSubscription(customerID string, params *SubscriptionParams) (*Subscription, error)
+	CancelSubscription(customerID string) (*Subscription, error)
+	CreateCharge(params *ChargeParams) (*Charge, error)
+	GetCharge(id string) (*Charge, error)
+
+	// FindCustomer gets the customer created with an idempotency key, or
+	// nil if there isn't one.
+	FindCustomer(idempotencyKey string) (*Customer, error)
+
+	// FindCharge gets the charge made to a customer with an idempotency
+	// key, or nil if there isn't one.
+	FindCharge(customerID, idempotencyKey string) (*Charge, error)
+}
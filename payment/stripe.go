@@ -0,0 +1,315 @@
+// Copyright 2014 Bowery, Inc.
+package payment
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stripeURL is Stripe's API.
+const stripeURL = "https://api.stripe.com/v1"
+
+// stripeKeyMetadata is the metadata idempotency keys are kept in, so
+// requests can be looked up after their response is lost.
+const stripeKeyMetadata = "idempotency_key"
+
+// stripeSearchLimit is how many of the newest customers or charges are
+// searched for an idempotency key. Lost requests are looked up soon after
+// they're made, so they're among the newest.
+const stripeSearchLimit = 100
+
+// StripeProvider takes payments with Stripe. It talks to Stripe's API
+// directly so idempotency keys can be sent in the Idempotency-Key header,
+// which Stripe keeps for 24 hours.
+type StripeProvider struct {
+	key    string
+	url    string
+	client *http.Client
+}
+
+// NewStripeProvider creates a StripeProvider using the given secret key.
+func NewStripeProvider(key string) *StripeProvider {
+	return &StripeProvider{
+		key:    key,
+		url:    stripeURL,
+		client: &http.Client{Timeout: 80 * time.Second},
+	}
+}
+
+// stripeCustomer, stripeSubscription and stripeCharge are the parts of
+// Stripe's objects that are used.
+type stripeCustomer struct {
+	ID           string              `json:"id"`
+	Subscription *stripeSubscription `json:"subscription"`
+	Metadata     map[string]string   `json:"metadata"`
+}
+
+type stripeSubscription struct {
+	Status           string `json:"status"`
+	Quantity         int64  `json:"quantity"`
+	CurrentPeriodEnd int64  `json:"current_period_end"`
+	Plan             *struct {
+		ID string `json:"id"`
+	} `json:"plan"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type stripeCharge struct {
+	ID       string            `json:"id"`
+	Customer string            `json:"customer"`
+	Amount   int64             `json:"amount"`
+	Currency string            `json:"currency"`
+	Paid     bool              `json:"paid"`
+	Refunded bool              `json:"refunded"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// stripeErrorResponse is the body of a failed request.
+type stripeErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *StripeProvider) CreateCustomer(params *CustomerParams) (*Customer, error) {
+	form := url.Values{}
+	setForm(form, "email", params.Email)
+	setForm(form, "description", params.Description)
+	setForm(form, "card", params.Card)
+	setForm(form, "plan", params.PlanID)
+	if params.Quantity > 0 {
+		form.Set("quantity", strconv.FormatInt(params.Quantity, 10))
+	}
+	setMetadataKey(form, params.IdempotencyKey)
+
+	customer := &stripeCustomer{}
+	if err := p.do("POST", "/customers", params.IdempotencyKey, form, customer); err != nil {
+		return nil, err
+	}
+
+	return fromStripeCustomer(customer), nil
+}
+
+func (p *StripeProvider) GetCustomer(id string) (*Customer, error) {
+	customer := &stripeCustomer{}
+	if err := p.do("GET", "/customers/"+url.QueryEscape(id), "", nil, customer); err != nil {
+		return nil, err
+	}
+
+	return fromStripeCustomer(customer), nil
+}
+
+func (p *StripeProvider) UpdateSubscription(customerID string, params *SubscriptionParams) (*Subscription, error) {
+	form := url.Values{"prorate": {strconv.FormatBool(params.Prorate)}}
+	setForm(form, "plan", params.PlanID)
+	setForm(form, "card", params.Card)
+	if params.Quantity > 0 {
+		form.Set("quantity", strconv.FormatInt(params.Quantity, 10))
+	}
+	setMetadataKey(form, params.IdempotencyKey)
+
+	sub := &stripeSubscription{}
+	path := "/customers/" + url.QueryEscape(customerID) + "/subscription"
+	if err := p.do("POST", path, params.IdempotencyKey, form, sub); err != nil {
+		return nil, err
+	}
+
+	return fromStripeSubscription(customerID, sub), nil
+}
+
+func (p *StripeProvider) CancelSubscription(customerID string) (*Subscription, error) {
+	sub := &stripeSubscription{}
+	path := "/customers/" + url.QueryEscape(customerID) + "/subscription"
+	if err := p.do("DELETE", path, "", nil, sub); err != nil {
+		return nil, err
+	}
+
+	return fromStripeSubscription(customerID, sub), nil
+}
+
+func (p *StripeProvider) CreateCharge(params *ChargeParams) (*Charge, error) {
+	form := url.Values{
+		"amount":   {strconv.FormatInt(params.Amount, 10)},
+		"currency": {params.Currency},
+	}
+	setForm(form, "customer", params.CustomerID)
+	setForm(form, "card", params.Card)
+	setForm(form, "description", params.Description)
+	setMetadataKey(form, params.IdempotencyKey)
+
+	charge := &stripeCharge{}
+	if err := p.do("POST", "/charges", params.IdempotencyKey, form, charge); err != nil {
+		return nil, err
+	}
+
+	return fromStripeCharge(charge, params.Description), nil
+}
+
+func (p *StripeProvider) GetCharge(id string) (*Charge, error) {
+	charge := &stripeCharge{}
+	if err := p.do("GET", "/charges/"+url.QueryEscape(id), "", nil, charge); err != nil {
+		return nil, err
+	}
+
+	return fromStripeCharge(charge, ""), nil
+}
+
+func (p *StripeProvider) FindCustomer(idempotencyKey string) (*Customer, error) {
+	list := struct {
+		Data []*stripeCustomer `json:"data"`
+	}{}
+	path := "/customers?limit=" + strconv.Itoa(stripeSearchLimit)
+	if err := p.do("GET", path, "", nil, &list); err != nil {
+		return nil, err
+	}
+
+	for _, customer := range list.Data {
+		if idempotencyKey != "" && customer.Metadata[stripeKeyMetadata] == idempotencyKey {
+			return fromStripeCustomer(customer), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (p *StripeProvider) FindCharge(customerID, idempotencyKey string) (*Charge, error) {
+	list := struct {
+		Data []*stripeCharge `json:"data"`
+	}{}
+	path := "/charges?" + url.Values{
+		"customer": {customerID},
+		"limit":    {strconv.Itoa(stripeSearchLimit)},
+	}.Encode()
+	if err := p.do("GET", path, "", nil, &list); err != nil {
+		return nil, err
+	}
+
+	for _, charge := range list.Data {
+		if idempotencyKey != "" && charge.Metadata[stripeKeyMetadata] == idempotencyKey {
+			return fromStripeCharge(charge, ""), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// do sends a request to Stripe and decodes the response into v. POSTs with
+// an idempotency key are only carried out once by Stripe, retries get the
+// first response.
+func (p *StripeProvider) do(method, path, idempotencyKey string, form url.Values, v interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, p.url+path, body)
+	if err != nil {
+		return &Error{Type: APIError, Message: err.Error()}
+	}
+	req.SetBasicAuth(p.key, "")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if method == "POST" && idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return &Error{Type: ConnectionError, Message: err.Error()}
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return &Error{Type: ConnectionError, Message: err.Error()}
+	}
+	if res.StatusCode >= 300 {
+		return stripeError(res.StatusCode, content)
+	}
+
+	// The request went through, but what it did is unknown. Retrying with
+	// the same key gets the response again.
+	if err := json.Unmarshal(content, v); err != nil {
+		return &Error{Type: ConnectionError, Message: "stripe: " + err.Error()}
+	}
+
+	return nil
+}
+
+// setForm sets a form value if it isn't empty.
+func setForm(form url.Values, key, val string) {
+	if val != "" {
+		form.Set(key, val)
+	}
+}
+
+// setMetadataKey keeps an idempotency key in the metadata of what a request
+// creates or changes.
+func setMetadataKey(form url.Values, key string) {
+	setForm(form, "metadata["+stripeKeyMetadata+"]", key)
+}
+
+// stripeError converts a failed response from Stripe. Only card errors are
+// declines, everything else is Stripe refusing the request, which is worth
+// retrying for rate limits and Stripe's own failures.
+func stripeError(status int, content []byte) error {
+	res := stripeErrorResponse{}
+	json.Unmarshal(content, &res)
+
+	msg := res.Error.Message
+	if msg == "" {
+		msg = "stripe: " + http.StatusText(status)
+	}
+
+	if res.Error.Type == "card_error" {
+		return &Error{Type: CardError, Message: msg, Status: status}
+	}
+
+	return &Error{Type: APIError, Message: msg, Status: status}
+}
+
+func fromStripeCustomer(customer *stripeCustomer) *Customer {
+	return &Customer{
+		ID:           customer.ID,
+		Subscription: fromStripeSubscription(customer.ID, customer.Subscription),
+	}
+}
+
+func fromStripeSubscription(customerID string, sub *stripeSubscription) *Subscription {
+	if sub == nil {
+		return nil
+	}
+
+	converted := &Subscription{
+		CustomerID:       customerID,
+		Status:           sub.Status,
+		Quantity:         sub.Quantity,
+		CurrentPeriodEnd: time.Unix(sub.CurrentPeriodEnd, 0),
+		IdempotencyKey:   sub.Metadata[stripeKeyMetadata],
+	}
+	if sub.Plan != nil {
+		converted.PlanID = sub.Plan.ID
+	}
+
+	return converted
+}
+
+func fromStripeCharge(charge *stripeCharge, desc string) *Charge {
+	return &Charge{
+		ID:          charge.ID,
+		CustomerID:  charge.Customer,
+		Amount:      charge.Amount,
+		Currency:    charge.Currency,
+		Description: desc,
+		Paid:        charge.Paid,
+		Refunded:    charge.Refunded,
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 Bowery, Inc.
+package payment
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stripeTest starts a server answering like Stripe with status and body,
+// recording the last request.
+func stripeTest(status int, body string, last **http.Request) (*StripeProvider, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		*last = req
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		rw.Write([]byte(body))
+	}))
+
+	p := NewStripeProvider("sk_test")
+	p.url = server.URL
+	return p, server.Close
+}
+
+func TestStripeIdempotencyKey(t *testing.T) {
+	var req *http.Request
+	p, done := stripeTest(http.StatusOK, `{"id": "ch_1", "amount": 500, "currency": "usd", "paid": true}`, &req)
+	defer done()
+
+	charge, err := p.CreateCharge(&ChargeParams{CustomerID: "cus_1", Amount: 500, Currency: "usd", IdempotencyKey: "pay_1"})
+	if err != nil || charge.ID != "ch_1" || !charge.Paid {
+		t.Fatal("charge should be created, got", charge, err)
+	}
+	if req.Header.Get("Idempotency-Key") != "pay_1" || req.PostForm.Get("metadata[idempotency_key]") != "pay_1" ||
+		req.PostForm.Get("customer") != "cus_1" {
+		t.Error("charge should be sent with its idempotency key, got", req.Header, req.PostForm)
+	}
+
+	p.UpdateSubscription("cus_1", &SubscriptionParams{PlanID: "monthly", IdempotencyKey: "pay_2"})
+	if req.URL.Path != "/customers/cus_1/subscription" || req.Header.Get("Idempotency-Key") != "pay_2" {
+		t.Error("subscription change should be sent with its idempotency key, got", req.URL, req.Header)
+	}
+}
+
+func TestStripeFindCharge(t *testing.T) {
+	var req *http.Request
+	p, done := stripeTest(http.StatusOK, `{"data": [
+		{"id": "ch_2", "paid": true, "metadata": {"idempotency_key": "pay_2"}},
+		{"id": "ch_1", "paid": true, "metadata": {"idempotency_key": "pay_1"}}
+	]}`, &req)
+	defer done()
+
+	charge, err := p.FindCharge("cus_1", "pay_1")
+	if err != nil || charge == nil || charge.ID != "ch_1" {
+		t.Fatal("charge should be found by its key, got", charge, err)
+	}
+	if req.URL.Query().Get("customer") != "cus_1" {
+		t.Error("only the customer's charges should be searched, got", req.URL)
+	}
+
+	if charge, err := p.FindCharge("cus_1", "pay_3"); charge != nil || err != nil {
+		t.Error("unknown key shouldn't find a charge, got", charge, err)
+	}
+}
+
+func TestStripeErrors(t *testing.T) {
+	for _, test := range []struct {
+		status    int
+		body      string
+		card      bool
+		temporary bool
+	}{
+		{http.StatusPaymentRequired, `{"error": {"type": "card_error", "message": "Your card was declined."}}`, true, false},
+		{http.StatusUnauthorized, `{"error": {"type": "invalid_request_error", "message": "Invalid API Key provided"}}`, false, false},
+		{http.StatusBadRequest, `{"error": {"type": "invalid_request_error", "message": "No such plan"}}`, false, false},
+		{http.StatusTooManyRequests, `{"error": {"type": "rate_limit_error"}}`, false, true},
+		{http.StatusInternalServerError, `{"error": {"type": "api_error"}}`, false, true},
+		{http.StatusOK, `not json`, false, true},
+	} {
+		var req *http.Request
+		p, done := stripeTest(test.status, test.body, &req)
+		_, err := p.CreateCharge(&ChargeParams{CustomerID: "cus_1", Amount: 500, Currency: "usd"})
+		done()
+
+		if err == nil || IsCardError(err) != test.card || IsTemporary(err) != test.temporary {
+			t.Errorf("%d %s: expected card %v and temporary %v, got %v", test.status, test.body, test.card, test.temporary, err)
+		}
+	}
+}
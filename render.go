@@ -2,91 +2,224 @@ package main
 
 import (
 	"bytes"
+	"embed"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
-	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/Bowery/broome/mail"
 )
 
+// embedded is the templates and static files built into the binary.
+//
+//go:embed static
+var embedded embed.FS
+
 var (
 	TEMPLATE_DIR string = "static"
-)
 
-func execute(name string, data interface{}) (*bytes.Buffer, error) {
-	fmt.Println("executed template", name, "with data:", data)
+	// reloadAssets reads the templates and static files from TEMPLATE_DIR on
+	// every request instead of using the embedded copies, for working on them.
+	reloadAssets bool
 
-	tmplName := name + "-partial"
+	// templates are parsed once by loadTemplates.
+	templates *templateSet
+)
 
-	t := template.New(tmplName)
+// templateSet is every page and email template, parsed.
+type templateSet struct {
+	pages      map[string]*template.Template
+	htmlEmails map[string]*template.Template
+	textEmails map[string]*texttemplate.Template
+}
 
-	path := TEMPLATE_DIR + "/" + name + ".html"
-	if os.Getenv("ENV") == "production" {
-		dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-		path = dir + "/" + path
+// assets gets the filesystem the templates and static files are read from.
+func assets() fs.FS {
+	if reloadAssets {
+		return os.DirFS(TEMPLATE_DIR)
 	}
 
-	buf, err := ioutil.ReadFile(path)
+	static, err := fs.Sub(embedded, "static")
 	if err != nil {
 		panic(err)
 	}
 
-	t = t.Funcs(template.FuncMap{
-		"yield": func() (string, error) {
-			return "", fmt.Errorf("yield called with no layout defined")
-		},
-		"current": func() (string, error) {
-			return name, nil
-		},
-	})
+	return static
+}
+
+// loadTemplates parses the templates so errors in them are found at startup
+// instead of when they're first rendered.
+func loadTemplates() error {
+	set, err := parseTemplates(assets())
+	if err != nil {
+		return err
+	}
+
+	templates = set
+	return nil
+}
+
+// currentTemplates gets the parsed templates, parsing them again first if
+// they're being reloaded.
+func currentTemplates() (*templateSet, error) {
+	if reloadAssets {
+		return parseTemplates(assets())
+	}
+	if templates == nil {
+		return nil, errors.New("templates haven't been loaded")
+	}
+
+	return templates, nil
+}
+
+// parseTemplates parses the pages in fsys, each wrapped in layout.html, and
+// the emails in fsys/emails.
+func parseTemplates(fsys fs.FS) (*templateSet, error) {
+	set := &templateSet{
+		pages:      map[string]*template.Template{},
+		htmlEmails: map[string]*template.Template{},
+		textEmails: map[string]*texttemplate.Template{},
+	}
+
+	layout, err := fs.ReadFile(fsys, "layout.html")
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := fs.Glob(fsys, "*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range pages {
+		if path == "layout.html" {
+			continue
+		}
+		name := strings.TrimSuffix(path, ".html")
+
+		page, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := template.New("layout.html").Funcs(template.FuncMap{
+			"current": func() string {
+				return name
+			},
+			"amount": formatAmount,
+		}).Parse(string(layout))
+		if err != nil {
+			return nil, fmt.Errorf("layout.html: %v", err)
+		}
+
+		if _, err := t.New("page").Parse(string(page)); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		set.pages[name] = t
+	}
 
-	t, err = t.Parse(string(buf))
+	emails, err := fs.Glob(fsys, "emails/*.txt")
 	if err != nil {
 		return nil, err
 	}
 
-	outBuf := new(bytes.Buffer)
-	return outBuf, t.Execute(outBuf, data)
+	for _, path := range emails {
+		if path == "emails/layout.txt" {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "emails/"), ".txt")
+
+		text, err := texttemplate.ParseFS(fsys, "emails/layout.txt", path)
+		if err != nil {
+			return nil, err
+		}
+		if text.Lookup("subject") == nil {
+			return nil, errors.New(path + ": no subject defined")
+		}
+
+		html, err := template.ParseFS(fsys, "emails/layout.html", "emails/"+name+".html")
+		if err != nil {
+			return nil, err
+		}
+
+		set.textEmails[name] = text
+		set.htmlEmails[name] = html
+	}
+
+	return set, nil
 }
 
+// RenderTemplate renders the named page inside the layout.
 func RenderTemplate(wr io.Writer, name string, data interface{}) error {
-	tmpl := template.New(name).Funcs(template.FuncMap{
-		"yield": func() (template.HTML, error) {
-			buf, err := execute(name, data)
-
-			// return safe html here since we are rendering our own template
-			fmt.Println("Yeild was called")
-			return template.HTML(buf.String()), err
-		},
-		"current": func() (string, error) {
-			return name, nil
-		},
-	})
-
-	layoutPath := TEMPLATE_DIR + "/layout.html"
-	if os.Getenv("ENV") == "production" {
-		dir, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-		layoutPath = dir + "/" + layoutPath
-	}
-
-	buf, err := ioutil.ReadFile(layoutPath)
+	set, err := currentTemplates()
 	if err != nil {
 		return err
 	}
 
-	tmpl, err = tmpl.Parse(string(buf))
-	if err != nil {
+	t, ok := set.pages[name]
+	if !ok {
+		return errors.New("no such template " + name)
+	}
+
+	// Render fully first so a failure doesn't leave half a page behind.
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
 		return err
 	}
-	return tmpl.Execute(wr, data)
+
+	_, err = buf.WriteTo(wr)
+	return err
 }
 
-func RenderEmail(name string, data interface{}) (string, error) {
-	html, err := execute(name, data)
+// RenderEmail renders the named email from the templates in the emails
+// directory. name.txt defines the subject and the text body, name.html
+// defines the HTML body, and each body is wrapped in the matching layout.
+func RenderEmail(name string, data interface{}) (*mail.Message, error) {
+	set, err := currentTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	text, ok := set.textEmails[name]
+	if !ok {
+		return nil, errors.New("no such email " + name)
+	}
+	html := set.htmlEmails[name]
+
+	subject, err := executeString(text, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	textBody, err := executeString(text, "layout.txt", data)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody, err := executeString(html, "layout.html", data)
 	if err != nil {
+		return nil, err
+	}
+
+	return &mail.Message{Subject: subject, Text: textBody, HTML: htmlBody}, nil
+}
+
+// executor is a parsed html or text template.
+type executor interface {
+	ExecuteTemplate(wr io.Writer, name string, data interface{}) error
+}
+
+// executeString executes the named template, trimming surrounding space.
+func executeString(t executor, name string, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
 		return "", err
 	}
 
-	return html.String(), nil
+	return strings.TrimSpace(buf.String()), nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseTemplates(t *testing.T) {
+	set, err := parseTemplates(assets())
+	if err != nil {
+		t.Fatal("Could not parse templates:", err)
+	}
+
+	for _, name := range []string{"home", "error", "settings", "emails"} {
+		if set.pages[name] == nil {
+			t.Error("page", name, "wasn't parsed.")
+		}
+	}
+	for name := range emailSamples {
+		if set.textEmails[name] == nil || set.htmlEmails[name] == nil {
+			t.Error("email", name, "wasn't parsed.")
+		}
+	}
+}
+
+func TestParseTemplatesErrors(t *testing.T) {
+	layout := &fstest.MapFile{Data: []byte(`<title>{{current}}</title>{{template "page" .}}`)}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"broken page": {
+			"layout.html": layout,
+			"home.html":   {Data: []byte("{{if}}")},
+		},
+		"email without a subject": {
+			"layout.html":        layout,
+			"emails/layout.txt":  {Data: []byte(`{{template "body" .}}`)},
+			"emails/layout.html": {Data: []byte(`{{template "body" .}}`)},
+			"emails/hello.txt":   {Data: []byte(`{{define "body"}}Hello{{end}}`)},
+			"emails/hello.html":  {Data: []byte(`{{define "body"}}Hello{{end}}`)},
+		},
+		"email without html": {
+			"layout.html":        layout,
+			"emails/layout.txt":  {Data: []byte(`{{template "body" .}}`)},
+			"emails/layout.html": {Data: []byte(`{{template "body" .}}`)},
+			"emails/hello.txt":   {Data: []byte(`{{define "subject"}}Hi{{end}}{{define "body"}}Hello{{end}}`)},
+		},
+	} {
+		if _, err := parseTemplates(fsys); err == nil {
+			t.Error(name, "should fail to parse.")
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := RenderTemplate(&buf, "error", map[string]string{"Error": "<oops>"}); err != nil {
+		t.Fatal("Could not render template:", err)
+	}
+
+	body := buf.String()
+	if !strings.Contains(body, "broome · error") || !strings.Contains(body, "&lt;oops&gt;") {
+		t.Error("page should be rendered escaped inside the layout, got", body)
+	}
+
+	buf.Reset()
+	if err := RenderTemplate(&buf, "missing", nil); err == nil || buf.Len() != 0 {
+		t.Error("rendering a missing template should fail without writing.")
+	}
+}
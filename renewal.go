@@ -0,0 +1,260 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the background worker that renews licenses before they expire.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// How often licenses are checked for renewal.
+	renewalPollInterval = 10 * time.Minute
+
+	// How long to wait after a renewal fails before trying again.
+	renewalRetryDelay = 24 * time.Hour
+)
+
+var errRenewalDeclined = &payment.Error{Type: payment.CardError, Message: "The payment for the subscription's renewal was declined."}
+
+// processRenewals renews licenses as they near expiring, and bills seats
+// that failed to update, forever.
+func processRenewals() {
+	for _ = range time.Tick(renewalPollInterval) {
+		if _, err := renewLicenses(time.Now()); err != nil {
+			fmt.Fprintln(os.Stderr, "renewal:", err)
+		}
+		if _, err := syncSeats(); err != nil {
+			fmt.Fprintln(os.Stderr, "seats:", err)
+		}
+	}
+}
+
+// syncSeats bills the organizations whose seats failed to update when a
+// member joined or left, returning how many were billed. Organizations that
+// fail again are left for the next run.
+func syncSeats() (int, error) {
+	orgs, err := store.GetOrganizationsOutOfSync()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, o := range orgs {
+		if err := updateSeats(o); err != nil {
+			fmt.Fprintln(os.Stderr, "seats:", o.ID.Hex(), err)
+			continue
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// renewLicenses renews every paid license that expires within the renewal
+// window, and retries past due renewals that are due, returning how many
+// were renewed.
+func renewLicenses(now time.Time) (int, error) {
+	ds, err := store.GetExpiringDevelopers(now.Add(conf.Billing.RenewBefore.Duration))
+	if err != nil {
+		return 0, err
+	}
+
+	// Past due subscriptions aren't paid, so they're only found by their
+	// renewals.
+	pastDue, err := store.GetRenewals(db.RenewalPastDue)
+	if err != nil {
+		return 0, err
+	}
+
+	found := map[bson.ObjectId]bool{}
+	for _, d := range ds {
+		found[d.ID] = true
+	}
+	for _, r := range pastDue {
+		if r.NextAttemptAt.After(now) {
+			break
+		}
+		if found[r.DeveloperID] {
+			continue
+		}
+
+		d, err := store.GetDeveloperById(r.DeveloperID.Hex())
+		if err != nil {
+			return 0, err
+		}
+		ds = append(ds, d)
+	}
+
+	renewed := 0
+	for _, d := range ds {
+		r, err := renewLicense(d, now)
+		if err != nil {
+			return renewed, err
+		}
+		if r != nil && r.Status == db.RenewalRenewed {
+			renewed++
+		}
+	}
+
+	return renewed, nil
+}
+
+// renewLicense renews a developer's license if an attempt is due, and
+// records the outcome. Failing to take the payment is part of the outcome,
+// only errors storing it are returned. A nil renewal means nothing was due.
+func renewLicense(d *schemas.Developer, now time.Time) (*db.Renewal, error) {
+	r, err := store.GetRenewal(d.ID)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	if err == mgo.ErrNotFound || !r.Expiration.Equal(d.Expiration) {
+		// A past due license that's been paid some other way, e.g. with a
+		// new card, is out of dunning.
+		if err == nil && r.Status == db.RenewalPastDue {
+			r.Status = db.RenewalRenewed
+			r.NextAttemptAt = time.Time{}
+			if err := store.SaveRenewal(r); err != nil {
+				return nil, err
+			}
+		}
+
+		r = &db.Renewal{DeveloperID: d.ID, Expiration: d.Expiration}
+	}
+	if r.NextAttemptAt.After(now) {
+		return nil, nil
+	}
+	if r.Status != db.RenewalPastDue && d.Expiration.After(now.Add(conf.Billing.RenewBefore.Duration)) {
+		return nil, nil
+	}
+
+	expiration := d.Expiration
+	err = renewPayment(d, r.Declines, now)
+	if err == errPaymentInProgress {
+		return nil, nil
+	}
+
+	r.Attempts++
+	r.AttemptedAt = now
+	r.Error = ""
+	switch {
+	case payment.IsCardError(err):
+		if err := dun(d, r, err, now); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		// Problems reaching the provider don't count against the developer,
+		// past due renewals stay past due.
+		if r.Status != db.RenewalPastDue {
+			r.Status = db.RenewalFailed
+		}
+		r.Error = err.Error()
+		r.NextAttemptAt = now.Add(renewalRetryDelay)
+	case d.Expiration.After(expiration):
+		r.Status = db.RenewalRenewed
+		r.NextAttemptAt = time.Time{}
+	default:
+		// The provider renews subscriptions when their period ends.
+		r.Status = db.RenewalWaiting
+		r.NextAttemptAt = expiration
+		if !r.NextAttemptAt.After(now) {
+			r.NextAttemptAt = now.Add(renewalRetryDelay)
+		}
+	}
+
+	return r, store.SaveRenewal(r)
+}
+
+// renewPayment gets a developer paid for their next period. Subscriptions
+// are renewed by the payment provider so they're synced, licenses from
+// before subscriptions are charged for the renewal plan. The charge is made
+// again after each decline, other failures retry the same charge.
+func renewPayment(d *schemas.Developer, declines int, now time.Time) error {
+	customer, err := payments.GetCustomer(d.StripeToken)
+	if err != nil {
+		return err
+	}
+
+	if customer.Subscription != nil {
+		sub, err := syncSubscription(d, customer.ID, customer.Subscription)
+		if err != nil {
+			return err
+		}
+
+		// The provider couldn't take the payment for the new period.
+		if sub.Status == db.SubscriptionPastDue || sub.Status == db.SubscriptionUnpaid {
+			return errRenewalDeclined
+		}
+		return nil
+	}
+
+	plan, _ := conf.Billing.Plan(conf.Billing.RenewalPlan)
+	expiration := d.Expiration
+
+	// Renewing early doesn't take away the time that's left.
+	start := expiration
+	if start.Before(now) {
+		start = now
+	}
+
+	p := &db.Payment{
+		Key:         paymentKey(d, "renewal", plan.ID, expiration.UTC().Format(time.RFC3339), strconv.Itoa(declines)),
+		DeveloperID: d.ID,
+		Description: "Renewal of " + plan.Name,
+		PlanID:      plan.ID,
+		Amount:      plan.Amount,
+		Currency:    plan.Currency,
+		CustomerID:  d.StripeToken,
+		PeriodEnd:   plan.PeriodEnd(start),
+	}
+
+	p, err = takePayment(p, func(p *db.Payment) error {
+		charge, err := payments.CreateCharge(&payment.ChargeParams{
+			CustomerID:     d.StripeToken,
+			Amount:         plan.Amount,
+			Currency:       plan.Currency,
+			Description:    p.Description,
+			IdempotencyKey: p.Key,
+		})
+		if err != nil {
+			return err
+		}
+
+		p.ChargeID = charge.ID
+		return nil
+	}, func(p *db.Payment) (bool, error) {
+		charge, err := payments.FindCharge(d.StripeToken, p.Key)
+		if charge == nil || err != nil {
+			return false, err
+		}
+		if !charge.Paid {
+			return false, &payment.Error{Type: payment.CardError, Message: "Your card was declined."}
+		}
+
+		p.ChargeID = charge.ID
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// A payment from an earlier attempt has the period it paid for.
+	d.IsPaid = true
+	d.Expiration = p.PeriodEnd
+	if d.Expiration.IsZero() {
+		d.Expiration = plan.PeriodEnd(start)
+	}
+	return store.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{
+		"isPaid":          d.IsPaid,
+		"nextPaymentTime": d.Expiration,
+	})
+}
@@ -0,0 +1,269 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+// legacyCustomer makes the developer a customer from before subscriptions,
+// with the given card and a paid license expiring at expiration.
+func legacyCustomer(t *testing.T, fake *payment.Fake, d *schemas.Developer, card string, expiration time.Time) *schemas.Developer {
+	customer, err := fake.CreateCustomer(&payment.CustomerParams{Card: card})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{
+		"isPaid":          true,
+		"stripeToken":     customer.ID,
+		"nextPaymentTime": expiration,
+	})
+	if err != nil {
+		t.Fatal("Could not update developer:", err)
+	}
+
+	d, err = store.GetDeveloperById(d.ID.Hex())
+	if err != nil {
+		t.Fatal("Could not get developer:", err)
+	}
+
+	return d
+}
+
+// getSession gets the session info for a developer, returning its status.
+func getSession(t *testing.T, d *schemas.Developer) string {
+	req, err := http.NewRequest("GET", "http://broome.io/session/"+d.ID.Hex(), nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+
+	status, _ := body["status"].(string)
+	return status
+}
+
+func TestRenewLicenses(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now().Truncate(time.Second)
+	expiration := now.Add(24 * time.Hour)
+	d := legacyCustomer(t, fake, mock, payment.TestCard, expiration)
+
+	// Nothing is due outside the renewal window.
+	if n, err := renewLicenses(now.Add(-conf.Billing.RenewBefore.Duration)); n != 0 || err != nil {
+		t.Fatal("nothing should be renewed yet, got", n, err)
+	}
+
+	if n, err := renewLicenses(now); n != 1 || err != nil {
+		t.Fatal("license should be renewed, got", n, err)
+	}
+
+	d, _ = store.GetDeveloperById(d.ID.Hex())
+	if !d.Expiration.Equal(expiration.AddDate(1, 0, 0)) {
+		t.Error("renewal should extend from the old expiration, got", d.Expiration)
+	}
+
+	r, err := store.GetRenewal(d.ID)
+	if err != nil || r.Status != db.RenewalRenewed || r.Attempts != 1 {
+		t.Error("renewal outcome not recorded.", err)
+	}
+
+	ledger, _ := store.GetPayments(d.ID)
+	if len(ledger) != 1 || ledger[0].Status != db.PaymentSucceeded || ledger[0].ChargeID == "" {
+		t.Error("renewal should be in the ledger, got", ledger)
+	}
+
+	if n, _ := renewLicenses(now); n != 0 || len(fake.Charges(d.StripeToken)) != 1 {
+		t.Error("renewed license shouldn't be charged again.")
+	}
+}
+
+func TestRenewLicensesDeclined(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now().Truncate(time.Second)
+	expiration := now.Add(24 * time.Hour)
+	d := legacyCustomer(t, fake, mock, payment.TestCardDeclined, expiration)
+
+	if n, err := renewLicenses(now); n != 0 || err != nil {
+		t.Fatal("declined license shouldn't be renewed, got", n, err)
+	}
+
+	r, err := store.GetRenewal(d.ID)
+	if err != nil || r.Status != db.RenewalPastDue || r.Declines != 1 || !r.NextAttemptAt.After(now) {
+		t.Fatal("declined renewal should be past due.", err)
+	}
+
+	d, _ = store.GetDeveloperById(d.ID.Hex())
+	if !d.Expiration.Equal(expiration) {
+		t.Error("declined renewal shouldn't change the expiration.")
+	}
+
+	// It's tried again once the retry is due, with a working card.
+	fake.SetCard(d.StripeToken, payment.TestCard)
+	if n, _ := renewLicenses(now.Add(time.Hour)); n != 0 {
+		t.Error("renewal shouldn't be retried before it's due.")
+	}
+	if n, _ := renewLicenses(r.NextAttemptAt); n != 1 {
+		t.Error("renewal should be retried once it's due.")
+	}
+}
+
+func TestRenewLicensesSubscription(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	if res := pay(t, mock.Token, paymentReq{StripeToken: payment.TestCard}); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	expiration := d.Expiration
+
+	// The provider hasn't renewed it yet.
+	now := expiration.Add(-time.Hour)
+	if n, err := renewLicenses(now); n != 0 || err != nil {
+		t.Fatal("subscription shouldn't be renewed before its period ends, got", n, err)
+	}
+	r, _ := store.GetRenewal(d.ID)
+	if r.Status != db.RenewalWaiting || !r.NextAttemptAt.Equal(expiration) {
+		t.Error("renewal should wait for the period to end, got", r)
+	}
+
+	fake.Now = func() time.Time { return expiration.Add(time.Minute) }
+	defer func() { fake.Now = time.Now }()
+	if n, err := renewLicenses(expiration); n != 1 || err != nil {
+		t.Fatal("subscription should be renewed, got", n, err)
+	}
+
+	d, _ = store.GetDeveloperById(mock.ID.Hex())
+	if !d.Expiration.After(expiration) || len(fake.Charges(d.StripeToken)) != 2 {
+		t.Error("developer should have the renewed period.")
+	}
+}
+
+func TestRenewLicensesConcurrent(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now()
+	d := legacyCustomer(t, fake, mock, payment.TestCard, now.Add(time.Hour))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			renewLicenses(now)
+		}()
+	}
+	wg.Wait()
+
+	if charges := fake.Charges(d.StripeToken); len(charges) != 1 {
+		t.Error("renewal should only be charged once, got", len(charges))
+	}
+}
+
+func TestSessionInfoHandler(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	d := legacyCustomer(t, fake, mock, payment.TestCard, time.Now().Add(time.Hour))
+	if status := getSession(t, d); status != requests.StatusFound {
+		t.Error("unexpired license should be found, got", status)
+	}
+
+	d = legacyCustomer(t, fake, mock, payment.TestCard, time.Now().Add(-time.Hour))
+	if status := getSession(t, d); status != requests.StatusExpired {
+		t.Error("expired license should be expired, got", status)
+	}
+	if len(fake.Charges(d.StripeToken)) != 0 {
+		t.Error("getting the session shouldn't charge.")
+	}
+}
+
+// lostCharge loses the response to the first charge made through it.
+type lostCharge struct {
+	payment.Provider
+	lost bool
+}
+
+func (l *lostCharge) CreateCharge(params *payment.ChargeParams) (*payment.Charge, error) {
+	charge, err := l.Provider.CreateCharge(params)
+	if !l.lost {
+		l.lost = true
+		return nil, &payment.Error{Type: payment.ConnectionError, Message: "timeout"}
+	}
+
+	return charge, err
+}
+
+func TestRenewLicensesNetworkError(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now()
+	d := legacyCustomer(t, fake, mock, payment.TestCard, now.Add(time.Hour))
+	payments = &lostCharge{Provider: fake}
+
+	if n, _ := renewLicenses(now); n != 0 {
+		t.Fatal("renewal shouldn't succeed without a response.")
+	}
+
+	r, _ := store.GetRenewal(d.ID)
+	if n, err := renewLicenses(r.NextAttemptAt); n != 1 || err != nil {
+		t.Fatal("retry should renew the license, got", n, err)
+	}
+	if charges := fake.Charges(d.StripeToken); len(charges) != 1 {
+		t.Error("retry should replay the charge, got", len(charges))
+	}
+}
+
+func TestRenewLicensesLostCharge(t *testing.T) {
+	fake, mock, done := billingTest(t)
+	defer done()
+
+	now := time.Now()
+	d := legacyCustomer(t, fake, mock, payment.TestCard, now.Add(time.Hour))
+	fake.IgnoreKeys()
+	payments = &lostCharge{Provider: fake}
+
+	if n, _ := renewLicenses(now); n != 0 {
+		t.Fatal("renewal shouldn't succeed without a response.")
+	}
+
+	r, _ := store.GetRenewal(d.ID)
+	if n, err := renewLicenses(r.NextAttemptAt); n != 1 || err != nil {
+		t.Fatal("retry should renew the license, got", n, err)
+	}
+	if charges := fake.Charges(d.StripeToken); len(charges) != 1 {
+		t.Error("retry should find the lost charge instead of charging again, got", len(charges))
+	}
+
+	ledger, _ := store.GetPayments(d.ID)
+	if len(ledger) != 1 || ledger[0].Status != db.PaymentSucceeded || ledger[0].ChargeID != fake.Charges(d.StripeToken)[0].ID {
+		t.Error("ledger should have the found charge, got", ledger)
+	}
+}
@@ -8,18 +8,20 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/Bowery/broome/config"
 	"github.com/Bowery/broome/db"
-	"github.com/Bowery/gopackages/config"
+	"github.com/Bowery/broome/mail"
+	"github.com/Bowery/broome/password"
+	"github.com/Bowery/broome/payment"
 	"github.com/Bowery/gopackages/requests"
 	"github.com/Bowery/gopackages/schemas"
 	"github.com/Bowery/gopackages/util"
 	"github.com/Bowery/gopackages/web"
-	"github.com/bradrydzewski/go.stripe"
+	"github.com/Bowery/slack"
 	"github.com/gorilla/mux"
 	"github.com/mattbaird/gochimp"
 	"github.com/unrolled/render"
@@ -33,10 +35,12 @@ const (
 )
 
 var (
-	STATIC_DIR      string = TEMPLATE_DIR
-	chimp           *gochimp.ChimpAPI
-	mandrill        *gochimp.MandrillAPI
-	stripePublicKey string
+	conf     *config.Config
+	chimp    *gochimp.ChimpAPI
+	mailer   mail.Mailer
+	payments payment.Provider
+	slackC   *slack.Client
+	store    db.Store
 )
 
 var renderer = render.New(render.Options{
@@ -46,18 +50,63 @@ var renderer = render.New(render.Options{
 
 // List of named routes.
 var Routes = []web.Route{
-	{"GET", "/admin", HomeHandler, true},
-	{"GET", "/admin/developers", AdminHandler, true},
+	{"GET", "/admin", requirePermission(permAdmin, HomeHandler), true},
+	{"GET", "/admin/developers", requirePermission(permViewDevelopers, AdminHandler), true},
+	{"GET", "/admin/settings", requirePermission(permSettings, SettingsHandler), true},
+	{"PUT", "/admin/settings", requirePermission(permSettings, UpdateSettingsHandler), true},
+	{"GET", "/admin/emails", requirePermission(permEmails, EmailsHandler), true},
+	{"POST", "/admin/emails/{id}/retry", requirePermission(permEmails, RetryEmailHandler), true},
+	{"GET", "/admin/emails/preview/{name}", requirePermission(permEmails, PreviewEmailHandler), true},
+	{"GET", "/admin/dunning", requirePermission(permBilling, DunningHandler), true},
+	{"GET", "/admin/organizations", requirePermission(permBilling, OrganizationsHandler), true},
+	{"GET", "/admin/clients", requirePermission(permClients, ClientsHandler), true},
+	{"POST", "/admin/clients", requirePermission(permClients, CreateClientHandler), true},
+	{"DELETE", "/admin/clients/{id}", requirePermission(permClients, RemoveClientHandler), true},
 	{"POST", "/developers", CreateDeveloperHandler, false},
 	{"POST", "/developers/token", CreateTokenHandler, false},
+	{"POST", "/developers/token/two-factor", TwoFactorLoginHandler, false},
 	{"POST", "/developers/check-admin", CheckAdminHandler, false},
+	{"GET", "/developers/verify/{token}", VerifyEmailHandler, false},
+	{"POST", "/developers/me/verify", ResendVerificationHandler, false},
 	{"GET", "/developers/me", GetCurrentDeveloperHandler, false},
+	{"GET", "/developers/me/sessions", SessionsHandler, false},
+	{"GET", "/developers/me/payments", PaymentsHandler, false},
+	{"DELETE", "/developers/me/sessions", RevokeSessionsHandler, false},
+	{"DELETE", "/developers/me/sessions/{id}", RevokeSessionHandler, false},
+	{"POST", "/developers/me/two-factor", EnrollTwoFactorHandler, false},
+	{"POST", "/developers/me/two-factor/confirm", ConfirmTwoFactorHandler, false},
+	{"DELETE", "/developers/me/two-factor", DisableTwoFactorHandler, false},
 	{"GET", "/developers/{id}", GetDeveloperByIDHandler, false},
-	{"GET", "/admin/developers/new", NewDevHandler, true},
+	{"GET", "/admin/developers/new", requirePermission(permEditProfile, NewDevHandler), true},
 	{"PUT", "/developers/{token}", UpdateDeveloperHandler, true},
-	{"GET", "/admin/developers/{token}", DeveloperInfoHandler, true},
+	{"GET", "/admin/developers/{token}", requirePermission(permViewDevelopers, DeveloperInfoHandler), true},
+	{"POST", "/admin/developers/{token}/unlock", requirePermission(permEditProfile, UnlockDeveloperHandler), true},
+	{"POST", "/organizations", CreateOrganizationHandler, false},
+	{"GET", "/organizations/{id}", GetOrganizationHandler, false},
+	{"POST", "/organizations/{id}/invitations", InviteHandler, false},
+	{"PUT", "/organizations/{id}/members/{developerId}", UpdateMemberHandler, false},
+	{"DELETE", "/organizations/{id}/members/{developerId}", RemoveMemberHandler, false},
+	{"POST", "/organizations/{id}/pay", OrganizationPaymentHandler, false},
+	{"GET", "/invitations/{invite}", GetInvitationHandler, false},
+	{"POST", "/invitations/{invite}/accept", AcceptInvitationHandler, false},
+	{"POST", "/invitations/{invite}/decline", DeclineInvitationHandler, false},
+	{"GET", "/oauth/authorize", AuthorizeHandler, false},
+	{"POST", "/oauth/authorize", ConsentHandler, false},
+	{"POST", "/oauth/token", OAuthTokenHandler, false},
+	{"POST", "/oauth/introspect", IntrospectHandler, false},
+	{"POST", "/oauth/revoke", RevokeHandler, false},
+	{"POST", "/oauth/device", DeviceAuthorizationHandler, false},
+	{"GET", "/device", DeviceHandler, false},
+	{"POST", "/device", ApproveDeviceHandler, false},
+	{"GET", "/oauth/userinfo", UserInfoHandler, false},
+	{"POST", "/oauth/userinfo", UserInfoHandler, false},
+	{"GET", "/.well-known/openid-configuration", DiscoveryHandler, false},
+	{"GET", "/.well-known/jwks.json", JWKSHandler, false},
+	{"GET", "/plans", PlansHandler, false},
 	{"POST", "/developers/{token}/pay", PaymentHandler, false},
+	{"POST", "/webhooks/stripe", StripeWebhookHandler, false},
 	{"GET", "/session/{id}", SessionInfoHandler, false},
+	{"GET", "/license/key", LicenseKeyHandler, false},
 	{"GET", "/admin/signup/{id}", SignUpHandler, false},
 	{"POST", "/signup", CreateSessionHandler, false},
 	{"GET", "/admin/thanks!", ThanksHandler, false},
@@ -70,39 +119,96 @@ var Routes = []web.Route{
 
 func init() {
 	rand.Seed(time.Now().UTC().UnixNano())
+}
 
-	stripeSecretKey := config.StripeTestSecretKey
-	stripePublicKey = config.StripeTestPublicKey
+// configure sets up the services used by the routes from c.
+func configure(c *config.Config) error {
+	conf = c
 
-	var cwd, _ = filepath.Abs(filepath.Dir(os.Args[0]))
-	if os.Getenv("ENV") == "production" {
-		STATIC_DIR = cwd + "/" + STATIC_DIR
-		stripeSecretKey = config.StripeLiveSecretKey
-		stripePublicKey = config.StripeLivePublicKey
+	if err := loadTemplates(); err != nil {
+		return err
+	}
+	if conf.Verification.Secret == "" {
+		conf.Verification.Secret = util.HashToken()
+	}
+	password.SetDefault(conf.Password.Algorithm)
+	chimp = gochimp.NewChimp(conf.Mailchimp.Key, true)
+	slackC = slack.NewClient(conf.Slack.Token)
+
+	var err error
+	licenseKey, err = newLicenseKey(conf)
+	if err != nil {
+		return err
 	}
-	stripe.SetKey(stripeSecretKey)
-	chimp = gochimp.NewChimp(config.MailchimpKey, true)
-	mandrill, _ = gochimp.NewMandrill(config.MandrillKey)
+
+	payments, err = newPaymentProvider(conf)
+	if err != nil {
+		return err
+	}
+
+	mailer, err = newMailer(&conf.Mail)
+	return err
 }
 
 func AuthHandler(req *http.Request, user, pass string) (bool, error) {
-	query := bson.M{}
+	dev, err := authenticate(req, user, pass)
+	return dev != nil, err
+}
+
+// authenticate gets the developer for basic auth credentials, either a
+// token with no password or an email and password. A nil developer means
+// the credentials are wrong, or there have been too many failed logins.
+func authenticate(req *http.Request, user, pass string) (*schemas.Developer, error) {
 	if pass == "" {
-		query["token"] = user
-	} else {
-		query["email"] = user
+		dev, _, err := developerByToken(user)
+		if err != nil || dev.ID == "" {
+			return nil, nil
+		}
+
+		return dev, nil
+	}
+
+	dev, wait, err := checkLogin(req, user, pass)
+	if wait > 0 || err == errInvalidLogin {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A password alone isn't enough with two-factor on, the token from
+	// logging in with a code has to be used instead.
+	twoFactor, err := getTwoFactor(dev)
+	if err != nil || twoFactor != nil {
+		return nil, err
 	}
+	succeedLogin(user)
+
+	return dev, nil
+}
 
-	dev, err := db.GetDeveloper(query)
-	if err != nil || dev.ID == "" {
-		return false, err
+// checkPassword verifies pass against a developer's stored hash. Hashes made
+// with an outdated algorithm are upgraded while the password is known.
+func checkPassword(d *schemas.Developer, pass string) bool {
+	ok, rehash, err := password.Verify(pass, d.Password, d.Salt)
+	if err != nil || !ok {
+		return false
 	}
 
-	if pass != "" && dev.Password != util.HashPassword(pass, dev.Salt) {
-		return false, nil
+	if rehash {
+		hash, err := password.Hash(pass)
+		if err == nil {
+			err = store.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{"password": hash})
+		}
+		if err != nil {
+			fmt.Println("unable to upgrade password hash for", d.ID.Hex(), err)
+			return true
+		}
+
+		d.Password = hash
 	}
 
-	return true, nil
+	return true
 }
 
 // GET /admin, Introduction
@@ -114,7 +220,7 @@ func HomeHandler(rw http.ResponseWriter, req *http.Request) {
 
 // GET /admin/developers, Admin Interface that lists developers
 func AdminHandler(rw http.ResponseWriter, req *http.Request) {
-	ds, err := db.GetDevelopers(map[string]interface{}{})
+	ds, err := store.GetDevelopers(map[string]interface{}{})
 	if err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 		return
@@ -130,26 +236,77 @@ func AdminHandler(rw http.ResponseWriter, req *http.Request) {
 // GET /admin/developers/{token}, Admin Interface for a single developer
 func DeveloperInfoHandler(rw http.ResponseWriter, req *http.Request) {
 	token := mux.Vars(req)["token"]
-	d, err := db.GetDeveloper(map[string]interface{}{"token": token})
+	d, err := store.GetDeveloper(map[string]interface{}{"token": token})
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	ledger, err := store.GetPayments(d.ID)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	renewal, err := store.GetRenewal(d.ID)
+	if err == mgo.ErrNotFound {
+		renewal, err = nil, nil
+	}
 	if err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 		return
 	}
 
+	logins, err := store.GetLoginAttempts("account:" + accountKey(d.Email))
+	if err == mgo.ErrNotFound {
+		logins, err = nil, nil
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	roles, err := getStaffRoles(d)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	// Only the fields the viewer can change are editable.
+	staff, err := loadStaff(req)
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	hasRole := map[string]bool{}
+	for _, role := range roles {
+		hasRole[role] = true
+	}
+
 	marshalledTime, _ := d.Expiration.MarshalJSON()
 
 	RenderTemplate(rw, "developer", map[string]interface{}{
 		"Token":               d.Token,
 		"Name":                d.Name,
 		"Email":               d.Email,
-		"IsAdmin":             d.IsAdmin,
+		"Roles":               hasRole,
+		"StaffRoles":          staffRoles,
+		"CanEditProfile":      staff.can(permEditProfile),
+		"CanEditBilling":      staff.can(permEditBilling),
+		"CanManageStaff":      staff.can(permManageStaff),
 		"IsPaid":              d.IsPaid,
 		"NextPaymentTime":     string(marshalledTime[1 : len(marshalledTime)-1]), // trim inexplainable quotes and Z at the end that breaks shit
 		"IntegrationEngineer": d.IntegrationEngineer,
+		"Payments":            ledger,
+		"Renewal":             renewal,
+		"Logins":              logins,
+		"Locked":              logins != nil && logins.LockedUntil.After(time.Now()),
 	})
 }
 
-// PUT /developers/{token}, edits a developer
+// PUT /developers/{token}, edits a developer, developers can edit their own
+// name, email and password and staff the fields their roles allow
 func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 	token := mux.Vars(req)["token"]
 	if token == "" {
@@ -168,10 +325,13 @@ func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	query := map[string]interface{}{"token": token}
 	update := map[string]interface{}{}
 
-	u, err := db.GetDeveloper(query)
+	u, _, err := developerByToken(token)
+	var staff *staffMember
+	if err == nil {
+		staff, err = loadStaff(req)
+	}
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -180,9 +340,17 @@ func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if password := req.FormValue("password"); password != "" {
+	if staff == nil || (staff.dev.ID != u.ID && !staff.can(permAdmin)) {
+		renderer.JSON(rw, http.StatusForbidden, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errPermission.Error(),
+		})
+		return
+	}
+
+	if newpass := req.FormValue("password"); newpass != "" {
 		oldpass := req.FormValue("oldpassword")
-		if oldpass == "" || util.HashPassword(oldpass, u.Salt) != u.Password {
+		if oldpass == "" || !checkPassword(u, oldpass) {
 			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 				"status": requests.StatusFailed,
 				"error":  "Old password is incorrect.",
@@ -190,30 +358,97 @@ func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		update["password"] = util.HashPassword(password, u.Salt)
+		update["password"], err = password.Hash(newpass)
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
 	}
 
 	if nextPaymentTime := req.FormValue("nextPaymentTime"); nextPaymentTime != "" {
-		update["nextPaymentTime"], err = time.Parse(time.RFC3339, nextPaymentTime)
-	}
+		expiration, err := time.Parse(time.RFC3339, nextPaymentTime)
+		if err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
 
-	if isAdmin := req.FormValue("isAdmin"); isAdmin != "" {
-		update["isAdmin"] = isAdmin == "on" || isAdmin == "true"
+		if !expiration.Equal(u.Expiration) {
+			update["nextPaymentTime"] = expiration
+		}
 	}
 
 	if isPaid := req.FormValue("isPaid"); isPaid != "" {
-		update["isPaid"] = isPaid == "on" || isPaid == "true"
+		if paid := isPaid == "on" || isPaid == "true"; paid != u.IsPaid {
+			update["isPaid"] = paid
+		}
 	}
 
-	// TODO add datetime parsing
+	current := map[string]string{"name": u.Name, "email": u.Email, "integrationEngineer": u.IntegrationEngineer}
 	for _, field := range []string{"name", "email", "integrationEngineer"} {
 		val := req.FormValue(field)
-		if val != "" {
+		if val != "" && val != current[field] {
 			update[field] = val
 		}
 	}
 
-	if err := db.UpdateDeveloper(query, update); err != nil {
+	// An empty roles value lets a form clear them all.
+	var roles []string
+	changeRoles := false
+	if values, ok := req.Form["roles"]; ok {
+		roles, err = parseStaffRoles(values)
+		if err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		currentRoles, err := getStaffRoles(u)
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+		changeRoles = !sameRoles(roles, currentRoles)
+	}
+
+	// Only the fields that change need permission, so staff can save a form
+	// with fields they can't edit left as they were.
+	fields := []string{}
+	for field := range update {
+		fields = append(fields, field)
+	}
+	if changeRoles {
+		fields = append(fields, "roles")
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if !staff.canEdit(u, field) {
+			renderer.JSON(rw, http.StatusForbidden, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "Your staff role doesn't allow changing " + field + ".",
+			})
+			return
+		}
+	}
+
+	// Saving a form without changing anything leaves nothing to set.
+	if len(update) > 0 {
+		err = store.UpdateDeveloper(bson.M{"_id": u.ID}, update)
+	}
+	if err == nil && changeRoles {
+		err = saveStaffRoles(u, roles, staff.dev)
+	}
+	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
@@ -221,10 +456,23 @@ func UpdateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+	// A new address has to be verified again.
+	if email, ok := update["email"].(string); ok && email != u.Email {
+		u.Email = email
+		if err := sendVerification(u); err != nil {
+			fmt.Println("unable to send verification email to", u.Email, err)
+		}
+	}
+
+	res := map[string]interface{}{
 		"status": requests.StatusUpdated,
 		"update": update,
-	})
+	}
+	if changeRoles {
+		res["roles"] = roles
+	}
+
+	renderer.JSON(rw, http.StatusOK, res)
 }
 
 // POST /developers, Creates a new developer
@@ -272,7 +520,7 @@ func CreateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		CreatedAt:           time.Now().UnixNano() / int64(time.Millisecond),
 	}
 
-	_, err = db.GetDeveloper(bson.M{"email": u.Email})
+	_, err = store.GetDeveloper(bson.M{"email": u.Email})
 	if err == nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -281,9 +529,10 @@ func CreateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if os.Getenv("ENV") == "production" && !strings.Contains(body.Email, "@bowery.io") {
+	internal := strings.Contains(body.Email, "@bowery.io")
+	if conf.IsProduction() && !internal {
 		if _, err := chimp.ListsSubscribe(gochimp.ListsSubscribe{
-			ListId: "200e892f56",
+			ListId: conf.Mailchimp.ListID,
 			Email:  gochimp.Email{Email: u.Email},
 		}); err != nil {
 			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
@@ -292,54 +541,37 @@ func CreateDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 			})
 			return
 		}
+	}
 
-		message, err := RenderEmail("welcome", map[string]interface{}{
-			"name":     strings.Split(u.Name, " ")[0],
-			"engineer": integrationEngineer,
+	if err := store.Save(u); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
 		})
+		return
+	}
 
-		if err != nil {
-			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
+	// Employees don't need a welcome, except when trying it out locally.
+	if !conf.IsProduction() || !internal {
+		err := sendEmail(mail.Address{Email: "hello@bowery.io", Name: integrationEngineer.Name},
+			u, "welcome", map[string]interface{}{
+				"name":     strings.Split(u.Name, " ")[0],
+				"engineer": integrationEngineer,
 			})
-			return
-		}
-
-		_, err = mandrill.MessageSend(gochimp.Message{
-			Subject:   "Welcome to Bowery!",
-			FromEmail: "hello@bowery.io",
-			FromName:  integrationEngineer.Name,
-			To: []gochimp.Recipient{{
-				Email: u.Email,
-				Name:  u.Name,
-			}},
-			Html: message,
-		}, false)
-
 		if err != nil {
-			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
-			return
+			fmt.Println("unable to queue welcome email to", u.Email, err)
 		}
 	}
 
-	if err := db.Save(u); err != nil {
-		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
-			"status": requests.StatusFailed,
-			"error":  err.Error(),
-		})
-		return
+	// The account is usable without it, they can ask for another link.
+	if err := sendVerification(u); err != nil {
+		fmt.Println("unable to send verification email to", u.Email, err)
 	}
 
 	// Post to slack
-	if os.Getenv("ENV") == "production" && !strings.Contains(body.Email, "@bowery.io") {
-		channel := "#activity"
+	if conf.IsProduction() && !strings.Contains(body.Email, "@bowery.io") {
 		message := u.Name + " " + u.Email + " just signed up."
-		username := "Drizzy Drake"
-		go slackC.SendMessage(channel, message, username)
+		go slackC.SendMessage(conf.Slack.Channel, message, conf.Slack.Username)
 	}
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
@@ -378,28 +610,64 @@ func CreateTokenHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	query := map[string]interface{}{"email": email}
-	u, err := db.GetDeveloper(query)
+	u, wait, err := checkLogin(req, email, password)
+	if wait > 0 {
+		renderLoginLimit(rw, wait)
+		return
+	}
 	if err != nil {
-		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+		status := http.StatusInternalServerError
+		if err == errInvalidLogin {
+			status = http.StatusUnauthorized
+		}
+
+		renderer.JSON(rw, status, map[string]string{
 			"status": requests.StatusFailed,
-			"error":  "No such developer with email " + email + ".",
+			"error":  err.Error(),
 		})
 		return
 	}
 
-	if util.HashPassword(password, u.Salt) != u.Password {
-		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+	if err := requireVerified(u); err != nil {
+		status := http.StatusInternalServerError
+		if err == errNotVerified {
+			status = http.StatusForbidden
+		}
+
+		renderer.JSON(rw, status, map[string]string{
 			"status": requests.StatusFailed,
-			"error":  "Incorrect Password",
+			"error":  err.Error(),
 		})
 		return
 	}
 
-	token := util.HashToken()
+	// With two-factor on, the token is only created once a code is given
+	// for the challenge.
+	twoFactor, err := getTwoFactor(u)
+	if err == nil && twoFactor != nil {
+		challenge, err := startLoginChallenge(u)
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status":    statusTwoFactor,
+			"challenge": challenge.Token,
+			"expiresAt": challenge.ExpiresAt,
+		})
+		return
+	}
 
-	update := map[string]interface{}{"token": token}
-	if err := db.UpdateDeveloper(query, update); err != nil {
+	var session *db.Session
+	if err == nil {
+		succeedLogin(email)
+		session, err = createSession(req, u, "")
+	}
+	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
@@ -408,13 +676,16 @@ func CreateTokenHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
-		"status": requests.StatusCreated,
-		"token":  token,
+		"status":  requests.StatusCreated,
+		"token":   session.Token,
+		"session": session,
 	})
 }
 
+// POST /developers/check-admin, checks an email and password belong to a
+// developer with a staff role, along with a two-factor code if it's on
 func CheckAdminHandler(rw http.ResponseWriter, req *http.Request) {
-	var body requests.LoginReq
+	var body checkAdminReq
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&body)
 	if err != nil {
@@ -435,25 +706,36 @@ func CheckAdminHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	query := map[string]interface{}{"email": email}
-	u, err := db.GetDeveloper(query)
-	if err != nil {
+	u, wait, err := checkLogin(req, email, password)
+	if wait > 0 {
+		renderLoginLimit(rw, wait)
+		return
+	}
+	if err == errInvalidLogin {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  "not admin",
 		})
 		return
 	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
 
-	if util.HashPassword(password, u.Salt) != u.Password {
-		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+	roles, err := getStaffRoles(u)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
-			"error":  "not admin",
+			"error":  err.Error(),
 		})
 		return
 	}
 
-	if !u.IsAdmin {
+	if len(roles) == 0 {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  "not admin",
@@ -461,8 +743,36 @@ func CheckAdminHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	renderer.JSON(rw, http.StatusOK, map[string]string{
+	twoFactor, err := getTwoFactor(u)
+	var settings *db.Settings
+	if err == nil {
+		settings, err = store.GetSettings()
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case err != nil:
+	case twoFactor != nil:
+		now := time.Now()
+		err = checkTwoFactorCode(twoFactor, body.Code, now)
+		if err == errInvalidCode {
+			failLogin(req, email, now)
+			status = http.StatusUnauthorized
+		}
+	case settings.RequireStaffTwoFactor:
+		status, err = http.StatusForbidden, errStaffTwoFactor
+	}
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	succeedLogin(email)
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status": requests.StatusSuccess,
+		"roles":  roles,
 	})
 }
 
@@ -478,7 +788,7 @@ func GetDeveloperByIDHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	dev, err := db.GetDeveloperById(id)
+	dev, err := store.GetDeveloperById(id)
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -489,7 +799,7 @@ func GetDeveloperByIDHandler(rw http.ResponseWriter, req *http.Request) {
 
 	// If the developer doing the request is not the dev found, only send
 	// minimal information.
-	if dev.Token != token {
+	if caller, _, err := developerByToken(token); err != nil || caller.ID != dev.ID {
 		dev = &schemas.Developer{
 			Email:               dev.Email,
 			Name:                dev.Name,
@@ -514,22 +824,17 @@ func GetCurrentDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	token := req.FormValue("token")
-	if token == "" {
+	u, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
-			"error":  "Valid token required.",
+			"error":  err.Error(),
 		})
 		return
 	}
 
-	query := map[string]interface{}{"token": token}
-	u, err := db.GetDeveloper(query)
+	res, err := newDeveloperRes(u)
 	if err != nil {
-		if err == mgo.ErrNotFound {
-			err = errors.New("Invalid Token.")
-		}
-
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
@@ -539,7 +844,7 @@ func GetCurrentDeveloperHandler(rw http.ResponseWriter, req *http.Request) {
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status":    requests.StatusFound,
-		"developer": u,
+		"developer": res,
 	})
 }
 
@@ -568,7 +873,7 @@ func CreateSessionHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// Silent Signup from cli and not signup form. Will not charge them, but will give them a free month
-	if err := db.Save(u); err != nil {
+	if err := store.Save(u); err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
@@ -576,6 +881,10 @@ func CreateSessionHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := sendVerification(u); err != nil {
+		fmt.Println("unable to send verification email to", u.Email, err)
+	}
+
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status":    requests.StatusCreated,
 		"developer": u,
@@ -584,7 +893,7 @@ func CreateSessionHandler(rw http.ResponseWriter, req *http.Request) {
 
 // POST /developers/{token}/pay payments
 func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
-	var body requests.PaymentReq
+	var body paymentReq
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&body)
 	if err != nil {
@@ -595,23 +904,19 @@ func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	d, err := db.GetDeveloper(map[string]interface{}{"token": mux.Vars(req)["token"]})
-	if err != nil {
+	if body.Plan == "" {
+		body.Plan = conf.Billing.DefaultPlan
+	}
+	plan, ok := conf.Billing.Plan(body.Plan)
+	if !ok {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
-			"error":  err.Error(),
+			"error":  "no such plan " + body.Plan,
 		})
 		return
 	}
 
-	// Create Stripe Customer
-	customerParams := stripe.CustomerParams{
-		Email: d.Email,
-		Desc:  d.Name,
-		Token: body.StripeToken,
-	}
-
-	customer, err := stripe.Customers.Create(&customerParams)
+	d, _, err := developerByToken(mux.Vars(req)["token"])
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -620,22 +925,32 @@ func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Charge Stripe Customer
-	chargeParams := stripe.ChargeParams{
-		Desc:     "Bowery 3",
-		Amount:   2900,
-		Currency: "usd",
-		Customer: customer.Id,
-	}
+	if err := requireVerified(d); err != nil {
+		status := http.StatusInternalServerError
+		if err == errNotVerified {
+			status = http.StatusForbidden
+		}
 
-	_, err = stripe.Charges.Create(&chargeParams)
-	if err != nil {
-		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
 		return
 	}
 
-	if err := db.UpdateDeveloper(map[string]interface{}{"token": d.Token}, map[string]interface{}{"isPaid": true}); err != nil {
-		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+	// Retries are recognized by their Idempotency-Key header, or by the card
+	// token since stripe.js only hands each one out once.
+	sub, err := subscribe(d, plan, body.StripeToken, req.Header.Get("Idempotency-Key"))
+	if err != nil {
+		// The provider couldn't be reached, the client can try again.
+		status := http.StatusBadRequest
+		if payment.IsTemporary(err) {
+			status = http.StatusBadGateway
+		} else if err == errPaymentInProgress {
+			status = http.StatusConflict
+		}
+
+		renderer.JSON(rw, status, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
@@ -643,17 +958,21 @@ func PaymentHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
-		"status":    requests.StatusSuccess,
-		"developer": d,
+		"status":       requests.StatusSuccess,
+		"developer":    d,
+		"subscription": sub,
 	})
 }
 
-// GET /session/{id}, Gets user by ID. If their license has expired it attempts
-// to charge them again. It is called everytime crosby is run.
+// GET /session/{id}, Gets user by ID, with whether their license has
+// expired. It is called everytime crosby is run, licenses are renewed in the
+// background by processRenewals. A developer authenticated with a session
+// or OAuth token also gets their account state and a signed license to
+// check offline.
 func SessionInfoHandler(rw http.ResponseWriter, req *http.Request) {
 	id := mux.Vars(req)["id"]
 	fmt.Println("Getting user by id", id)
-	u, err := db.GetDeveloperById(id)
+	u, err := store.GetDeveloperById(id)
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -662,41 +981,50 @@ func SessionInfoHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if u.Expiration.After(time.Now()) {
-		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
-			"status":    requests.StatusFound,
-			"developer": u,
+	holder, err := licenseHolder(req)
+	if err != nil {
+		renderer.JSON(rw, http.StatusUnauthorized, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
 		})
 		return
 	}
-
-	if u.StripeToken == "" {
-		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
-			"status":    requests.StatusExpired,
-			"developer": u,
+	if holder != nil && holder.ID != u.ID {
+		renderer.JSON(rw, http.StatusForbidden, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Licenses are only issued to the developer they're for.",
 		})
 		return
 	}
 
-	// Charge them, update expiration, & respond with found.
-	// Charge Stripe Customer
-	chargeParams := stripe.ChargeParams{
-		Desc:     "Crosby Annual License",
-		Amount:   2500,
-		Currency: "usd",
-		Customer: u.StripeToken,
-	}
-	_, err = stripe.Charges.Create(&chargeParams)
+	res, err := newDeveloperRes(u)
 	if err != nil {
-		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
-	u.Expiration = time.Now()
-	if err := db.Save(u); err != nil { // not actually a save, but an update. fix
-		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+
+	// Past due licenses work through their grace period.
+	now := time.Now()
+	status := requests.StatusFound
+	if !res.licensed(now) {
+		status = requests.StatusExpired
+	}
+
+	// Anyone can look up a developer, so they only get the developer.
+	if holder == nil {
+		renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+			"status":    status,
+			"developer": res.Developer,
+		})
+		return
+	}
+
+	res.License, err = issueLicense(res, now)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
@@ -704,8 +1032,8 @@ func SessionInfoHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
-		"status": requests.StatusFound,
-		"user":   u,
+		"status":    status,
+		"developer": res,
 	})
 }
 
@@ -713,7 +1041,7 @@ func SessionInfoHandler(rw http.ResponseWriter, req *http.Request) {
 func SignUpHandler(rw http.ResponseWriter, req *http.Request) {
 	if err := RenderTemplate(rw, "signup", map[string]interface{}{
 		"isSignup":     true,
-		"stripePubKey": stripePublicKey,
+		"stripePubKey": conf.Stripe.PublicKey,
 		"id":           mux.Vars(req)["id"],
 	}); err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
@@ -739,7 +1067,7 @@ func ResetPasswordHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	u, err := db.GetDeveloper(map[string]interface{}{"email": email})
+	u, err := store.GetDeveloper(map[string]interface{}{"email": email})
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -748,31 +1076,24 @@ func ResetPasswordHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	message, err := RenderEmail("password_email", map[string]interface{}{
-		"name":     strings.Split(u.Name, " ")[0],
-		"id":       u.ID.Hex(),
-		"token":    u.Token,
-		"engineer": u.IntegrationEngineer,
-	})
-	if err != nil {
-		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+	reset := &db.ResetToken{
+		DeveloperID: u.ID,
+		Token:       util.HashToken(),
+		CreatedAt:   time.Now(),
+		ExpiresAt:   time.Now().Add(conf.Reset.TTL.Duration),
+	}
+	if err := store.SaveResetToken(reset); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
 
-	_, err = mandrill.MessageSend(gochimp.Message{
-		Subject:   "Bowery Password Reset",
-		FromEmail: "support@bowery.io",
-		FromName:  "Bowery Support",
-		To: []gochimp.Recipient{{
-			Email: u.Email,
-			Name:  u.Name,
-		}},
-		Html: message,
-	}, false)
-
+	err = sendEmail(supportAddress, u, "reset_password", map[string]interface{}{
+		"name": strings.Split(u.Name, " ")[0],
+		"link": conf.URL + "/developers/reset/" + reset.Token + "/" + u.ID.Hex(),
+	})
 	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
@@ -786,31 +1107,27 @@ func ResetPasswordHandler(rw http.ResponseWriter, req *http.Request) {
 	})
 }
 
-// GET /developers/{token}/reset/{id}, Serves from where users can reset their password.
+// GET /developers/reset/{token}/{id}, Serves from where users can reset their password.
 func ResetHandler(rw http.ResponseWriter, req *http.Request) {
 	id := mux.Vars(req)["id"]
 	token := mux.Vars(req)["token"]
 
-	u, err := db.GetDeveloperById(id)
-	if err != nil {
-		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
-		return
-	}
-
-	if token != u.Token {
-		RenderTemplate(rw, "error", map[string]string{"Error": "Invalid Token"})
+	reset, err := store.GetResetToken(token)
+	if err != nil || reset.DeveloperID.Hex() != id {
+		RenderTemplate(rw, "error", map[string]string{"Error": "Invalid or expired reset link"})
 		return
 	}
 
 	if err := RenderTemplate(rw, "password_reset", map[string]interface{}{
-		"Token": u.Token,
-		"ID":    u.ID.Hex(),
+		"Token": token,
+		"ID":    id,
 	}); err != nil {
 		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
 	}
 }
 
-// PUT /developers/{token}/reset, Edit password
+// PUT /developers/reset/{token}, Edit password with a reset token. The token
+// is used up, and every session for the developer is revoked.
 func PasswordEditHandler(rw http.ResponseWriter, req *http.Request) {
 	if err := req.ParseForm(); err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
@@ -820,9 +1137,33 @@ func PasswordEditHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	id := req.FormValue("id")
-	u, err := db.GetDeveloperById(id)
+	newpass := req.FormValue("new")
+	if newpass == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "New password required.",
+		})
+		return
+	}
+
+	hash, err := password.Hash(newpass)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	reset, err := store.ConsumeResetToken(mux.Vars(req)["token"])
+	if err == nil && req.FormValue("id") != "" && reset.DeveloperID.Hex() != req.FormValue("id") {
+		err = mgo.ErrNotFound
+	}
 	if err != nil {
+		if err == mgo.ErrNotFound {
+			err = errors.New("Invalid or expired reset token.")
+		}
+
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
@@ -830,9 +1171,8 @@ func PasswordEditHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	query := map[string]interface{}{"token": mux.Vars(req)["token"]}
-	update := map[string]interface{}{"password": util.HashPassword(req.FormValue("new"), u.Salt)}
-	if err := db.UpdateDeveloper(query, update); err != nil {
+	u, err := store.GetDeveloperById(reset.DeveloperID.Hex())
+	if err != nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
@@ -840,9 +1180,24 @@ func PasswordEditHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := store.UpdateDeveloper(bson.M{"_id": u.ID}, bson.M{"password": hash}); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := revokeSessions(u); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
 	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
 		"status": requests.StatusSuccess,
-		"user":   u,
 	})
 }
 
@@ -852,5 +1207,5 @@ func HealthzHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 func StaticHandler(res http.ResponseWriter, req *http.Request) {
-	http.StripPrefix("/static/", http.FileServer(http.Dir(STATIC_DIR))).ServeHTTP(res, req)
+	http.StripPrefix("/static/", http.FileServer(http.FS(assets()))).ServeHTTP(res, req)
 }
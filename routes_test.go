@@ -3,15 +3,19 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Bowery/broome/config"
 	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/mail"
+	"github.com/Bowery/broome/password"
 	"github.com/Bowery/gopackages/requests"
 	"github.com/Bowery/gopackages/web"
 	"labix.org/v2/mgo/bson"
@@ -20,6 +24,15 @@ import (
 var broomeServer http.HandlerFunc
 
 func init() {
+	conf := config.Default("testing")
+	conf.Mail.Driver = "memory"
+	conf.Billing.Provider = "fake"
+	conf.TrustedProxies = []string{testProxy}
+	if err := configure(conf); err != nil {
+		panic(err)
+	}
+	store = db.NewMemoryStore()
+
 	server := web.NewServer(":3000", []web.Handler{
 		new(web.SlashHandler),
 		new(web.CorsHandler),
@@ -85,7 +98,7 @@ func TestStaticHandler(t *testing.T) {
 }
 
 func TestUpdateDeveloperHandler(t *testing.T) {
-	mock, err := db.MockDB()
+	mock, err := db.MockDB(store)
 	if err != nil {
 		t.Fatal("Could not Mock DB:", err)
 	}
@@ -127,7 +140,7 @@ func TestUpdateDeveloperHandler(t *testing.T) {
 }
 
 func TestCreateTokenHandler(t *testing.T) {
-	_, err := db.MockDB()
+	_, err := db.MockDB(store)
 	if err != nil {
 		t.Fatal("Could not Mock DB:", err)
 	}
@@ -164,8 +177,47 @@ func TestCreateTokenHandler(t *testing.T) {
 	}
 }
 
+func TestCreateTokenHandlerRehash(t *testing.T) {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+
+	var body bytes.Buffer
+	bodyReq := map[string]interface{}{"Email": mock.Email, "Password": "java$cript"}
+	if err := json.NewEncoder(&body).Encode(bodyReq); err != nil {
+		t.Fatal("Could not encode JSON:", err)
+	}
+
+	req, err := http.NewRequest("POST", "http://broome.io/developers/token", &body)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	dev, err := store.GetDeveloperById(mock.ID.Hex())
+	if err != nil {
+		t.Fatal("Could not get developer:", err)
+	}
+
+	if dev.Password == mock.Password {
+		t.Fatal("legacy password hash was not upgraded on login")
+	}
+
+	ok, rehash, err := password.Verify("java$cript", dev.Password, dev.Salt)
+	if err != nil || !ok || rehash {
+		t.Error("upgraded password hash doesn't verify:", ok, rehash, err)
+	}
+}
+
 func TestDeveloperMeHandler(t *testing.T) {
-	mock, err := db.MockDB()
+	mock, err := db.MockDB(store)
 	if err != nil {
 		t.Fatal("Could not Mock DB:", err)
 	}
@@ -204,7 +256,7 @@ func TestDeveloperMeHandler(t *testing.T) {
 }
 
 func TestResetRequestHandler(t *testing.T) {
-	mock, err := db.MockDB()
+	mock, err := db.MockDB(store)
 	if err != nil {
 		t.Fatal("Could not Mock DB:", err)
 	}
@@ -234,76 +286,50 @@ func TestResetRequestHandler(t *testing.T) {
 	if resBody["status"] != "success" {
 		t.Fatal("response status should be 'created' not ", resBody["status"])
 	}
+
+	if _, err := deliverEmails(); err != nil {
+		t.Fatal("Could not deliver emails:", err)
+	}
+	msg := mailer.(*mail.MemoryMailer).Last(email)
+	if msg == nil || !strings.Contains(msg.HTML, "/developers/reset/") || !strings.Contains(msg.Text, "/developers/reset/") {
+		t.Fatal("reset email should have been sent with a reset link")
+	}
 }
 
-// TODO (thebyrd) get a valid stripeToken for testing from stripe.js
-// func TestPaymentHandler(t *testing.T) {
-// 	mock, err := db.MockDB()
-// 	if err != nil {
-// 		t.Fatal("Could not Mock DB:", err)
-// 	}
-//
-// 	var token string
-// 	if token = mock.Token; token == "" {
-// 		t.Fatal("Invalid token")
-// 	}
-//
-// 	var email string
-// 	if email = mock.Email; email == "" {
-// 		t.Fatal("Invalid email")
-// 	}
-//
-// 	req, err := http.NewRequest("POST", "http://broome.io/developers/"+token+"/pay", nil)
-// 	if err != nil {
-// 		t.Fatal("Could not Create Request", err)
-// 	}
-// 	req.SetBasicAuth(token, "")
-// 	req.PostForm = url.Values{
-// 		"stripeToken": {"blah blah"},
-// 	}
-// 	res := httptest.NewRecorder()
-// 	broomeServer(res, req)
-//
-// 	if res.Code != http.StatusOK {
-// 		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
-// 	}
-//
-// 	body := map[string]interface{}{}
-// 	if err := json.Unmarshal([]byte(res.Body.String()), &body); err != nil {
-// 		t.Fatal("Response is not valid JSON", err)
-// 	}
-//
-// 	if body["status"] != "success" {
-// 		t.Fatal("response status should be 'updated' not ", body["status"])
-// 	}
-// }
+// putNewPassword completes a password reset with the given reset token.
+func putNewPassword(token, id string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("PUT", "http://broome.io/developers/reset/"+token, nil)
+	req.PostForm = url.Values{
+		"id":  {id},
+		"new": {"password"},
+	}
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+
+	return res
+}
 
 func TestPasswordEditHandler(t *testing.T) {
-	mock, err := db.MockDB()
+	mock, err := db.MockDB(store)
 	if err != nil {
 		t.Fatal("Could not Mock DB:", err)
 	}
 
 	var id bson.ObjectId
-	fmt.Printf("%T", mock.ID)
 	id = mock.ID
 
-	var token string
-	if token = mock.Token; token == "" {
-		t.Fatal("Invalid token")
+	reset := &db.ResetToken{
+		DeveloperID: id,
+		Token:       "reset-token",
+		CreatedAt:   time.Now(),
+		ExpiresAt:   time.Now().Add(time.Hour),
 	}
-
-	req, err := http.NewRequest("PUT", "http://broome.io/developers/reset/"+token, nil)
-	if err != nil {
-		t.Fatal("Could not Create Request", err)
-	}
-	req.PostForm = url.Values{
-		"id":  {id.Hex()},
-		"new": {"password"},
+	if err := store.SaveResetToken(reset); err != nil {
+		t.Fatal("Could not save reset token:", err)
 	}
-	res := httptest.NewRecorder()
-	broomeServer(res, req)
+	session := login(t, "laptop")
 
+	res := putNewPassword(reset.Token, id.Hex())
 	if res.Code != http.StatusOK {
 		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
 	}
@@ -316,4 +342,45 @@ func TestPasswordEditHandler(t *testing.T) {
 	if body["status"] != "success" {
 		t.Fatal("response status should be 'updated' not ", body["status"])
 	}
+
+	dev, err := store.GetDeveloperById(id.Hex())
+	if err != nil {
+		t.Fatal("Could not get developer:", err)
+	}
+	if ok, _, _ := password.Verify("password", dev.Password, dev.Salt); !ok {
+		t.Error("password was not changed.")
+	}
+
+	for _, token := range []string{session, mock.Token} {
+		if _, code := currentDeveloper(token); code == http.StatusOK {
+			t.Error("sessions should be revoked after a password reset.")
+		}
+	}
+
+	if res := putNewPassword(reset.Token, id.Hex()); res.Code != http.StatusBadRequest {
+		t.Error("reset tokens should only be usable once, got", res.Code)
+	}
+}
+
+func TestPasswordEditHandlerInvalidToken(t *testing.T) {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+
+	expired := &db.ResetToken{
+		DeveloperID: mock.ID,
+		Token:       "expired-token",
+		CreatedAt:   time.Now().Add(-2 * time.Hour),
+		ExpiresAt:   time.Now().Add(-time.Hour),
+	}
+	if err := store.SaveResetToken(expired); err != nil {
+		t.Fatal("Could not save reset token:", err)
+	}
+
+	for _, token := range []string{expired.Token, mock.Token} {
+		if res := putNewPassword(token, mock.ID.Hex()); res.Code != http.StatusBadRequest {
+			t.Error("reset with token", token, "should fail, got", res.Code)
+		}
+	}
 }
@@ -39,9 +39,15 @@ go get \
   -ldflags "${CGO_LDFLAGS}" \
   ./...
 
+cd "${DIR}"
+
+# Assets are embedded in the binary, so compile them first
+/bin/bash ${DIR}/scripts/check-myth.sh
+echo "--> Compiling Assets with Myth"
+myth static/style.css static/out.css
+
 # Build Broome!
 echo "--> Building Broome..."
-cd "${DIR}"
 go build \
     -ldflags "${CGO_LDFLAGS} -X main.GitCommit ${GIT_COMMIT}${GIT_DIRTY}" \
     -v \
@@ -49,10 +55,6 @@ go build \
 cp bin/broome${EXTENSION} ${GOPATHSINGLE}/bin
 
 /bin/bash ${DIR}/scripts/check-mongo.sh
-/bin/bash ${DIR}/scripts/check-myth.sh
-
-echo "--> Compiling Assets with Myth"
-myth static/style.css static/out.css
 
 
 echo "--> Running on Port 4000"
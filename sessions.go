@@ -0,0 +1,248 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the session routes and token lookup.
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// How often a session's last seen time is written.
+const touchInterval = time.Minute
+
+// createSession starts a new session for a developer on the device making
+// the request, named if the device was approved in a browser.
+func createSession(req *http.Request, d *schemas.Developer, name string) (*db.Session, error) {
+	now := time.Now()
+	session := &db.Session{
+		DeveloperID: d.ID,
+		Token:       util.HashToken(),
+		Name:        name,
+		IP:          remoteIP(req),
+		UserAgent:   req.UserAgent(),
+		CreatedAt:   now,
+		LastSeenAt:  now,
+		ExpiresAt:   now.Add(conf.Sessions.TTL.Duration),
+	}
+
+	return session, store.SaveSession(session)
+}
+
+// retiredToken marks account tokens that can't be used to log in. They're
+// only kept to find developers on the admin pages.
+const retiredToken = "retired-"
+
+// developerByToken finds the developer a session token belongs to.
+// Developers' original account tokens are turned into a session the first
+// time they're used, so they expire and can be revoked like any other.
+func developerByToken(token string) (*schemas.Developer, *db.Session, error) {
+	if token == "" {
+		return nil, nil, errors.New("Valid token required.")
+	}
+
+	session, err := store.GetSession(token)
+	if err == mgo.ErrNotFound {
+		session, err = accountSession(token)
+	}
+	if err == mgo.ErrNotFound {
+		err = errors.New("Invalid Token.")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d, err := store.GetDeveloperById(session.DeveloperID.Hex())
+	if err == mgo.ErrNotFound {
+		err = errors.New("Invalid Token.")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if now := time.Now(); now.Sub(session.LastSeenAt) > touchInterval {
+		session.LastSeenAt = now
+		store.TouchSession(session.ID, now)
+	}
+
+	return d, session, nil
+}
+
+// accountSession turns a developer's account token into a session. The
+// account token is retired first, so it only ever becomes one session.
+func accountSession(token string) (*db.Session, error) {
+	if strings.HasPrefix(token, retiredToken) {
+		return nil, mgo.ErrNotFound
+	}
+
+	d, err := store.GetDeveloper(bson.M{"token": token})
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.UpdateDeveloper(bson.M{"_id": d.ID, "token": token}, bson.M{"token": retiredToken + util.HashToken()})
+	if err == mgo.ErrNotFound {
+		// Another request retired it first.
+		return store.GetSession(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &db.Session{
+		DeveloperID: d.ID,
+		Token:       token,
+		Name:        "Account token",
+		CreatedAt:   now,
+		LastSeenAt:  now,
+		ExpiresAt:   now.Add(conf.Sessions.TTL.Duration),
+	}
+
+	return session, store.SaveSession(session)
+}
+
+// revokeSessions signs a developer out everywhere, including the account
+// token which is retired.
+func revokeSessions(d *schemas.Developer) error {
+	if err := store.RemoveSessions(d.ID); err != nil {
+		return err
+	}
+
+	d.Token = retiredToken + util.HashToken()
+	return store.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{"token": d.Token})
+}
+
+// remoteIP gets the address of the client. X-Forwarded-For is only read
+// when the request comes from a trusted proxy, and then the client is the
+// rightmost address a trusted proxy didn't add, anything left of that could
+// have been sent by the client.
+func remoteIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !conf.TrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !conf.TrustedProxy(hop) {
+			return hop
+		}
+
+		ip = hop
+	}
+
+	return ip
+}
+
+// GET /developers/me/sessions, lists the logged in developer's sessions
+func SessionsHandler(rw http.ResponseWriter, req *http.Request) {
+	d, current, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	sessions, err := store.GetSessions(d.ID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	for _, session := range sessions {
+		session.Current = current != nil && session.ID == current.ID
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusFound,
+		"sessions": sessions,
+	})
+}
+
+// DELETE /developers/me/sessions/{id}, revokes one of the logged in
+// developer's sessions
+func RevokeSessionHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid session id",
+		})
+		return
+	}
+
+	if err := store.RemoveSession(d.ID, bson.ObjectIdHex(id)); err != nil {
+		status := http.StatusInternalServerError
+		if err == mgo.ErrNotFound {
+			status = http.StatusNotFound
+			err = errors.New("no such session")
+		}
+
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// DELETE /developers/me/sessions, revokes all of the logged in developer's
+// sessions, including the one making the request
+func RevokeSessionsHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if err := revokeSessions(d); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// login creates a new session for the mock developer.
+func login(t *testing.T, userAgent string) string {
+	var body bytes.Buffer
+	bodyReq := map[string]interface{}{"Email": "byrd@bowery.io", "Password": "java$cript"}
+	if err := json.NewEncoder(&body).Encode(bodyReq); err != nil {
+		t.Fatal("Could not encode JSON:", err)
+	}
+
+	req, err := http.NewRequest("POST", "http://broome.io/developers/token", &body)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	resBody := map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &resBody); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+
+	token, _ := resBody["token"].(string)
+	if token == "" {
+		t.Fatal("No token in response:", res.Body)
+	}
+
+	return token
+}
+
+// currentDeveloper gets the developer for a token from /developers/me.
+func currentDeveloper(token string) (*schemas.Developer, int) {
+	req, _ := http.NewRequest("GET", "http://broome.io/developers/me?token="+token, nil)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+
+	body := struct {
+		Developer *schemas.Developer `json:"developer"`
+	}{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+
+	return body.Developer, res.Code
+}
+
+func listSessions(t *testing.T, token string) []*db.Session {
+	req, err := http.NewRequest("GET", "http://broome.io/developers/me/sessions?token="+token, nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	body := struct {
+		Sessions []*db.Session `json:"sessions"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+
+	return body.Sessions
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+	store.RemoveSessions(mock.ID)
+
+	laptop := login(t, "laptop")
+	crosby := login(t, "crosby")
+
+	for _, token := range []string{laptop, crosby, mock.Token} {
+		dev, code := currentDeveloper(token)
+		if code != http.StatusOK || dev.ID != mock.ID {
+			t.Error("token should still be valid after logging in elsewhere:", code)
+		}
+	}
+
+	// The account token became a session when it was used.
+	sessions := listSessions(t, laptop)
+	if len(sessions) != 3 {
+		t.Fatal("expected 3 sessions, got", len(sessions))
+	}
+
+	current := 0
+	for _, session := range sessions {
+		if session.UserAgent != "laptop" && session.UserAgent != "crosby" && session.Name != "Account token" {
+			t.Error("session user agent not recorded:", session.UserAgent)
+		}
+		if session.Current {
+			current++
+			if session.UserAgent != "laptop" {
+				t.Error("wrong session marked as current.")
+			}
+		}
+		if session.ExpiresAt.Before(session.CreatedAt) {
+			t.Error("session expires before it's created.")
+		}
+	}
+	if current != 1 {
+		t.Error("exactly one session should be current, got", current)
+	}
+}
+
+func TestRevokeSessionHandler(t *testing.T) {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+	store.RemoveSessions(mock.ID)
+
+	laptop := login(t, "laptop")
+	crosby := login(t, "crosby")
+
+	var crosbyID string
+	for _, session := range listSessions(t, laptop) {
+		if session.UserAgent == "crosby" {
+			crosbyID = session.ID.Hex()
+		}
+	}
+
+	req, err := http.NewRequest("DELETE", "http://broome.io/developers/me/sessions/"+crosbyID+"?token="+laptop, nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	if _, code := currentDeveloper(crosby); code == http.StatusOK {
+		t.Error("revoked session should no longer be valid.")
+	}
+
+	if _, code := currentDeveloper(laptop); code != http.StatusOK {
+		t.Error("other sessions should still be valid.")
+	}
+}
+
+func TestRevokeSessionsHandler(t *testing.T) {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+
+	laptop := login(t, "laptop")
+	crosby := login(t, "crosby")
+
+	req, err := http.NewRequest("DELETE", "http://broome.io/developers/me/sessions?token="+laptop, nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	for _, token := range []string{laptop, crosby, mock.Token} {
+		if _, code := currentDeveloper(token); code == http.StatusOK {
+			t.Error("all sessions should be revoked.")
+		}
+	}
+}
+
+func TestAccountTokenSession(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+
+	// The account token only works as the session it becomes.
+	d, code := currentDeveloper(mock.Token)
+	if code != http.StatusOK || d.Token != "" || d.Password != "" || d.Salt != "" {
+		t.Fatalf("developer should be found without credentials, got %v %+v", code, d)
+	}
+	stored, _ := store.GetDeveloperById(mock.ID.Hex())
+	if _, code := currentDeveloper(stored.Token); code == http.StatusOK {
+		t.Error("retired account token shouldn't log in.")
+	}
+
+	var id string
+	for _, session := range listSessions(t, mock.Token) {
+		id = session.ID.Hex()
+	}
+	req, _ := http.NewRequest("DELETE", "http://broome.io/developers/me/sessions/"+id+"?token="+mock.Token, nil)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if _, code := currentDeveloper(mock.Token); code == http.StatusOK {
+		t.Error("revoked account token shouldn't log in.")
+	}
+}
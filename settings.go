@@ -0,0 +1,62 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the admin settings routes.
+package main
+
+import (
+	"net/http"
+
+	"github.com/Bowery/gopackages/requests"
+)
+
+// GET /admin/settings, Admin interface for the settings
+func SettingsHandler(rw http.ResponseWriter, req *http.Request) {
+	settings, err := store.GetSettings()
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if err := RenderTemplate(rw, "settings", settings); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// PUT /admin/settings, edits the settings
+func UpdateSettingsHandler(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	settings, err := store.GetSettings()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if val := req.FormValue("requireEmailVerification"); val != "" {
+		settings.RequireEmailVerification = val == "on" || val == "true"
+	}
+	if val := req.FormValue("requireStaffTwoFactor"); val != "" {
+		settings.RequireStaffTwoFactor = val == "on" || val == "true"
+	}
+
+	if err := store.SaveSettings(settings); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusUpdated,
+		"settings": settings,
+	})
+}
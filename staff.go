@@ -0,0 +1,224 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the staff roles, and the permissions they grant on the admin
+// routes and on developers' fields.
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	errPermission       = errors.New("Your staff role doesn't allow that.")
+	errInvalidStaffRole = errors.New("roles must be support, billing-admin or super-admin")
+)
+
+// The staff roles. Support helps developers with their accounts, billing
+// admins look after payments, and super admins can do anything.
+const (
+	roleSupport      = "support"
+	roleBillingAdmin = "billing-admin"
+	roleSuperAdmin   = "super-admin"
+)
+
+// The permissions the staff roles grant.
+const (
+	permAdmin          = "admin"
+	permViewDevelopers = "developers.view"
+	permEditProfile    = "developers.profile"
+	permEditBilling    = "developers.billing"
+	permManageStaff    = "staff"
+	permEmails         = "emails"
+	permBilling        = "billing"
+	permSettings       = "settings"
+	permClients        = "clients"
+)
+
+// staffRoles lists the staff roles in the order they're shown.
+var staffRoles = []string{roleSupport, roleBillingAdmin, roleSuperAdmin}
+
+// rolePermissions is what each staff role is allowed to do.
+var rolePermissions = map[string][]string{
+	roleSupport:      {permAdmin, permViewDevelopers, permEditProfile, permEmails},
+	roleBillingAdmin: {permAdmin, permViewDevelopers, permEditBilling, permBilling},
+	roleSuperAdmin: {permAdmin, permViewDevelopers, permEditProfile, permEditBilling,
+		permManageStaff, permEmails, permBilling, permSettings, permClients},
+}
+
+// fieldPermissions is the permission needed to change each of another
+// developer's fields.
+var fieldPermissions = map[string]string{
+	"name":                permEditProfile,
+	"email":               permEditProfile,
+	"password":            permEditProfile,
+	"integrationEngineer": permEditProfile,
+	"isPaid":              permEditBilling,
+	"nextPaymentTime":     permEditBilling,
+	"roles":               permManageStaff,
+}
+
+// ownFields are the fields developers can change on their own account
+// without a staff role.
+var ownFields = map[string]bool{"name": true, "email": true, "password": true}
+
+// staffMember is a developer along with their staff roles. Staff who need
+// two-factor on and haven't turned it on can't use their roles.
+type staffMember struct {
+	dev            *schemas.Developer
+	roles          []string
+	needsTwoFactor bool
+}
+
+// can checks if any of the staff member's roles grant perm.
+func (s *staffMember) can(perm string) bool {
+	if s.needsTwoFactor {
+		return false
+	}
+
+	for _, role := range s.roles {
+		for _, p := range rolePermissions[role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// canEdit checks if the staff member can change a developer's field.
+func (s *staffMember) canEdit(d *schemas.Developer, field string) bool {
+	if s.dev.ID == d.ID && ownFields[field] {
+		return true
+	}
+
+	perm, ok := fieldPermissions[field]
+	return ok && s.can(perm)
+}
+
+// getStaffRoles gets a developer's staff roles. Admins from before roles,
+// who only have isAdmin, are super admins until they're given roles.
+func getStaffRoles(d *schemas.Developer) ([]string, error) {
+	staff, err := store.GetStaff(d.ID)
+	if err == mgo.ErrNotFound {
+		if d.IsAdmin {
+			return []string{roleSuperAdmin}, nil
+		}
+
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return staff.Roles, nil
+}
+
+// loadStaff gets the developer making a request from its basic auth, along
+// with their staff roles. A nil staff member means the credentials are
+// wrong.
+func loadStaff(req *http.Request) (*staffMember, error) {
+	user, pass, _ := req.BasicAuth()
+	d, err := authenticate(req, user, pass)
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	roles, err := getStaffRoles(d)
+	if err != nil {
+		return nil, err
+	}
+
+	needsTwoFactor, err := staffNeedsTwoFactor(d, roles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &staffMember{dev: d, roles: roles, needsTwoFactor: needsTwoFactor}, nil
+}
+
+// parseStaffRoles checks the roles in a form are all known, ignoring empty
+// values so a form can clear every role.
+func parseStaffRoles(values []string) ([]string, error) {
+	roles := []string{}
+	for _, role := range values {
+		if role == "" {
+			continue
+		}
+		if _, ok := rolePermissions[role]; !ok {
+			return nil, errInvalidStaffRole
+		}
+
+		roles = append(roles, role)
+	}
+
+	sort.Strings(roles)
+	return roles, nil
+}
+
+// sameRoles checks if two lists of roles have the same roles.
+func sameRoles(a, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requirePermission only lets staff whose roles grant perm through to h.
+// The route still needs auth so the caller is known.
+func requirePermission(perm string, h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		staff, err := loadStaff(req)
+		if err != nil {
+			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		if staff == nil || !staff.can(perm) {
+			err = errPermission
+			if staff != nil && staff.needsTwoFactor {
+				err = errStaffTwoFactor
+			}
+
+			renderer.JSON(rw, http.StatusForbidden, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+
+		h(rw, req)
+	}
+}
+
+// saveStaffRoles replaces a developer's staff roles, keeping isAdmin in
+// step for anything that still reads it.
+func saveStaffRoles(d *schemas.Developer, roles []string, by *schemas.Developer) error {
+	if err := store.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{"isAdmin": len(roles) > 0}); err != nil {
+		return err
+	}
+
+	return store.SaveStaff(&db.Staff{DeveloperID: d.ID, Roles: roles, UpdatedBy: by.ID, UpdatedAt: time.Now()})
+}
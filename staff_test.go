@@ -0,0 +1,154 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+// newStaff saves a developer with the given staff roles.
+func newStaff(t *testing.T, email string, roles ...string) *schemas.Developer {
+	d := newDeveloper(t, email)
+	if err := store.SaveStaff(&db.Staff{DeveloperID: d.ID, Roles: roles}); err != nil {
+		t.Fatal("Could not save staff:", err)
+	}
+
+	return d
+}
+
+// staffRequest makes a request as a developer, with form as its body.
+func staffRequest(t *testing.T, d *schemas.Developer, method, path string, form url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://broome.io"+path, nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	req.SetBasicAuth(d.Token, "")
+	req.PostForm = form
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	return res
+}
+
+// adminPath gets the admin page for a developer. Pages are found by the
+// stored account token, which is retired once it's been used, so it's used
+// first.
+func adminPath(t *testing.T, d *schemas.Developer) string {
+	developerByToken(d.Token)
+	stored, err := store.GetDeveloperById(d.ID.Hex())
+	if err != nil {
+		t.Fatal("Could not get developer:", err)
+	}
+
+	return "/admin/developers/" + stored.Token
+}
+
+func TestRoutePermissions(t *testing.T) {
+	_, _, done := billingTest(t)
+	defer done()
+
+	support := newStaff(t, "support@bowery.io", roleSupport)
+	billing := newStaff(t, "billing@bowery.io", roleBillingAdmin)
+	developer := newDeveloper(t, "steve@bowery.io")
+
+	for _, c := range []struct {
+		d    *schemas.Developer
+		path string
+		code int
+	}{
+		{support, "/admin", http.StatusOK},
+		{support, "/admin/emails", http.StatusOK},
+		{support, "/admin/dunning", http.StatusForbidden},
+		{support, "/admin/settings", http.StatusForbidden},
+		{billing, "/admin/dunning", http.StatusOK},
+		{billing, "/admin/organizations", http.StatusOK},
+		{billing, "/admin/emails", http.StatusForbidden},
+		{billing, "/admin/developers/" + developer.Token, http.StatusOK},
+		{developer, "/admin", http.StatusForbidden},
+		{developer, "/admin/developers", http.StatusForbidden},
+	} {
+		if res := staffRequest(t, c.d, "GET", c.path, nil); res.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.d.Email, c.path, c.code, res.Code)
+		}
+	}
+}
+
+func TestUpdateDeveloperPermissions(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+
+	support := newStaff(t, "support@bowery.io", roleSupport)
+	billing := newStaff(t, "billing@bowery.io", roleBillingAdmin)
+	developer := newDeveloper(t, "steve@bowery.io")
+	path := "/developers/" + developer.Token
+
+	for _, c := range []struct {
+		d    *schemas.Developer
+		form url.Values
+		code int
+	}{
+		{support, url.Values{"name": {"Steve"}, "email": {"steve@kaliski.com"}}, http.StatusOK},
+		{support, url.Values{"isPaid": {"on"}}, http.StatusForbidden},
+		{support, url.Values{"roles": {"", roleSuperAdmin}}, http.StatusForbidden},
+		{support, url.Values{"name": {"Steven"}, "roles": {""}}, http.StatusOK},
+		{billing, url.Values{"name": {"Steve"}}, http.StatusForbidden},
+		{billing, url.Values{"isPaid": {"on"}}, http.StatusOK},
+		{support, url.Values{"name": {"Steve"}, "isPaid": {"on"}}, http.StatusOK},
+		{admin, url.Values{"roles": {"boss"}}, http.StatusBadRequest},
+		{admin, url.Values{"roles": {"", roleSupport}}, http.StatusOK},
+		{newDeveloper(t, "david@bowery.io"), url.Values{"name": {"David"}}, http.StatusForbidden},
+		{developer, url.Values{"name": {"Steve Kaliski"}}, http.StatusOK},
+		{developer, url.Values{"isPaid": {"false"}}, http.StatusForbidden},
+	} {
+		if res := staffRequest(t, c.d, "PUT", path, c.form); res.Code != c.code {
+			t.Errorf("%s %v: expected %d, got %v\tbody: %v", c.d.Email, c.form, c.code, res.Code, res.Body)
+		}
+	}
+
+	d, _ := store.GetDeveloperById(developer.ID.Hex())
+	if d.Name != "Steve Kaliski" || d.Email != "steve@kaliski.com" || !d.IsPaid || !d.IsAdmin {
+		t.Error("allowed changes should be saved, got", d)
+	}
+	if roles, _ := getStaffRoles(d); len(roles) != 1 || roles[0] != roleSupport {
+		t.Error("roles should be saved, got", roles)
+	}
+
+	// The new role applies straight away.
+	if res := staffRequest(t, developer, "GET", "/admin/emails", nil); res.Code != http.StatusOK {
+		t.Error("new support staff should see emails, got", res.Code)
+	}
+}
+
+func TestCheckAdminRoles(t *testing.T) {
+	_, _, done := billingTest(t)
+	defer done()
+
+	d := &schemas.Developer{ID: bson.NewObjectId(), Email: "steve@bowery.io", Password: "java$cript"}
+	if err := store.Save(d); err != nil {
+		t.Fatal("Could not save developer:", err)
+	}
+
+	checkAdmin := func(email string) (int, interface{}) {
+		res, body := jsonRequest(t, "POST", "/developers/check-admin", map[string]string{"email": email, "password": "java$cript"})
+		return res.Code, body["roles"]
+	}
+
+	if code, roles := checkAdmin("byrd@bowery.io"); code != http.StatusOK || fmt.Sprint(roles) != "[super-admin]" {
+		t.Error("admins from before roles should be super admins, got", code, roles)
+	}
+	if code, _ := checkAdmin(d.Email); code != http.StatusBadRequest {
+		t.Error("developer without a role isn't an admin, got", code)
+	}
+
+	store.SaveStaff(&db.Staff{DeveloperID: d.ID, Roles: []string{roleSupport}})
+	if code, roles := checkAdmin(d.Email); code != http.StatusOK || fmt.Sprint(roles) != "[support]" {
+		t.Error("support staff should be admins, got", code, roles)
+	}
+}
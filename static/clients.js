@@ -0,0 +1,57 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Manages the OAuth clients
+ * @constructor
+ */
+function ClientsController () {
+  this.formEl = $('.group-new-client .form')
+
+  $('.group-new-client .btn-submit').click(this.createClient.bind(this))
+  $('.group-clients .btn-remove').click(this.removeClient.bind(this))
+}
+
+/**
+ * Registers a client, showing its secret since it can't be seen again.
+ * @param {Event} e
+ */
+ClientsController.prototype.createClient = function (e) {
+  e.preventDefault()
+
+  var payload = {
+    url: '/admin/clients',
+    type: 'POST',
+    data: $(this.formEl).serialize()
+  }
+  $.ajax(payload)
+    .done(function (res) {
+      var text = 'Client id ' + res.client.id
+      if (res.client.secret) text += ', secret ' + res.client.secret + ' (it won\'t be shown again)'
+      $('.group-new-client .client-secret').text(text)
+      butterbar('Client created.', 'confirm')
+    })
+    .error(butterbar.bind(this, 'Create Failed.', 'alert'))
+}
+
+/**
+ * Removes a client, revoking its tokens.
+ * @param {Event} e
+ */
+ClientsController.prototype.removeClient = function (e) {
+  e.preventDefault()
+
+  var el = $(e.target)
+  var payload = {
+    url: '/admin/clients/' + el.data('id'),
+    type: 'DELETE'
+  }
+  $.ajax(payload)
+    .done(function () {
+      el.closest('.item').remove()
+      butterbar('Client removed.', 'confirm')
+    })
+    .error(butterbar.bind(this, 'Remove Failed.', 'alert'))
+}
+
+$(document).ready(function () {
+  var cc = new ClientsController()
+})
@@ -10,6 +10,7 @@ function DevController () {
   this.editUrl = '/developers/' + this.formEl.data('token')
   console.log(this.editUrl)
   $('.group-developer .btn-submit').click(this.editDev.bind(this))
+  $('.group-logins .btn-unlock').click(this.unlock.bind(this))
 }
 
 /**
@@ -35,6 +36,25 @@ DevController.prototype.editDev = function (e) {
     .error(butterbar.bind(this, 'Update Failed.', 'alert'))
 }
 
+/**
+ * Forgets the developer's failed logins so they can log in again.
+ * @param {Event} e
+ */
+DevController.prototype.unlock = function (e) {
+  e.preventDefault()
+
+  var payload = {
+    url: '/admin/developers/' + $(e.target).data('token') + '/unlock',
+    type: 'POST'
+  }
+  $.ajax(payload)
+    .done(function () {
+      butterbar('Unlocked.', 'confirm')
+      $('.group-logins').remove()
+    })
+    .error(butterbar.bind(this, 'Unlock Failed.', 'alert'))
+}
+
 $(document).ready(function () {
   var dc = new DevController()
 })
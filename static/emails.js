@@ -0,0 +1,32 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Manages the admin email queue
+ * @constructor
+ */
+function EmailsController () {
+  $('.group-emails .btn-retry').click(this.retryEmail.bind(this))
+}
+
+/**
+ * Puts a dead email back in the queue.
+ * @param {Event} e
+ */
+EmailsController.prototype.retryEmail = function (e) {
+  e.preventDefault()
+
+  var el = $(e.target)
+  var payload = {
+    url: '/admin/emails/' + el.data('id') + '/retry',
+    type: 'POST'
+  }
+  $.ajax(payload)
+    .done(function () {
+      el.closest('.item').remove()
+      butterbar('Email queued.', 'confirm')
+    })
+    .error(butterbar.bind(this, 'Retry Failed.', 'alert'))
+}
+
+$(document).ready(function () {
+  var ec = new EmailsController()
+})
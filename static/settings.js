@@ -0,0 +1,31 @@
+// Copyright 2014 Bowery, Inc.
+/**
+ * Manages the admin settings
+ * @constructor
+ */
+function SettingsController () {
+  this.formEl = $('.group-settings .form')
+
+  $('.group-settings .btn-submit').click(this.editSettings.bind(this))
+}
+
+/**
+ * Grabs all the information in the form and submits it.
+ * @param {Event} e
+ */
+SettingsController.prototype.editSettings = function (e) {
+  e.preventDefault()
+
+  var payload = {
+    url: '/admin/settings',
+    type: 'PUT',
+    data: $(this.formEl).serialize()
+  }
+  $.ajax(payload)
+    .done(butterbar.bind(this, 'Update Successful.', 'confirm'))
+    .error(butterbar.bind(this, 'Update Failed.', 'alert'))
+}
+
+$(document).ready(function () {
+  var sc = new SettingsController()
+})
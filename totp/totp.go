@@ -0,0 +1,125 @@
+// Copyright 2014 Bowery, Inc.
+// Contains time-based one-time passwords (RFC 6238) as used by
+// authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Codes are 6 digits and change every 30 seconds, which is all most
+// authenticator apps support.
+const (
+	Digits = 6
+	Period = 30 * time.Second
+)
+
+// secretLen is the length of a secret in bytes, the size of a SHA-1 hash.
+const secretLen = 20
+
+var (
+	ErrSecret = errors.New("totp: invalid secret")
+	ErrCode   = errors.New("totp: invalid code")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret creates a random base32 secret.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(secret), nil
+}
+
+// URI gets the otpauth URI authenticator apps read from a QR code.
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(int(Period / time.Second))},
+	}
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Counter gets the time step t is in.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code gets the code for a secret at t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, Counter(t)), nil
+}
+
+// Validate checks a code against a secret at t, allowing for clocks that
+// are up to skew time steps apart. It returns the time step the code is for
+// so callers can refuse a code that's been used before.
+func Validate(secret, code string, t time.Time, skew int) (int64, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, err
+	}
+
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != Digits {
+		return 0, ErrCode
+	}
+
+	now := Counter(t)
+	for i := -skew; i <= skew; i++ {
+		counter := now + int64(i)
+		if subtle.ConstantTimeCompare([]byte(code), []byte(hotp(key, counter))) == 1 {
+			return counter, nil
+		}
+	}
+
+	return 0, ErrCode
+}
+
+// decodeSecret decodes a base32 secret, ignoring case and padding.
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.TrimRight(strings.ToUpper(strings.Replace(secret, " ", "", -1)), "=")
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, ErrSecret
+	}
+
+	return key, nil
+}
+
+// hotp is the HOTP (RFC 4226) code for a key and counter.
+func hotp(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1000000)
+}
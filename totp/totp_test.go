@@ -0,0 +1,59 @@
+// Copyright 2014 Bowery, Inc.
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from the RFC 6238 test vectors, in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The RFC's 8 digit codes, cut to 6.
+	for unix, expected := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		code, err := Code(rfcSecret, time.Unix(unix, 0))
+		if err != nil || code != expected {
+			t.Errorf("code at %d should be %s, got %s %v", unix, expected, code, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1400000000, 0)
+	code, _ := Code(secret, now.Add(-Period))
+	counter, err := Validate(secret, code[:3]+" "+code[3:], now, 1)
+	if err != nil || counter != Counter(now)-1 {
+		t.Error("code from the last period should be valid, got", counter, err)
+	}
+
+	if _, err := Validate(secret, code, now.Add(Period), 1); err != ErrCode {
+		t.Error("code from two periods ago should be invalid, got", err)
+	}
+	if _, err := Validate(secret, "12345", now, 1); err != ErrCode {
+		t.Error("short code should be invalid, got", err)
+	}
+	if _, err := Validate("not base32!", code, now, 1); err != ErrSecret {
+		t.Error("bad secret should be refused, got", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Bowery", "steve@bowery.io", rfcSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Bowery:steve@bowery.io?") || !strings.Contains(uri, "secret="+rfcSecret) ||
+		!strings.Contains(uri, "issuer=Bowery") {
+		t.Error("unexpected uri", uri)
+	}
+}
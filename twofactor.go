@@ -0,0 +1,424 @@
+// Copyright 2014 Bowery, Inc.
+// Contains two-factor authentication with authenticator apps.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/totp"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/Bowery/gopackages/util"
+	"labix.org/v2/mgo"
+)
+
+// statusTwoFactor is the status of a login that needs a code to finish.
+const statusTwoFactor = "two_factor_required"
+
+const (
+	// recoveryCodes is how many recovery codes a developer gets.
+	recoveryCodes = 10
+
+	// maxChallengeAttempts is how many codes a login can try.
+	maxChallengeAttempts = 5
+
+	// codeSkew is how many periods apart the app's clock can be.
+	codeSkew = 1
+)
+
+var (
+	errTwoFactorOn     = errors.New("Two-factor authentication is already on.")
+	errTwoFactorOff    = errors.New("Two-factor authentication isn't on.")
+	errNoEnrollment    = errors.New("Set up two-factor authentication before confirming it.")
+	errInvalidCode     = errors.New("Invalid two-factor code.")
+	errNoChallenge     = errors.New("This login has expired, log in again.")
+	errTooManyAttempts = errors.New("Too many invalid codes, log in again.")
+	errStaffTwoFactor  = errors.New("Staff need two-factor authentication turned on.")
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// codeReq is the body of a request that needs a two-factor code.
+type codeReq struct {
+	Code string `json:"code"`
+}
+
+// checkAdminReq is the body of a staff login, which needs a code if
+// two-factor is on.
+type checkAdminReq struct {
+	requests.LoginReq
+	Code string `json:"code"`
+}
+
+// challengeReq is the body of the second step of a login.
+type challengeReq struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// getTwoFactor gets a developer's two-factor settings, or nil if it isn't
+// on.
+func getTwoFactor(d *schemas.Developer) (*db.TwoFactor, error) {
+	t, err := store.GetTwoFactor(d.ID)
+	if err == mgo.ErrNotFound || (err == nil && !t.Enabled) {
+		return nil, nil
+	}
+
+	return t, err
+}
+
+// staffNeedsTwoFactor checks if a developer with roles can't use them until
+// they turn on two-factor authentication.
+func staffNeedsTwoFactor(d *schemas.Developer, roles []string) (bool, error) {
+	if len(roles) == 0 {
+		return false, nil
+	}
+
+	settings, err := store.GetSettings()
+	if err != nil || !settings.RequireStaffTwoFactor {
+		return false, err
+	}
+
+	t, err := getTwoFactor(d)
+	return t == nil, err
+}
+
+// checkTwoFactorCode checks a code from an authenticator app or a recovery
+// code, using it up so it can't be used again.
+func checkTwoFactorCode(t *db.TwoFactor, code string, now time.Time) error {
+	counter, err := totp.Validate(t.Secret, code, now, codeSkew)
+	if err == nil {
+		if counter <= t.LastCounter {
+			return errInvalidCode
+		}
+
+		err = store.UseTwoFactorCode(t.DeveloperID, t.LastCounter, counter)
+		if err == mgo.ErrNotFound {
+			return errInvalidCode
+		}
+
+		return err
+	}
+	if err != totp.ErrCode {
+		return err
+	}
+
+	err = store.UseRecoveryCode(t.DeveloperID, hashRecoveryCode(code))
+	if err == mgo.ErrNotFound {
+		return errInvalidCode
+	}
+
+	return err
+}
+
+// generateRecoveryCodes creates a set of recovery codes, along with the
+// hashes that are stored.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodes)
+	hashes := make([]string, recoveryCodes)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(recoveryEncoding.EncodeToString(buf))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case, spaces and
+// dashes.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return db.HashToken(code)
+}
+
+// startLoginChallenge saves a login waiting on a two-factor code, returning
+// it with its token.
+func startLoginChallenge(d *schemas.Developer) (*db.LoginChallenge, error) {
+	now := time.Now()
+	c := &db.LoginChallenge{
+		Token:       util.HashToken(),
+		DeveloperID: d.ID,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(conf.TwoFactor.ChallengeTTL.Duration),
+	}
+
+	return c, store.SaveLoginChallenge(c)
+}
+
+// POST /developers/me/two-factor, starts setting up two-factor
+// authentication, returning the secret and the otpauth URI for a QR code
+func EnrollTwoFactorHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	t, err := getTwoFactor(d)
+	if err == nil && t != nil {
+		renderer.JSON(rw, http.StatusConflict, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errTwoFactorOn.Error(),
+		})
+		return
+	}
+
+	var secret string
+	if err == nil {
+		secret, err = totp.GenerateSecret()
+	}
+	if err == nil {
+		err = store.SaveTwoFactor(&db.TwoFactor{DeveloperID: d.ID, Secret: secret, CreatedAt: time.Now()})
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusCreated,
+		"secret": secret,
+		"uri":    totp.URI(conf.TwoFactor.Issuer, d.Email, secret),
+	})
+}
+
+// POST /developers/me/two-factor/confirm, turns on two-factor authentication
+// with a first code from the app, returning the recovery codes
+func ConfirmTwoFactorHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var body codeReq
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	t, err := store.GetTwoFactor(d.ID)
+	status := http.StatusInternalServerError
+	var counter int64
+	switch {
+	case err == mgo.ErrNotFound:
+		status, err = http.StatusBadRequest, errNoEnrollment
+	case err == nil && t.Enabled:
+		status, err = http.StatusConflict, errTwoFactorOn
+	case err == nil:
+		counter, err = totp.Validate(t.Secret, body.Code, time.Now(), codeSkew)
+		if err == totp.ErrCode {
+			status, err = http.StatusUnauthorized, errInvalidCode
+		}
+	}
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err == nil {
+		t.Enabled = true
+		t.LastCounter = counter
+		t.RecoveryCodes = hashes
+		t.ConfirmedAt = time.Now()
+		err = store.SaveTwoFactor(t)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":        requests.StatusSuccess,
+		"recoveryCodes": codes,
+	})
+}
+
+// DELETE /developers/me/two-factor, turns off two-factor authentication with
+// a code from the app or a recovery code
+func DisableTwoFactorHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var body codeReq
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	t, err := getTwoFactor(d)
+	var roles []string
+	if err == nil {
+		roles, err = getStaffRoles(d)
+	}
+	var settings *db.Settings
+	if err == nil {
+		settings, err = store.GetSettings()
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case err != nil:
+	case t == nil:
+		status, err = http.StatusBadRequest, errTwoFactorOff
+	case len(roles) > 0 && settings.RequireStaffTwoFactor:
+		status, err = http.StatusForbidden, errStaffTwoFactor
+	default:
+		err = checkTwoFactorCode(t, body.Code, time.Now())
+		if err == errInvalidCode {
+			status = http.StatusUnauthorized
+		}
+		if err == nil {
+			err = store.RemoveTwoFactor(d.ID)
+		}
+	}
+	if err != nil {
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// POST /developers/token/two-factor, finishes a login that needs a code,
+// creating the token
+func TwoFactorLoginHandler(rw http.ResponseWriter, req *http.Request) {
+	var body challengeReq
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c, err := store.GetLoginChallenge(body.Challenge)
+	var d *schemas.Developer
+	if err == nil {
+		d, err = store.GetDeveloperById(c.DeveloperID.Hex())
+	}
+	var t *db.TwoFactor
+	if err == nil {
+		t, err = getTwoFactor(d)
+		if err == nil && t == nil {
+			err = mgo.ErrNotFound
+		}
+	}
+	if err == mgo.ErrNotFound {
+		renderer.JSON(rw, http.StatusUnauthorized, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errNoChallenge.Error(),
+		})
+		return
+	}
+
+	// Wrong codes count as failed logins, so a locked account can't keep
+	// guessing with the challenges it has.
+	now := time.Now()
+	var wait time.Duration
+	if err == nil {
+		wait, err = loginWait(req, d.Email, now)
+	}
+	if wait > 0 {
+		renderLoginLimit(rw, wait)
+		return
+	}
+
+	if err == nil {
+		err = checkTwoFactorCode(t, body.Code, now)
+	}
+	if err == errInvalidCode {
+		failLogin(req, d.Email, now)
+
+		// Each login only gets a few tries, then it has to start over with
+		// the password.
+		if c.Attempts+1 >= maxChallengeAttempts {
+			store.RemoveLoginChallenge(c.ID)
+			err = errTooManyAttempts
+		} else {
+			store.FailLoginChallenge(c.ID, c.Attempts)
+		}
+
+		renderer.JSON(rw, http.StatusUnauthorized, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	// Removing it makes sure only one login uses it.
+	if err == nil {
+		err = store.RemoveLoginChallenge(c.ID)
+		if err == mgo.ErrNotFound {
+			renderer.JSON(rw, http.StatusUnauthorized, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  errNoChallenge.Error(),
+			})
+			return
+		}
+	}
+
+	var session *db.Session
+	if err == nil {
+		succeedLogin(d.Email)
+		session, err = createSession(req, d, "")
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusCreated,
+		"token":   session.Token,
+		"session": session,
+	})
+}
@@ -0,0 +1,258 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/config"
+	"github.com/Bowery/broome/totp"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// code gets the code for a secret a number of periods from now.
+func code(t *testing.T, secret string, periods int) string {
+	c, err := totp.Code(secret, time.Now().Add(time.Duration(periods)*totp.Period))
+	if err != nil {
+		t.Fatal("Could not create code:", err)
+	}
+
+	return c
+}
+
+// enableTwoFactor enrolls and confirms two-factor for a developer with the
+// code from the last period, returning the secret and recovery codes.
+func enableTwoFactor(t *testing.T, d *schemas.Developer) (string, []interface{}) {
+	res, body := jsonRequest(t, "POST", "/developers/me/two-factor?token="+d.Token, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	secret := body["secret"].(string)
+
+	res, body = jsonRequest(t, "POST", "/developers/me/two-factor/confirm?token="+d.Token, codeReq{Code: code(t, secret, -1)})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	return secret, body["recoveryCodes"].([]interface{})
+}
+
+// startLogin logs in the mock developer with their password, returning the
+// challenge for the second step.
+func startLogin(t *testing.T) string {
+	res, body := jsonRequest(t, "POST", "/developers/token", requests.LoginReq{Email: "byrd@bowery.io", Password: "java$cript"})
+	if res.Code != http.StatusOK || body["status"] != statusTwoFactor || body["token"] != nil {
+		t.Fatalf("password login should need a code, got %v\tbody: %v", res.Code, res.Body)
+	}
+
+	return body["challenge"].(string)
+}
+
+func TestTwoFactorEnroll(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+
+	res, body := jsonRequest(t, "POST", "/developers/me/two-factor?token="+mock.Token, nil)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	secret := body["secret"].(string)
+	if uri := body["uri"].(string); uri != totp.URI("Bowery", mock.Email, secret) {
+		t.Error("uri should be for the secret, got", uri)
+	}
+
+	// Until it's confirmed the password is still enough.
+	login(t, "test")
+
+	res, _ = jsonRequest(t, "POST", "/developers/me/two-factor/confirm?token="+mock.Token, codeReq{Code: "000000"})
+	if res.Code != http.StatusUnauthorized {
+		t.Error("wrong code shouldn't confirm, got", res.Code)
+	}
+
+	res, body = jsonRequest(t, "POST", "/developers/me/two-factor/confirm?token="+mock.Token, codeReq{Code: code(t, secret, 0)})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if codes := body["recoveryCodes"].([]interface{}); len(codes) != recoveryCodes {
+		t.Error("should get recovery codes, got", codes)
+	}
+
+	stored, _ := store.GetTwoFactor(mock.ID)
+	for _, c := range body["recoveryCodes"].([]interface{}) {
+		for _, hash := range stored.RecoveryCodes {
+			if hash == c.(string) {
+				t.Fatal("recovery codes should be stored hashed")
+			}
+		}
+	}
+
+	if res, _ = jsonRequest(t, "POST", "/developers/me/two-factor?token="+mock.Token, nil); res.Code != http.StatusConflict {
+		t.Error("can't enroll again while it's on, got", res.Code)
+	}
+	_, body = jsonRequest(t, "GET", "/developers/me?token="+mock.Token, nil)
+	if on := body["developer"].(map[string]interface{})["twoFactor"]; on != true {
+		t.Error("account should show two-factor is on, got", on)
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+	secret, _ := enableTwoFactor(t, mock)
+
+	challenge := startLogin(t)
+	res, body := jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: challenge, Code: code(t, secret, 0)})
+	if res.Code != http.StatusOK || body["token"] == nil {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if d, _ := currentDeveloper(body["token"].(string)); d == nil || d.ID != mock.ID {
+		t.Error("token should be for the developer, got", d)
+	}
+
+	// Challenges are single use.
+	res, _ = jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: challenge, Code: code(t, secret, 1)})
+	if res.Code != http.StatusUnauthorized {
+		t.Error("challenge should only be used once, got", res.Code)
+	}
+
+	// The same code can't be used twice.
+	res, _ = jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: startLogin(t), Code: code(t, secret, 0)})
+	if res.Code != http.StatusUnauthorized {
+		t.Error("used code should be refused, got", res.Code)
+	}
+
+	// A password isn't enough for basic auth anymore.
+	req, _ := http.NewRequest("GET", "http://broome.io/admin", nil)
+	if ok, _ := AuthHandler(req, "byrd@bowery.io", "java$cript"); ok {
+		t.Error("password alone shouldn't authenticate with two-factor on")
+	}
+	if ok, _ := AuthHandler(req, mock.Token, ""); !ok {
+		t.Error("token should still authenticate")
+	}
+}
+
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+	_, codes := enableTwoFactor(t, mock)
+	recovery := codes[0].(string)
+
+	res, _ := jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: startLogin(t), Code: recovery})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	res, _ = jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: startLogin(t), Code: recovery})
+	if res.Code != http.StatusUnauthorized {
+		t.Error("recovery code should only work once, got", res.Code)
+	}
+
+	res, _ = jsonRequest(t, "DELETE", "/developers/me/two-factor?token="+mock.Token, codeReq{Code: codes[1].(string)})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	login(t, "test")
+}
+
+// twoFactorLimits are login limits with two free failures and a long wait
+// after them.
+var twoFactorLimits = config.LoginConfig{
+	Account:  config.LoginLimit{FreeFailures: 2, MaxFailures: 4},
+	IP:       config.LoginLimit{FreeFailures: 100, MaxFailures: 200},
+	Delay:    config.Duration{time.Hour},
+	MaxDelay: config.Duration{time.Hour},
+	Lockout:  config.Duration{time.Hour},
+}
+
+func TestTwoFactorAttempts(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+	secret, _ := enableTwoFactor(t, mock)
+
+	// Leave room for every attempt before the account is throttled.
+	limits := twoFactorLimits
+	limits.Account = config.LoginLimit{FreeFailures: maxChallengeAttempts, MaxFailures: 2 * maxChallengeAttempts}
+	defer loginTest(limits)()
+
+	challenge := startLogin(t)
+	for i := 0; i < maxChallengeAttempts; i++ {
+		res, _ := jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: challenge, Code: "000000"})
+		if res.Code != http.StatusUnauthorized {
+			t.Fatal("wrong code should be refused, got", res.Code)
+		}
+	}
+
+	res, _ := jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: challenge, Code: code(t, secret, 0)})
+	if res.Code != http.StatusUnauthorized {
+		t.Error("challenge should be gone after too many attempts, got", res.Code)
+	}
+}
+
+func TestTwoFactorThrottle(t *testing.T) {
+	_, mock, done := billingTest(t)
+	defer done()
+	defer loginTest(twoFactorLimits)()
+	secret, _ := enableTwoFactor(t, mock)
+
+	// The right password with a wrong code is a failed login.
+	login := requests.LoginReq{Email: "byrd@bowery.io", Password: "java$cript"}
+	if res, _ := jsonRequest(t, "POST", "/developers/check-admin", checkAdminReq{LoginReq: login, Code: "000000"}); res.Code != http.StatusUnauthorized {
+		t.Fatal("wrong code should be refused, got", res.Code)
+	}
+
+	// Getting the password right again doesn't forget it.
+	challenge := startLogin(t)
+	if res, _ := jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: challenge, Code: "000000"}); res.Code != http.StatusUnauthorized {
+		t.Fatal("wrong code should be refused, got", res.Code)
+	}
+
+	if res, _ := jsonRequest(t, "POST", "/developers/token", login); res.Code != http.StatusTooManyRequests {
+		t.Error("wrong codes should throttle the password, got", res.Code)
+	}
+	res, _ := jsonRequest(t, "POST", "/developers/token/two-factor", challengeReq{Challenge: challenge, Code: code(t, secret, 0)})
+	if res.Code != http.StatusTooManyRequests {
+		t.Error("wrong codes should throttle the challenge, got", res.Code)
+	}
+}
+
+func TestStaffTwoFactorRequired(t *testing.T) {
+	_, admin, done := billingTest(t)
+	defer done()
+
+	settings, _ := store.GetSettings()
+	settings.RequireStaffTwoFactor = true
+	store.SaveSettings(settings)
+
+	developer := newDeveloper(t, "steve@bowery.io")
+	if res := staffRequest(t, admin, "GET", "/admin", nil); res.Code != http.StatusForbidden {
+		t.Error("staff without two-factor shouldn't get in, got", res.Code)
+	}
+	if res, _ := jsonRequest(t, "GET", "/developers/me?token="+developer.Token, nil); res.Code != http.StatusOK {
+		t.Error("developers without a role don't need two-factor, got", res.Code)
+	}
+
+	check := requests.LoginReq{Email: "byrd@bowery.io", Password: "java$cript"}
+	if res, _ := jsonRequest(t, "POST", "/developers/check-admin", check); res.Code != http.StatusForbidden {
+		t.Error("staff without two-factor shouldn't pass check-admin, got", res.Code)
+	}
+
+	secret, codes := enableTwoFactor(t, admin)
+	if res := staffRequest(t, admin, "GET", "/admin", nil); res.Code != http.StatusOK {
+		t.Error("staff with two-factor should get in, got", res.Code)
+	}
+
+	if res, _ := jsonRequest(t, "POST", "/developers/check-admin", check); res.Code != http.StatusUnauthorized {
+		t.Error("check-admin should need a code, got", res.Code)
+	}
+	res, _ := jsonRequest(t, "POST", "/developers/check-admin", checkAdminReq{check, code(t, secret, 0)})
+	if res.Code != http.StatusOK {
+		t.Error("check-admin with a code should pass, got", res.Code)
+	}
+
+	res, _ = jsonRequest(t, "DELETE", "/developers/me/two-factor?token="+admin.Token, codeReq{Code: codes[0].(string)})
+	if res.Code != http.StatusForbidden {
+		t.Error("staff can't turn off two-factor while it's required, got", res.Code)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2014 Bowery, Inc.
+// Contains email verification for new developers.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// How long to wait before another verification email can be sent.
+const resendInterval = time.Minute
+
+var (
+	errInvalidVerification = errors.New("Invalid or expired verification link.")
+	errNotVerified         = errors.New("Email address has not been verified.")
+)
+
+// isVerified checks if a developer has verified their email address. The
+// verification is nil for developers from before verification existed.
+func isVerified(d *schemas.Developer) (bool, *db.Verification, error) {
+	v, err := store.GetVerification(d.ID)
+	if err == mgo.ErrNotFound {
+		return true, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	return v.Verified && v.Email == d.Email, v, nil
+}
+
+// requireVerified returns errNotVerified if admins require verification and
+// the developer hasn't verified their email address.
+func requireVerified(d *schemas.Developer) error {
+	settings, err := store.GetSettings()
+	if err != nil {
+		return err
+	}
+	if !settings.RequireEmailVerification {
+		return nil
+	}
+
+	verified, _, err := isVerified(d)
+	if err == nil && !verified {
+		err = errNotVerified
+	}
+
+	return err
+}
+
+// signVerification creates the token for a verification link. The token
+// holds the developer, the address being verified and when it expires,
+// signed with the verification secret.
+func signVerification(devID bson.ObjectId, email string, expires time.Time) string {
+	payload := strings.Join([]string{devID.Hex(), strconv.FormatInt(expires.Unix(), 10), email}, "|")
+	encoded := base64.URLEncoding.EncodeToString([]byte(payload))
+
+	return encoded + "." + verificationSignature(encoded)
+}
+
+// parseVerification checks a verification token's signature and expiry and
+// returns the developer and address it's for.
+func parseVerification(token string) (bson.ObjectId, string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(verificationSignature(parts[0])), []byte(parts[1])) {
+		return "", "", errInvalidVerification
+	}
+
+	payload, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", errInvalidVerification
+	}
+
+	fields := strings.SplitN(string(payload), "|", 3)
+	if len(fields) != 3 || !bson.IsObjectIdHex(fields[0]) {
+		return "", "", errInvalidVerification
+	}
+
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return "", "", errInvalidVerification
+	}
+
+	return bson.ObjectIdHex(fields[0]), fields[2], nil
+}
+
+// verificationSignature signs an encoded verification payload.
+func verificationSignature(encoded string) string {
+	mac := hmac.New(sha256.New, []byte(conf.Verification.Secret))
+	mac.Write([]byte(encoded))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sendVerification marks a developer's current address as unverified and
+// emails them a link to verify it.
+func sendVerification(d *schemas.Developer) error {
+	now := time.Now()
+	token := signVerification(d.ID, d.Email, now.Add(conf.Verification.TTL.Duration))
+
+	err := store.SaveVerification(&db.Verification{
+		DeveloperID: d.ID,
+		Email:       d.Email,
+		SentAt:      now,
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendEmail(supportAddress, d, "verify", map[string]interface{}{
+		"name": strings.Split(d.Name, " ")[0],
+		"link": conf.URL + "/developers/verify/" + token,
+	})
+}
+
+// GET /developers/verify/{token}, Confirms a developer's email address from
+// the link in their verification email
+func VerifyEmailHandler(rw http.ResponseWriter, req *http.Request) {
+	devID, email, err := parseVerification(mux.Vars(req)["token"])
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	d, err := store.GetDeveloperById(devID.Hex())
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	// The link is for an address the developer no longer uses.
+	if d.Email != email {
+		RenderTemplate(rw, "error", map[string]string{"Error": errInvalidVerification.Error()})
+		return
+	}
+
+	v, err := store.GetVerification(d.ID)
+	if err == mgo.ErrNotFound {
+		v, err = &db.Verification{DeveloperID: d.ID}, nil
+	}
+	if err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+		return
+	}
+
+	if !v.Verified || v.Email != email {
+		v.Email = email
+		v.Verified = true
+		v.VerifiedAt = time.Now()
+		if err := store.SaveVerification(v); err != nil {
+			RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+			return
+		}
+	}
+
+	if err := RenderTemplate(rw, "verified", map[string]string{"Email": email}); err != nil {
+		RenderTemplate(rw, "error", map[string]string{"Error": err.Error()})
+	}
+}
+
+// POST /developers/me/verify, Sends the logged in developer another
+// verification email
+func ResendVerificationHandler(rw http.ResponseWriter, req *http.Request) {
+	d, _, err := developerByToken(req.FormValue("token"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	verified, v, err := isVerified(d)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if verified {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Email address is already verified.",
+		})
+		return
+	}
+
+	if v != nil && v.Email == d.Email && time.Since(v.SentAt) < resendInterval {
+		renderer.JSON(rw, http.StatusTooManyRequests, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "A verification email was just sent, please wait a minute.",
+		})
+		return
+	}
+
+	if err := sendVerification(d); err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
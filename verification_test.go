@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/mail"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+var verifyLink = regexp.MustCompile(`http://[^"]+/developers/verify/[^"<]+`)
+
+// signup creates a developer through POST /developers.
+func signup(t *testing.T, email string) *schemas.Developer {
+	var body bytes.Buffer
+	bodyReq := map[string]interface{}{"Name": "Steve Kaliski", "Email": email, "Password": "java$cript"}
+	if err := json.NewEncoder(&body).Encode(bodyReq); err != nil {
+		t.Fatal("Could not encode JSON:", err)
+	}
+
+	req, err := http.NewRequest("POST", "http://broome.io/developers", &body)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	resBody := struct {
+		Developer *schemas.Developer `json:"developer"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &resBody); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+
+	return resBody.Developer
+}
+
+// emailVerified gets the verification state from /developers/me.
+func emailVerified(t *testing.T, token string) (bool, bool) {
+	req, _ := http.NewRequest("GET", "http://broome.io/developers/me?token="+token, nil)
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	body := struct {
+		Developer struct {
+			EmailVerified   bool       `json:"emailVerified"`
+			EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+		} `json:"developer"`
+	}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil {
+		t.Fatal("Response is not valid JSON", err)
+	}
+
+	return body.Developer.EmailVerified, body.Developer.EmailVerifiedAt != nil
+}
+
+func TestSignVerification(t *testing.T) {
+	id := bson.NewObjectId()
+	token := signVerification(id, "steve@bowery.io", time.Now().Add(time.Hour))
+
+	devID, email, err := parseVerification(token)
+	if err != nil {
+		t.Fatal("Unable to parse verification token:", err)
+	}
+	if devID != id || email != "steve@bowery.io" {
+		t.Error("verification token not parsed correctly.")
+	}
+
+	other := signVerification(id, "larz@bowery.io", time.Now().Add(time.Hour))
+	tampered := strings.Split(other, ".")[0] + "." + strings.Split(token, ".")[1]
+	expired := signVerification(id, "steve@bowery.io", time.Now().Add(-time.Second))
+
+	for _, token := range []string{tampered, expired, "garbage", ""} {
+		if _, _, err := parseVerification(token); err != errInvalidVerification {
+			t.Error("invalid verification token", token, "should fail, got", err)
+		}
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	dev := signup(t, "verify@example.com")
+
+	if verified, _ := emailVerified(t, dev.Token); verified {
+		t.Fatal("new developers should start unverified.")
+	}
+
+	if _, err := deliverEmails(); err != nil {
+		t.Fatal("Could not deliver emails:", err)
+	}
+	msg := mailer.(*mail.MemoryMailer).Last(dev.Email)
+	if msg == nil {
+		t.Fatal("signing up should send a verification email.")
+	}
+
+	link := verifyLink.FindString(msg.HTML)
+	if link == "" {
+		t.Fatal("verification email should have a verification link.")
+	}
+
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "Email Verified") {
+		t.Fatalf("Verification failed: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	verified, hasTime := emailVerified(t, dev.Token)
+	if !verified || !hasTime {
+		t.Error("developer should be verified with a timestamp.")
+	}
+}
+
+func TestLegacyDevelopersVerified(t *testing.T) {
+	mock, err := db.MockDB(store)
+	if err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+
+	if verified, _ := emailVerified(t, mock.Token); !verified {
+		t.Error("developers from before verification should count as verified.")
+	}
+}
+
+func TestRequireEmailVerification(t *testing.T) {
+	dev := signup(t, "unverified@example.com")
+
+	if err := store.SaveSettings(&db.Settings{RequireEmailVerification: true}); err != nil {
+		t.Fatal("Could not save settings:", err)
+	}
+	defer store.SaveSettings(&db.Settings{})
+
+	var body bytes.Buffer
+	bodyReq := map[string]interface{}{"Email": dev.Email, "Password": "java$cript"}
+	if err := json.NewEncoder(&body).Encode(bodyReq); err != nil {
+		t.Fatal("Could not encode JSON:", err)
+	}
+
+	req, err := http.NewRequest("POST", "http://broome.io/developers/token", &body)
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	if res.Code != http.StatusForbidden {
+		t.Errorf("unverified login should be forbidden, got %v\tbody: %v", res.Code, res.Body)
+	}
+
+	// Verified accounts can still log in.
+	if _, err := db.MockDB(store); err != nil {
+		t.Fatal("Could not Mock DB:", err)
+	}
+	login(t, "laptop")
+}
@@ -0,0 +1,574 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the Stripe webhook receiver.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	// How far a webhook's signed timestamp can be from now, so old requests
+	// can't be replayed.
+	stripeSignatureTolerance = 5 * time.Minute
+
+	// How long processing an event holds it from other deliveries.
+	eventLease = time.Minute
+)
+
+var (
+	errInvalidSignature = errors.New("Invalid Stripe signature.")
+	errEventInProgress  = errors.New("This event is already being processed.")
+)
+
+// stripeEvent is the part of a Stripe event broome reads, the object is
+// decoded based on the type.
+type stripeEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// stripePlanObject is a plan inside a Stripe object.
+type stripePlanObject struct {
+	ID string `json:"id"`
+}
+
+// stripeSubscriptionObject is a subscription in a customer.subscription event.
+type stripeSubscriptionObject struct {
+	Customer         string            `json:"customer"`
+	Status           string            `json:"status"`
+	Quantity         int64             `json:"quantity"`
+	CurrentPeriodEnd int64             `json:"current_period_end"`
+	Plan             *stripePlanObject `json:"plan"`
+}
+
+// stripeInvoiceObject is an invoice in an invoice event.
+type stripeInvoiceObject struct {
+	ID        string `json:"id"`
+	Customer  string `json:"customer"`
+	Charge    string `json:"charge"`
+	AmountDue int64  `json:"amount_due"`
+	Currency  string `json:"currency"`
+	Lines     struct {
+		Data []struct {
+			Type   string `json:"type"`
+			Period struct {
+				End int64 `json:"end"`
+			} `json:"period"`
+			Plan *stripePlanObject `json:"plan"`
+		} `json:"data"`
+	} `json:"lines"`
+}
+
+// stripeChargeObject is a charge in a charge event.
+type stripeChargeObject struct {
+	ID       string `json:"id"`
+	Customer string `json:"customer"`
+	Refunded bool   `json:"refunded"`
+}
+
+// stripeDisputeObject is a dispute in a charge.dispute event.
+type stripeDisputeObject struct {
+	Charge string `json:"charge"`
+}
+
+// verifyStripeSignature checks the Stripe-Signature header of a webhook, it
+// has the time it was signed and one or more signatures of the payload.
+func verifyStripeSignature(payload []byte, header, secret string, now time.Time) error {
+	var timestamp string
+	signatures := []string{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errInvalidSignature
+	}
+
+	age := now.Sub(time.Unix(signedAt, 0))
+	if age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return errInvalidSignature
+	}
+
+	expected := []byte(stripeSignature(payload, timestamp, secret))
+	for _, signature := range signatures {
+		if hmac.Equal(expected, []byte(signature)) {
+			return nil
+		}
+	}
+
+	return errInvalidSignature
+}
+
+// stripeSignature signs a webhook payload sent at timestamp.
+func stripeSignature(payload []byte, timestamp, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// processStripeEvent updates the account of the customer an event is about.
+// Events for customers broome doesn't know and types it doesn't use are
+// ignored. Stripe doesn't send events in order, so subscription changes
+// older than what's stored are skipped.
+func processStripeEvent(event *stripeEvent) error {
+	created := time.Unix(event.Created, 0)
+
+	switch event.Type {
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var obj stripeSubscriptionObject
+		if err := json.Unmarshal(event.Data.Object, &obj); err != nil {
+			return err
+		}
+
+		sub := &payment.Subscription{
+			CustomerID:       obj.Customer,
+			Status:           obj.Status,
+			Quantity:         obj.Quantity,
+			CurrentPeriodEnd: time.Unix(obj.CurrentPeriodEnd, 0),
+			AsOf:             created,
+		}
+		if obj.Plan != nil {
+			sub.PlanID = obj.Plan.ID
+		}
+		if event.Type == "customer.subscription.deleted" {
+			sub.Status = db.SubscriptionCanceled
+		}
+
+		d, o, err := accountByCustomer(obj.Customer)
+		if o != nil {
+			if created.Before(o.AsOf) {
+				return nil
+			}
+
+			return syncOrganization(o, obj.Customer, sub)
+		}
+		if d == nil || err != nil {
+			return err
+		}
+
+		current, err := store.GetSubscription(d.ID)
+		if err == nil && created.Before(current.AsOf) {
+			return nil
+		}
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+
+		_, err = syncSubscription(d, obj.Customer, sub)
+		return err
+	case "invoice.payment_succeeded", "invoice.payment_failed":
+		var obj stripeInvoiceObject
+		if err := json.Unmarshal(event.Data.Object, &obj); err != nil {
+			return err
+		}
+
+		d, o, err := accountByCustomer(obj.Customer)
+		if (d == nil && o == nil) || err != nil {
+			return err
+		}
+
+		// Start from what's known, the invoice only has part of the picture.
+		updated := &payment.Subscription{CustomerID: obj.Customer, AsOf: created}
+		var asOf time.Time
+		if o != nil {
+			updated.Status = o.Status
+			updated.PlanID = o.PlanID
+			updated.CurrentPeriodEnd = o.CurrentPeriodEnd
+			asOf = o.AsOf
+		} else {
+			sub, err := store.GetSubscription(d.ID)
+			if err == mgo.ErrNotFound {
+				sub, err = &db.Subscription{}, nil
+			}
+			if err != nil {
+				return err
+			}
+
+			updated.Status = sub.Status
+			updated.PlanID = sub.PlanID
+			updated.Quantity = sub.Quantity
+			updated.CurrentPeriodEnd = sub.CurrentPeriodEnd
+			asOf = sub.AsOf
+		}
+
+		// The period the invoice pays for.
+		var periodEnd time.Time
+		planID := updated.PlanID
+		for _, line := range obj.Lines.Data {
+			if line.Type != "subscription" {
+				continue
+			}
+
+			if end := time.Unix(line.Period.End, 0); end.After(periodEnd) {
+				periodEnd = end
+			}
+			if line.Plan != nil {
+				planID = line.Plan.ID
+			}
+		}
+
+		if event.Type == "invoice.payment_failed" {
+			updated.Status = db.SubscriptionPastDue
+		} else {
+			updated.Status = db.SubscriptionActive
+			updated.PlanID = planID
+			if periodEnd.After(updated.CurrentPeriodEnd) {
+				updated.CurrentPeriodEnd = periodEnd
+			}
+		}
+
+		status := db.PaymentSucceeded
+		if event.Type == "invoice.payment_failed" {
+			status = db.PaymentFailed
+		}
+
+		// An old invoice still goes in the ledger, it just doesn't change
+		// the subscription.
+		stale := created.Before(asOf)
+		if o != nil {
+			if !stale {
+				if err := syncOrganization(o, obj.Customer, updated); err != nil {
+					return err
+				}
+			}
+
+			return recordInvoice(o.BillingContactID, o.ID, &obj, updated.PlanID, periodEnd, status)
+		}
+
+		if !stale {
+			if _, err := syncSubscription(d, obj.Customer, updated); err != nil {
+				return err
+			}
+		}
+
+		return recordInvoice(d.ID, "", &obj, updated.PlanID, periodEnd, status)
+	case "charge.refunded":
+		var obj stripeChargeObject
+		if err := json.Unmarshal(event.Data.Object, &obj); err != nil {
+			return err
+		}
+
+		// Partial refunds don't take anything away.
+		if !obj.Refunded {
+			return nil
+		}
+
+		d, o, err := accountByCustomer(obj.Customer)
+		if (d == nil && o == nil) || err != nil {
+			return err
+		}
+
+		p, err := store.GetPaymentByCharge(obj.ID)
+		if err == nil {
+			p.Status = db.PaymentRefunded
+			p.UpdatedAt = time.Now()
+			err = store.UpdatePayment(p)
+		}
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+
+		// Refunding an earlier period's payment leaves the current one. A
+		// charge the ledger doesn't know the period of is taken as current.
+		var periodEnd time.Time
+		if err == nil {
+			periodEnd = p.PeriodEnd
+		}
+		if o != nil {
+			if !periodEnd.IsZero() && periodEnd.Before(o.CurrentPeriodEnd) {
+				return nil
+			}
+
+			return revokeOrganization(o)
+		}
+		if !periodEnd.IsZero() && periodEnd.Before(d.Expiration) {
+			return nil
+		}
+
+		return revokePayment(d)
+	case "charge.dispute.created":
+		var obj stripeDisputeObject
+		if err := json.Unmarshal(event.Data.Object, &obj); err != nil {
+			return err
+		}
+
+		charge, err := payments.GetCharge(obj.Charge)
+		if err != nil {
+			return err
+		}
+
+		d, o, err := accountByCustomer(charge.CustomerID)
+		if o != nil {
+			return revokeOrganization(o)
+		}
+		if d == nil || err != nil {
+			return err
+		}
+
+		return revokePayment(d)
+	}
+
+	return nil
+}
+
+// recordInvoice records a subscription invoice the provider charged in the
+// ledger, paying for the period ending at periodEnd. It's kept by the
+// invoice id, so the provider retrying a declined invoice updates the same
+// payment. The invoice for starting or changing a subscription pays for the
+// payment recorded when it was made, so that payment is updated with what
+// was charged instead.
+func recordInvoice(devID, orgID bson.ObjectId, obj *stripeInvoiceObject, planID string, periodEnd time.Time, status string) error {
+	now := time.Now()
+	p, err := store.GetPaymentByInvoice(obj.ID)
+	found := err == nil
+	if err == mgo.ErrNotFound {
+		p, err = subscriptionPayment(devID, obj.Customer, planID, now)
+		found = p != nil
+	}
+	if err == nil && !found {
+		p = &db.Payment{
+			Key:            "invoice:" + obj.ID,
+			DeveloperID:    devID,
+			OrganizationID: orgID,
+			Description:    "Invoice for " + planID,
+			PlanID:         planID,
+			CustomerID:     obj.Customer,
+			CreatedAt:      now,
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	p.Status = status
+	p.Amount = obj.AmountDue
+	p.Currency = obj.Currency
+	p.InvoiceID = obj.ID
+	p.ChargeID = obj.Charge
+	p.PeriodEnd = periodEnd
+	p.Error = ""
+	p.UpdatedAt = now
+	if found {
+		return store.UpdatePayment(p)
+	}
+
+	return store.SavePayment(p)
+}
+
+// subscriptionPayment finds the payment for starting or changing a
+// customer's subscription to a plan that no invoice has been recorded for
+// yet, or nil if there isn't one. A payment that's still being made gives
+// errPaymentInProgress, so Stripe sends the event again once it's done.
+func subscriptionPayment(devID bson.ObjectId, customerID, planID string, now time.Time) (*db.Payment, error) {
+	ledger, err := store.GetPayments(devID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range ledger {
+		if p.CustomerID != customerID || p.PlanID != planID || p.InvoiceID != "" || p.ChargeID != "" ||
+			strings.HasPrefix(p.Key, "invoice:") {
+			continue
+		}
+
+		switch p.Status {
+		case db.PaymentPending:
+			if p.LockedUntil.After(now) {
+				return nil, errPaymentInProgress
+			}
+
+			// The attempt's response was lost, the invoice shows it went
+			// through.
+			return p, nil
+		case db.PaymentSucceeded:
+			return p, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// developerByCustomer finds the developer for a Stripe customer, or nil if
+// it isn't one of ours.
+func developerByCustomer(customerID string) (*schemas.Developer, error) {
+	if customerID == "" {
+		return nil, nil
+	}
+
+	d, err := store.GetDeveloper(bson.M{"stripeToken": customerID})
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+
+	return d, err
+}
+
+// accountByCustomer finds the developer or organization for a Stripe
+// customer, both are nil if it isn't one of ours.
+func accountByCustomer(customerID string) (*schemas.Developer, *db.Organization, error) {
+	d, err := developerByCustomer(customerID)
+	if d != nil || err != nil {
+		return d, nil, err
+	}
+
+	o, err := organizationByCustomer(customerID)
+	return nil, o, err
+}
+
+// revokeOrganization takes away an organization's paid time after its
+// money is returned.
+func revokeOrganization(o *db.Organization) error {
+	o.Status = db.SubscriptionCanceled
+	o.CurrentPeriodEnd = time.Now()
+	o.UpdatedAt = o.CurrentPeriodEnd
+
+	return store.UpdateOrganization(o)
+}
+
+// revokePayment takes away a developer's paid time after their money is
+// returned.
+func revokePayment(d *schemas.Developer) error {
+	d.IsPaid = false
+	d.Expiration = time.Now()
+
+	return store.UpdateDeveloper(bson.M{"_id": d.ID}, bson.M{
+		"isPaid":          d.IsPaid,
+		"nextPaymentTime": d.Expiration,
+	})
+}
+
+// POST /webhooks/stripe, Receives events from Stripe. Each event is only
+// processed once, a failure responds with an error so Stripe sends it again
+func StripeWebhookHandler(rw http.ResponseWriter, req *http.Request) {
+	if conf.Stripe.WebhookSecret == "" {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "webhooks aren't configured",
+		})
+		return
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	err = verifyStripeSignature(payload, req.Header.Get("Stripe-Signature"), conf.Stripe.WebhookSecret, time.Now())
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	var event stripeEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.ID == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "invalid event",
+		})
+		return
+	}
+
+	// Claim the event before processing it, so concurrent deliveries of the
+	// same event don't both apply it.
+	now := time.Now()
+	e := &db.Event{
+		ID:          event.ID,
+		Type:        event.Type,
+		Payload:     string(payload),
+		CreatedAt:   time.Unix(event.Created, 0),
+		ReceivedAt:  now,
+		LockedUntil: now.Add(eventLease),
+	}
+	err = store.SaveEvent(e)
+	if mgo.IsDup(err) {
+		err = store.LockEvent(event.ID, now, eventLease)
+		if err == mgo.ErrNotFound {
+			e, err = store.GetEvent(event.ID)
+			if err == nil && e.Processed {
+				renderer.JSON(rw, http.StatusOK, map[string]string{
+					"status": requests.StatusSuccess,
+				})
+				return
+			}
+			if err == nil {
+				renderer.JSON(rw, http.StatusConflict, map[string]string{
+					"status": requests.StatusFailed,
+					"error":  errEventInProgress.Error(),
+				})
+				return
+			}
+		} else if err == nil {
+			e, err = store.GetEvent(event.ID)
+		}
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	err = processStripeEvent(&event)
+	e.Processed = err == nil
+	e.ProcessedAt = time.Now()
+	e.LockedUntil = time.Time{}
+	e.Error = ""
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if updateErr := store.UpdateEvent(e); err == nil {
+		err = updateErr
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
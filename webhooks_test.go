@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Bowery/broome/db"
+	"github.com/Bowery/broome/payment"
+	"github.com/Bowery/gopackages/schemas"
+	"labix.org/v2/mgo/bson"
+)
+
+// testCustomer is the customer in the recorded events.
+const testCustomer = "cus_4fdAW5ftNQow1a"
+
+// fakeStripe replays events recorded from Stripe in testdata/stripe to the
+// webhook, signed the way Stripe signs them.
+type fakeStripe struct {
+	secret string
+}
+
+// replay sends the recorded event with the given name.
+func (f *fakeStripe) replay(t *testing.T, name string) *httptest.ResponseRecorder {
+	payload, err := ioutil.ReadFile("testdata/stripe/" + name + ".json")
+	if err != nil {
+		t.Fatal("Could not read event:", err)
+	}
+
+	return f.send(t, payload, time.Now())
+}
+
+// send posts a payload to the webhook, signed at the given time.
+func (f *fakeStripe) send(t *testing.T, payload []byte, signedAt time.Time) *httptest.ResponseRecorder {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	req, err := http.NewRequest("POST", "http://broome.io/webhooks/stripe", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal("Could not create request:", err)
+	}
+	req.Header.Set("Stripe-Signature", "t="+timestamp+",v1="+stripeSignature(payload, timestamp, f.secret))
+
+	res := httptest.NewRecorder()
+	broomeServer(res, req)
+	return res
+}
+
+// webhookTest sets up an empty store with a developer who's the customer in
+// the recorded events, and returns the fake to send events with.
+func webhookTest(t *testing.T) (*fakeStripe, *schemas.Developer, func()) {
+	shared, secret := store, conf.Stripe.WebhookSecret
+	store = db.NewMemoryStore()
+	conf.Stripe.WebhookSecret = "whsec_test"
+	done := func() { store, conf.Stripe.WebhookSecret = shared, secret }
+
+	mock, err := db.MockDB(store)
+	if err != nil {
+		done()
+		t.Fatal("Could not Mock DB:", err)
+	}
+	if err := store.UpdateDeveloper(bson.M{"_id": mock.ID}, bson.M{"stripeToken": testCustomer}); err != nil {
+		done()
+		t.Fatal("Could not update developer:", err)
+	}
+
+	return &fakeStripe{secret: conf.Stripe.WebhookSecret}, mock, done
+}
+
+func TestVerifyStripeSignature(t *testing.T) {
+	payload := []byte(`{"id": "evt_123"}`)
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := stripeSignature(payload, timestamp, "whsec_test")
+
+	for header, valid := range map[string]bool{
+		"t=" + timestamp + ",v1=" + signature:                                         true,
+		"t=" + timestamp + ",v1=deadbeef,v1=" + signature:                             true,
+		"t=" + timestamp + ",v1=" + stripeSignature(payload, timestamp, "whsec_no"):   false,
+		"t=" + strconv.FormatInt(now.Add(-time.Hour).Unix(), 10) + ",v1=" + signature: false,
+		"v1=" + signature: false,
+		"":                false,
+	} {
+		err := verifyStripeSignature(payload, header, "whsec_test", now)
+		if (err == nil) != valid {
+			t.Errorf("signature %q valid should be %v, got %v", header, valid, err)
+		}
+	}
+}
+
+func TestStripeWebhookHandler(t *testing.T) {
+	fake, mock, done := webhookTest(t)
+	defer done()
+
+	res := fake.replay(t, "customer.subscription.updated")
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	sub, err := store.GetSubscription(mock.ID)
+	if err != nil {
+		t.Fatal("Could not get subscription:", err)
+	}
+	if !d.IsPaid || d.Expiration.Unix() != 1893456000 || sub.PlanID != "crosby-annual" {
+		t.Error("subscription event didn't update the developer.")
+	}
+
+	res = fake.replay(t, "invoice.payment_succeeded")
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ = store.GetDeveloperById(mock.ID.Hex())
+	sub, _ = store.GetSubscription(mock.ID)
+	if !d.IsPaid || d.Expiration.Unix() != 1924992000 || sub.PlanID != "bowery-monthly" {
+		t.Error("paid invoice should extend the developer's license.")
+	}
+
+	res = fake.replay(t, "invoice.payment_failed")
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ = store.GetDeveloperById(mock.ID.Hex())
+	sub, _ = store.GetSubscription(mock.ID)
+	if d.IsPaid || sub.Status != db.SubscriptionPastDue {
+		t.Error("failed invoice should make the subscription past due.")
+	}
+}
+
+func TestStripeWebhookHandlerOnce(t *testing.T) {
+	fake, mock, done := webhookTest(t)
+	defer done()
+
+	if res := fake.replay(t, "invoice.payment_succeeded"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	res := fake.replay(t, "charge.refunded")
+	if res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	if d.IsPaid {
+		t.Error("refunded charge should take away the developer's payment.")
+	}
+	p, err := store.GetPaymentByCharge("ch_14aTfd2eZvKYlo2CYcL1LPhV")
+	if err != nil || p.Status != db.PaymentRefunded || p.Amount != 2900 {
+		t.Error("invoice should be in the ledger as refunded.", err)
+	}
+
+	// Stripe sending the invoice again shouldn't undo the refund.
+	if res := fake.replay(t, "invoice.payment_succeeded"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	d, _ = store.GetDeveloperById(mock.ID.Hex())
+	if d.IsPaid {
+		t.Error("duplicate event shouldn't be processed again.")
+	}
+
+	e, err := store.GetEvent("evt_14aTfe2eZvKYlo2CCvJKXfXs")
+	if err != nil || !e.Processed || e.Type != "invoice.payment_succeeded" {
+		t.Error("event should be stored as processed.")
+	}
+}
+
+func TestStripeWebhookHandlerOutOfOrder(t *testing.T) {
+	fake, mock, done := webhookTest(t)
+	defer done()
+
+	if res := fake.replay(t, "invoice.payment_succeeded"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	// The subscription update was sent before the invoice, but arrives after.
+	if res := fake.replay(t, "customer.subscription.updated"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	sub, _ := store.GetSubscription(mock.ID)
+	if !d.IsPaid || d.Expiration.Unix() != 1924992000 || sub.PlanID != "bowery-monthly" {
+		t.Error("older subscription event shouldn't undo a newer one, got", d.Expiration.Unix(), sub.PlanID)
+	}
+}
+
+func TestStripeWebhookHandlerInProgress(t *testing.T) {
+	fake, mock, done := webhookTest(t)
+	defer done()
+
+	// Another delivery of the event is being processed.
+	err := store.SaveEvent(&db.Event{
+		ID:          "evt_14aTfe2eZvKYlo2CCvJKXfXs",
+		Type:        "invoice.payment_succeeded",
+		ReceivedAt:  time.Now(),
+		LockedUntil: time.Now().Add(eventLease),
+	})
+	if err != nil {
+		t.Fatal("Could not save event:", err)
+	}
+
+	if res := fake.replay(t, "invoice.payment_succeeded"); res.Code != http.StatusConflict {
+		t.Fatal("event being processed shouldn't be processed again, got", res.Code)
+	}
+	if ledger, _ := store.GetPayments(mock.ID); len(ledger) != 0 {
+		t.Fatal("event being processed shouldn't be applied, got", ledger)
+	}
+
+	// Once the other delivery's lease runs out the event can be retried.
+	e, _ := store.GetEvent("evt_14aTfe2eZvKYlo2CCvJKXfXs")
+	e.LockedUntil = time.Now().Add(-time.Second)
+	if err := store.UpdateEvent(e); err != nil {
+		t.Fatal("Could not update event:", err)
+	}
+	if res := fake.replay(t, "invoice.payment_succeeded"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if e, err := store.GetEvent("evt_14aTfe2eZvKYlo2CCvJKXfXs"); err != nil || !e.Processed || !e.LockedUntil.IsZero() {
+		t.Error("retried event should be processed and released, got", e, err)
+	}
+}
+
+func TestStripeWebhookHandlerEarlierRefund(t *testing.T) {
+	fake, mock, done := webhookTest(t)
+	defer done()
+
+	if res := fake.replay(t, "invoice.payment_succeeded"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	// The developer has since paid for the next period.
+	next := time.Unix(1924992000, 0).AddDate(0, 1, 0)
+	if err := store.UpdateDeveloper(bson.M{"_id": mock.ID}, bson.M{"nextPaymentTime": next}); err != nil {
+		t.Fatal("Could not update developer:", err)
+	}
+
+	if res := fake.replay(t, "charge.refunded"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	if !d.IsPaid || !d.Expiration.Equal(next) {
+		t.Error("refunding an earlier period shouldn't take away the current one.")
+	}
+	if p, err := store.GetPaymentByCharge("ch_14aTfd2eZvKYlo2CYcL1LPhV"); err != nil || p.Status != db.PaymentRefunded {
+		t.Error("refund should still be in the ledger, got", p, err)
+	}
+}
+
+func TestStripeWebhookHandlerSubscriptionPayment(t *testing.T) {
+	fake, mock, done := webhookTest(t)
+	defer done()
+
+	// Subscribing records the payment before Stripe sends its invoice.
+	err := store.SavePayment(&db.Payment{
+		Key:         "subscribe-1",
+		DeveloperID: mock.ID,
+		PlanID:      "bowery-monthly",
+		Amount:      2900,
+		Currency:    "usd",
+		CustomerID:  testCustomer,
+		Status:      db.PaymentSucceeded,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		t.Fatal("Could not save payment:", err)
+	}
+
+	if res := fake.replay(t, "invoice.payment_succeeded"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	ledger, _ := store.GetPayments(mock.ID)
+	if len(ledger) != 1 || ledger[0].Key != "subscribe-1" || ledger[0].InvoiceID != "in_14aTfb2eZvKYlo2C0wkMXTHJ" ||
+		ledger[0].ChargeID != "ch_14aTfd2eZvKYlo2CYcL1LPhV" {
+		t.Fatal("invoice should be recorded with the subscription's payment, got", ledger)
+	}
+
+	if res := fake.replay(t, "charge.refunded"); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+	if p, err := store.GetPayment("subscribe-1"); err != nil || p.Status != db.PaymentRefunded {
+		t.Error("refund should update the subscription's payment, got", p, err)
+	}
+}
+
+func TestStripeWebhookHandlerInvalid(t *testing.T) {
+	fake, _, done := webhookTest(t)
+	defer done()
+
+	payload, _ := ioutil.ReadFile("testdata/stripe/charge.refunded.json")
+	if res := fake.send(t, payload, time.Now().Add(-time.Hour)); res.Code != http.StatusBadRequest {
+		t.Error("stale signature should be rejected, got", res.Code)
+	}
+
+	fake.secret = "whsec_wrong"
+	if res := fake.replay(t, "charge.refunded"); res.Code != http.StatusBadRequest {
+		t.Error("bad signature should be rejected, got", res.Code)
+	}
+
+	if _, err := store.GetEvent("evt_14aU0F2eZvKYlo2CXo3Sb9yk"); err == nil {
+		t.Error("rejected events shouldn't be stored.")
+	}
+}
+
+func TestStripeWebhookHandlerDispute(t *testing.T) {
+	fake, mock, done := webhookTest(t)
+	defer done()
+
+	provider, err := newPaymentProvider(conf)
+	if err != nil {
+		t.Fatal("Could not create payment provider:", err)
+	}
+	shared := payments
+	payments = provider
+	defer func() { payments = shared }()
+
+	customer, err := payments.CreateCustomer(&payment.CustomerParams{Card: payment.TestCard, PlanID: "bowery-monthly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncSubscription(mock, customer.ID, customer.Subscription); err != nil {
+		t.Fatal("Could not sync subscription:", err)
+	}
+
+	charges := provider.(*payment.Fake).Charges(customer.ID)
+	payload := []byte(`{"id": "evt_dispute", "type": "charge.dispute.created", "created": 1402876800,
+		"data": {"object": {"object": "dispute", "charge": "` + charges[0].ID + `"}}}`)
+	if res := fake.send(t, payload, time.Now()); res.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code: %v\tbody: %v", res.Code, res.Body)
+	}
+
+	d, _ := store.GetDeveloperById(mock.ID.Hex())
+	if d.IsPaid {
+		t.Error("disputed charge should take away the developer's payment.")
+	}
+}